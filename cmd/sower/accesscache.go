@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/sower-proxy/sower/internal/admin"
+	"github.com/sower-proxy/sower/router"
+)
+
+// accessCacheSaveInterval bounds how many probe verdicts a crash can lose.
+// Save is a no-op while nothing changed.
+const accessCacheSaveInterval = time.Minute
+
+// runAccessCacheSaver saves the router's access probe verdicts
+// periodically until ctx is done.
+func runAccessCacheSaver(ctx context.Context, r *router.Router) {
+	ticker := time.NewTicker(accessCacheSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			saveAccessCache(r)
+		}
+	}
+}
+
+// saveAccessCache flushes the access cache, logging instead of failing: a
+// lost save only costs a fresh probe per site.
+func saveAccessCache(r *router.Router) {
+	if err := r.SaveAccessCache(); err != nil {
+		slog.Warn("save access cache", "error", err)
+	}
+}
+
+// accessCache implements admin.AccessCache on the router.
+type accessCache struct {
+	r *router.Router
+}
+
+func (c accessCache) AccessEntries() []admin.AccessEntry {
+	entries := c.r.AccessEntries()
+	out := make([]admin.AccessEntry, 0, len(entries))
+	for _, e := range entries {
+		ae := admin.AccessEntry{Domain: e.Domain, Port: e.Port, Reachable: e.Reachable, Pinned: e.Pinned, At: e.At}
+		if !e.Expires.IsZero() {
+			ae.Expires = &e.Expires
+		}
+		out = append(out, ae)
+	}
+	return out
+}
+
+func (c accessCache) EvictAccess(domain string, port uint16) bool {
+	return c.r.EvictAccess(domain, port)
+}
+
+func (c accessCache) FlushAccess() int {
+	return c.r.FlushAccess()
+}
+
+func (c accessCache) PinAccess(domain string, port uint16, reachable bool) error {
+	return c.r.PinAccess(domain, port, reachable)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"sync/atomic"
+
+	"github.com/sower-proxy/sower/config"
+	"github.com/sower-proxy/sower/internal/admin"
+)
+
+// clientACL is the live access control list of one listener group. The
+// admin console swaps its lists at runtime, so accept loops read them
+// through an atomic pointer. A nil *clientACL admits every client.
+type clientACL struct {
+	name  string
+	rules atomic.Pointer[aclRules]
+}
+
+type aclRules struct {
+	allow, deny []netip.Prefix
+}
+
+// set replaces the lists. On a parse error the previous lists stay.
+func (a *clientACL) set(c config.ClientACL) error {
+	allow, err := config.ParseClientPrefixes(c.Allow)
+	if err != nil {
+		return fmt.Errorf("acl %s allow: %w", a.name, err)
+	}
+	deny, err := config.ParseClientPrefixes(c.Deny)
+	if err != nil {
+		return fmt.Errorf("acl %s deny: %w", a.name, err)
+	}
+	a.rules.Store(&aclRules{allow: allow, deny: deny})
+	return nil
+}
+
+// admits reports whether the client at addr may use the listener. A client
+// without an IP address is only admitted while no allow list is set.
+func (a *clientACL) admits(addr net.Addr) bool {
+	if a == nil {
+		return true
+	}
+	rules := a.rules.Load()
+	if rules == nil || len(rules.allow) == 0 && len(rules.deny) == 0 {
+		return true
+	}
+	ip, ok := clientAddr(addr)
+	if !ok {
+		return len(rules.allow) == 0
+	}
+	for _, prefix := range rules.deny {
+		if prefix.Contains(ip) {
+			return false
+		}
+	}
+	if len(rules.allow) == 0 {
+		return true
+	}
+	for _, prefix := range rules.allow {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientAddr returns the unmapped IP of a TCP or UDP client address.
+func clientAddr(addr net.Addr) (netip.Addr, bool) {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.AddrPort().Addr().Unmap(), true
+	case *net.UDPAddr:
+		return a.AddrPort().Addr().Unmap(), true
+	default:
+		return netip.Addr{}, false
+	}
+}
+
+// refuseClient records a client refused by the ACL or client CIDRs of the
+// named listener.
+func refuseClient(stats *admin.Stats, listener string, addr net.Addr) {
+	slog.Debug("refuse client", "listener", listener, "client", addr)
+	if stats != nil {
+		stats.RecordACLRefusal()
+	}
+}
+
+// clientACLs holds the ACL of every listener group.
+type clientACLs struct {
+	dns, http, https, socks5, transparent clientACL
+}
+
+func newClientACLs(cfg config.SowerConfig) (*clientACLs, error) {
+	a := &clientACLs{
+		dns:         clientACL{name: "dns"},
+		http:        clientACL{name: "http"},
+		https:       clientACL{name: "https"},
+		socks5:      clientACL{name: "socks5"},
+		transparent: clientACL{name: "transparent"},
+	}
+	if err := a.set(cfg); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// set applies the ACL section of cfg to every group.
+func (a *clientACLs) set(cfg config.SowerConfig) error {
+	for _, g := range []struct {
+		acl *clientACL
+		c   config.ClientACL
+	}{
+		{&a.dns, cfg.ACL.DNS},
+		{&a.http, cfg.ACL.HTTP},
+		{&a.https, cfg.ACL.HTTPS},
+		{&a.socks5, cfg.ACL.Socks5},
+		{&a.transparent, cfg.ACL.Transparent},
+	} {
+		if err := g.acl.set(g.c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sower-proxy/sower/config"
+	"github.com/sower-proxy/sower/internal/admin"
+)
+
+func TestClientACLAdmits(t *testing.T) {
+	t.Parallel()
+
+	acl := &clientACL{name: "dns"}
+	if err := acl.set(config.ClientACL{
+		Allow: []string{"192.168.1.0/24", "2001:db8::/32", ""},
+		Deny:  []string{"192.168.1.13"},
+	}); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	for _, test := range []struct {
+		addr net.Addr
+		want bool
+	}{
+		{addr: net.UDPAddrFromAddrPort(netip.MustParseAddrPort("192.168.1.20:5353")), want: true},
+		{addr: net.TCPAddrFromAddrPort(netip.MustParseAddrPort("[::ffff:192.168.1.20]:50000")), want: true},
+		{addr: net.TCPAddrFromAddrPort(netip.MustParseAddrPort("[2001:db8::7]:50000")), want: true},
+		{addr: net.UDPAddrFromAddrPort(netip.MustParseAddrPort("192.168.1.13:5353")), want: false},
+		{addr: net.TCPAddrFromAddrPort(netip.MustParseAddrPort("10.0.0.1:50000")), want: false},
+		{addr: &net.UnixAddr{Name: "@", Net: "unix"}, want: false},
+	} {
+		if got := acl.admits(test.addr); got != test.want {
+			t.Errorf("admits(%s) = %v, want %v", test.addr, got, test.want)
+		}
+	}
+
+	if err := acl.set(config.ClientACL{Allow: []string{"lan"}}); err == nil {
+		t.Fatal("set accepted an invalid entry")
+	}
+	if acl.admits(net.UDPAddrFromAddrPort(netip.MustParseAddrPort("192.168.1.13:5353"))) {
+		t.Fatal("a failed set replaced the previous lists")
+	}
+
+	var open *clientACL
+	if !open.admits(&net.UnixAddr{Name: "@", Net: "unix"}) {
+		t.Fatal("nil acl refused a client")
+	}
+}
+
+func TestServeHTTPRefusesClientByACL(t *testing.T) {
+	t.Parallel()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	stats := newTestStats(t)
+	acl := &clientACL{name: "http"}
+	if err := acl.set(config.ClientACL{Deny: []string{"127.0.0.0/8"}}); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- ServeHTTP(ctx, ln, newTestRouter(), stats, acl, "") }()
+	defer func() {
+		cancel()
+		_ = ln.Close()
+		<-done
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Fatalf("read from refused connection = %v, want EOF", err)
+	}
+
+	snap := stats.Snapshot(admin.DomainSortBytes, admin.SourceAll, "")
+	if snap.Errors.ACL != 1 || len(snap.Events) != 0 {
+		t.Fatalf("errors = %+v, events = %+v, want one acl refusal and no event", snap.Errors, snap.Events)
+	}
+}
+
+func TestDNSStatsHandlerRefusesClientByACL(t *testing.T) {
+	t.Parallel()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen udp: %v", err)
+	}
+	stats := newTestStats(t)
+	acl := &clientACL{name: "dns"}
+	if err := acl.set(config.ClientACL{Allow: []string{"192.168.1.0/24"}}); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+	next := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		t.Errorf("refused query for %s reached the router", req.Question[0].Name)
+	})
+	server := &dns.Server{PacketConn: pc, Handler: dnsStatsHandler{Handler: next, stats: stats, acl: acl}}
+	go func() { _ = server.ActivateAndServe() }()
+	t.Cleanup(func() {
+		_ = server.Shutdown()
+		_ = pc.Close()
+	})
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	client := &dns.Client{Net: "udp", Timeout: 2 * time.Second}
+	resp, _, err := client.Exchange(req, pc.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("exchange: %v", err)
+	}
+	if resp.Rcode != dns.RcodeRefused {
+		t.Fatalf("rcode = %s, want REFUSED", dns.RcodeToString[resp.Rcode])
+	}
+	snap := stats.Snapshot(admin.DomainSortBytes, admin.SourceAll, "")
+	if snap.Errors.ACL != 1 || snap.DNSQueries != 0 {
+		t.Fatalf("acl refusals = %d, dns queries = %d, want 1 and 0", snap.Errors.ACL, snap.DNSQueries)
+	}
+}
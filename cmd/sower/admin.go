@@ -20,25 +20,62 @@ import (
 
 const adminShutdownTimeout = 5 * time.Second
 
-// newAdminServer builds the admin server, wiring in the configured reverse
-// DNS hostname resolver when present.
-func newAdminServer(cfg config.SowerConfig, password string, temporary bool, rules admin.RuleManager, configMgr admin.ConfigManager, stats *admin.Stats, restartCh chan<- struct{}) *admin.Server {
-	var hostnames admin.HostnameResolver
+// adminDeps carries the runtime services the admin server exposes. Optional
+// members stay nil when their feature is off.
+type adminDeps struct {
+	rules  admin.RuleManager
+	config admin.ConfigManager
+	stats  *admin.Stats
+	dnsLog *admin.DNSLog
+	// state holds the API tokens next to the rule and config deltas.
+	state *admin.StateStore
+	audit *admin.AuditLog
+	// rollback restores a retained admin state revision at runtime.
+	rollback func(revision uint64) (uint64, error)
+	explain  admin.RouteExplainer
+	access   admin.AccessCache
+	// leases supplies client hostnames from the built-in DHCP server.
+	leases    admin.HostnameResolver
+	restartCh chan<- struct{}
+}
+
+// newAdminServer builds the admin server, wiring in DHCP lease hostnames and
+// the configured reverse DNS resolver when present; leases are consulted
+// first.
+func newAdminServer(cfg config.SowerConfig, password string, temporary bool, deps adminDeps) *admin.Server {
+	var resolvers hostnameResolvers
+	if deps.leases != nil {
+		resolvers = append(resolvers, deps.leases)
+	}
 	if cfg.DNS.Reverse != "" {
-		hostnames = newDNSHostnameResolver(cfg.DNS.Reverse)
+		resolvers = append(resolvers, newDNSHostnameResolver(cfg.DNS.Reverse))
+	}
+	var hostnames admin.HostnameResolver
+	switch len(resolvers) {
+	case 0:
+	case 1:
+		hostnames = resolvers[0]
+	default:
+		hostnames = resolvers
 	}
 	return admin.NewServer(admin.Options{
 		Password:          password,
 		TemporaryPassword: temporary,
 		Version:           version,
 		Date:              date,
-		Rules:             rules,
-		Stats:             stats,
+		Rules:             deps.rules,
+		Stats:             deps.stats,
 		SessionFile:       cfg.AdminSessionFile(),
 		CookieSecure:      cfg.Admin.CookieSecure,
-		Config:            configMgr,
-		Restart:           restartFn(restartCh),
+		Config:            deps.config,
+		Restart:           restartFn(deps.restartCh),
 		Hostnames:         hostnames,
+		DNSLog:            deps.dnsLog,
+		State:             deps.state,
+		Audit:             deps.audit,
+		Rollback:          deps.rollback,
+		Explain:           deps.explain,
+		Access:            deps.access,
 	})
 }
 
@@ -108,7 +145,7 @@ func (a *adminRules) RuleSearch(category admin.Category, q string, offset, limit
 		for i, rule := range rules {
 			entries[i] = a.entry(category, rule)
 		}
-		return entries, total, nil
+		return a.withExpiry(category, entries), total, nil
 	}
 
 	// Non-default ordering needs the full filtered set. Stat lookups are
@@ -146,7 +183,21 @@ func (a *adminRules) RuleSearch(category admin.Category, q string, offset, limit
 	if end > len(entries) {
 		end = len(entries)
 	}
-	return entries[offset:end], total, nil
+	return a.withExpiry(category, entries[offset:end]), total, nil
+}
+
+// withExpiry attaches the expiry of temporary additions to a listing page.
+func (a *adminRules) withExpiry(category admin.Category, entries []admin.RuleEntry) []admin.RuleEntry {
+	expires := a.state.Delta(category).Expires
+	if len(expires) == 0 {
+		return entries
+	}
+	for i := range entries {
+		if at, ok := expires[entries[i].Rule]; ok {
+			entries[i].Expires = &at
+		}
+	}
+	return entries
 }
 
 // partitionByStat splits entries into those carrying a stat and those
@@ -218,6 +269,12 @@ func (a *adminRules) tracker(category admin.Category) *ruleHitTracker {
 }
 
 func (a *adminRules) RuleAdd(category admin.Category, rules ...string) error {
+	return a.RuleAddUntil(category, time.Time{}, rules...)
+}
+
+// RuleAddUntil adds rules that the rule reaper removes again at expires,
+// or permanently for a zero expires. It implements admin.RuleExpirer.
+func (a *adminRules) RuleAddUntil(category admin.Category, expires time.Time, rules ...string) error {
 	a.mutationMu.Lock()
 	defer a.mutationMu.Unlock()
 
@@ -225,14 +282,43 @@ func (a *adminRules) RuleAdd(category admin.Category, rules ...string) error {
 	if err != nil {
 		return err
 	}
-	runtimeAdd, err := a.state.RuleAdd(category, rules...)
+	runtimeAdd, err := a.state.RuleAddUntil(category, expires, rules...)
 	if err != nil {
 		return fmt.Errorf("persist rule additions: %w", err)
 	}
 	if len(runtimeAdd) == 0 {
 		return nil
 	}
+	a.addRuntimeLocked(category, rs, runtimeAdd)
+	return nil
+}
+
+// RuleAddSet adds rules to several categories in one state revision, then
+// updates each runtime rule set. It implements admin.RuleSuggester.
+func (a *adminRules) RuleAddSet(rules map[admin.Category][]string) (map[admin.Category][]string, error) {
+	a.mutationMu.Lock()
+	defer a.mutationMu.Unlock()
+
+	sets := make(map[admin.Category]*router.RuleSet, len(rules))
+	for category := range rules {
+		rs, err := a.rules(category)
+		if err != nil {
+			return nil, err
+		}
+		sets[category] = rs
+	}
+	runtimeAdd, err := a.state.RuleAddSet(rules)
+	if err != nil {
+		return nil, fmt.Errorf("persist rule additions: %w", err)
+	}
+	for category, added := range runtimeAdd {
+		a.addRuntimeLocked(category, sets[category], added)
+	}
+	return runtimeAdd, nil
+}
 
+// addRuntimeLocked applies persisted additions to the runtime rule set.
+func (a *adminRules) addRuntimeLocked(category admin.Category, rs *router.RuleSet, runtimeAdd []string) {
 	// Reinstating a baseline rule must restore the boot order. MatchRule is
 	// intentionally first-match for diagnostics, so appending a restored
 	// baseline rule would otherwise change its observable result.
@@ -240,13 +326,11 @@ func (a *adminRules) RuleAdd(category admin.Category, rules ...string) error {
 		if a.isBaselineRule(category, rule) {
 			rs.Replace(a.effectiveRules(category)...)
 			a.invalidateHits(category)
-			return nil
+			return
 		}
 	}
 	rs.Add(runtimeAdd...)
-	rs.Compact()
 	a.invalidateHits(category)
-	return nil
 }
 
 // invalidateHits drops the rule hit cache of one category after a rule
@@ -289,6 +373,12 @@ func (a *adminRules) RuleRemove(category admin.Category, rule string) (bool, err
 // RuleRemoveMany persists the full deletion candidate before touching the
 // runtime RuleSet, so a write failure cannot partially apply a batch.
 func (a *adminRules) RuleRemoveMany(category admin.Category, rules ...string) ([]string, error) {
+	return a.RuleRemoveUntil(category, time.Time{}, rules...)
+}
+
+// RuleRemoveUntil is RuleRemoveMany with baseline rules coming back at
+// expires. It implements admin.RuleExpirer.
+func (a *adminRules) RuleRemoveUntil(category admin.Category, expires time.Time, rules ...string) ([]string, error) {
 	a.mutationMu.Lock()
 	defer a.mutationMu.Unlock()
 
@@ -296,7 +386,7 @@ func (a *adminRules) RuleRemoveMany(category admin.Category, rules ...string) ([
 	if err != nil {
 		return nil, err
 	}
-	removed, err := a.state.RuleRemoveBatch(category, rules...)
+	removed, err := a.state.RuleRemoveUntil(category, expires, rules...)
 	if err != nil {
 		return nil, fmt.Errorf("persist rule removals: %w", err)
 	}
@@ -356,6 +446,46 @@ func (a *adminRules) RuleReset(category admin.Category) error {
 	return nil
 }
 
+// RuleExpire reverts the temporary rule changes due at now and rebuilds the
+// affected runtime rule sets. It returns what was reverted per category.
+func (a *adminRules) RuleExpire(now time.Time) (map[admin.Category]admin.RuleDelta, error) {
+	a.mutationMu.Lock()
+	defer a.mutationMu.Unlock()
+
+	expired, err := a.state.RuleExpire(now)
+	if err != nil {
+		return nil, fmt.Errorf("persist rule expiry: %w", err)
+	}
+	for category := range expired {
+		rs, err := a.rules(category)
+		if err != nil {
+			return nil, err
+		}
+		// Restored baseline rules must regain their boot position.
+		rs.Replace(a.effectiveRules(category)...)
+		a.invalidateHits(category)
+	}
+	return expired, nil
+}
+
+// RuleExport reports the effective rules of a category with the baseline
+// and deltas behind them, read under mutationMu so they agree.
+func (a *adminRules) RuleExport(category admin.Category) (admin.RuleExport, error) {
+	if _, err := a.rules(category); err != nil {
+		return admin.RuleExport{}, err
+	}
+	a.mutationMu.Lock()
+	defer a.mutationMu.Unlock()
+	d := a.state.Delta(category)
+	return admin.RuleExport{
+		Category:   category,
+		Rules:      a.effectiveRules(category),
+		Baseline:   append([]string{}, a.baseline[category]...),
+		Additions:  append([]string{}, d.Add...),
+		Tombstones: append([]string{}, d.Remove...),
+	}, nil
+}
+
 // RuleMiss implements admin.RuleMissProvider, forwarding to the rule-miss
 // tracker. byCount orders by connection count, otherwise by recency.
 func (a *adminRules) RuleMiss(byCount bool, limit int) []admin.RuleHit {
@@ -433,25 +563,37 @@ func (a *adminRules) TestDomain(domain string) (admin.DomainTest, error) {
 }
 
 // dnsStatsHandler counts DNS queries before delegating to the router.
+// Clients refused by acl get REFUSED; the check uses the packet source,
+// never the spoofable EDNS client subnet.
 type dnsStatsHandler struct {
 	dns.Handler
 	stats *admin.Stats
+	acl   *clientACL
 }
 
 func (h dnsStatsHandler) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	if !h.acl.admits(w.RemoteAddr()) {
+		refuseClient(h.stats, "dns", w.RemoteAddr())
+		resp := new(dns.Msg)
+		resp.SetRcode(req, dns.RcodeRefused)
+		if err := w.WriteMsg(resp); err != nil {
+			slog.Debug("write dns refusal", "error", err)
+		}
+		return
+	}
 	if len(req.Question) == 1 {
 		h.stats.RecordDNS(req.Question[0].Name, router.ClientIPOf(req, w.RemoteAddr()))
 	}
 	h.Handler.ServeDNS(w, req)
 }
 
-func startAdminListener(ctx context.Context, wg *sync.WaitGroup, cfg config.SowerConfig, rules admin.RuleManager, configMgr admin.ConfigManager, stats *admin.Stats, errCh chan<- error, restartCh chan<- struct{}) error {
+func startAdminListener(ctx context.Context, wg *sync.WaitGroup, cfg config.SowerConfig, deps adminDeps, errCh chan<- error) error {
 	if cfg.Admin.Disable || cfg.Admin.Addr == "" {
 		return nil
 	}
 
 	password, temporary := resolveAdminPassword(cfg.Admin.Password.Value())
-	srv := newAdminServer(cfg, password, temporary, rules, configMgr, stats, restartCh)
+	srv := newAdminServer(cfg, password, temporary, deps)
 
 	ln, err := net.Listen("tcp", cfg.Admin.Addr)
 	if err != nil {
@@ -478,7 +620,7 @@ func startAdminListener(ctx context.Context, wg *sync.WaitGroup, cfg config.Sowe
 // startSharedHTTPListener serves the admin console and the HTTP proxy from
 // one listener on the DNS HTTP address. It is used when admin.addr exactly
 // matches dns.serve:80.
-func startSharedHTTPListener(ctx context.Context, wg *sync.WaitGroup, cfg config.SowerConfig, r *router.Router, rules admin.RuleManager, configMgr admin.ConfigManager, stats *admin.Stats, errCh chan<- error, restartCh chan<- struct{}) error {
+func startSharedHTTPListener(ctx context.Context, wg *sync.WaitGroup, cfg config.SowerConfig, r *router.Router, acl *clientACL, deps adminDeps, errCh chan<- error) error {
 	addr, ok := sharedAdminHTTPAddr(cfg)
 	if !ok {
 		return nil
@@ -490,7 +632,7 @@ func startSharedHTTPListener(ctx context.Context, wg *sync.WaitGroup, cfg config
 	slog.Info("service listening", "service", "http proxy + admin", "network", "tcp", "addr", addr)
 
 	password, temporary := resolveAdminPassword(cfg.Admin.Password.Value())
-	srv := newAdminServer(cfg, password, temporary, rules, configMgr, stats, restartCh)
+	srv := newAdminServer(cfg, password, temporary, deps)
 	go func() {
 		<-ctx.Done()
 		shutdownCtx, cancel := context.WithTimeout(context.Background(), adminShutdownTimeout)
@@ -502,7 +644,7 @@ func startSharedHTTPListener(ctx context.Context, wg *sync.WaitGroup, cfg config
 	wg.Add(1)
 	go closeOnDone(ctx, wg, ln)
 	go serveAndReport(errCh, "http proxy + admin", func() error {
-		return ServeSharedHTTP(ctx, ln, r, stats, srv, cfg.DNS.Serve, errCh)
+		return ServeSharedHTTP(ctx, ln, r, deps.stats, acl, srv, cfg.DNS.Serve, blockPageConsoleAddr(cfg), errCh)
 	})
 	return nil
 }
@@ -2,6 +2,7 @@ package main
 
 import (
 	"log/slog"
+	"net"
 	"os"
 	"path/filepath"
 	"slices"
@@ -214,6 +215,32 @@ func TestAdminRulesResetRestoresBaseline(t *testing.T) {
 	}
 }
 
+func TestAdminRulesExport(t *testing.T) {
+	t.Parallel()
+	a, _ := bootAdapter(t, filepath.Join(t.TempDir(), "admin-state.json"))
+	if err := a.RuleAdd(admin.CategoryBlock, "ads.example.net"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.RuleRemove(admin.CategoryBlock, "example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := a.RuleExport(admin.CategoryBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(got.Rules, []string{"ads.example.net"}) || !slices.Equal(got.Baseline, []string{"example.com"}) ||
+		!slices.Equal(got.Additions, []string{"ads.example.net"}) || !slices.Equal(got.Tombstones, []string{"example.com"}) {
+		t.Fatalf("block export = %+v", got)
+	}
+	if proxy, err := a.RuleExport(admin.CategoryProxy); err != nil || proxy.Additions == nil || len(proxy.Rules) != 0 {
+		t.Fatalf("proxy export = %+v, %v", proxy, err)
+	}
+	if _, err := a.RuleExport("nope"); err == nil {
+		t.Fatal("export of an unknown category succeeded")
+	}
+}
+
 func TestApplyConfigOverrides(t *testing.T) {
 	strPtr := func(s string) *string { return &s }
 
@@ -264,12 +291,12 @@ func TestAdminConfigViewAndApply(t *testing.T) {
 	base.Admin.StateFile = "/etc/sower/admin-state.json"
 
 	state := admin.LoadStateStore("")
-	ac := newAdminConfig(base, state, newTestRouter())
+	ac := newAdminConfig(base, state, newTestRouter(), nil)
 
 	// The view renders all sections and never exposes secret values.
 	view := ac.ConfigView()
-	if len(view.Sections) != 5 {
-		t.Fatalf("expected 5 sections, got %d", len(view.Sections))
+	if len(view.Sections) != 6 {
+		t.Fatalf("expected 6 sections, got %d", len(view.Sections))
 	}
 	for _, sec := range view.Sections {
 		for _, f := range sec.Fields {
@@ -344,6 +371,40 @@ func TestAdminConfigViewAndApply(t *testing.T) {
 	}
 }
 
+func TestAdminConfigAppliesClientACLImmediately(t *testing.T) {
+	var base config.SowerConfig
+	base.ACL.DNS.Deny = []string{"10.0.0.0/8"}
+	acls, err := newClientACLs(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ac := newAdminConfig(base, admin.LoadStateStore(""), newTestRouter(), acls)
+	lan := &net.UDPAddr{IP: net.ParseIP("192.168.1.20"), Port: 5353}
+	office := &net.UDPAddr{IP: net.ParseIP("10.1.2.3"), Port: 5353}
+	if !acls.dns.admits(lan) || acls.dns.admits(office) {
+		t.Fatal("dns acl from the config file not applied")
+	}
+
+	allow := []string{"192.168.2.0/24"}
+	if _, err := ac.ApplyConfigChanges(admin.ConfigChanges{ACL: map[string]admin.ACLOverride{"dns": {Allow: &allow}}}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if acls.dns.admits(lan) || acls.dns.admits(office) {
+		t.Fatal("dns allow override not applied")
+	}
+	if !acls.dns.admits(&net.UDPAddr{IP: net.ParseIP("192.168.2.7"), Port: 5353}) {
+		t.Fatal("client inside the allow override refused")
+	}
+
+	var cleared []string
+	if _, err := ac.ApplyConfigChanges(admin.ConfigChanges{ACL: map[string]admin.ACLOverride{"dns": {Allow: &cleared}}}, 1); err != nil {
+		t.Fatal(err)
+	}
+	if !acls.dns.admits(lan) || acls.dns.admits(office) {
+		t.Fatal("clearing the override must restore the config file acl")
+	}
+}
+
 func TestAdminRulesRestoresBaselineOrder(t *testing.T) {
 	statePath := filepath.Join(t.TempDir(), "admin-state.json")
 	r := newTestRouter()
@@ -516,3 +577,45 @@ func TestRestartFn(t *testing.T) {
 	default:
 	}
 }
+
+func TestAdminRulesExpire(t *testing.T) {
+	t.Parallel()
+	statePath := filepath.Join(t.TempDir(), "admin-state.json")
+	audit, err := admin.NewAuditLog(admin.AuditOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, _ := bootAdapter(t, statePath)
+	expires := time.Now().Add(time.Hour)
+	if err := a.RuleAddUntil(admin.CategoryProxy, expires, "**.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.RuleRemoveUntil(admin.CategoryBlock, expires, "example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if !a.r.ProxyRule.Match("www.example.com") || a.r.BlockRule.Match("example.com") {
+		t.Fatal("temporary changes not applied")
+	}
+	entries, _, err := a.RuleSearch(admin.CategoryProxy, "", 0, 10, admin.RuleSortDefault, admin.SortDirAsc)
+	if err != nil || len(entries) != 1 || entries[0].Expires == nil || !entries[0].Expires.Equal(expires) {
+		t.Fatalf("listing = %+v, %v", entries, err)
+	}
+
+	reapExpiredRules(a, audit, time.Now())
+	if a.r.ProxyRule.Count() != 1 || a.r.BlockRule.Count() != 0 {
+		t.Fatal("reaper reverted changes before their expiry")
+	}
+	reapExpiredRules(a, audit, expires)
+	if a.r.ProxyRule.Count() != 0 || !a.r.BlockRule.Match("example.com") {
+		t.Fatalf("after expiry: proxy %v, block %v", a.r.ProxyRule.List(), a.r.BlockRule.List())
+	}
+	if got := audit.Query(admin.AuditFilter{Action: admin.AuditRulesExpire}, 10); len(got) != 2 {
+		t.Fatalf("audit = %+v", got)
+	}
+
+	// The reverted state survives a restart.
+	b, _ := bootAdapter(t, statePath)
+	if b.r.ProxyRule.Count() != 0 || b.r.BlockRule.Count() != 1 {
+		t.Fatalf("after restart: proxy %v, block %v", b.r.ProxyRule.List(), b.r.BlockRule.List())
+	}
+}
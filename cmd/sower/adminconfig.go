@@ -2,6 +2,7 @@ package main
 
 import (
 	"log/slog"
+	"maps"
 	"slices"
 	"strconv"
 	"strings"
@@ -15,22 +16,24 @@ import (
 // adminConfig adapts the effective sower configuration to the admin
 // ConfigManager interface. It keeps the pre-override file/flag config so a
 // cleared override can revert the runtime to it, and applies whitelisted
-// changes to the log level and the router's DNS upstreams immediately;
-// every other whitelisted field takes effect on the next restart.
+// changes to the log level, the router's DNS upstreams and the client ACLs
+// immediately; every other whitelisted field takes effect on the next
+// restart.
 type adminConfig struct {
 	mu        sync.Mutex // guards effective
 	base      config.SowerConfig
 	effective config.SowerConfig
 	state     *admin.StateStore
 	router    *router.Router
+	acls      *clientACLs
 }
 
 // newAdminConfig builds the adapter. base must be the configuration before
 // admin-state overrides were applied.
-func newAdminConfig(base config.SowerConfig, state *admin.StateStore, r *router.Router) *adminConfig {
+func newAdminConfig(base config.SowerConfig, state *admin.StateStore, r *router.Router, acls *clientACLs) *adminConfig {
 	effective := base
 	applyConfigOverrides(&effective, state.ConfigOverrides())
-	return &adminConfig{base: base, effective: effective, state: state, router: r}
+	return &adminConfig{base: base, effective: effective, state: state, router: r, acls: acls}
 }
 
 // ApplyConfigChanges persists the overrides first, then applies them to the
@@ -100,23 +103,54 @@ func (ac *adminConfig) ApplyConfigChanges(changes admin.ConfigChanges, revision
 	applyStr(&overrides.RouterCountryMMDB, changes.RouterCountryMMDB)
 	applyStr(&overrides.RouterCountryFile, changes.RouterCountryFile)
 	applyList(&overrides.RouterCountryRules, changes.RouterCountryRules)
+	if len(changes.ACL) > 0 {
+		// The map is shared with the stored state: apply to a copy.
+		acl := maps.Clone(overrides.ACL)
+		if acl == nil {
+			acl = make(map[string]admin.ACLOverride, len(changes.ACL))
+		}
+		for group, c := range changes.ACL {
+			o := acl[group]
+			applyList(&o.Allow, c.Allow)
+			applyList(&o.Deny, c.Deny)
+			if o.Allow == nil && o.Deny == nil {
+				delete(acl, group)
+			} else {
+				acl[group] = o
+			}
+		}
+		overrides.ACL = acl
+	}
 
 	newRevision, err := ac.state.ApplyConfig(overrides, revision)
 	if err != nil {
 		return admin.ConfigView{}, err
 	}
+	ac.applyLocked(overrides, changes.DNSUpstream != nil || changes.DNSFallback != nil)
+	// Never log override values: the whitelisted fields are not secrets
+	// today, but the revision is all an operator needs to correlate.
+	slog.Info("applied admin config override", "revision", newRevision)
+	return ac.configViewLocked(), nil
+}
 
+// applyLocked recomputes the effective config from the persisted overrides
+// and applies the immediate-effect fields to the running process;
+// everything else takes effect on the next restart. The DNS upstreams are
+// reset when dnsChanged or when their effective values moved.
+func (ac *adminConfig) applyLocked(overrides admin.ConfigOverrides, dnsChanged bool) {
+	prev := ac.effective.DNS
 	ac.effective = ac.base
 	applyConfigOverrides(&ac.effective, overrides)
-	// Immediate-effect fields apply to the running process; everything else
-	// takes effect on the next restart.
-	if changes.DNSUpstream != nil || changes.DNSFallback != nil {
+	if dnsChanged || prev.Upstream != ac.effective.DNS.Upstream || prev.Fallback != ac.effective.DNS.Fallback {
 		ac.router.SetDNS(ac.effective.DNS.Upstream, ac.effective.DNS.Fallback)
 	}
-	// Never log override values: the whitelisted fields are not secrets
-	// today, but the revision is all an operator needs to correlate.
-	slog.Info("applied admin config override", "revision", newRevision)
-	return ac.configViewLocked(), nil
+	if ac.acls != nil {
+		// Entries were validated with the changes; a failure here means
+		// the file config itself is invalid and the previous lists stay.
+		if err := ac.acls.set(ac.effective); err != nil {
+			slog.Warn("apply client acl override", "error", err)
+		}
+	}
 }
 
 func (ac *adminConfig) ConfigView() admin.ConfigView {
@@ -201,6 +235,7 @@ func (ac *adminConfig) configViewLocked() admin.ConfigView {
 				{Key: "admin.state_file", Value: cfg.Admin.StateFile, ApplyMode: admin.ApplyReadonly, Source: admin.SourceConfig,
 					Constraint: "状态文件在启动时加载，运行期切换不生效"},
 			}},
+			{Name: "访问控制", Fields: aclFields(cfg, overrides)},
 			{Name: "规则来源", Fields: ruleSourceFields(cfg, overrides)},
 		},
 	}
@@ -262,3 +297,39 @@ func ruleSourceFields(cfg config.SowerConfig, o admin.ConfigOverrides) []admin.C
 	)
 	return fields
 }
+
+// aclFields renders the client ACL of each listener group as editable
+// lists, one CIDR or IP per line.
+func aclFields(cfg config.SowerConfig, o admin.ConfigOverrides) []admin.ConfigField {
+	source := func(overridden bool) string {
+		if overridden {
+			return admin.SourceOverride
+		}
+		return admin.SourceConfig
+	}
+	labels := map[string]string{
+		"dns":         "DNS 53",
+		"http":        "HTTP 80",
+		"https":       "HTTPS 443",
+		"socks5":      "SOCKS5/HTTP 代理",
+		"transparent": "透明代理",
+	}
+	fields := make([]admin.ConfigField, 0, 2*len(admin.ACLGroups))
+	for _, group := range admin.ACLGroups {
+		acl, override, label := cfg.ClientACL(group), o.ACL[group], labels[group]
+		fields = append(fields,
+			admin.ConfigField{Key: "acl." + group + ".allow", Value: strings.Join(nonEmpty(acl.Allow), "\n"), Editable: true,
+				Type: "list", ApplyMode: admin.ApplyImmediate, Source: source(override.Allow != nil),
+				Constraint: label + " 允许的客户端 CIDR 或 IP，每行一条；清空恢复配置文件值，为空时允许所有"},
+			admin.ConfigField{Key: "acl." + group + ".deny", Value: strings.Join(nonEmpty(acl.Deny), "\n"), Editable: true,
+				Type: "list", ApplyMode: admin.ApplyImmediate, Source: source(override.Deny != nil),
+				Constraint: label + " 拒绝的客户端 CIDR 或 IP，每行一条；优先于允许列表"},
+		)
+	}
+	return fields
+}
+
+// nonEmpty drops the empty entry an empty TOML array decodes to.
+func nonEmpty(list []string) []string {
+	return slices.DeleteFunc(slices.Clone(list), func(s string) bool { return s == "" })
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"log/slog"
+
+	"github.com/sower-proxy/sower/config"
+	"github.com/sower-proxy/sower/internal/admin"
+)
+
+// newAuditLog builds the admin audit trail from [admin.audit], nil when the
+// console is disabled. An unwritable file degrades to an in-memory trail
+// instead of keeping the proxy from starting.
+func newAuditLog(cfg config.SowerConfig) *admin.AuditLog {
+	if cfg.Admin.Disable {
+		return nil
+	}
+	a := cfg.Admin.Audit
+	opts := admin.AuditOptions{
+		Size:       a.Size,
+		File:       a.File,
+		MaxBytes:   int64(a.MaxSizeMB) << 20,
+		MaxBackups: a.MaxBackups,
+	}
+	l, err := admin.NewAuditLog(opts)
+	if err != nil {
+		slog.Warn("open admin audit log, keeping it in memory only", "error", err)
+		opts.File = ""
+		l, _ = admin.NewAuditLog(opts)
+	}
+	return l
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/sower-proxy/sower/config"
+)
+
+// blockPageConsoleAddr returns the admin address the block page links to for
+// unblock requests: one a LAN client can reach, or empty when the console is
+// disabled or only listens on loopback.
+func blockPageConsoleAddr(cfg config.SowerConfig) string {
+	if cfg.Admin.Disable || cfg.Admin.Addr == "" {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(cfg.Admin.Addr)
+	if err != nil {
+		return ""
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return ""
+	}
+	return cfg.Admin.Addr
+}
+
+var blockPageTemplate = template.Must(template.New("block").Parse(`<!doctype html>
+<html lang="zh-CN">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>访问已被拦截</title>
+<style>
+body{font-family:system-ui,sans-serif;max-width:36rem;margin:12vh auto;padding:0 1.5rem;color:#222}
+h1{font-size:1.4rem}code{background:#f2f2f2;padding:.1rem .3rem;border-radius:3px}
+a{color:#0b63ce}
+</style>
+</head>
+<body>
+<h1>访问已被拦截</h1>
+<p><code>{{.Host}}</code> 命中了 sower 拦截规则 <code>{{.Rule}}</code>。</p>
+{{if .UnblockURL}}<p><a href="{{.UnblockURL}}">申请解除拦截</a></p>{{end}}
+</body>
+</html>
+`))
+
+// blockPageUnblockURL links to the block rules view of the admin console,
+// searching for rule. An unspecified admin host is replaced by localIP, the
+// sower address the client already reached.
+func blockPageUnblockURL(consoleAddr string, localIP net.IP, rule string) string {
+	if consoleAddr == "" {
+		return ""
+	}
+	host, port, err := net.SplitHostPort(consoleAddr)
+	if err != nil {
+		return ""
+	}
+	if ip := net.ParseIP(host); ip == nil || ip.IsUnspecified() {
+		if localIP == nil {
+			return ""
+		}
+		host = localIP.String()
+	}
+	u := url.URL{
+		Scheme:   "http",
+		Host:     net.JoinHostPort(host, port),
+		Path:     "/rules/block",
+		RawQuery: url.Values{"q": {rule}}.Encode(),
+	}
+	return u.String()
+}
+
+// writeBlockPage answers a plain-HTTP request for a blocked host with a 403
+// page naming the matched rule, then lets the caller close the connection.
+// console is the blockPageConsoleAddr to link, or empty for no link.
+func writeBlockPage(conn net.Conn, console, host, rule string) {
+	var localIP net.IP
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		localIP = addr.IP
+	}
+
+	var body bytes.Buffer
+	if err := blockPageTemplate.Execute(&body, map[string]string{
+		"Host":       host,
+		"Rule":       rule,
+		"UnblockURL": blockPageUnblockURL(console, localIP, rule),
+	}); err != nil {
+		slog.Debug("render block page", "error", err, "host", host)
+		return
+	}
+
+	resp := http.Response{
+		StatusCode:    http.StatusForbidden,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{},
+		ContentLength: int64(body.Len()),
+		Close:         true,
+		Body:          io.NopCloser(&body),
+	}
+	resp.Header.Set("Content-Type", "text/html; charset=utf-8")
+	resp.Header.Set("Cache-Control", "no-store")
+	if err := resp.Write(conn); err != nil {
+		slog.Debug("write block page", "error", err, "host", host)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sower-proxy/sower/config"
+	"github.com/sower-proxy/sower/router"
+)
+
+func TestHandleHTTPConnServesBlockPageInSowerIPMode(t *testing.T) {
+	t.Parallel()
+
+	downstreamServer, downstreamClient := net.Pipe()
+	defer downstreamClient.Close()
+
+	r := newTestRouter()
+	r.BlockRule = router.NewRuleSet("**.ads.example")
+	r.ProxyDial = func(network, host string, port uint16) (net.Conn, error) {
+		t.Errorf("blocked host dialed through proxy: %s:%d", host, port)
+		return nil, router.ErrBlocked
+	}
+	r.SetDNSBlockMode(router.DNSBlockSowerIP)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		handleHTTPConn(downstreamServer, r, newTestStats(t), "10.0.0.1:19090")
+	}()
+
+	_ = downstreamClient.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := downstreamClient.Write([]byte("GET / HTTP/1.1\r\nHost: tracker.ads.example\r\n\r\n")); err != nil {
+		t.Fatalf("write request: %v", err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(downstreamClient), nil)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("read body: %v", err)
+	}
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("status = %d, want 403", resp.StatusCode)
+	}
+	if !strings.Contains(string(body), "tracker.ads.example") || !strings.Contains(string(body), "**.ads.example") {
+		t.Fatalf("block page does not name host and rule: %s", body)
+	}
+	if !strings.Contains(string(body), "http://10.0.0.1:19090/rules/block?q=") {
+		t.Fatalf("block page does not link the console: %s", body)
+	}
+
+	_ = downstreamClient.Close()
+	waitForHandler(t, &wg)
+}
+
+func TestBlockPageUnblockURL(t *testing.T) {
+	t.Parallel()
+
+	localIP := net.ParseIP("192.168.1.2")
+	tests := []struct {
+		console string
+		want    string
+	}{
+		{console: "", want: ""},
+		{console: "10.0.0.1:19090", want: "http://10.0.0.1:19090/rules/block?q=%2A%2A.ads.example"},
+		{console: "0.0.0.0:19090", want: "http://192.168.1.2:19090/rules/block?q=%2A%2A.ads.example"},
+		{console: "[::]:80", want: "http://192.168.1.2:80/rules/block?q=%2A%2A.ads.example"},
+	}
+	for _, tt := range tests {
+		if got := blockPageUnblockURL(tt.console, localIP, "**.ads.example"); got != tt.want {
+			t.Fatalf("blockPageUnblockURL(%q) = %q, want %q", tt.console, got, tt.want)
+		}
+	}
+}
+
+func TestBlockPageConsoleAddrSkipsLoopback(t *testing.T) {
+	t.Parallel()
+
+	var cfg config.SowerConfig
+	cfg.Admin.Addr = "127.0.0.1:19090"
+	if got := blockPageConsoleAddr(cfg); got != "" {
+		t.Fatalf("loopback console addr = %q, want empty", got)
+	}
+	cfg.Admin.Addr = "0.0.0.0:19090"
+	if got := blockPageConsoleAddr(cfg); got != cfg.Admin.Addr {
+		t.Fatalf("console addr = %q, want %q", got, cfg.Admin.Addr)
+	}
+	cfg.Admin.Disable = true
+	if got := blockPageConsoleAddr(cfg); got != "" {
+		t.Fatalf("disabled console addr = %q, want empty", got)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sower-proxy/sower/config"
+	"github.com/sower-proxy/sower/pkg/dhcp"
+)
+
+// newDHCPServer builds the built-in DHCP server, or returns nil when it is
+// disabled. An empty netmask is taken from the dns.serve address on the
+// served interface.
+func newDHCPServer(cfg config.SowerConfig) (*dhcp.Server, error) {
+	if !cfg.DHCP.Enable {
+		return nil, nil
+	}
+	serverIP := net.ParseIP(cfg.DNS.Serve)
+	mask := net.IPMask(net.ParseIP(cfg.DHCP.Netmask).To4())
+	if cfg.DHCP.Netmask == "" {
+		var err error
+		if mask, err = ifaceMask(cfg.DHCP.Iface, serverIP); err != nil {
+			return nil, err
+		}
+	}
+	srv, err := dhcp.NewServer(dhcp.ServerConfig{
+		ServerIP:   serverIP,
+		Netmask:    mask,
+		Gateway:    net.ParseIP(cfg.DHCP.Gateway),
+		RangeStart: net.ParseIP(cfg.DHCP.RangeStart),
+		RangeEnd:   net.ParseIP(cfg.DHCP.RangeEnd),
+		Lease:      time.Duration(cfg.DHCP.LeaseHours) * time.Hour,
+		LeaseFile:  cfg.DHCP.LeaseFile,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("build dhcp server: %w", err)
+	}
+	return srv, nil
+}
+
+// ifaceMask returns the mask of ip as configured on iface.
+func ifaceMask(iface string, ip net.IP) (net.IPMask, error) {
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return nil, fmt.Errorf("get dhcp interface: %w", err)
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("get dhcp interface addresses: %w", err)
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return ipNet.Mask[len(ipNet.Mask)-net.IPv4len:], nil
+		}
+	}
+	return nil, fmt.Errorf("dns serve ip %s is not assigned to dhcp interface %s; set dhcp.netmask", ip, iface)
+}
+
+func startDHCPListener(ctx context.Context, wg *sync.WaitGroup, cfg config.SowerConfig, srv *dhcp.Server, errCh chan<- error) error {
+	if srv == nil {
+		return nil
+	}
+	conn, err := dhcp.Listen(cfg.DHCP.Iface)
+	if err != nil {
+		return err
+	}
+	slog.Info("service listening", "service", "dhcp server", "network", "udp", "iface", cfg.DHCP.Iface,
+		"range", cfg.DHCP.RangeStart+"-"+cfg.DHCP.RangeEnd)
+	wg.Add(1)
+	go closeOnDone(ctx, wg, conn)
+	go serveAndReport(errCh, "dhcp server", func() error {
+		return srv.Serve(conn)
+	})
+	return nil
+}
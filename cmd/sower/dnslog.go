@@ -0,0 +1,37 @@
+package main
+
+import (
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sower-proxy/sower/config"
+	"github.com/sower-proxy/sower/internal/admin"
+	"github.com/sower-proxy/sower/router"
+)
+
+// newDNSLog builds the DNS query log from [dns.query_log]. The in-memory ring
+// is always kept; the JSONL file sink is opt-in.
+func newDNSLog(cfg config.SowerConfig) (*admin.DNSLog, error) {
+	return admin.NewDNSLog(admin.DNSLogOptions{
+		Size:       cfg.DNS.QueryLog.Size,
+		File:       cfg.DNS.QueryLog.File,
+		MaxBytes:   int64(cfg.DNS.QueryLog.MaxSizeMB) << 20,
+		MaxBackups: cfg.DNS.QueryLog.MaxBackups,
+	})
+}
+
+// dnsQueryLogger converts router query reports into query log entries.
+func dnsQueryLogger(l *admin.DNSLog) router.DNSQueryObserver {
+	return func(q router.DNSQuery) {
+		l.Record(admin.DNSLogEntry{
+			Time:       time.Now(),
+			Client:     q.Client,
+			Domain:     q.Domain,
+			Type:       dns.TypeToString[q.Qtype],
+			Decision:   string(q.Decision),
+			Upstream:   q.Upstream,
+			Rcode:      dns.RcodeToString[q.Rcode],
+			DurationMs: float64(q.Duration.Microseconds()) / 1000,
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net"
+	"net/netip"
+	"strconv"
+
+	"github.com/sower-proxy/sower/internal/admin"
+	"github.com/sower-proxy/sower/router"
+)
+
+// routeExplainer implements admin.RouteExplainer on Router.Explain, adding
+// the upstream of the route and the client ACL verdicts.
+type routeExplainer struct {
+	r    *router.Router
+	acls *clientACLs
+	// remote names the proxy upstream, e.g. "sower proxy.example.com:443".
+	remote string
+}
+
+func (e routeExplainer) ExplainRoute(domain string, port uint16, client netip.Addr) admin.RouteExplain {
+	t := e.r.Explain(domain, port)
+	out := admin.RouteExplain{
+		Domain:       domain,
+		Port:         port,
+		Steps:        make([]admin.ExplainStep, 0, len(t.Steps)),
+		IPs:          make([]admin.ExplainIP, 0, len(t.IPs)),
+		ResolveError: t.ResolveErr,
+		Route:        string(t.Route),
+		Pending:      t.Pending,
+		DNS: admin.DNSExplain{
+			Decision: string(t.DNS.Decision),
+			Rule:     t.DNS.Rule,
+			Answer:   t.DNS.Answer,
+			Upstream: t.DNS.Upstream,
+			Poisoned: t.DNS.Poisoned,
+		},
+	}
+	for _, s := range t.Steps {
+		out.Steps = append(out.Steps, admin.ExplainStep{Check: s.Check, Matched: s.Matched, Skipped: s.Skipped, Rule: s.Rule, Detail: s.Detail})
+	}
+	for _, ip := range t.IPs {
+		out.IPs = append(out.IPs, admin.ExplainIP{IP: ip.IP.String(), CIDR: ip.CIDR, Country: ip.Country, Local: ip.Local, Error: ip.Err})
+	}
+	switch t.Route {
+	case router.RouteDirect:
+		out.Upstream = "direct " + net.JoinHostPort(domain, strconv.FormatUint(uint64(port), 10))
+	case router.RouteProxy:
+		out.Upstream = e.remote
+	}
+
+	if client.IsValid() {
+		out.Client = client.String()
+		addr := net.TCPAddrFromAddrPort(netip.AddrPortFrom(client, 0))
+		for _, acl := range []*clientACL{&e.acls.dns, &e.acls.http, &e.acls.https, &e.acls.socks5, &e.acls.transparent} {
+			out.ACL = append(out.ACL, admin.ACLVerdict{Listener: acl.name, Allowed: acl.admits(addr)})
+		}
+	}
+	return out
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/sower-proxy/sower/config"
+	"github.com/sower-proxy/sower/router"
+)
+
+func TestRouteExplainerUpstreamAndACL(t *testing.T) {
+	var cfg config.SowerConfig
+	cfg.ACL.Socks5.Allow = []string{"192.168.1.0/24"}
+	cfg.ACL.HTTP.Deny = []string{"192.168.1.10"}
+	acls, err := newClientACLs(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := newTestRouter()
+	r.DirectRule = router.NewRuleSet("**.example.cn")
+	r.ProxyRule = router.NewRuleSet("**.google.com")
+	e := routeExplainer{r: r, acls: acls, remote: "sower proxy.example.org:443"}
+
+	for domain, want := range map[string]string{
+		"www.example.cn": "direct www.example.cn:8443",
+		"www.google.com": "sower proxy.example.org:443",
+		"example.com":    "",
+	} {
+		if got := e.ExplainRoute(domain, 8443, netip.Addr{}); got.Upstream != want || got.ACL != nil {
+			t.Errorf("%s upstream = %q, acl %v, want %q", domain, got.Upstream, got.ACL, want)
+		}
+	}
+
+	got := e.ExplainRoute("example.com", 443, netip.MustParseAddr("192.168.1.10"))
+	if got.Route != "block" || got.Client != "192.168.1.10" {
+		t.Fatalf("explain = %+v", got)
+	}
+	allowed := make(map[string]bool)
+	for _, v := range got.ACL {
+		allowed[v.Listener] = v.Allowed
+	}
+	want := map[string]bool{"dns": true, "http": false, "https": true, "socks5": true, "transparent": true}
+	if len(allowed) != len(want) {
+		t.Fatalf("acl = %+v", got.ACL)
+	}
+	for name, ok := range want {
+		if allowed[name] != ok {
+			t.Errorf("acl %s = %v, want %v", name, allowed[name], ok)
+		}
+	}
+	if got := e.ExplainRoute("example.com", 443, netip.MustParseAddr("10.0.0.1")); got.ACL[3].Allowed {
+		t.Errorf("socks5 admits a client outside its allow list: %+v", got.ACL)
+	}
+}
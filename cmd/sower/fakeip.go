@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/sower-proxy/sower/router"
+)
+
+// fakeIPSaveInterval bounds how many fresh fake-IP mappings a crash can
+// lose. Save is a no-op while nothing changed, so idle gateways stay quiet.
+const fakeIPSaveInterval = time.Minute
+
+// runFakeIPSaver saves the router's fake-IP pool periodically until ctx is
+// done. It returns immediately when fake-IP DNS is off.
+func runFakeIPSaver(ctx context.Context, r *router.Router) {
+	if r.FakeIPPool() == nil {
+		return
+	}
+	ticker := time.NewTicker(fakeIPSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			saveFakeIPPool(r)
+		}
+	}
+}
+
+// saveFakeIPPool flushes the fake-IP pool, logging instead of failing: a
+// lost save only costs clients a fresh address for the affected domains.
+func saveFakeIPPool(r *router.Router) {
+	pool := r.FakeIPPool()
+	if pool == nil {
+		return
+	}
+	if err := pool.Save(); err != nil {
+		slog.Warn("save fake ip pool", "error", err)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/miekg/dns"
+	"github.com/sower-proxy/sower/internal/admin"
 )
 
 // dnsHostnameResolver resolves client IPs to hostnames via PTR queries to a
@@ -50,3 +51,16 @@ func (r *dnsHostnameResolver) Hostname(ctx context.Context, ip string) string {
 	}
 	return ""
 }
+
+// hostnameResolvers tries each resolver in order and returns the first
+// non-empty hostname.
+type hostnameResolvers []admin.HostnameResolver
+
+func (rs hostnameResolvers) Hostname(ctx context.Context, ip string) string {
+	for _, r := range rs {
+		if host := r.Hostname(ctx, ip); host != "" {
+			return host
+		}
+	}
+	return ""
+}
@@ -83,3 +83,26 @@ func TestDNSHostnameResolver(t *testing.T) {
 		t.Fatalf("reverse with canceled ctx: got %q", got)
 	}
 }
+
+type staticHostnames map[string]string
+
+func (s staticHostnames) Hostname(_ context.Context, ip string) string { return s[ip] }
+
+func TestHostnameResolversPreferEarlierResolver(t *testing.T) {
+	t.Parallel()
+
+	rs := hostnameResolvers{
+		staticHostnames{"192.168.1.100": "laptop"},
+		staticHostnames{"192.168.1.100": "laptop.lan", "192.168.1.1": "router.lan"},
+	}
+	ctx := context.Background()
+	if got := rs.Hostname(ctx, "192.168.1.100"); got != "laptop" {
+		t.Fatalf("lease hostname: got %q", got)
+	}
+	if got := rs.Hostname(ctx, "192.168.1.1"); got != "router.lan" {
+		t.Fatalf("fallback hostname: got %q", got)
+	}
+	if got := rs.Hostname(ctx, "10.0.0.1"); got != "" {
+		t.Fatalf("unknown ip: got %q", got)
+	}
+}
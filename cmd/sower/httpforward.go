@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	stderrors "errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sower-proxy/conns/relay"
+	"github.com/sower-proxy/sower/internal/admin"
+	"github.com/sower-proxy/sower/router"
+)
+
+const (
+	// httpKeepAliveTimeout bounds how long a client connection may idle
+	// between requests.
+	httpKeepAliveTimeout = 2 * time.Minute
+	// maxForwardUpstreams caps the upstream connections one client keeps;
+	// the oldest-idle host is closed past it.
+	maxForwardUpstreams = 8
+)
+
+// hopHeaders describe a single connection (RFC 9110 section 7.6.1) and are
+// not forwarded. Transfer-Encoding is already parsed out by net/http.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// httpForwarder serves the plain HTTP/1.1 requests of one client connection.
+// Each request is routed on its own Host, so a browser that reuses the
+// connection for another site reaches that site, and upstream connections
+// are kept per host:port for the requests that follow.
+type httpForwarder struct {
+	statsConn net.Conn // the stats-wrapped client connection
+	conn      net.Conn // client reads, past br, and writes
+	br        *bufio.Reader
+	r         *router.Router
+	stats     *admin.Stats
+	// proxyOnly marks the DNS-mode listener, which stands in for origins
+	// rather than serving proxy clients.
+	proxyOnly bool
+	// blockConsole is the console address the block page links to.
+	blockConsole string
+	dial         router.ProxyDialFn
+
+	upstreams map[string]*forwardUpstream
+	bound     string
+}
+
+type forwardUpstream struct {
+	key      string
+	conn     net.Conn
+	br       *bufio.Reader
+	lastUsed time.Time
+}
+
+func newHTTPForwarder(statsConn, conn net.Conn, br *bufio.Reader, r *router.Router, stats *admin.Stats, proxyOnly bool, blockConsole string, dial router.ProxyDialFn) *httpForwarder {
+	return &httpForwarder{
+		statsConn:    statsConn,
+		conn:         conn,
+		br:           br,
+		r:            r,
+		stats:        stats,
+		proxyOnly:    proxyOnly,
+		blockConsole: blockConsole,
+		dial:         dial,
+		upstreams:    make(map[string]*forwardUpstream),
+	}
+}
+
+// serve forwards req and the requests that follow it on the connection. It
+// returns a CONNECT request for the caller to tunnel, or nil once the
+// connection is done.
+func (f *httpForwarder) serve(req *http.Request) *http.Request {
+	for {
+		if req.Method == http.MethodConnect {
+			return req
+		}
+		if !f.forward(req) {
+			return nil
+		}
+
+		_ = f.conn.SetReadDeadline(time.Now().Add(httpKeepAliveTimeout))
+		next, err := http.ReadRequest(f.br)
+		if err != nil {
+			var ne net.Error
+			if !stderrors.Is(err, io.EOF) && !stderrors.Is(err, net.ErrClosed) && !(stderrors.As(err, &ne) && ne.Timeout()) {
+				slog.Debug("read next http request", "error", err)
+			}
+			return nil
+		}
+		_ = f.conn.SetReadDeadline(time.Time{})
+		req = next
+	}
+}
+
+// Close closes every upstream connection kept for the client.
+func (f *httpForwarder) Close() {
+	for key := range f.upstreams {
+		f.drop(key)
+	}
+}
+
+// forward relays one request and its response, and reports whether the
+// client connection can carry another request.
+func (f *httpForwarder) forward(req *http.Request) bool {
+	host, port, err := f.target(req)
+	if err != nil {
+		if _, err := f.conn.Write([]byte("HTTP/1.1 400 Bad Request\r\n\r\n")); err != nil {
+			slog.Debug("write bad request response", "error", err, "host", req.Host)
+		}
+		return false
+	}
+	if f.bound != host {
+		f.bound = host
+		f.stats.BindConn(f.statsConn, targetDomain(f.r, host))
+	}
+	if f.proxyOnly {
+		// When DNS answers blocked names with the sower IP, plain HTTP for
+		// them gets a page naming the rule instead.
+		if rule, blocked := blockedBySowerIP(f.r, host); blocked {
+			writeBlockPage(f.conn, f.blockConsole, host, rule)
+			return false
+		}
+	}
+
+	upgrade := upgradeType(req.Header)
+	removeHopHeaders(req.Header)
+	if upgrade != "" {
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", upgrade)
+	}
+	if _, ok := req.Header["User-Agent"]; !ok {
+		// Keep net/http from adding its own.
+		req.Header["User-Agent"] = []string{""}
+	}
+
+	up, resp, err := f.roundTrip(req, host, port)
+	if err != nil {
+		if !stderrors.Is(err, router.ErrBlocked) {
+			slog.Error("forward http request", "error", err, "host", host, "port", port, "req", req.URL)
+			f.stats.RecordProxyError("dial", fmt.Sprintf("%s: %v", targetDomain(f.r, host), err))
+		}
+		if !f.proxyOnly {
+			// The DNS-mode listener stands in for the origin, so it closes
+			// as an unreachable origin would; a proxy client gets a status.
+			writeHTTPProxyError(f.conn, err)
+		}
+		return false
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		if err := resp.Write(f.conn); err != nil {
+			f.drop(up.key)
+			return false
+		}
+		// The connection now speaks the upgraded protocol: hand both ends,
+		// with whatever their readers buffered, to a raw relay.
+		delete(f.upstreams, up.key)
+		defer up.conn.Close()
+		client := &prefixConn{Conn: f.conn, prefix: bytes.NewReader(peekBuffered(f.br))}
+		upstream := &prefixConn{Conn: up.conn, prefix: bytes.NewReader(peekBuffered(up.br))}
+		if err := relay.Relay(client, upstream); err != nil {
+			slog.Debug("relay upgraded http connection", "error", err, "host", host, "upgrade", upgrade)
+		}
+		return false
+	}
+
+	upstreamClose := resp.Close
+	removeHopHeaders(resp.Header)
+	resp.Close = resp.Close || req.Close
+	if err := resp.Write(f.conn); err != nil {
+		slog.Debug("write http response", "error", err, "host", host, "req", req.URL)
+		f.drop(up.key)
+		return false
+	}
+	if upstreamClose {
+		f.drop(up.key)
+	} else {
+		up.lastUsed = time.Now()
+	}
+	return !resp.Close
+}
+
+// target returns the host and port a request is for. The DNS-mode listener
+// receives origin-form requests whose Host defaults to port 80; a proxy
+// client sends absolute-form ones whose scheme sets the default.
+func (f *httpForwarder) target(req *http.Request) (string, uint16, error) {
+	if f.proxyOnly {
+		host, port := splitHostPort(req.Host, 80)
+		return host, port, nil
+	}
+	return router.ParseHostPort(req.Host, req.URL)
+}
+
+// roundTrip writes req to the upstream for host:port and reads its final
+// response, passing interim 1xx responses on to the client. A kept
+// connection the origin closed while idle is replaced once, provided the
+// request body has not been consumed.
+func (f *httpForwarder) roundTrip(req *http.Request, host string, port uint16) (*forwardUpstream, *http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		up, reused, err := f.upstream(host, port)
+		if err != nil {
+			return nil, nil, err
+		}
+		bindUpstream(f.stats, f.statsConn, up.conn, port)
+		resp, err := up.roundTrip(req, f.conn)
+		if err == nil {
+			return up, resp, nil
+		}
+		f.drop(up.key)
+		if !reused || attempt > 0 || req.Body != http.NoBody {
+			return nil, nil, err
+		}
+	}
+}
+
+func (up *forwardUpstream) roundTrip(req *http.Request, client io.Writer) (*http.Response, error) {
+	if err := req.Write(up.conn); err != nil {
+		return nil, fmt.Errorf("write request to %s: %w", up.key, err)
+	}
+	for {
+		resp, err := http.ReadResponse(up.br, req)
+		if err != nil {
+			return nil, fmt.Errorf("read response from %s: %w", up.key, err)
+		}
+		if resp.StatusCode >= 200 || resp.StatusCode == http.StatusSwitchingProtocols {
+			return resp, nil
+		}
+		if err := resp.Write(client); err != nil {
+			return nil, fmt.Errorf("write interim response: %w", err)
+		}
+	}
+}
+
+// upstream returns the kept connection for host:port, or dials one.
+func (f *httpForwarder) upstream(host string, port uint16) (up *forwardUpstream, reused bool, err error) {
+	key := net.JoinHostPort(host, strconv.Itoa(int(port)))
+	if up := f.upstreams[key]; up != nil {
+		return up, true, nil
+	}
+
+	rc, err := f.dial("tcp", host, port)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(f.upstreams) >= maxForwardUpstreams {
+		var idlest *forwardUpstream
+		for _, u := range f.upstreams {
+			if idlest == nil || u.lastUsed.Before(idlest.lastUsed) {
+				idlest = u
+			}
+		}
+		f.drop(idlest.key)
+	}
+	up = &forwardUpstream{key: key, conn: rc, br: bufio.NewReader(rc), lastUsed: time.Now()}
+	f.upstreams[key] = up
+	return up, false, nil
+}
+
+func (f *httpForwarder) drop(key string) {
+	if up := f.upstreams[key]; up != nil {
+		_ = up.conn.Close()
+		delete(f.upstreams, key)
+	}
+}
+
+// upgradeType returns the protocol a request asks to upgrade to, which
+// survives hop-by-hop stripping so WebSocket handshakes reach the origin.
+func upgradeType(h http.Header) string {
+	for _, v := range h.Values("Connection") {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(textproto.TrimString(token), "Upgrade") {
+				return h.Get("Upgrade")
+			}
+		}
+	}
+	return ""
+}
+
+// removeHopHeaders deletes the hop-by-hop headers, including any that
+// Connection names.
+func removeHopHeaders(h http.Header) {
+	for _, v := range h.Values("Connection") {
+		for _, token := range strings.Split(v, ",") {
+			if token = textproto.TrimString(token); token != "" {
+				h.Del(token)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+func peekBuffered(br *bufio.Reader) []byte {
+	b, _ := br.Peek(br.Buffered())
+	return b
+}
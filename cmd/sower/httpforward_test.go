@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sower-proxy/sower/router"
+)
+
+// fakeOrigins answers proxied requests per host, echoing the host and path
+// and recording the request headers each origin saw.
+type fakeOrigins struct {
+	mu      sync.Mutex
+	dials   map[string]int
+	headers []http.Header
+}
+
+func (o *fakeOrigins) dial(network, host string, port uint16) (net.Conn, error) {
+	o.mu.Lock()
+	o.dials[host]++
+	o.mu.Unlock()
+
+	client, server := net.Pipe()
+	go func() {
+		defer server.Close()
+		br := bufio.NewReader(server)
+		for {
+			req, err := http.ReadRequest(br)
+			if err != nil {
+				return
+			}
+			o.mu.Lock()
+			o.headers = append(o.headers, req.Header.Clone())
+			o.mu.Unlock()
+			body := host + req.URL.Path
+			if _, err := fmt.Fprintf(server, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\nKeep-Alive: timeout=5\r\n\r\n%s", len(body), body); err != nil {
+				return
+			}
+		}
+	}()
+	return client, nil
+}
+
+func TestHandleSocks5ConnRoutesEachKeepAliveRequest(t *testing.T) {
+	t.Parallel()
+
+	origins := &fakeOrigins{dials: make(map[string]int)}
+	r := newTestRouter()
+	r.ProxyRule = router.NewRuleSet("**.example.org")
+	r.ProxyDial = origins.dial
+
+	server, client := net.Pipe()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		handleProxyConn(server, r, newTestStats(t), newTestListener(sniffOptions{}))
+	}()
+	_ = client.SetDeadline(time.Now().Add(2 * time.Second))
+
+	br := bufio.NewReader(client)
+	for _, target := range []string{"a.example.org/one", "b.example.org/two", "a.example.org/three"} {
+		host, _, _ := strings.Cut(target, "/")
+		req := "GET http://" + target + " HTTP/1.1\r\nHost: " + host +
+			"\r\nProxy-Connection: keep-alive\r\nConnection: X-Trace\r\nX-Trace: 1\r\nAccept: */*\r\n\r\n"
+		if _, err := io.WriteString(client, req); err != nil {
+			t.Fatalf("write request for %s: %v", target, err)
+		}
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("read response for %s: %v", target, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != target {
+			t.Fatalf("response body = %q, want %q", body, target)
+		}
+		if resp.Header.Get("Keep-Alive") != "" {
+			t.Fatalf("hop-by-hop Keep-Alive reached the client for %s", target)
+		}
+	}
+
+	origins.mu.Lock()
+	if origins.dials["a.example.org"] != 1 || origins.dials["b.example.org"] != 1 {
+		t.Errorf("dials = %v, want one upstream per host", origins.dials)
+	}
+	for _, h := range origins.headers {
+		for _, name := range []string{"Proxy-Connection", "Connection", "X-Trace", "User-Agent"} {
+			if _, ok := h[name]; ok {
+				t.Errorf("origin saw header %s: %v", name, h)
+			}
+		}
+		if h.Get("Accept") != "*/*" {
+			t.Errorf("end-to-end Accept header lost: %v", h)
+		}
+	}
+	origins.mu.Unlock()
+
+	_ = client.Close()
+	waitForHandler(t, &wg)
+}
+
+func TestHandleHTTPConnClosesAfterClientConnectionClose(t *testing.T) {
+	t.Parallel()
+
+	origins := &fakeOrigins{dials: make(map[string]int)}
+	r := newTestRouter()
+	r.ProxyDial = origins.dial
+
+	server, client := net.Pipe()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		handleHTTPConn(server, r, newTestStats(t), "")
+	}()
+	_ = client.SetDeadline(time.Now().Add(2 * time.Second))
+
+	if _, err := io.WriteString(client, "GET /page HTTP/1.1\r\nHost: www.example.org\r\nConnection: close\r\n\r\n"); err != nil {
+		t.Fatalf("write request: %v", err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "www.example.org/page" {
+		t.Fatalf("response body = %q", body)
+	}
+	if !resp.Close {
+		t.Fatal("response does not announce Connection: close")
+	}
+	waitForHandler(t, &wg)
+}
+
+func TestRemoveHopHeaders(t *testing.T) {
+	t.Parallel()
+
+	h := http.Header{}
+	h.Set("Connection", "keep-alive, X-Session")
+	h.Set("X-Session", "abc")
+	h.Set("Keep-Alive", "timeout=5")
+	h.Set("Upgrade", "websocket")
+	h.Set("Content-Type", "text/plain")
+	if got := upgradeType(h); got != "" {
+		t.Fatalf("upgradeType without Connection: Upgrade = %q", got)
+	}
+
+	removeHopHeaders(h)
+	if len(h) != 1 || h.Get("Content-Type") != "text/plain" {
+		t.Fatalf("headers after removal = %v, want only Content-Type", h)
+	}
+
+	h = http.Header{}
+	h.Set("Connection", "Upgrade")
+	h.Set("Upgrade", "websocket")
+	if got := upgradeType(h); got != "websocket" {
+		t.Fatalf("upgradeType = %q, want websocket", got)
+	}
+}
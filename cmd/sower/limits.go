@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/sower-proxy/sower/config"
+	"github.com/sower-proxy/sower/internal/admin"
+	"github.com/sower-proxy/sower/router"
+)
+
+// quotaSaveInterval bounds how much metered usage a crash can lose.
+const quotaSaveInterval = time.Minute
+
+// newLimiter builds the bandwidth limiter of the [limits] section, nil
+// when it sets no cap and no quota. The section was validated on load.
+func newLimiter(cfg config.SowerConfig) *admin.Limiter {
+	limits := cfg.Limits
+	if limits.RateKB == 0 && limits.ClientRateKB == 0 && len(limits.Domains) == 0 && len(limits.Quotas) == 0 {
+		return nil
+	}
+	opts := admin.LimitOptions{
+		BytesPerSec:       int64(limits.RateKB) << 10,
+		ClientBytesPerSec: int64(limits.ClientRateKB) << 10,
+		QuotaFile:         limits.QuotaFile,
+	}
+	for _, d := range limits.Domains {
+		opts.Domains = append(opts.Domains, admin.DomainRate{
+			Pattern:     d.Pattern,
+			Match:       router.NewRuleSet(d.Pattern).Match,
+			BytesPerSec: int64(d.RateKB) << 10,
+		})
+	}
+	for _, q := range limits.Quotas {
+		prefixes, err := config.ParseClientPrefixes([]string{q.Client})
+		if err != nil || len(prefixes) != 1 {
+			slog.Warn("skip client quota", "client", q.Client, "error", err)
+			continue
+		}
+		opts.Quotas = append(opts.Quotas, admin.QuotaRule{
+			Client: q.Client,
+			Prefix: prefixes[0],
+			Limit:  uint64(q.LimitMB) << 20,
+			Period: q.Period,
+			Action: q.Action,
+		})
+	}
+	return admin.NewLimiter(opts)
+}
+
+// runQuotaSaver saves quota usage periodically until ctx is done. It
+// returns immediately without a limiter.
+func runQuotaSaver(ctx context.Context, l *admin.Limiter) {
+	if l == nil {
+		return
+	}
+	ticker := time.NewTicker(quotaSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			saveQuotaUsage(l)
+		}
+	}
+}
+
+// saveQuotaUsage flushes quota usage, logging instead of failing: a lost
+// save only hands clients back the usage metered since the last one.
+func saveQuotaUsage(l *admin.Limiter) {
+	if err := l.Save(); err != nil {
+		slog.Warn("save quota usage", "error", err)
+	}
+}
+
+// quotaDirect reports whether the client of a wrapped connection used up
+// a quota that stops proxying it.
+func quotaDirect(stats *admin.Stats, conn net.Conn) bool {
+	return stats.ExhaustedQuota(conn) == admin.QuotaDirect
+}
+
+// forClient returns the listener as seen by the client of conn: a direct
+// listener once the client used up a direct-action quota.
+func (l *proxyListener) forClient(stats *admin.Stats, conn net.Conn) *proxyListener {
+	if l.mode == config.ListenerModeDirect || !quotaDirect(stats, conn) {
+		return l
+	}
+	direct := *l
+	direct.mode = config.ListenerModeDirect
+	return &direct
+}
+
+// proxyOnlyDial returns the dial of the proxy-only DNS-mode listeners for
+// the client of conn, which dials directly once the client used up a
+// direct-action quota.
+func proxyOnlyDial(r *router.Router, stats *admin.Stats, conn net.Conn) func(network, host string, port uint16) (net.Conn, error) {
+	if !quotaDirect(stats, conn) {
+		return r.DialProxyOnly
+	}
+	return func(network, host string, port uint16) (net.Conn, error) {
+		return r.DialForced(router.RouteDirect, network, host, host, port, nil)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/sower-proxy/sower/config"
+	"github.com/sower-proxy/sower/internal/admin"
+)
+
+type addrConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c addrConn) RemoteAddr() net.Addr        { return c.remote }
+func (c addrConn) Write(p []byte) (int, error) { return len(p), nil }
+
+func TestProxyListenerForClientGoesDirectOnQuota(t *testing.T) {
+	t.Parallel()
+
+	var cfg config.SowerConfig
+	cfg.Limits.Quotas = []config.ClientQuota{{Client: "192.0.2.0/24", LimitMB: 1, Period: config.QuotaDaily, Action: config.QuotaDirect}}
+	limiter := newLimiter(cfg)
+	stats := newTestStats(t)
+	stats.SetLimiter(limiter)
+
+	l := &proxyListener{name: "lan", kind: listenerSocks5, mode: config.ListenerModeSmart}
+	conn := stats.WrapConn(addrConn{remote: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 9), Port: 40000}}, "socks5")
+	if got := l.forClient(stats, conn); got != l {
+		t.Fatal("listener switched before the quota was used up")
+	}
+
+	stats.BindConn(conn, "example.org")
+	for used := 0; used < 1<<20; used += 64 << 10 {
+		_, _ = conn.Write(make([]byte, 64<<10))
+	}
+	quotas := limiter.QuotaStats()
+	if len(quotas) != 1 || !quotas[0].Exhausted || quotas[0].Action != admin.QuotaDirect {
+		t.Fatalf("quotas = %+v, want one exhausted direct quota", quotas)
+	}
+	direct := l.forClient(stats, conn)
+	if direct == l || direct.mode != config.ListenerModeDirect || l.mode != config.ListenerModeSmart {
+		t.Fatalf("forClient mode = %s, listener mode = %s", direct.mode, l.mode)
+	}
+
+	if newLimiter(config.SowerConfig{}) != nil {
+		t.Fatal("empty limits section built a limiter")
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/sower-proxy/sower/config"
+	"github.com/sower-proxy/sower/internal/admin"
+	"github.com/sower-proxy/sower/pkg/upstreamtls"
+	"github.com/sower-proxy/sower/router"
+)
+
+// Proxy listener kinds: a socks5 listener also serves HTTP proxy requests
+// on its port, an http one serves only those.
+const (
+	listenerSocks5 = "socks5"
+	listenerHTTP   = "http"
+)
+
+// proxyListener is one SOCKS5 or HTTP proxy listener with its own routing
+// mode, credentials and allowed client CIDRs. acl is the ACL shared by all
+// proxy listeners, checked on top of allow.
+type proxyListener struct {
+	name string
+	kind string
+	mode string
+	// remote dials the upstream of a mode "remote" listener.
+	remote             router.ProxyDialFn
+	username, password string
+	allow              []netip.Prefix
+	acl                *clientACL
+	sniff              sniffOptions
+}
+
+func newProxyListener(kind string, l config.ProxyListener, upstreamDNS string, stats *admin.Stats) (*proxyListener, error) {
+	pl := &proxyListener{
+		name:     l.Name,
+		kind:     kind,
+		mode:     l.Mode,
+		username: l.Username,
+		password: l.Password,
+		sniff:    sniffOptions{enable: l.Sniff, dialDomain: l.SniffDialDomain},
+	}
+	allow, err := config.ParseClientPrefixes(l.Allow)
+	if err != nil {
+		return nil, fmt.Errorf("parse allow: %w", err)
+	}
+	pl.allow = allow
+	if l.Mode == config.ListenerModeRemote {
+		remote, err := GenProxyDial(l.Remote.Type, l.Remote.Addr, l.Remote.Password, upstreamDNS, upstreamtls.Options{
+			ServerName:         l.Remote.TLS.ServerName,
+			ClientHello:        l.Remote.TLS.ClientHello,
+			InsecureSkipVerify: l.Remote.TLS.InsecureSkipVerify,
+		}, stats)
+		if err != nil {
+			return nil, fmt.Errorf("build remote dialer: %w", err)
+		}
+		pl.remote = remote
+	}
+	return pl, nil
+}
+
+// allowed reports whether a client at addr passes the proxy ACL and the
+// listener's client CIDRs.
+func (l *proxyListener) allowed(addr net.Addr) bool {
+	if !l.acl.admits(addr) {
+		return false
+	}
+	if len(l.allow) == 0 {
+		return true
+	}
+	if _, ok := addr.(*net.TCPAddr); !ok {
+		return false
+	}
+	ip, _ := clientAddr(addr)
+	for _, prefix := range l.allow {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// dial routes a connection for target, named domain, by the listener mode.
+// Smart listeners follow Router.DialSniffed; the others force their route
+// and only consult the block rules.
+func (l *proxyListener) dial(r *router.Router, network, domain, target string, port uint16) (net.Conn, error) {
+	switch l.mode {
+	case config.ListenerModeProxy:
+		return r.DialForced(router.RouteProxy, network, domain, target, port, nil)
+	case config.ListenerModeRemote:
+		return r.DialForced(router.RouteProxy, network, domain, target, port, l.remote)
+	case config.ListenerModeDirect:
+		return r.DialForced(router.RouteDirect, network, domain, target, port, nil)
+	default:
+		return r.DialSniffed(network, domain, target, port)
+	}
+}
+
+// dialHost is dial for a target routed on its own name.
+func (l *proxyListener) dialHost(r *router.Router) func(network, host string, port uint16) (net.Conn, error) {
+	return func(network, host string, port uint16) (net.Conn, error) {
+		return l.dial(r, network, host, host, port)
+	}
+}
+
+// authorized checks the Basic Proxy-Authorization of an HTTP proxy request
+// against the listener credentials.
+func (l *proxyListener) authorized(req *http.Request) bool {
+	if l.username == "" && l.password == "" {
+		return true
+	}
+	scheme, encoded, ok := strings.Cut(req.Header.Get("Proxy-Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Basic") {
+		return false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return false
+	}
+	user, pass, _ := strings.Cut(string(decoded), ":")
+	userOK := subtle.ConstantTimeCompare([]byte(user), []byte(l.username))
+	passOK := subtle.ConstantTimeCompare([]byte(pass), []byte(l.password))
+	return userOK&passOK == 1
+}
+
+func writeProxyAuthRequired(conn net.Conn) {
+	const resp = "HTTP/1.1 407 Proxy Authentication Required\r\n" +
+		"Proxy-Authenticate: Basic realm=\"sower\"\r\n" +
+		"Content-Length: 0\r\nConnection: close\r\n\r\n"
+	if _, err := conn.Write([]byte(resp)); err != nil {
+		slog.Debug("write proxy auth challenge", "error", err)
+	}
+}
+
+// ServeProxy accepts connections for a SOCKS5 or HTTP proxy listener,
+// refusing clients outside its allowed CIDRs or the proxy ACL.
+func ServeProxy(ctx context.Context, ln net.Listener, r *router.Router, stats *admin.Stats, l *proxyListener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if shouldRetryAccept(ctx, l.kind, err, stats) {
+				continue
+			}
+			return wrapAcceptErr(ctx, l.kind, err)
+		}
+		if !l.allowed(conn.RemoteAddr()) {
+			refuseClient(stats, l.kind+" "+l.name, conn.RemoteAddr())
+			stats.RecordListenerReject(l.name)
+			_ = conn.Close()
+			continue
+		}
+		go handleProxyConn(conn, r, stats, l)
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sower-proxy/sower/config"
+	"github.com/sower-proxy/sower/internal/admin"
+	"github.com/sower-proxy/sower/router"
+)
+
+func TestProxyListenerAllowed(t *testing.T) {
+	t.Parallel()
+
+	l, err := newProxyListener(listenerSocks5, config.ProxyListener{
+		Name:  "lan",
+		Addr:  "0.0.0.0:1080",
+		Mode:  config.ListenerModeSmart,
+		Allow: []string{"192.168.1.0/24", "2001:db8::1", ""},
+	}, "223.5.5.5", nil)
+	if err != nil {
+		t.Fatalf("new listener: %v", err)
+	}
+	for _, test := range []struct {
+		addr net.Addr
+		want bool
+	}{
+		{addr: net.TCPAddrFromAddrPort(netip.MustParseAddrPort("192.168.1.20:50000")), want: true},
+		{addr: net.TCPAddrFromAddrPort(netip.MustParseAddrPort("[::ffff:192.168.1.20]:50000")), want: true},
+		{addr: net.TCPAddrFromAddrPort(netip.MustParseAddrPort("[2001:db8::1]:50000")), want: true},
+		{addr: net.TCPAddrFromAddrPort(netip.MustParseAddrPort("192.168.2.20:50000")), want: false},
+		{addr: &net.UnixAddr{Name: "@", Net: "unix"}, want: false},
+	} {
+		if got := l.allowed(test.addr); got != test.want {
+			t.Errorf("allowed(%s) = %v, want %v", test.addr, got, test.want)
+		}
+	}
+	if !newTestListener(sniffOptions{}).allowed(&net.UnixAddr{Name: "@", Net: "unix"}) {
+		t.Error("listener without allow entries refused a client")
+	}
+}
+
+func TestServeProxyRefusesClientOutsideAllow(t *testing.T) {
+	t.Parallel()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	stats := newTestStats(t)
+	stats.AddListener("lan", listenerSocks5, ln.Addr().String(), config.ListenerModeSmart)
+	l := newTestListener(sniffOptions{})
+	l.name = "lan"
+	l.allow = []netip.Prefix{netip.MustParsePrefix("192.168.1.0/24")}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- ServeProxy(ctx, ln, newTestRouter(), stats, l) }()
+	defer func() {
+		cancel()
+		_ = ln.Close()
+		<-done
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Fatalf("read from refused connection = %v, want EOF", err)
+	}
+
+	snap := stats.Snapshot(admin.DomainSortBytes, admin.SourceAll, "")
+	if len(snap.Listeners) != 1 || snap.Listeners[0].Rejected != 1 || snap.Listeners[0].Conns != 0 {
+		t.Fatalf("listener stats = %+v, want one rejection and no connection", snap.Listeners)
+	}
+}
+
+func TestHandleProxyConnRequiresHTTPProxyAuth(t *testing.T) {
+	t.Parallel()
+
+	origins := &fakeOrigins{dials: make(map[string]int)}
+	r := newTestRouter()
+	r.ProxyDial = origins.dial
+	l := newTestListener(sniffOptions{})
+	l.kind = listenerHTTP
+	l.username, l.password = "alice", "secret"
+
+	for _, test := range []struct {
+		name  string
+		auth  string
+		want  int
+		dials int
+	}{
+		{name: "missing", want: http.StatusProxyAuthRequired},
+		{name: "wrong", auth: "alice:guess", want: http.StatusProxyAuthRequired},
+		{name: "valid", auth: "alice:secret", want: http.StatusOK, dials: 1},
+	} {
+		server, client := net.Pipe()
+		stats := newTestStats(t)
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			handleProxyConn(server, r, stats, l)
+		}()
+		_ = client.SetDeadline(time.Now().Add(2 * time.Second))
+
+		req := "GET http://www.example.org/ HTTP/1.1\r\nHost: www.example.org\r\nConnection: close\r\n"
+		if test.auth != "" {
+			req += "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(test.auth)) + "\r\n"
+		}
+		if _, err := io.WriteString(client, req+"\r\n"); err != nil {
+			t.Fatalf("%s: write request: %v", test.name, err)
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+		if err != nil {
+			t.Fatalf("%s: read response: %v", test.name, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.want {
+			t.Fatalf("%s: status = %d, want %d", test.name, resp.StatusCode, test.want)
+		}
+		if test.want == http.StatusProxyAuthRequired && !strings.HasPrefix(resp.Header.Get("Proxy-Authenticate"), "Basic") {
+			t.Fatalf("%s: Proxy-Authenticate = %q", test.name, resp.Header.Get("Proxy-Authenticate"))
+		}
+		_ = client.Close()
+		waitForHandler(t, &wg)
+
+		origins.mu.Lock()
+		dials := origins.dials["www.example.org"]
+		origins.mu.Unlock()
+		if dials != test.dials {
+			t.Fatalf("%s: origin dials = %d, want %d", test.name, dials, test.dials)
+		}
+		if conns := stats.Snapshot(admin.DomainSortBytes, admin.SourceAll, "").Conns; conns.HTTP != 1 || conns.Socks5 != 0 {
+			t.Fatalf("%s: conns http=%d socks5=%d, want http listener counted as http", test.name, conns.HTTP, conns.Socks5)
+		}
+	}
+}
+
+func TestHandleProxyConnRemoteModeUsesListenerUpstream(t *testing.T) {
+	t.Parallel()
+
+	r := newTestRouter()
+	r.ProxyDial = func(network, host string, port uint16) (net.Conn, error) {
+		t.Errorf("remote-mode listener used the main upstream for %s", host)
+		return nil, errors.New("main upstream called")
+	}
+	r.DirectRule = router.NewRuleSet("**.example.org")
+	remote := &fakeOrigins{dials: make(map[string]int)}
+	l := newTestListener(sniffOptions{})
+	l.mode = config.ListenerModeRemote
+	l.remote = remote.dial
+
+	server, client := net.Pipe()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		handleProxyConn(server, r, newTestStats(t), l)
+	}()
+	_ = client.SetDeadline(time.Now().Add(2 * time.Second))
+
+	br := bufio.NewReader(client)
+	// A direct rule does not apply to a forced route; a block rule does.
+	for _, test := range []struct {
+		host string
+		want int
+	}{
+		{host: "www.example.org", want: http.StatusOK},
+		{host: "example.com", want: http.StatusForbidden},
+	} {
+		req := "GET http://" + test.host + "/ HTTP/1.1\r\nHost: " + test.host + "\r\n\r\n"
+		if _, err := io.WriteString(client, req); err != nil {
+			t.Fatalf("write request for %s: %v", test.host, err)
+		}
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("read response for %s: %v", test.host, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.want {
+			t.Fatalf("%s: status = %d, want %d", test.host, resp.StatusCode, test.want)
+		}
+	}
+	_ = client.Close()
+	waitForHandler(t, &wg)
+
+	remote.mu.Lock()
+	defer remote.mu.Unlock()
+	if remote.dials["www.example.org"] != 1 || remote.dials["example.com"] != 0 {
+		t.Fatalf("listener upstream dials = %v", remote.dials)
+	}
+}
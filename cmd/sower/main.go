@@ -23,7 +23,6 @@ import (
 	"time"
 
 	"github.com/cristalhq/aconfig"
-	"github.com/cristalhq/aconfig/aconfigtoml"
 	"github.com/lmittmann/tint"
 	"github.com/miekg/dns"
 	"github.com/sower-proxy/deferlog/v2"
@@ -62,7 +61,7 @@ func loadConfig() (config.SowerConfig, error) {
 			"/etc/sower/sower.toml",
 		},
 		FileDecoders: map[string]aconfig.FileDecoder{
-			".toml": aconfigtoml.New(),
+			".toml": config.NewTOMLDecoder(),
 		},
 	}).Load()
 	return cfg, err
@@ -134,7 +133,15 @@ func init() {
 		"remote_password", deferlog.Secret(conf.Remote.Password),
 		"remote_tls", conf.Remote.TLS,
 		"dns", conf.DNS,
-		"socks5", conf.Socks5,
+		"socks5", slog.GroupValue(
+			slog.Bool("disable", conf.Socks5.Disable),
+			slog.String("addr", conf.Socks5.Addr),
+			slog.String("mode", conf.Socks5.Mode),
+			slog.String("username", conf.Socks5.Username),
+			slog.Any("password", deferlog.Secret(conf.Socks5.Password)),
+			slog.Any("allow", conf.Socks5.Allow),
+			slog.Bool("sniff", conf.Socks5.Sniff)),
+		"transparent", conf.Transparent,
 		"router", conf.Router)
 }
 
@@ -150,6 +157,9 @@ func main() {
 
 func run(ctx context.Context, stop context.CancelFunc, cfg config.SowerConfig) error {
 	stateStore := loadAdminState(cfg)
+	if err := bootRevision(stateStore, cfg.AdminStateRevision); err != nil {
+		return err
+	}
 	baseCfg := cfg
 	applyConfigOverrides(&cfg, stateStore.ConfigOverrides())
 
@@ -158,6 +168,18 @@ func run(ctx context.Context, stop context.CancelFunc, cfg config.SowerConfig) e
 	if err != nil {
 		return fmt.Errorf("init stats: %w", err)
 	}
+	limiter := newLimiter(cfg)
+	stats.SetLimiter(limiter)
+	defer saveQuotaUsage(limiter)
+	go runQuotaSaver(ctx, limiter)
+	usage := newUsageStore(cfg)
+	stats.SetUsage(usage)
+	defer flushUsage(stats, usage)
+	go runUsageRoller(ctx, stats, usage)
+	audit := newAuditLog(cfg)
+	if audit != nil {
+		defer audit.Close()
+	}
 	proxyDial, err := GenProxyDial(cfg.Remote.Type, cfg.Remote.Addr, cfg.Remote.Password, upstreamDNS, upstreamtls.Options{
 		ServerName:         cfg.Remote.TLS.ServerName,
 		ClientHello:        cfg.Remote.TLS.ClientHello,
@@ -175,6 +197,10 @@ func run(ctx context.Context, stop context.CancelFunc, cfg config.SowerConfig) e
 			slog.Warn("close router", "error", err)
 		}
 	}()
+	defer saveFakeIPPool(r)
+	go runFakeIPSaver(ctx, r)
+	defer saveAccessCache(r)
+	go runAccessCacheSaver(ctx, r)
 
 	blockHits := newRuleHitTracker(r.BlockRule, maxRuleHits)
 	directHits := newRuleHitTracker(r.DirectRule, maxRuleHitsWide)
@@ -193,9 +219,16 @@ func run(ctx context.Context, stop context.CancelFunc, cfg config.SowerConfig) e
 			proxyHits.OnHit(domain)
 		}
 	})
-	r.SetRuleMissObserver(func(domain string) {
-		missHits.OnMiss(domain)
+	r.SetRuleMissObserver(missHits.OnMiss)
+	r.SetPoisonObserver(func(domain string) {
+		missHits.OnPoisoned(domain)
 	})
+	dnsLog, err := newDNSLog(cfg)
+	if err != nil {
+		return err
+	}
+	defer dnsLog.Close()
+	r.SetDNSQueryObserver(dnsQueryLogger(dnsLog))
 
 	start := time.Now()
 	if err := loadRouterRules(ctx, r, proxyDial, cfg); err != nil {
@@ -206,24 +239,54 @@ func run(ctx context.Context, stop context.CancelFunc, cfg config.SowerConfig) e
 	stateStore.SetBaseline(baseline)
 	applyRuleDeltas(r, stateStore)
 	rulesMgr := newAdminRules(r, stateStore, baseline, blockHits, directHits, proxyHits, missHits)
-	configMgr := newAdminConfig(baseCfg, stateStore, r)
+	go runRuleReaper(ctx, rulesMgr, audit)
+	acls, err := newClientACLs(cfg)
+	if err != nil {
+		return err
+	}
+	configMgr := newAdminConfig(baseCfg, stateStore, r, acls)
 
 	errCh := make(chan error, 8)
 	// restartCh coalesces restart requests from the admin API; the process
 	// replaces itself in place (same PID) so systemd stays unaware.
 	restartCh := make(chan struct{}, 1)
 	var wg sync.WaitGroup
-	if err := startDNSListeners(ctx, &wg, cfg, r, stats, errCh); err != nil {
+	if err := startDNSListeners(ctx, &wg, cfg, r, stats, acls, errCh); err != nil {
+		return err
+	}
+	if err := startProxyListeners(ctx, &wg, cfg, upstreamDNS, r, stats, acls, errCh); err != nil {
+		return err
+	}
+	if err := startTransparentListener(ctx, &wg, cfg, r, stats, acls, errCh); err != nil {
+		return err
+	}
+	dhcpServer, err := newDHCPServer(cfg)
+	if err != nil {
 		return err
 	}
-	if err := startSocks5Listener(ctx, &wg, cfg, r, stats, errCh); err != nil {
+	if err := startDHCPListener(ctx, &wg, cfg, dhcpServer, errCh); err != nil {
 		return err
 	}
+	deps := adminDeps{
+		rules:     rulesMgr,
+		config:    configMgr,
+		stats:     stats,
+		dnsLog:    dnsLog,
+		state:     stateStore,
+		audit:     audit,
+		rollback:  stateRollback{rules: rulesMgr, config: configMgr}.Rollback,
+		explain:   routeExplainer{r: r, acls: acls, remote: cfg.Remote.Type + " " + cfg.Remote.Addr},
+		access:    accessCache{r: r},
+		restartCh: restartCh,
+	}
+	if dhcpServer != nil {
+		deps.leases = dhcpServer
+	}
 	if _, shared := sharedAdminHTTPAddr(cfg); shared {
-		if err := startSharedHTTPListener(ctx, &wg, cfg, r, rulesMgr, configMgr, stats, errCh, restartCh); err != nil {
+		if err := startSharedHTTPListener(ctx, &wg, cfg, r, &acls.http, deps, errCh); err != nil {
 			return err
 		}
-	} else if err := startAdminListener(ctx, &wg, cfg, rulesMgr, configMgr, stats, errCh, restartCh); err != nil {
+	} else if err := startAdminListener(ctx, &wg, cfg, deps, errCh); err != nil {
 		return err
 	}
 
@@ -250,6 +313,12 @@ func run(ctx context.Context, stop context.CancelFunc, cfg config.SowerConfig) e
 		case <-time.After(10 * time.Second):
 			slog.Warn("listener shutdown timed out, restarting anyway")
 		}
+		// exec skips deferred calls: flush state that is saved on exit.
+		saveFakeIPPool(r)
+		saveAccessCache(r)
+		saveQuotaUsage(limiter)
+		flushUsage(stats, usage)
+		dnsLog.Close()
 		if err := restartCurrentProcess(); err != nil {
 			return fmt.Errorf("restart current process: %w", err)
 		}
@@ -271,15 +340,18 @@ func effectiveUpstreamDNS(cfg config.SowerConfig) string {
 // the --ignore-admin-state escape hatch yields an in-memory store, so the
 // rest of the code never has to nil-check persistence.
 func loadAdminState(cfg config.SowerConfig) *admin.StateStore {
+	var st *admin.StateStore
 	switch {
 	case cfg.Admin.StateFile == "":
-		return admin.LoadStateStore("")
+		st = admin.LoadStateStore("")
 	case cfg.IgnoreAdminState:
 		slog.Warn("ignoring admin state file", "file", cfg.Admin.StateFile)
-		return admin.LoadStateStore("")
+		st = admin.LoadStateStore("")
 	default:
-		return admin.LoadStateStore(cfg.Admin.StateFile)
+		st = admin.LoadStateStore(cfg.Admin.StateFile)
 	}
+	st.SetRevisionLimit(cfg.Admin.StateRevisions)
+	return st
 }
 
 // applyConfigOverrides applies the whitelisted admin-state config overrides
@@ -369,6 +441,12 @@ func applyConfigOverrides(cfg *config.SowerConfig, o admin.ConfigOverrides) {
 	applyStr(&cfg.Router.Country.MMDB, o.RouterCountryMMDB)
 	applyStr(&cfg.Router.Country.File, o.RouterCountryFile)
 	applyList(&cfg.Router.Country.Rules, o.RouterCountryRules)
+	for group, acl := range o.ACL {
+		if c := cfg.ClientACL(group); c != nil {
+			applyList(&c.Allow, acl.Allow)
+			applyList(&c.Deny, acl.Deny)
+		}
+	}
 
 	logLevel.Set(cfg.LogLevel)
 }
@@ -416,6 +494,32 @@ func newRouter(cfg config.SowerConfig, proxyDial router.ProxyDialFn) (*router.Ro
 		_ = r.Close()
 		return nil, err
 	}
+	if err := r.SetPoisonDetection(router.PoisonConfig{
+		Trusted:  cfg.DNS.Poison.Trusted,
+		BogusIPs: cfg.DNS.Poison.BogusIPs,
+		MinRTT:   time.Duration(cfg.DNS.Poison.MinRTTMs) * time.Millisecond,
+	}); err != nil {
+		_ = r.Close()
+		return nil, err
+	}
+	blockMode, err := router.ParseDNSBlockMode(cfg.DNS.BlockMode)
+	if err != nil {
+		_ = r.Close()
+		return nil, err
+	}
+	r.SetDNSBlockMode(blockMode)
+	if cfg.DNS.FakeIP.Range != "" {
+		pool, err := router.NewFakeIPPool(cfg.DNS.FakeIP.Range, cfg.DNS.FakeIP.File)
+		if err != nil {
+			_ = r.Close()
+			return nil, err
+		}
+		r.SetFakeIPPool(pool)
+	}
+	// A lost access cache only costs a probe per site: start without it.
+	if err := r.SetAccessCacheFile(cfg.Router.AccessCache.File); err != nil {
+		slog.Warn("restore access cache", "error", err)
+	}
 	return r, nil
 }
 
@@ -439,25 +543,26 @@ func loadRouterRules(ctx context.Context, r *router.Router, proxyDial router.Pro
 	return nil
 }
 
-func startDNSListeners(ctx context.Context, wg *sync.WaitGroup, cfg config.SowerConfig, r *router.Router, stats *admin.Stats, errCh chan<- error) error {
+func startDNSListeners(ctx context.Context, wg *sync.WaitGroup, cfg config.SowerConfig, r *router.Router, stats *admin.Stats, acls *clientACLs, errCh chan<- error) error {
 	if cfg.DNS.Disable {
 		slog.Info("DNS proxy disabled")
 		return nil
 	}
 
 	_, shared := sharedAdminHTTPAddr(cfg)
+	blockConsole := blockPageConsoleAddr(cfg)
 	for _, ip := range dnsListenIPs(cfg) {
 		// In shared mode the admin console takes over the primary HTTP
 		// listener; the HTTPS and DNS listeners still start normally.
 		if !(shared && ip == cfg.DNS.Serve) {
-			if err := startHTTPListener(ctx, wg, ip, r, stats, errCh); err != nil {
+			if err := startHTTPListener(ctx, wg, ip, r, stats, &acls.http, blockConsole, errCh); err != nil {
 				return err
 			}
 		}
-		if err := startHTTPSListener(ctx, wg, ip, r, stats, errCh); err != nil {
+		if err := startHTTPSListener(ctx, wg, ip, r, stats, &acls.https, errCh); err != nil {
 			return err
 		}
-		if err := startDNSUDPListener(ctx, wg, ip, r, stats, errCh); err != nil {
+		if err := startDNSUDPListener(ctx, wg, ip, r, stats, &acls.dns, errCh); err != nil {
 			return err
 		}
 	}
@@ -475,7 +580,7 @@ func dnsListenIPs(cfg config.SowerConfig) []string {
 	return ips
 }
 
-func startHTTPListener(ctx context.Context, wg *sync.WaitGroup, ip string, r *router.Router, stats *admin.Stats, errCh chan<- error) error {
+func startHTTPListener(ctx context.Context, wg *sync.WaitGroup, ip string, r *router.Router, stats *admin.Stats, acl *clientACL, blockConsole string, errCh chan<- error) error {
 	addr := net.JoinHostPort(ip, "80")
 	ln, err := net.Listen("tcp", addr)
 	if err != nil {
@@ -485,12 +590,12 @@ func startHTTPListener(ctx context.Context, wg *sync.WaitGroup, ip string, r *ro
 	wg.Add(1)
 	go closeOnDone(ctx, wg, ln)
 	go serveAndReport(errCh, "http proxy", func() error {
-		return ServeHTTP(ctx, ln, r, stats)
+		return ServeHTTP(ctx, ln, r, stats, acl, blockConsole)
 	})
 	return nil
 }
 
-func startHTTPSListener(ctx context.Context, wg *sync.WaitGroup, ip string, r *router.Router, stats *admin.Stats, errCh chan<- error) error {
+func startHTTPSListener(ctx context.Context, wg *sync.WaitGroup, ip string, r *router.Router, stats *admin.Stats, acl *clientACL, errCh chan<- error) error {
 	addr := net.JoinHostPort(ip, "443")
 	ln, err := net.Listen("tcp", addr)
 	if err != nil {
@@ -500,12 +605,12 @@ func startHTTPSListener(ctx context.Context, wg *sync.WaitGroup, ip string, r *r
 	wg.Add(1)
 	go closeOnDone(ctx, wg, ln)
 	go serveAndReport(errCh, "https proxy", func() error {
-		return ServeHTTPS(ctx, ln, r, stats)
+		return ServeHTTPS(ctx, ln, r, stats, acl)
 	})
 	return nil
 }
 
-func startDNSUDPListener(ctx context.Context, wg *sync.WaitGroup, ip string, r *router.Router, stats *admin.Stats, errCh chan<- error) error {
+func startDNSUDPListener(ctx context.Context, wg *sync.WaitGroup, ip string, r *router.Router, stats *admin.Stats, acl *clientACL, errCh chan<- error) error {
 	addr := net.JoinHostPort(ip, "53")
 	pc, err := net.ListenPacket("udp", addr)
 	if err != nil {
@@ -514,7 +619,7 @@ func startDNSUDPListener(ctx context.Context, wg *sync.WaitGroup, ip string, r *
 
 	server := &dns.Server{
 		PacketConn: pc,
-		Handler:    dnsStatsHandler{Handler: r, stats: stats},
+		Handler:    dnsStatsHandler{Handler: r, stats: stats, acl: acl},
 	}
 	slog.Info("service listening", "service", "dns proxy", "network", "udp", "addr", addr)
 	wg.Add(1)
@@ -527,21 +632,71 @@ func startDNSUDPListener(ctx context.Context, wg *sync.WaitGroup, ip string, r *
 	return nil
 }
 
-func startSocks5Listener(ctx context.Context, wg *sync.WaitGroup, cfg config.SowerConfig, r *router.Router, stats *admin.Stats, errCh chan<- error) error {
-	if cfg.Socks5.Disable {
+func startProxyListeners(ctx context.Context, wg *sync.WaitGroup, cfg config.SowerConfig, upstreamDNS string, r *router.Router, stats *admin.Stats, acls *clientACLs, errCh chan<- error) error {
+	socks5Listeners, httpListeners := cfg.ProxyListeners()
+	if cfg.Socks5.Disable && len(socks5Listeners) == 0 {
 		slog.Info("SOCKS5 proxy disabled")
+	}
+	for _, group := range []struct {
+		kind      string
+		listeners []config.ProxyListener
+	}{
+		{kind: listenerSocks5, listeners: socks5Listeners},
+		{kind: listenerHTTP, listeners: httpListeners},
+	} {
+		for _, cl := range group.listeners {
+			l, err := newProxyListener(group.kind, cl, upstreamDNS, stats)
+			if err != nil {
+				return fmt.Errorf("%s proxy %q: %w", group.kind, cl.Name, err)
+			}
+			l.acl = &acls.socks5
+			ln, err := net.Listen("tcp", cl.Addr)
+			if err != nil {
+				return fmt.Errorf("listen %s proxy %q on %s: %w", group.kind, cl.Name, cl.Addr, err)
+			}
+			stats.AddListener(l.name, l.kind, cl.Addr, l.mode)
+			slog.Info("service listening", "service", group.kind+" proxy", "network", "tcp", "addr", cl.Addr,
+				"name", l.name, "mode", l.mode, "auth", l.username != "", "allow", cl.Allow)
+			wg.Add(1)
+			go closeOnDone(ctx, wg, ln)
+			go serveAndReport(errCh, group.kind+" proxy "+l.name, func() error {
+				return ServeProxy(ctx, ln, r, stats, l)
+			})
+		}
+	}
+	return nil
+}
+
+func startTransparentListener(ctx context.Context, wg *sync.WaitGroup, cfg config.SowerConfig, r *router.Router, stats *admin.Stats, acls *clientACLs, errCh chan<- error) error {
+	if !cfg.Transparent.Enable {
 		return nil
 	}
 
-	ln, err := net.Listen("tcp", cfg.Socks5.Addr)
+	tproxy := cfg.Transparent.Mode == "tproxy"
+	sniff := sniffOptions{enable: true, dialDomain: cfg.Transparent.SniffDialDomain}
+	ln, err := listenTransparent(cfg.Transparent.Addr, tproxy)
 	if err != nil {
-		return fmt.Errorf("listen socks5 proxy on %s: %w", cfg.Socks5.Addr, err)
+		return fmt.Errorf("listen transparent proxy on %s: %w", cfg.Transparent.Addr, err)
 	}
-	slog.Info("service listening", "service", "socks5 proxy", "network", "tcp", "addr", cfg.Socks5.Addr)
+	slog.Info("service listening", "service", "transparent proxy", "network", "tcp", "addr", cfg.Transparent.Addr, "mode", cfg.Transparent.Mode)
 	wg.Add(1)
 	go closeOnDone(ctx, wg, ln)
-	go serveAndReport(errCh, "socks5 proxy", func() error {
-		return ServeSocks5(ctx, ln, r, stats)
+	go serveAndReport(errCh, "transparent proxy", func() error {
+		return ServeTransparent(ctx, ln, r, stats, &acls.transparent, sniff)
+	})
+
+	if !tproxy || !cfg.Transparent.UDP {
+		return nil
+	}
+	pc, err := listenTransparentUDP(cfg.Transparent.Addr)
+	if err != nil {
+		return fmt.Errorf("listen transparent udp proxy on %s: %w", cfg.Transparent.Addr, err)
+	}
+	slog.Info("service listening", "service", "transparent proxy", "network", "udp", "addr", cfg.Transparent.Addr, "mode", cfg.Transparent.Mode)
+	wg.Add(1)
+	go closeOnDone(ctx, wg, pc)
+	go serveAndReport(errCh, "transparent udp proxy", func() error {
+		return ServeTransparentUDP(ctx, pc, r, stats, &acls.transparent, sniff)
 	})
 	return nil
 }
@@ -552,14 +707,16 @@ func loadRule(ctx context.Context, rule *router.RuleSet, proxyDial router.ProxyD
 	if err != nil {
 		return err
 	}
+	items := make([]string, 0, len(lines))
 	for _, line := range lines {
 		item := linePrefix + line
 		if skipRule.Match(line) || skipRule.Match(item) {
 			continue
 		}
-		rule.Add(item)
+		items = append(items, item)
 	}
-	rule.Compact()
+	// One Add publishes the whole file as one tree copy.
+	rule.Add(items...)
 	return nil
 }
 
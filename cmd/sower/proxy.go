@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	stderrors "errors"
 	"fmt"
@@ -153,7 +154,9 @@ func upstreamDialAddr(addr, defaultPort string) (string, error) {
 	return net.JoinHostPort(addr, defaultPort), nil
 }
 
-func ServeHTTP(ctx context.Context, ln net.Listener, r *router.Router, stats *admin.Stats) error {
+// ServeHTTP serves the transparent HTTP listener. blockConsole is the
+// console address the block page links to, see blockPageConsoleAddr.
+func ServeHTTP(ctx context.Context, ln net.Listener, r *router.Router, stats *admin.Stats, acl *clientACL, blockConsole string) error {
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
@@ -162,11 +165,16 @@ func ServeHTTP(ctx context.Context, ln net.Listener, r *router.Router, stats *ad
 			}
 			return wrapAcceptErr(ctx, "http", err)
 		}
-		go handleHTTPConn(conn, r, stats)
+		if !acl.admits(conn.RemoteAddr()) {
+			refuseClient(stats, "http", conn.RemoteAddr())
+			_ = conn.Close()
+			continue
+		}
+		go handleHTTPConn(conn, r, stats, blockConsole)
 	}
 }
 
-func ServeHTTPS(ctx context.Context, ln net.Listener, r *router.Router, stats *admin.Stats) error {
+func ServeHTTPS(ctx context.Context, ln net.Listener, r *router.Router, stats *admin.Stats, acl *clientACL) error {
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
@@ -175,24 +183,16 @@ func ServeHTTPS(ctx context.Context, ln net.Listener, r *router.Router, stats *a
 			}
 			return wrapAcceptErr(ctx, "https", err)
 		}
-		go handleHTTPSConn(conn, r, stats)
-	}
-}
-
-func ServeSocks5(ctx context.Context, ln net.Listener, r *router.Router, stats *admin.Stats) error {
-	for {
-		conn, err := ln.Accept()
-		if err != nil {
-			if shouldRetryAccept(ctx, "socks5", err, stats) {
-				continue
-			}
-			return wrapAcceptErr(ctx, "socks5", err)
+		if !acl.admits(conn.RemoteAddr()) {
+			refuseClient(stats, "https", conn.RemoteAddr())
+			_ = conn.Close()
+			continue
 		}
-		go handleSocks5Conn(conn, r, stats)
+		go handleHTTPSConn(conn, r, stats)
 	}
 }
 
-func handleHTTPConn(conn net.Conn, r *router.Router, stats *admin.Stats) {
+func handleHTTPConn(conn net.Conn, r *router.Router, stats *admin.Stats, blockConsole string) {
 	start := time.Now()
 	conn = stats.WrapConn(conn, "http")
 	rereadConn := reread.New(conn)
@@ -206,42 +206,49 @@ func handleHTTPConn(conn net.Conn, r *router.Router, stats *admin.Stats) {
 		return
 	}
 	_ = rereadConn.SetDeadline(time.Time{})
+	// The request head must not be replayed: plain requests are forwarded
+	// one by one, and a CONNECT target expects TLS data.
+	rereadConn.Stop().Reset()
+
+	dial := proxyOnlyDial(r, stats, conn)
+	if req.Method != http.MethodConnect {
+		fwd := newHTTPForwarder(conn, rereadConn, br, r, stats, true, blockConsole, dial)
+		defer fwd.Close()
+		if req = fwd.serve(req); req == nil {
+			return
+		}
+	}
 
 	stats.BindConn(conn, hostOnly(req.Host))
-	defPort := uint16(80)
-	if req.Method == http.MethodConnect {
-		// CONNECT targets use the port from the request line, defaulting to 443.
-		defPort = 443
+	// The transparent listeners otherwise proxy whatever reaches them.
+	if _, blocked := blockedBySowerIP(r, hostOnly(req.Host)); blocked {
+		writeHTTPProxyError(rereadConn, router.ErrBlocked)
+		return
 	}
-	host, port := splitHostPort(req.Host, defPort)
-	rc, err := r.DialProxyOnly("tcp", host, port)
+	// CONNECT targets use the port from the request line, defaulting to 443.
+	host, port := splitHostPort(req.Host, 443)
+	rc, err := dial("tcp", host, port)
 	if err != nil {
 		slog.Error("dial proxy", "error", err, "host", req.Host, "req", req.URL)
 		stats.RecordProxyError("dial", fmt.Sprintf("%s: %v", hostOnly(req.Host), err))
 		return
 	}
 	defer rc.Close()
-
-	if req.Method == http.MethodConnect {
-		// Acknowledge CONNECT before tunneling raw bytes; the request head
-		// must not be replayed to the target, which expects TLS data.
-		rereadConn.Stop().Reset()
-		// The bufio reader may already have pulled bytes past the request
-		// head (a client that pipelines tunnel data without waiting for the
-		// 200). Replay those before relaying, or the tunnel's first bytes
-		// would be lost and the target would see a truncated TLS stream.
-		if buffered := br.Buffered(); buffered > 0 {
-			if _, err := io.CopyN(rc, br, int64(buffered)); err != nil {
-				slog.Debug("flush pipelined connect bytes", "error", err, "host", host, "port", port)
-				return
-			}
-		}
-		if _, err := rereadConn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
-			slog.Debug("write connect response", "error", err, "host", host, "port", port)
+	bindUpstream(stats, conn, rc, port)
+
+	// The bufio reader may already have pulled bytes past the request head
+	// (a client that pipelines tunnel data without waiting for the 200).
+	// Replay those before relaying, or the tunnel's first bytes would be
+	// lost and the target would see a truncated TLS stream.
+	if buffered := br.Buffered(); buffered > 0 {
+		if _, err := io.CopyN(rc, br, int64(buffered)); err != nil {
+			slog.Debug("flush pipelined connect bytes", "error", err, "host", host, "port", port)
 			return
 		}
-	} else {
-		rereadConn.Stop().Reread()
+	}
+	if _, err := rereadConn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		slog.Debug("write connect response", "error", err, "host", host, "port", port)
+		return
 	}
 	err = relay.Relay(rereadConn, rc)
 	if err != nil {
@@ -268,13 +275,18 @@ func handleHTTPSConn(conn net.Conn, r *router.Router, stats *admin.Stats) {
 	_ = rereadConn.SetDeadline(time.Time{})
 
 	stats.BindConn(conn, domain)
-	rc, err := r.DialProxyOnly("tcp", domain, 443)
+	if _, blocked := blockedBySowerIP(r, domain); blocked {
+		slog.Debug("refuse blocked tls server name", "host", domain)
+		return
+	}
+	rc, err := proxyOnlyDial(r, stats, conn)("tcp", domain, 443)
 	if err != nil {
 		slog.Error("dial proxy", "error", err, "host", domain)
 		stats.RecordProxyError("dial", fmt.Sprintf("%s: %v", domain, err))
 		return
 	}
 	defer rc.Close()
+	bindUpstream(stats, conn, rc, 443)
 
 	rereadConn.Stop().Reread()
 	err = relay.Relay(rereadConn, rc)
@@ -338,9 +350,12 @@ func readTLSClientHello(conn io.Reader) ([]byte, error) {
 	}
 }
 
-func handleSocks5Conn(conn net.Conn, r *router.Router, stats *admin.Stats) {
-	conn = stats.WrapConn(conn, "socks5")
+// handleProxyConn serves one connection of a SOCKS5 or HTTP proxy
+// listener, routing it by the listener mode.
+func handleProxyConn(conn net.Conn, r *router.Router, stats *admin.Stats, l *proxyListener) {
+	conn = stats.WrapListenerConn(conn, l.kind, l.name)
 	defer conn.Close()
+	l = l.forClient(stats, conn)
 
 	rereadConn := reread.New(conn)
 	_ = rereadConn.SetDeadline(time.Now().Add(proxyReadTimeout))
@@ -352,11 +367,16 @@ func handleSocks5Conn(conn net.Conn, r *router.Router, stats *admin.Stats) {
 	}
 	rereadConn.Reread()
 
-	if byte1[0] == 5 {
+	if byte1[0] == 5 && l.kind == listenerSocks5 {
 		rereadConn.Stop()
-		server := socks5.New()
+		server := socks5.NewWithAuth(l.username, l.password)
 		addr, err := server.ReadRequest(rereadConn)
 		if err != nil {
+			if stderrors.Is(err, socks5.ErrAuthFailed) {
+				slog.Debug("refuse socks5 client", "listener", l.name, "client", conn.RemoteAddr(), "error", err)
+				stats.RecordListenerReject(l.name)
+				return
+			}
 			slog.Error("read socks5 request", "error", err)
 			return
 		}
@@ -366,11 +386,21 @@ func handleSocks5Conn(conn net.Conn, r *router.Router, stats *admin.Stats) {
 		_ = rereadConn.SetDeadline(time.Time{})
 
 		host, port := addr.(*socks5.AddrHead).Addr()
-		stats.BindConn(conn, host)
-		rc, err := r.DialSmart("tcp", host, port)
+		if l.sniff.applies(r, host) {
+			// The client sends nothing until the tunnel is up, so a dial
+			// failure past this point can only be reported by closing.
+			if err := server.WriteReply(rereadConn, socks5.RepSucceeded); err != nil {
+				slog.Debug("write socks5 success reply", "error", err, "host", host, "port", port)
+				return
+			}
+			relaySniffed(conn, rereadConn, host, port, r, stats, l)
+			return
+		}
+		stats.BindConn(conn, targetDomain(r, host))
+		rc, err := l.dial(r, "tcp", host, host, port)
 		if err != nil {
 			if !stderrors.Is(err, router.ErrBlocked) {
-				stats.RecordProxyError("dial", fmt.Sprintf("%s: %v", host, err))
+				stats.RecordProxyError("dial", fmt.Sprintf("%s: %v", targetDomain(r, host), err))
 			}
 			if replyErr := server.WriteReply(rereadConn, routeSocks5ReplyCode(err)); replyErr != nil {
 				slog.Debug("write socks5 failure reply", "error", replyErr, "host", host, "port", port)
@@ -378,6 +408,7 @@ func handleSocks5Conn(conn net.Conn, r *router.Router, stats *admin.Stats) {
 			return
 		}
 		defer rc.Close()
+		bindUpstream(stats, conn, rc, port)
 
 		if err := server.WriteReply(rereadConn, socks5.RepSucceeded); err != nil {
 			slog.Debug("write socks5 success reply", "error", err, "host", host, "port", port)
@@ -395,40 +426,62 @@ func handleSocks5Conn(conn net.Conn, r *router.Router, stats *admin.Stats) {
 	}
 	// Handshake complete; clear the deadline before dialing.
 	_ = rereadConn.SetDeadline(time.Time{})
+	rereadConn.Stop().Reset()
+	// Credentials are checked once per connection, as for SOCKS5.
+	if !l.authorized(req) {
+		slog.Debug("refuse http proxy client", "listener", l.name, "client", conn.RemoteAddr())
+		stats.RecordListenerReject(l.name)
+		writeProxyAuthRequired(rereadConn)
+		return
+	}
+
+	if req.Method != http.MethodConnect {
+		fwd := newHTTPForwarder(conn, rereadConn, br, r, stats, false, "", l.dialHost(r))
+		defer fwd.Close()
+		if req = fwd.serve(req); req == nil {
+			return
+		}
+	}
 
 	host, port, err := router.ParseHostPort(req.Host, req.URL)
 	if err != nil {
-		rereadConn.Stop().Write([]byte("HTTP/1.1 400 Bad Request\r\n\r\n"))
+		rereadConn.Write([]byte("HTTP/1.1 400 Bad Request\r\n\r\n"))
+		return
+	}
+
+	if l.sniff.applies(r, host) {
+		if _, err := rereadConn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+			slog.Debug("write connect response", "error", err, "host", host, "port", port)
+			return
+		}
+		// Pipelined tunnel bytes already sit in br; sniff them first.
+		relaySniffed(conn, &prefixConn{Conn: rereadConn, prefix: bytes.NewReader(peekBuffered(br))}, host, port, r, stats, l)
 		return
 	}
 
-	stats.BindConn(conn, host)
-	rc, err := r.DialSmart("tcp", host, port)
+	stats.BindConn(conn, targetDomain(r, host))
+	rc, err := l.dial(r, "tcp", host, host, port)
 	if err != nil {
 		if !stderrors.Is(err, router.ErrBlocked) {
-			stats.RecordProxyError("dial", fmt.Sprintf("%s: %v", host, err))
+			stats.RecordProxyError("dial", fmt.Sprintf("%s: %v", targetDomain(r, host), err))
 		}
-		writeHTTPProxyError(rereadConn.Stop(), err)
+		writeHTTPProxyError(rereadConn, err)
 		return
 	}
 	defer rc.Close()
+	bindUpstream(stats, conn, rc, port)
 
-	if req.Method == http.MethodConnect {
-		rereadConn.Stop().Reset()
-		// Replay bytes the bufio reader already pulled past the request
-		// head (pipelined tunnel data) before relaying raw bytes.
-		if buffered := br.Buffered(); buffered > 0 {
-			if _, err := io.CopyN(rc, br, int64(buffered)); err != nil {
-				slog.Debug("flush pipelined connect bytes", "error", err, "host", host, "port", port)
-				return
-			}
-		}
-		if _, err := rereadConn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
-			slog.Debug("write connect response", "error", err, "host", host, "port", port)
+	// Replay bytes the bufio reader already pulled past the request head
+	// (pipelined tunnel data) before relaying raw bytes.
+	if buffered := br.Buffered(); buffered > 0 {
+		if _, err := io.CopyN(rc, br, int64(buffered)); err != nil {
+			slog.Debug("flush pipelined connect bytes", "error", err, "host", host, "port", port)
 			return
 		}
-	} else {
-		rereadConn.Stop().Reread()
+	}
+	if _, err := rereadConn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		slog.Debug("write connect response", "error", err, "host", host, "port", port)
+		return
 	}
 
 	if err := relay.Relay(rereadConn, rc); err != nil {
@@ -436,6 +489,31 @@ func handleSocks5Conn(conn net.Conn, r *router.Router, stats *admin.Stats) {
 	}
 }
 
+// bindUpstream registers rc as the upstream of the wrapped client conn, so
+// the console lists its route and can close both ends.
+func bindUpstream(stats *admin.Stats, conn, rc net.Conn, port uint16) {
+	stats.BindUpstream(conn, rc, port)
+}
+
+// blockedBySowerIP returns the block rule matching host when DNS answers
+// blocked names with the sower IP, so the transparent listeners see them.
+func blockedBySowerIP(r *router.Router, host string) (string, bool) {
+	if r.DNSBlockMode() != router.DNSBlockSowerIP {
+		return "", false
+	}
+	return r.BlockingRule(host)
+}
+
+// targetDomain returns the domain behind a fake-IP target so stats show the
+// name the client resolved; any other host is returned unchanged. Dialing
+// does its own mapping in Router.DialSmart.
+func targetDomain(r *router.Router, host string) string {
+	if domain, ok := r.FakeIPDomain(host); ok {
+		return domain
+	}
+	return host
+}
+
 func shouldRetryAccept(ctx context.Context, protocol string, err error, stats *admin.Stats) bool {
 	if err == nil || ctx.Err() != nil {
 		return false
@@ -9,6 +9,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/sower-proxy/sower/config"
 	"github.com/sower-proxy/sower/internal/admin"
 	"github.com/sower-proxy/sower/pkg/upstreamtls"
 	"github.com/sower-proxy/sower/router"
@@ -81,7 +82,7 @@ func TestHandleSocks5ConnReturnsForbiddenForBlockedConnect(t *testing.T) {
 	defer client.Close()
 
 	r := newTestRouter()
-	go handleSocks5Conn(server, r, newTestStats(t))
+	go handleProxyConn(server, r, newTestStats(t), newTestListener(sniffOptions{}))
 
 	client.SetDeadline(time.Now().Add(2 * time.Second))
 	if _, err := io.WriteString(client, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n"); err != nil {
@@ -102,7 +103,7 @@ func TestHandleSocks5ConnReturnsSocks5FailureForBlockedRequest(t *testing.T) {
 	defer client.Close()
 
 	r := newTestRouter()
-	go handleSocks5Conn(server, r, newTestStats(t))
+	go handleProxyConn(server, r, newTestStats(t), newTestListener(sniffOptions{}))
 
 	client.SetDeadline(time.Now().Add(2 * time.Second))
 	if _, err := client.Write([]byte{0x05, 0x01, 0x00}); err != nil {
@@ -184,7 +185,7 @@ func TestHandleHTTPConnUsesProxyOnlyEvenWhenBlocked(t *testing.T) {
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		handleHTTPConn(downstreamServer, r, newTestStats(t))
+		handleHTTPConn(downstreamServer, r, newTestStats(t), "")
 	}()
 
 	downstreamClient.SetWriteDeadline(time.Now().Add(2 * time.Second))
@@ -421,6 +422,11 @@ func newTestRouter() *router.Router {
 	}
 }
 
+// newTestListener returns the default smart socks5 listener.
+func newTestListener(sniff sniffOptions) *proxyListener {
+	return &proxyListener{name: "socks5", kind: listenerSocks5, mode: config.ListenerModeSmart, sniff: sniff}
+}
+
 func newTestStats(t *testing.T) *admin.Stats {
 	t.Helper()
 	s, err := admin.NewStats()
@@ -460,7 +466,7 @@ func TestHandleHTTPConnConnectTunnelsToTargetPort(t *testing.T) {
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		handleHTTPConn(downstreamServer, r, newTestStats(t))
+		handleHTTPConn(downstreamServer, r, newTestStats(t), "")
 	}()
 
 	downstreamClient.SetWriteDeadline(time.Now().Add(2 * time.Second))
@@ -499,3 +505,54 @@ func TestHandleHTTPConnConnectTunnelsToTargetPort(t *testing.T) {
 	_ = upstreamServer.Close()
 	waitForHandler(t, &wg)
 }
+
+func TestHandleSocks5ConnMapsFakeIPToProxiedDomain(t *testing.T) {
+	t.Parallel()
+
+	pool, err := router.NewFakeIPPool("198.18.0.0/15", "")
+	if err != nil {
+		t.Fatalf("new fake ip pool: %v", err)
+	}
+	fake := pool.Lookup("video.example.org.")
+
+	type dialed struct {
+		host string
+		port uint16
+	}
+	dials := make(chan dialed, 1)
+	r := newTestRouter()
+	r.ProxyDial = func(network, host string, port uint16) (net.Conn, error) {
+		dials <- dialed{host, port}
+		return nil, router.ErrBlocked
+	}
+	r.SetFakeIPPool(pool)
+
+	server, client := net.Pipe()
+	defer client.Close()
+	go handleProxyConn(server, r, newTestStats(t), newTestListener(sniffOptions{}))
+
+	client.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := client.Write([]byte{0x05, 0x01, 0x00}); err != nil {
+		t.Fatalf("write auth request: %v", err)
+	}
+	authResp := make([]byte, 2)
+	if _, err := io.ReadFull(client, authResp); err != nil {
+		t.Fatalf("read auth response: %v", err)
+	}
+
+	req := []byte{0x05, 0x01, 0x00, 0x01}
+	req = append(req, fake.AsSlice()...)
+	req = append(req, 0x1f, 0x90) // 8080: fake IPs map back on any port
+	if _, err := client.Write(req); err != nil {
+		t.Fatalf("write connect request: %v", err)
+	}
+
+	select {
+	case got := <-dials:
+		if got.host != "video.example.org" || got.port != 8080 {
+			t.Fatalf("proxy dial = %s:%d, want video.example.org:8080", got.host, got.port)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("fake ip connect was not proxied")
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+// QUIC v1 Initial packets (RFC 9000, RFC 9001) are protected with keys
+// derived from the client's destination connection ID, so any on-path
+// observer can open them and read the TLS ClientHello they carry.
+
+const (
+	quicVersion1          = 0x00000001
+	quicPacketTypeInitial = 0
+	quicMaxConnIDLen      = 20
+	quicSampleLen         = 16
+	quicMaxCryptoLen      = 64 * 1024
+
+	quicFramePadding = 0x00
+	quicFramePing    = 0x01
+	quicFrameACK     = 0x02
+	quicFrameACKECN  = 0x03
+	quicFrameCrypto  = 0x06
+)
+
+var (
+	quicV1InitialSalt = []byte{
+		0x38, 0x76, 0x2c, 0xf7, 0xf5, 0x59, 0x34, 0xb3, 0x4d, 0x17,
+		0x9a, 0xe6, 0xa4, 0xc8, 0x0c, 0xad, 0xcc, 0xbb, 0x7f, 0x0a,
+	}
+	errNotQUICInitial = errors.New("not a quic v1 initial packet")
+)
+
+// quicSniffer reassembles the CRYPTO frames of a client's Initial packets.
+// A ClientHello carrying post-quantum key shares spans several packets, so
+// datagrams are fed in until it is complete.
+type quicSniffer struct {
+	frames []quicCryptoFrame
+}
+
+type quicCryptoFrame struct {
+	offset uint64
+	data   []byte
+}
+
+// Add feeds one client datagram. It returns done with the server name, which
+// may be empty, once the ClientHello is complete, and an error when the
+// datagram is not a readable QUIC Initial.
+func (s *quicSniffer) Add(datagram []byte) (name string, done bool, err error) {
+	for len(datagram) > 0 {
+		payload, rest, err := openQUICInitial(datagram)
+		if err != nil {
+			if len(s.frames) > 0 && errors.Is(err, errNotQUICInitial) {
+				break // a coalesced 0-RTT or Handshake packet
+			}
+			return "", false, err
+		}
+		if err := s.addFrames(payload); err != nil {
+			return "", false, err
+		}
+		datagram = rest
+	}
+
+	hello, err := s.clientHello()
+	if err != nil || hello == nil {
+		return "", false, err
+	}
+	parsed := utls.UnmarshalClientHello(hello)
+	if parsed == nil {
+		return "", false, fmt.Errorf("parse quic client hello")
+	}
+	return parsed.ServerName, true, nil
+}
+
+func (s *quicSniffer) addFrames(payload []byte) error {
+	for len(payload) > 0 {
+		switch payload[0] {
+		case quicFramePadding, quicFramePing:
+			payload = payload[1:]
+		case quicFrameACK, quicFrameACKECN:
+			// largest, delay, range count, first range, then count ranges of
+			// (gap, length), then three ECN counts for ACK_ECN.
+			b := payload[1:]
+			var vals [4]uint64
+			for i := range vals {
+				v, n := quicVarint(b)
+				if n == 0 {
+					return fmt.Errorf("truncated quic ack frame")
+				}
+				vals[i], b = v, b[n:]
+			}
+			skip := 2 * vals[2]
+			if payload[0] == quicFrameACKECN {
+				skip += 3
+			}
+			for ; skip > 0; skip-- {
+				_, n := quicVarint(b)
+				if n == 0 {
+					return fmt.Errorf("truncated quic ack frame")
+				}
+				b = b[n:]
+			}
+			payload = b
+		case quicFrameCrypto:
+			b := payload[1:]
+			offset, n := quicVarint(b)
+			if n == 0 {
+				return fmt.Errorf("truncated quic crypto frame")
+			}
+			b = b[n:]
+			length, n := quicVarint(b)
+			if n == 0 || length > uint64(len(b)-n) || offset+length > quicMaxCryptoLen {
+				return fmt.Errorf("invalid quic crypto frame")
+			}
+			b = b[n:]
+			s.frames = append(s.frames, quicCryptoFrame{offset: offset, data: bytes.Clone(b[:length])})
+			payload = b[length:]
+		default:
+			return fmt.Errorf("unexpected quic frame type %#x in initial packet", payload[0])
+		}
+	}
+	return nil
+}
+
+// clientHello returns the ClientHello handshake message once the contiguous
+// CRYPTO stream from offset 0 holds all of it, or nil until then.
+func (s *quicSniffer) clientHello() ([]byte, error) {
+	slices.SortFunc(s.frames, func(a, b quicCryptoFrame) int {
+		return cmp.Compare(a.offset, b.offset)
+	})
+	var stream []byte
+	for _, f := range s.frames {
+		if f.offset > uint64(len(stream)) {
+			break
+		}
+		if end := f.offset + uint64(len(f.data)); end > uint64(len(stream)) {
+			stream = append(stream, f.data[uint64(len(stream))-f.offset:]...)
+		}
+	}
+	if len(stream) < 4 {
+		return nil, nil
+	}
+	if stream[0] != tlsHandshakeTypeHello {
+		return nil, fmt.Errorf("unexpected tls handshake type %d", stream[0])
+	}
+	helloLen := int(stream[1])<<16 | int(stream[2])<<8 | int(stream[3])
+	if len(stream) < 4+helloLen {
+		return nil, nil
+	}
+	return stream[:4+helloLen], nil
+}
+
+// openQUICInitial removes header protection from the Initial packet at the
+// start of datagram and decrypts its payload. rest holds the packets
+// coalesced after it.
+func openQUICInitial(datagram []byte) (payload, rest []byte, err error) {
+	// Long header: form and fixed bits, type, version, connection IDs.
+	if len(datagram) < 7 || datagram[0]&0xc0 != 0xc0 ||
+		binary.BigEndian.Uint32(datagram[1:5]) != quicVersion1 ||
+		(datagram[0]>>4)&0x03 != quicPacketTypeInitial {
+		return nil, nil, errNotQUICInitial
+	}
+	p := 5
+	dcidLen := int(datagram[p])
+	p++
+	if dcidLen > quicMaxConnIDLen || p+dcidLen >= len(datagram) {
+		return nil, nil, fmt.Errorf("invalid quic destination connection id")
+	}
+	dcid := datagram[p : p+dcidLen]
+	p += dcidLen
+	scidLen := int(datagram[p])
+	p += 1 + scidLen
+	if scidLen > quicMaxConnIDLen || p >= len(datagram) {
+		return nil, nil, fmt.Errorf("invalid quic source connection id")
+	}
+	tokenLen, n := quicVarint(datagram[p:])
+	if n == 0 || tokenLen > uint64(len(datagram)-p-n) {
+		return nil, nil, fmt.Errorf("invalid quic token")
+	}
+	p += n + int(tokenLen)
+	length, n := quicVarint(datagram[p:])
+	p += n
+	pnOffset := p
+	if n == 0 || length > uint64(len(datagram)-pnOffset) || pnOffset+4+quicSampleLen > len(datagram) {
+		return nil, nil, fmt.Errorf("invalid quic packet length")
+	}
+	end := pnOffset + int(length)
+
+	key, iv, hp, err := quicClientInitialKeys(dcid)
+	if err != nil {
+		return nil, nil, err
+	}
+	hpBlock, err := aes.NewCipher(hp)
+	if err != nil {
+		return nil, nil, err
+	}
+	mask := make([]byte, aes.BlockSize)
+	hpBlock.Encrypt(mask, datagram[pnOffset+4:pnOffset+4+quicSampleLen])
+
+	header := bytes.Clone(datagram[:pnOffset+4])
+	header[0] ^= mask[0] & 0x0f
+	pnLen := int(header[0]&0x03) + 1
+	if pnOffset+pnLen > end {
+		return nil, nil, fmt.Errorf("invalid quic packet number")
+	}
+	var pn uint64
+	for i := range pnLen {
+		header[pnOffset+i] ^= mask[1+i]
+		pn = pn<<8 | uint64(header[pnOffset+i])
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce := bytes.Clone(iv)
+	for i := range 8 {
+		nonce[len(nonce)-1-i] ^= byte(pn >> (8 * i))
+	}
+	payload, err = aead.Open(nil, nonce, datagram[pnOffset+pnLen:end], header[:pnOffset+pnLen])
+	if err != nil {
+		return nil, nil, fmt.Errorf("decrypt quic initial: %w", err)
+	}
+	return payload, datagram[end:], nil
+}
+
+// quicClientInitialKeys derives the client Initial packet protection keys
+// (RFC 9001 section 5.2).
+func quicClientInitialKeys(dcid []byte) (key, iv, hp []byte, err error) {
+	initial, err := hkdf.Extract(sha256.New, dcid, quicV1InitialSalt)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	client, err := hkdfExpandLabel(initial, "client in", sha256.Size)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if key, err = hkdfExpandLabel(client, "quic key", 16); err != nil {
+		return nil, nil, nil, err
+	}
+	if iv, err = hkdfExpandLabel(client, "quic iv", 12); err != nil {
+		return nil, nil, nil, err
+	}
+	if hp, err = hkdfExpandLabel(client, "quic hp", 16); err != nil {
+		return nil, nil, nil, err
+	}
+	return key, iv, hp, nil
+}
+
+// hkdfExpandLabel is TLS 1.3 HKDF-Expand-Label with an empty context.
+func hkdfExpandLabel(secret []byte, label string, length int) ([]byte, error) {
+	label = "tls13 " + label
+	info := binary.BigEndian.AppendUint16(nil, uint16(length))
+	info = append(info, byte(len(label)))
+	info = append(info, label...)
+	info = append(info, 0)
+	return hkdf.Expand(sha256.New, secret, string(info), length)
+}
+
+// quicVarint decodes a variable-length integer, returning n == 0 when b is
+// too short.
+func quicVarint(b []byte) (v uint64, n int) {
+	if len(b) == 0 {
+		return 0, 0
+	}
+	n = 1 << (b[0] >> 6)
+	if len(b) < n {
+		return 0, 0
+	}
+	v = uint64(b[0] & 0x3f)
+	for _, c := range b[1:n] {
+		v = v<<8 | uint64(c)
+	}
+	return v, n
+}
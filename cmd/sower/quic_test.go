@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+func TestQUICClientInitialKeys(t *testing.T) {
+	t.Parallel()
+
+	// RFC 9001 appendix A.1.
+	dcid, _ := hex.DecodeString("8394c8f03e515708")
+	key, iv, hp, err := quicClientInitialKeys(dcid)
+	if err != nil {
+		t.Fatalf("derive keys: %v", err)
+	}
+	for _, test := range []struct {
+		name string
+		got  []byte
+		want string
+	}{
+		{name: "key", got: key, want: "1f369613dd76d5467730efcbe3b1a22d"},
+		{name: "iv", got: iv, want: "fa044b2f42a3fd3b46fb255c"},
+		{name: "hp", got: hp, want: "9f50449e04a0e810283a1e9933adedd2"},
+	} {
+		if got := hex.EncodeToString(test.got); got != test.want {
+			t.Errorf("%s = %s, want %s", test.name, got, test.want)
+		}
+	}
+}
+
+// sealQUICInitial builds a client Initial packet carrying payload, the
+// inverse of openQUICInitial.
+func sealQUICInitial(t *testing.T, dcid []byte, pn uint32, payload []byte) []byte {
+	t.Helper()
+
+	key, iv, hp, err := quicClientInitialKeys(dcid)
+	if err != nil {
+		t.Fatalf("derive keys: %v", err)
+	}
+	block, _ := aes.NewCipher(key)
+	aead, _ := cipher.NewGCM(block)
+
+	// A 4-byte packet number, no source connection ID and no token.
+	header := []byte{0xc3}
+	header = binary.BigEndian.AppendUint32(header, quicVersion1)
+	header = append(header, byte(len(dcid)))
+	header = append(header, dcid...)
+	header = append(header, 0, 0)
+	header = binary.BigEndian.AppendUint16(header, 0x4000|uint16(4+len(payload)+aead.Overhead()))
+	pnOffset := len(header)
+	header = binary.BigEndian.AppendUint32(header, pn)
+
+	nonce := bytes.Clone(iv)
+	for i := range 4 {
+		nonce[len(nonce)-1-i] ^= byte(pn >> (8 * i))
+	}
+	packet := aead.Seal(header, nonce, payload, header)
+
+	hpBlock, _ := aes.NewCipher(hp)
+	mask := make([]byte, aes.BlockSize)
+	hpBlock.Encrypt(mask, packet[pnOffset+4:pnOffset+4+quicSampleLen])
+	packet[0] ^= mask[0] & 0x0f
+	for i := range 4 {
+		packet[pnOffset+i] ^= mask[1+i]
+	}
+	return packet
+}
+
+func quicCryptoFrameBytes(offset int, data []byte) []byte {
+	frame := []byte{quicFrameCrypto}
+	frame = binary.BigEndian.AppendUint32(frame, 0x80000000|uint32(offset))
+	frame = binary.BigEndian.AppendUint16(frame, 0x4000|uint16(len(data)))
+	return append(frame, data...)
+}
+
+func TestQUICSnifferReassemblesClientHello(t *testing.T) {
+	t.Parallel()
+
+	// Strip the TLS record header: QUIC carries the bare handshake message.
+	hello := generateTLSClientHelloRecord(t, "www.example.org")[tlsRecordHeaderLen:]
+	dcid, _ := hex.DecodeString("8394c8f03e515708")
+	half := len(hello) / 2
+
+	// The second half arrives first, as a reordered datagram would.
+	second := sealQUICInitial(t, dcid, 1, append(quicCryptoFrameBytes(half, hello[half:]), make([]byte, 32)...))
+	first := sealQUICInitial(t, dcid, 0, append([]byte{quicFramePing}, quicCryptoFrameBytes(0, hello[:half])...))
+
+	var s quicSniffer
+	if name, done, err := s.Add(second); err != nil || done || name != "" {
+		t.Fatalf("Add(second) = %q, %v, %v; want incomplete", name, done, err)
+	}
+	name, done, err := s.Add(first)
+	if err != nil || !done {
+		t.Fatalf("Add(first) = %q, %v, %v; want complete", name, done, err)
+	}
+	if name != "www.example.org" {
+		t.Fatalf("server name = %q, want www.example.org", name)
+	}
+}
+
+func TestQUICSnifferRejectsOtherDatagrams(t *testing.T) {
+	t.Parallel()
+
+	var s quicSniffer
+	// A DNS query header: short, and no long-header form bit.
+	if _, _, err := s.Add([]byte{0x12, 0x34, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00}); !errors.Is(err, errNotQUICInitial) {
+		t.Fatalf("Add(dns) error = %v, want errNotQUICInitial", err)
+	}
+
+	dcid, _ := hex.DecodeString("8394c8f03e515708")
+	packet := sealQUICInitial(t, dcid, 0, quicCryptoFrameBytes(0, make([]byte, 64)))
+	packet[len(packet)-1] ^= 0xff // corrupt the tag
+	if _, _, err := s.Add(packet); err == nil {
+		t.Fatal("Add(corrupt initial) succeeded")
+	}
+}
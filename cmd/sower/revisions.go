@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/sower-proxy/sower/internal/admin"
+)
+
+// stateRollback restores retained admin state revisions at runtime. The
+// StateStore makes the revision current first; the rule sets are then
+// rebuilt with Replace and the config overrides re-applied, the same way a
+// rule reset and a config PATCH reach the runtime.
+type stateRollback struct {
+	rules  *adminRules
+	config *adminConfig
+}
+
+// Rollback implements admin.Options.Rollback.
+func (sr stateRollback) Rollback(revision uint64) (uint64, error) {
+	sr.rules.mutationMu.Lock()
+	defer sr.rules.mutationMu.Unlock()
+	sr.config.mu.Lock()
+	defer sr.config.mu.Unlock()
+
+	newRevision, err := sr.rules.state.Checkout(revision)
+	if err != nil {
+		return 0, err
+	}
+	for _, cat := range []admin.Category{admin.CategoryBlock, admin.CategoryDirect, admin.CategoryProxy} {
+		rs, err := sr.rules.rules(cat)
+		if err != nil {
+			return 0, err
+		}
+		rs.Replace(sr.rules.effectiveRules(cat)...)
+	}
+	sr.rules.invalidateHits("")
+	sr.config.applyLocked(sr.rules.state.ConfigOverrides(), false)
+	return newRevision, nil
+}
+
+// bootRevision checks out the revision chosen with --admin-state-revision
+// before anything reads the state; a negative revision keeps the latest.
+// The checkout happens once per revision: an admin restart re-executes
+// with the same arguments, and a service unit may keep the flag, so a
+// later boot with it must not undo the changes made since. A revision
+// that is no longer retained only logs a warning.
+func bootRevision(state *admin.StateStore, revision int) error {
+	if revision < 0 {
+		return nil
+	}
+	newRevision, checkedOut, err := state.CheckoutOnce(uint64(revision))
+	switch {
+	case errors.Is(err, admin.ErrRevisionNotFound):
+		slog.Warn("admin state revision not retained, booting from the latest", "from", revision, "revision", state.Revision())
+		return nil
+	case err != nil:
+		return fmt.Errorf("boot from admin state revision %d: %w", revision, err)
+	case !checkedOut:
+		slog.Info("admin state revision already checked out, booting from the latest", "from", revision, "revision", newRevision)
+		return nil
+	}
+	slog.Warn("booting from an earlier admin state revision", "from", revision, "revision", newRevision)
+	return nil
+}
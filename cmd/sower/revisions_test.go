@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/sower-proxy/sower/config"
+	"github.com/sower-proxy/sower/internal/admin"
+)
+
+func TestStateRollbackRestoresRulesAndConfig(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "admin-state.json")
+	rules, state := bootAdapter(t, statePath)
+	base := config.SowerConfig{}
+	base.DNS.Upstream = "8.8.8.8"
+	base.DNS.Fallback = "223.5.5.5"
+	ac := newAdminConfig(base, state, rules.r, nil)
+
+	if err := rules.RuleAdd(admin.CategoryProxy, "**.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	upstream := "1.1.1.1"
+	if _, err := ac.ApplyConfigChanges(admin.ConfigChanges{DNSUpstream: &upstream}, state.Revision()); err != nil {
+		t.Fatal(err)
+	}
+	if rules.r.ProxyRule.Count() != 1 || ac.effective.DNS.Upstream != upstream {
+		t.Fatalf("setup: proxy rules %d, upstream %q", rules.r.ProxyRule.Count(), ac.effective.DNS.Upstream)
+	}
+
+	rollback := stateRollback{rules: rules, config: ac}
+	revision, err := rollback.Rollback(0)
+	if err != nil {
+		t.Fatalf("rollback: %v", err)
+	}
+	if revision != 3 || state.Revision() != 3 {
+		t.Fatalf("rollback revision = %d, state %d", revision, state.Revision())
+	}
+	if rules.r.ProxyRule.Count() != 0 || ac.effective.DNS.Upstream != "8.8.8.8" {
+		t.Fatalf("after rollback: proxy rules %d, upstream %q", rules.r.ProxyRule.Count(), ac.effective.DNS.Upstream)
+	}
+
+	// The rollback is itself a revision and can be undone.
+	if _, err := rollback.Rollback(2); err != nil {
+		t.Fatalf("undo rollback: %v", err)
+	}
+	if rules.r.ProxyRule.Count() != 1 || ac.effective.DNS.Upstream != upstream {
+		t.Fatalf("after undo: proxy rules %d, upstream %q", rules.r.ProxyRule.Count(), ac.effective.DNS.Upstream)
+	}
+	if _, err := rollback.Rollback(99); !errors.Is(err, admin.ErrRevisionNotFound) {
+		t.Fatalf("unknown revision = %v", err)
+	}
+}
+
+func TestBootRevision(t *testing.T) {
+	t.Parallel()
+	statePath := filepath.Join(t.TempDir(), "admin-state.json")
+	rules, _ := bootAdapter(t, statePath)
+	if err := rules.RuleAdd(admin.CategoryProxy, "**.example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	state := admin.LoadStateStore(statePath)
+	if err := bootRevision(state, -1); err != nil || state.Revision() != 1 {
+		t.Fatalf("latest boot = %v, revision %d", err, state.Revision())
+	}
+	if err := bootRevision(state, 0); err != nil {
+		t.Fatalf("boot from 0: %v", err)
+	}
+	if d := state.Delta(admin.CategoryProxy); len(d.Add) != 0 {
+		t.Fatalf("proxy delta after boot from 0 = %+v", d)
+	}
+	booted := state.Revision()
+
+	// A restart repeating the flag keeps the changes made since the boot.
+	if _, err := state.RuleAdd(admin.CategoryDirect, "**.example.org"); err != nil {
+		t.Fatal(err)
+	}
+	state = admin.LoadStateStore(statePath)
+	if err := bootRevision(state, 0); err != nil {
+		t.Fatalf("repeated boot from 0: %v", err)
+	}
+	if state.Revision() != booted+1 || len(state.Delta(admin.CategoryDirect).Add) != 1 {
+		t.Fatalf("repeated boot: revision %d, direct delta %+v", state.Revision(), state.Delta(admin.CategoryDirect))
+	}
+
+	if err := bootRevision(state, 7); err != nil || state.Revision() != booted+1 {
+		t.Fatalf("boot from an unretained revision = %v, revision %d", err, state.Revision())
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/sower-proxy/sower/internal/admin"
+)
+
+// ruleReapInterval bounds how long a temporary rule change outlives its
+// expiry.
+const ruleReapInterval = 15 * time.Second
+
+// runRuleReaper reverts expired temporary rule changes until ctx is done.
+// The first pass runs right away, so changes that expired while sower was
+// down do not linger after boot.
+func runRuleReaper(ctx context.Context, rules *adminRules, audit *admin.AuditLog) {
+	ticker := time.NewTicker(ruleReapInterval)
+	defer ticker.Stop()
+	for {
+		reapExpiredRules(rules, audit, time.Now())
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// reapExpiredRules runs one reaper pass and records each reverted category
+// in the audit log. Failures are logged; the next pass retries.
+func reapExpiredRules(rules *adminRules, audit *admin.AuditLog, now time.Time) {
+	expired, err := rules.RuleExpire(now)
+	if err != nil {
+		slog.Warn("expire temporary rules", "error", err)
+		return
+	}
+	for category, d := range expired {
+		slog.Info("expired temporary rules", "category", category, "removed", len(d.Add), "restored", len(d.Remove))
+		if audit != nil {
+			audit.Record(admin.AuditEntry{Action: admin.AuditRulesExpire, Target: string(category), Before: d})
+		}
+	}
+}
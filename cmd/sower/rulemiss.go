@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/sower-proxy/sower/internal/admin"
+	"github.com/sower-proxy/sower/router"
 )
 
 const (
@@ -26,7 +27,14 @@ const (
 
 type ruleMiss struct {
 	count uint64
-	last  time.Time
+	// direct and proxy split count by the route detection chose; the failed
+	// counters are the dials of that route that errored.
+	direct, directFailed uint64
+	proxy, proxyFailed   uint64
+	// poisoned counts direct DNS answers for the domain that were detected
+	// as poisoned; such domains are proxy-rule candidates.
+	poisoned uint64
+	last     time.Time
 }
 
 // ruleMissTracker counts connections per domain for domains that matched no
@@ -69,8 +77,33 @@ func missShardIndex(domain string) uint32 {
 	return h & (missShards - 1)
 }
 
-// OnMiss counts one rule-less connection for the domain.
-func (t *ruleMissTracker) OnMiss(domain string) {
+// OnMiss counts one rule-less connection for the domain, the route it took
+// and whether its dial failed.
+func (t *ruleMissTracker) OnMiss(domain string, route router.RouteCategory, err error) {
+	t.update(domain, func(m *ruleMiss) {
+		m.count++
+		switch route {
+		case router.RouteDirect:
+			m.direct++
+			if err != nil {
+				m.directFailed++
+			}
+		case router.RouteProxy:
+			m.proxy++
+			if err != nil {
+				m.proxyFailed++
+			}
+		}
+	})
+}
+
+// OnPoisoned records one poisoned direct DNS answer for the domain, marking
+// it as a proxy-rule candidate.
+func (t *ruleMissTracker) OnPoisoned(domain string) {
+	t.update(domain, func(m *ruleMiss) { m.poisoned++ })
+}
+
+func (t *ruleMissTracker) update(domain string, fn func(*ruleMiss)) {
 	domain = normalizeHitDomain(domain)
 	if domain == "" {
 		return
@@ -88,7 +121,7 @@ func (t *ruleMissTracker) OnMiss(domain string) {
 		m = &ruleMiss{}
 		s.miss[domain] = m
 	}
-	m.count++
+	fn(m)
 	m.last = time.Now()
 }
 
@@ -140,7 +173,16 @@ func (t *ruleMissTracker) snapshot() []admin.RuleHit {
 		s := &t.shards[i]
 		s.mu.Lock()
 		for domain, m := range s.miss {
-			out = append(out, admin.RuleHit{Rule: domain, Count: m.count, LastSeen: m.last})
+			out = append(out, admin.RuleHit{
+				Rule:         domain,
+				Count:        m.count,
+				Direct:       m.direct,
+				DirectFailed: m.directFailed,
+				Proxy:        m.proxy,
+				ProxyFailed:  m.proxyFailed,
+				Poisoned:     m.poisoned,
+				LastSeen:     m.last,
+			})
 		}
 		s.mu.Unlock()
 	}
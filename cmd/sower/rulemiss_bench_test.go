@@ -20,7 +20,7 @@ func BenchmarkRuleMissOnMiss(b *testing.B) {
 	b.RunParallel(func(pb *testing.PB) {
 		i := 0
 		for pb.Next() {
-			tracker.OnMiss(domains[i&1023])
+			tracker.OnMiss(domains[i&1023], router.RouteDirect, nil)
 			i++
 		}
 	})
@@ -50,7 +50,7 @@ func BenchmarkRuleHitOnHit(b *testing.B) {
 func BenchmarkRuleMissTop(b *testing.B) {
 	tracker := newRuleMissTracker()
 	for i := 0; i < 30000; i++ {
-		tracker.OnMiss(fmt.Sprintf("host%d.sub.example.com", i))
+		tracker.OnMiss(fmt.Sprintf("host%d.sub.example.com", i), router.RouteDirect, nil)
 	}
 	b.ReportAllocs()
 	b.ResetTimer()
@@ -5,15 +5,17 @@ import (
 	"sync"
 	"testing"
 	"time"
+
+	"github.com/sower-proxy/sower/router"
 )
 
 func TestRuleMissTrackerCountsPerDomain(t *testing.T) {
 	tracker := newRuleMissTracker()
 
-	tracker.OnMiss("a.example.com")
-	tracker.OnMiss("b.example.com")
-	tracker.OnMiss("b.example.com")
-	tracker.OnMiss("c.example.com")
+	tracker.OnMiss("a.example.com", router.RouteDirect, nil)
+	tracker.OnMiss("b.example.com", router.RouteDirect, nil)
+	tracker.OnMiss("b.example.com", router.RouteDirect, nil)
+	tracker.OnMiss("c.example.com", router.RouteDirect, nil)
 
 	top := tracker.Top(10)
 	if len(top) != 3 {
@@ -28,13 +30,29 @@ func TestRuleMissTrackerCountsPerDomain(t *testing.T) {
 	}
 }
 
+func TestRuleMissTrackerCountsPoisonedAnswers(t *testing.T) {
+	tracker := newRuleMissTracker()
+
+	tracker.OnPoisoned("blocked.example.com.")
+	tracker.OnMiss("blocked.example.com", router.RouteDirect, nil)
+	tracker.OnPoisoned("blocked.example.com")
+
+	top := tracker.Top(10)
+	if len(top) != 1 {
+		t.Fatalf("expected 1 domain, got %d", len(top))
+	}
+	if top[0].Rule != "blocked.example.com" || top[0].Count != 1 || top[0].Poisoned != 2 {
+		t.Fatalf("unexpected entry: %+v", top[0])
+	}
+}
+
 func TestRuleMissTrackerRecent(t *testing.T) {
 	tracker := newRuleMissTracker()
 
-	tracker.OnMiss("first.example")
+	tracker.OnMiss("first.example", router.RouteDirect, nil)
 	time.Sleep(2 * time.Millisecond)
-	tracker.OnMiss("second.example")
-	tracker.OnMiss("second.example")
+	tracker.OnMiss("second.example", router.RouteDirect, nil)
+	tracker.OnMiss("second.example", router.RouteDirect, nil)
 
 	recent := tracker.Recent(10)
 	if len(recent) != 2 {
@@ -51,9 +69,9 @@ func TestRuleMissTrackerRecent(t *testing.T) {
 func TestRuleMissTrackerLimitAndTopCap(t *testing.T) {
 	tracker := newRuleMissTracker()
 	for i := 0; i < 5; i++ {
-		tracker.OnMiss("x.example")
+		tracker.OnMiss("x.example", router.RouteDirect, nil)
 	}
-	tracker.OnMiss("y.example")
+	tracker.OnMiss("y.example", router.RouteDirect, nil)
 
 	if got := len(tracker.Top(1)); got != 1 {
 		t.Fatalf("expected limit 1, got %d", got)
@@ -77,7 +95,7 @@ func TestRuleMissTrackerCapEvictsOldest(t *testing.T) {
 		s.mu.Unlock()
 	}
 
-	tracker.OnMiss("fresh.example")
+	tracker.OnMiss("fresh.example", router.RouteDirect, nil)
 
 	idx := missShardIndex("fresh.example")
 	s := &tracker.shards[idx]
@@ -107,7 +125,7 @@ func TestRuleMissTrackerConcurrentSnapshot(t *testing.T) {
 			case <-stop:
 				return
 			default:
-				tracker.OnMiss(fmt.Sprintf("host%d.example.com", i%64))
+				tracker.OnMiss(fmt.Sprintf("host%d.example.com", i%64), router.RouteDirect, nil)
 			}
 		}
 	}()
@@ -211,8 +211,10 @@ func (l *chanListener) dispatch(conn net.Conn) {
 
 // ServeSharedHTTP serves the admin console and the HTTP proxy from one
 // listener, classifying each connection by its request head. adminHost is the
-// normalized listener IP that identifies admin traffic.
-func ServeSharedHTTP(ctx context.Context, ln net.Listener, r *router.Router, stats *admin.Stats, srv *admin.Server, adminHost string, errCh chan<- error) error {
+// normalized listener IP that identifies admin traffic. acl applies to the
+// proxied connections only; the console has its own login. blockConsole is
+// the console address the block page links to.
+func ServeSharedHTTP(ctx context.Context, ln net.Listener, r *router.Router, stats *admin.Stats, acl *clientACL, srv *admin.Server, adminHost, blockConsole string, errCh chan<- error) error {
 	adminLn := newChanListener(ln.Addr())
 	go func() {
 		if err := srv.Serve(adminLn); err != nil && !errors.Is(err, net.ErrClosed) {
@@ -238,7 +240,12 @@ func ServeSharedHTTP(ctx context.Context, ln net.Listener, r *router.Router, sta
 				adminLn.dispatch(replayed)
 				return
 			}
-			handleHTTPConn(replayed, r, stats)
+			if !acl.admits(conn.RemoteAddr()) {
+				refuseClient(stats, "http", conn.RemoteAddr())
+				_ = replayed.Close()
+				return
+			}
+			handleHTTPConn(replayed, r, stats, blockConsole)
 		}(conn)
 	}
 }
@@ -203,7 +203,7 @@ func TestServeSharedHTTPRoutesAdminAndProxy(t *testing.T) {
 	defer cancel()
 	errCh := make(chan error, 1)
 	go func() {
-		if err := ServeSharedHTTP(ctx, ln, newTestRouter(), stats, srv, host, errCh); err != nil {
+		if err := ServeSharedHTTP(ctx, ln, newTestRouter(), stats, nil, srv, host, "", errCh); err != nil {
 			t.Errorf("serve shared http: %v", err)
 		}
 	}()
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	stderrors "errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/sower-proxy/conns/relay"
+	"github.com/sower-proxy/sower/internal/admin"
+	"github.com/sower-proxy/sower/router"
+)
+
+// sniffTimeout bounds the wait for the client's first bytes. Server-first
+// protocols (SMTP, FTP) send nothing until greeted, so they are routed by
+// destination IP once it expires.
+const sniffTimeout = 300 * time.Millisecond
+
+// sniffOptions controls routing on names sniffed from a connection whose
+// target is an IP literal.
+type sniffOptions struct {
+	enable bool
+	// dialDomain dials the sniffed name instead of the original IP, letting
+	// the proxy resolve it remotely.
+	dialDomain bool
+}
+
+// applies reports whether host is an IP literal to sniff a name for. Fake
+// IPs are left alone: they map back to their domain when dialed.
+func (o sniffOptions) applies(r *router.Router, host string) bool {
+	if !o.enable || net.ParseIP(host) == nil {
+		return false
+	}
+	_, fake := r.FakeIPDomain(host)
+	return !fake
+}
+
+// sniffTarget returns the name to route an IP-literal host on, and the host
+// to dial. A fake IP already maps back to its domain, and an empty name
+// keeps routing on the IP.
+func (o sniffOptions) sniffTarget(r *router.Router, host, name string) (route, dial string) {
+	if _, fake := r.FakeIPDomain(host); fake || name == "" || net.ParseIP(name) != nil {
+		return host, host
+	}
+	if o.dialDomain {
+		return name, name
+	}
+	return name, host
+}
+
+// sniffHost reads the client's first bytes and returns the HTTP Host or TLS
+// SNI they carry, or "" when there is none. head holds every byte read, to
+// be replayed to the target.
+func sniffHost(conn net.Conn, timeout time.Duration) (name string, head []byte) {
+	var buf bytes.Buffer
+	tee := io.TeeReader(conn, &buf)
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	defer func() { _ = conn.SetReadDeadline(time.Time{}) }()
+
+	first := make([]byte, 1)
+	if _, err := io.ReadFull(tee, first); err != nil {
+		return "", buf.Bytes()
+	}
+	rd := io.MultiReader(bytes.NewReader(first), tee)
+	switch {
+	case first[0] == tlsRecordTypeHandshake:
+		name, _ = peekTLSClientHelloServerName(rd)
+	case first[0] >= 'A' && first[0] <= 'Z': // an HTTP method
+		if req, err := http.ReadRequest(bufio.NewReader(rd)); err == nil {
+			name = hostOnly(req.Host)
+		}
+	}
+	return name, buf.Bytes()
+}
+
+// relaySniffed tunnels conn, whose client was already told the tunnel is up,
+// to host:port routed on the name sniffed from its first bytes. statsConn is
+// the stats-wrapped connection the traffic is attributed through.
+func relaySniffed(statsConn, conn net.Conn, host string, port uint16, r *router.Router, stats *admin.Stats, l *proxyListener) {
+	name, head := sniffHost(conn, sniffTimeout)
+	route, dial := l.sniff.sniffTarget(r, host, name)
+
+	stats.BindConn(statsConn, targetDomain(r, route))
+	rc, err := l.dial(r, "tcp", route, dial, port)
+	if err != nil {
+		if !stderrors.Is(err, router.ErrBlocked) {
+			stats.RecordProxyError("dial", fmt.Sprintf("%s: %v", route, err))
+		}
+		return
+	}
+	defer rc.Close()
+	bindUpstream(stats, statsConn, rc, port)
+
+	if err := relay.Relay(&prefixConn{Conn: conn, prefix: bytes.NewReader(head)}, rc); err != nil {
+		slog.Debug("serve sniffed tunnel", "error", err, "host", route, "addr", dial, "port", port)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sower-proxy/sower/internal/admin"
+	"github.com/sower-proxy/sower/router"
+)
+
+// runSniffedSocks5 serves one socks5-port connection with sniffing enabled
+// and returns the client end, the upstream end and the proxy target the
+// router dialed.
+func runSniffedSocks5(t *testing.T, r *router.Router, stats *admin.Stats, sniff sniffOptions) (client, upstream net.Conn, target <-chan string, wg *sync.WaitGroup) {
+	t.Helper()
+
+	downstreamServer, downstreamClient := net.Pipe()
+	upstreamClient, upstreamServer := net.Pipe()
+	targetCh := make(chan string, 1)
+	r.ProxyDial = func(network, host string, port uint16) (net.Conn, error) {
+		targetCh <- net.JoinHostPort(host, strconv.Itoa(int(port)))
+		return upstreamClient, nil
+	}
+
+	wg = &sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		handleProxyConn(downstreamServer, r, stats, newTestListener(sniff))
+	}()
+	t.Cleanup(func() {
+		_ = downstreamClient.Close()
+		_ = upstreamServer.Close()
+	})
+	_ = downstreamClient.SetDeadline(time.Now().Add(2 * time.Second))
+	return downstreamClient, upstreamServer, targetCh, wg
+}
+
+func TestHandleSocks5ConnSniffsIPLiteralTarget(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		name       string
+		dialDomain bool
+		want       string
+	}{
+		{name: "dial ip", want: "203.0.113.10:443"},
+		{name: "dial domain", dialDomain: true, want: "www.example.org:443"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			r := newTestRouter()
+			r.ProxyRule = router.NewRuleSet("**.example.org")
+			stats := newTestStats(t)
+			client, upstream, target, wg := runSniffedSocks5(t, r, stats, sniffOptions{enable: true, dialDomain: test.dialDomain})
+
+			if _, err := client.Write([]byte{0x05, 0x01, 0x00}); err != nil {
+				t.Fatalf("write auth request: %v", err)
+			}
+			authResp := make([]byte, 2)
+			if _, err := io.ReadFull(client, authResp); err != nil {
+				t.Fatalf("read auth response: %v", err)
+			}
+			if _, err := client.Write([]byte{0x05, 0x01, 0x00, 0x01, 203, 0, 113, 10, 0x01, 0xbb}); err != nil {
+				t.Fatalf("write connect request: %v", err)
+			}
+			reply := make([]byte, 10)
+			if _, err := io.ReadFull(client, reply); err != nil {
+				t.Fatalf("read connect reply: %v", err)
+			}
+			if reply[1] != 0x00 {
+				t.Fatalf("connect reply = %d, want success before sniffing", reply[1])
+			}
+
+			hello := generateTLSClientHelloRecord(t, "www.example.org")
+			go func() { _, _ = client.Write(hello) }()
+
+			gotHello := make([]byte, len(hello))
+			_ = upstream.SetReadDeadline(time.Now().Add(2 * time.Second))
+			if _, err := io.ReadFull(upstream, gotHello); err != nil {
+				t.Fatalf("read upstream client hello: %v", err)
+			}
+			if string(gotHello) != string(hello) {
+				t.Fatal("client hello was not relayed intact")
+			}
+			if got := <-target; got != test.want {
+				t.Fatalf("proxy target = %s, want %s", got, test.want)
+			}
+
+			_ = client.Close()
+			_ = upstream.Close()
+			waitForHandler(t, wg)
+
+			snap := stats.Snapshot(admin.DomainSortBytes, admin.SourceAll, "")
+			if len(snap.Domains) != 1 || snap.Domains[0].Domain != "www.example.org" {
+				t.Fatalf("stats domains = %+v, want www.example.org", snap.Domains)
+			}
+		})
+	}
+}
+
+func TestHandleSocks5ConnSniffsIPLiteralHTTPConnect(t *testing.T) {
+	t.Parallel()
+
+	r := newTestRouter()
+	r.ProxyRule = router.NewRuleSet("**.example.org")
+	client, upstream, target, wg := runSniffedSocks5(t, r, newTestStats(t), sniffOptions{enable: true})
+
+	// The tunneled request is pipelined behind the CONNECT head, so it is
+	// already buffered when the tunnel opens.
+	tunneled := "GET / HTTP/1.1\r\nHost: www.example.org\r\n\r\n"
+	go func() {
+		_, _ = io.WriteString(client, "CONNECT 203.0.113.10:80 HTTP/1.1\r\nHost: 203.0.113.10:80\r\n\r\n"+tunneled)
+	}()
+
+	established := "HTTP/1.1 200 Connection established\r\n\r\n"
+	resp := make([]byte, len(established))
+	if _, err := io.ReadFull(client, resp); err != nil {
+		t.Fatalf("read connect response: %v", err)
+	}
+	if string(resp) != established {
+		t.Fatalf("connect response = %q, want %q", resp, established)
+	}
+
+	got := make([]byte, len(tunneled))
+	_ = upstream.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(upstream, got); err != nil {
+		t.Fatalf("read upstream request: %v", err)
+	}
+	if string(got) != tunneled {
+		t.Fatalf("upstream request = %q, want %q", got, tunneled)
+	}
+	if got := <-target; got != "203.0.113.10:80" {
+		t.Fatalf("proxy target = %s, want 203.0.113.10:80", got)
+	}
+
+	_ = client.Close()
+	_ = upstream.Close()
+	waitForHandler(t, wg)
+}
+
+func TestSniffOptionsApplies(t *testing.T) {
+	t.Parallel()
+
+	r := newTestRouter()
+	on := sniffOptions{enable: true}
+	for _, test := range []struct {
+		sniff sniffOptions
+		host  string
+		want  bool
+	}{
+		{sniff: on, host: "203.0.113.10", want: true},
+		{sniff: on, host: "2001:db8::1", want: true},
+		{sniff: on, host: "www.example.org", want: false},
+		{sniff: sniffOptions{}, host: "203.0.113.10", want: false},
+	} {
+		if got := test.sniff.applies(r, test.host); got != test.want {
+			t.Errorf("applies(%q) with %+v = %v, want %v", test.host, test.sniff, got, test.want)
+		}
+	}
+}
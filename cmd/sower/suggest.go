@@ -0,0 +1,138 @@
+package main
+
+import (
+	"cmp"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/sower-proxy/sower/internal/admin"
+	"github.com/sower-proxy/sower/router"
+	"golang.org/x/net/publicsuffix"
+)
+
+// ruleSuggestionSamples bounds the missed names listed per suggestion.
+const ruleSuggestionSamples = 5
+
+// RuleSuggestions groups the rule-miss stats by registrable domain and
+// proposes a "**." rule per group, busiest first. IP literals and names a
+// rule matches by now are skipped. A direct suggestion lists the block and
+// proxy rules inside its suffix, since accepting it would send the rest of
+// the domain direct around them. It implements admin.RuleSuggester.
+func (a *adminRules) RuleSuggestions(limit int) []admin.RuleSuggestion {
+	if a.missHits == nil {
+		return nil
+	}
+	groups := make(map[string]*admin.RuleSuggestion)
+	members := make(map[string][]admin.RuleHit)
+	for _, m := range a.missHits.snapshot() {
+		if _, err := netip.ParseAddr(m.Rule); err == nil || a.ruleMatches(m.Rule) {
+			continue
+		}
+		domain := registrableDomain(m.Rule)
+		g := groups[domain]
+		if g == nil {
+			g = &admin.RuleSuggestion{Rule: "**." + domain, Domain: domain}
+			groups[domain] = g
+		}
+		g.Count += m.Count
+		g.Direct += m.Direct
+		g.DirectFailed += m.DirectFailed
+		g.Proxy += m.Proxy
+		g.ProxyFailed += m.ProxyFailed
+		g.Poisoned += m.Poisoned
+		if m.LastSeen.After(g.LastSeen) {
+			g.LastSeen = m.LastSeen
+		}
+		members[domain] = append(members[domain], m)
+	}
+
+	direct := make(map[string]*admin.RuleSuggestion)
+	for domain, g := range groups {
+		hits := members[domain]
+		slices.SortFunc(hits, func(x, y admin.RuleHit) int {
+			return cmp.Compare(y.Count, x.Count)
+		})
+		g.Domains = len(hits)
+		for _, h := range hits[:min(len(hits), ruleSuggestionSamples)] {
+			g.Samples = append(g.Samples, h.Rule)
+		}
+		g.Category, g.Reason = suggestRoute(g)
+		if g.Category == admin.CategoryDirect {
+			direct[domain] = g
+		}
+	}
+	a.addOverlaps(direct)
+
+	out := make([]admin.RuleSuggestion, 0, len(groups))
+	for _, g := range groups {
+		out = append(out, *g)
+	}
+	slices.SortFunc(out, func(x, y admin.RuleSuggestion) int {
+		if c := cmp.Compare(y.Count, x.Count); c != 0 {
+			return c
+		}
+		return y.LastSeen.Compare(x.LastSeen)
+	})
+	if limit <= 0 || limit > ruleMissTop {
+		limit = ruleMissTop
+	}
+	return out[:min(len(out), limit)]
+}
+
+// suggestRoute picks the category a group's traffic calls for. Poisoned
+// answers and mostly failing direct dials mean the sites need the proxy;
+// otherwise the route detection settled on most often wins.
+func suggestRoute(g *admin.RuleSuggestion) (admin.Category, string) {
+	switch {
+	case g.Poisoned > 0:
+		return admin.CategoryProxy, admin.SuggestPoisoned
+	case g.DirectFailed > 0 && g.DirectFailed*2 >= g.Direct:
+		return admin.CategoryProxy, admin.SuggestDirectFailed
+	case g.Proxy > g.Direct:
+		return admin.CategoryProxy, admin.SuggestProxied
+	default:
+		return admin.CategoryDirect, admin.SuggestDirect
+	}
+}
+
+// registrableDomain returns the public suffix plus one label
+// ("www.example.co.uk" -> "example.co.uk"), or the name itself when it has
+// none, e.g. a bare public suffix.
+func registrableDomain(domain string) string {
+	if reg, err := publicsuffix.EffectiveTLDPlusOne(domain); err == nil {
+		return reg
+	}
+	return strings.TrimSuffix(domain, ".")
+}
+
+// addOverlaps lists, on each suggestion keyed by its registrable domain,
+// the block and proxy rules for that domain or names below it.
+func (a *adminRules) addOverlaps(suggestions map[string]*admin.RuleSuggestion) {
+	if len(suggestions) == 0 {
+		return
+	}
+	for _, set := range []struct {
+		category admin.Category
+		rules    *router.RuleSet
+	}{{admin.CategoryBlock, a.r.BlockRule}, {admin.CategoryProxy, a.r.ProxyRule}} {
+		for _, rule := range set.rules.List() {
+			name := strings.ToLower(strings.TrimSuffix(rule, "."))
+			for {
+				if g := suggestions[name]; g != nil {
+					g.Overlaps = append(g.Overlaps, admin.CategoryRule{Category: set.category, Rule: rule})
+					break
+				}
+				_, rest, ok := strings.Cut(name, ".")
+				if !ok {
+					break
+				}
+				name = rest
+			}
+		}
+	}
+}
+
+func (a *adminRules) ruleMatches(domain string) bool {
+	return a.r.BlockRule.Match(domain) || a.r.DirectRule.Match(domain) || a.r.ProxyRule.Match(domain)
+}
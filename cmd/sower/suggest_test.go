@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/sower-proxy/sower/internal/admin"
+	"github.com/sower-proxy/sower/router"
+)
+
+func TestRuleSuggestionsGroupByRegistrableDomain(t *testing.T) {
+	t.Parallel()
+	a, state := bootAdapter(t, filepath.Join(t.TempDir(), "admin-state.json"))
+	dialErr := errors.New("connection reset")
+	for range 3 {
+		a.missHits.OnMiss("www.example.co.uk", router.RouteDirect, nil)
+	}
+	a.missHits.OnMiss("static.example.co.uk", router.RouteDirect, nil)
+	a.missHits.OnMiss("api.blocked.example", router.RouteDirect, dialErr)
+	a.missHits.OnMiss("cdn.blocked.example", router.RouteDirect, nil)
+	a.missHits.OnMiss("img.blocked.example", router.RouteDirect, dialErr)
+	a.missHits.OnMiss("news.example.net", router.RouteProxy, nil)
+	a.missHits.OnPoisoned("search.example.org")
+	a.missHits.OnMiss("10.0.0.1", router.RouteDirect, nil)
+	// example.com is a baseline block rule of the test router.
+	a.missHits.OnMiss("example.com", router.RouteDirect, nil)
+	// A direct "**.example.co.uk" would route around these.
+	a.r.ProxyRule.Add("**.mail.example.co.uk", "example.net.uk")
+	a.r.BlockRule.Add("ads.example.co.uk")
+
+	got := a.RuleSuggestions(0)
+	byDomain := make(map[string]admin.RuleSuggestion, len(got))
+	for _, s := range got {
+		byDomain[s.Domain] = s
+	}
+	if len(got) != 4 || got[0].Domain != "example.co.uk" {
+		t.Fatalf("suggestions = %+v", got)
+	}
+	if s := got[0]; s.Rule != "**.example.co.uk" || s.Category != admin.CategoryDirect || s.Reason != admin.SuggestDirect ||
+		s.Count != 4 || s.Domains != 2 || !slices.Equal(s.Samples, []string{"www.example.co.uk", "static.example.co.uk"}) {
+		t.Fatalf("example.co.uk = %+v", s)
+	}
+	if !slices.Equal(got[0].Overlaps, []admin.CategoryRule{
+		{Category: admin.CategoryBlock, Rule: "ads.example.co.uk"},
+		{Category: admin.CategoryProxy, Rule: "**.mail.example.co.uk"},
+	}) {
+		t.Fatalf("example.co.uk overlaps = %+v", got[0].Overlaps)
+	}
+	if s := byDomain["example.net"]; s.Overlaps != nil {
+		t.Errorf("proxy suggestion overlaps = %+v", s.Overlaps)
+	}
+	for domain, want := range map[string]string{
+		"blocked.example": admin.SuggestDirectFailed,
+		"example.net":     admin.SuggestProxied,
+		"example.org":     admin.SuggestPoisoned,
+	} {
+		if s := byDomain[domain]; s.Category != admin.CategoryProxy || s.Reason != want {
+			t.Errorf("%s = %+v, want proxy/%s", domain, s, want)
+		}
+	}
+
+	before := state.Revision()
+	added, err := a.RuleAddSet(map[admin.Category][]string{
+		admin.CategoryDirect: {"**.example.co.uk"},
+		admin.CategoryProxy:  {"**.blocked.example", "**.example.net"},
+	})
+	if err != nil || len(added) != 2 {
+		t.Fatalf("accept = %v, %v", added, err)
+	}
+	if state.Revision() != before+1 {
+		t.Fatalf("accept bumped revision %d -> %d, want one step", before, state.Revision())
+	}
+	if !a.r.DirectRule.Match("www.example.co.uk") || !a.r.ProxyRule.Match("api.blocked.example") {
+		t.Fatal("accepted rules not applied to the runtime rule sets")
+	}
+	if got := a.RuleSuggestions(0); len(got) != 1 || got[0].Domain != "example.org" {
+		t.Fatalf("suggestions after accept = %+v", got)
+	}
+}
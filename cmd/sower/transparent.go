@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	stderrors "errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sower-proxy/conns/relay"
+	"github.com/sower-proxy/sower/internal/admin"
+	"github.com/sower-proxy/sower/router"
+)
+
+const (
+	// transparentUDPIdleTimeout closes a UDP flow after this long without a
+	// datagram in either direction.
+	transparentUDPIdleTimeout = time.Minute
+	maxUDPDatagramLen         = 64 * 1024
+	// quicSniffDatagrams caps the datagrams held back while a flow's QUIC
+	// ClientHello is reassembled; the flow is routed by IP past it.
+	quicSniffDatagrams = 4
+	// maxQueuedUDPDatagrams caps the datagrams held for a flow while it is
+	// opened; later ones are dropped like on a full socket buffer.
+	maxQueuedUDPDatagrams = 32
+)
+
+var errTransparentUnsupported = stderrors.New("transparent proxy is only supported on linux")
+
+func ServeTransparent(ctx context.Context, ln net.Listener, r *router.Router, stats *admin.Stats, acl *clientACL, sniff sniffOptions) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if shouldRetryAccept(ctx, "transparent", err, stats) {
+				continue
+			}
+			return wrapAcceptErr(ctx, "transparent", err)
+		}
+		if !acl.admits(conn.RemoteAddr()) {
+			refuseClient(stats, "transparent", conn.RemoteAddr())
+			_ = conn.Close()
+			continue
+		}
+		go func() {
+			// The destination must be read from the raw socket, before the
+			// connection is wrapped for stats.
+			dst, err := originalDst(conn)
+			if err != nil {
+				slog.Error("read transparent destination", "error", err, "client", conn.RemoteAddr())
+				_ = conn.Close()
+				return
+			}
+			if isListenerAddr(dst, ln.Addr()) {
+				// Not redirected: dialing the destination would loop back
+				// into this listener.
+				slog.Debug("refuse direct connection to transparent listener", "client", conn.RemoteAddr())
+				_ = conn.Close()
+				return
+			}
+			handleTransparentConn(conn, dst, r, stats, sniff)
+		}()
+	}
+}
+
+// handleTransparentConn routes a redirected connection for dst. The HTTP
+// Host or TLS SNI sniffed from the first bytes names the target; without
+// one the destination IP does, which a fake IP maps back to its domain.
+// Sniffing always runs here: every target is an IP.
+func handleTransparentConn(conn net.Conn, dst netip.AddrPort, r *router.Router, stats *admin.Stats, sniff sniffOptions) {
+	start := time.Now()
+	conn = stats.WrapConn(conn, "transparent")
+	defer conn.Close()
+
+	name, head := sniffHost(conn, sniffTimeout)
+	host, dialHost := sniff.sniffTarget(r, dst.Addr().Unmap().String(), name)
+	port := dst.Port()
+
+	stats.BindConn(conn, targetDomain(r, host))
+	var rc net.Conn
+	var err error
+	if quotaDirect(stats, conn) {
+		rc, err = r.DialForced(router.RouteDirect, "tcp", host, dialHost, port, nil)
+	} else {
+		rc, err = r.DialSniffed("tcp", host, dialHost, port)
+	}
+	if err != nil {
+		if !stderrors.Is(err, router.ErrBlocked) {
+			slog.Error("dial transparent target", "error", err, "host", host, "port", port)
+			stats.RecordProxyError("dial", fmt.Sprintf("%s: %v", targetDomain(r, host), err))
+		}
+		return
+	}
+	defer rc.Close()
+	bindUpstream(stats, conn, rc, port)
+
+	if err := relay.Relay(&prefixConn{Conn: conn, prefix: bytes.NewReader(head)}, rc); err != nil {
+		slog.Debug("serve transparent", "error", err, "host", host, "port", port, "spend", time.Since(start))
+	}
+}
+
+// isListenerAddr reports whether dst is the listener itself, reached without
+// a redirect.
+func isListenerAddr(dst netip.AddrPort, ln net.Addr) bool {
+	lnAddr, ok := ln.(*net.TCPAddr)
+	if !ok || int(dst.Port()) != lnAddr.Port {
+		return false
+	}
+	ip := net.IP(dst.Addr().Unmap().AsSlice())
+	if !lnAddr.IP.IsUnspecified() {
+		return lnAddr.IP.Equal(ip)
+	}
+	if ip.IsLoopback() {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// udpFlow relays one client/destination pair of a TPROXY UDP listener.
+// Replies leave from a socket bound to the original destination so the
+// client sees them come from the address it sent to.
+type udpFlow struct {
+	upstream net.Conn
+	reply    *net.UDPConn
+	client   netip.AddrPort
+	lastSeen atomic.Int64
+}
+
+// pendingUDPFlow holds a new flow's datagrams while its QUIC ClientHello
+// is reassembled.
+type pendingUDPFlow struct {
+	sniffer   quicSniffer
+	datagrams [][]byte
+	started   time.Time
+}
+
+// ServeTransparentUDP relays UDP flows received by a TPROXY listener. Flows
+// follow Router.DialUDP: blocked and proxy-routed flows are dropped, and
+// the rest are relayed directly. A QUIC flow is routed on the SNI of its
+// Initial packets, so a proxy-routed site is dropped and its client falls
+// back to TCP. Datagrams from clients the ACL refuses are dropped before
+// they reach any flow.
+func ServeTransparentUDP(ctx context.Context, pc *net.UDPConn, r *router.Router, stats *admin.Stats, acl *clientACL, sniff sniffOptions) error {
+	flows := newUDPFlowTable(func(src, dst netip.AddrPort, name string) (*udpFlow, error) {
+		return newUDPFlow(r, src, dst, sniff, name)
+	})
+	buf := make([]byte, maxUDPDatagramLen)
+	oob := make([]byte, 1024)
+	for {
+		n, src, dst, err := readTransparentUDP(pc, buf, oob)
+		if err != nil {
+			if ctx.Err() != nil || stderrors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			slog.Debug("read transparent udp", "error", err)
+			continue
+		}
+		if client := net.UDPAddrFromAddrPort(src); !acl.admits(client) {
+			refuseClient(stats, "transparent", client)
+			continue
+		}
+		flows.dispatch(src, dst, buf[:n])
+	}
+}
+
+// udpFlowTable hands the datagrams of a TPROXY UDP listener to their flows.
+// Only the read loop calls dispatch. Flows are opened on goroutines of
+// their own, so a slow setup, such as the DNS lookup for a sniffed name,
+// holds up only its own datagrams, which queue meanwhile. A flow the router
+// refused stays refused until transparentUDPIdleTimeout instead of being
+// routed, and counted, again for every datagram.
+type udpFlowTable struct {
+	open func(src, dst netip.AddrPort, name string) (*udpFlow, error)
+
+	// pending and lastPrune are only touched by the read loop.
+	pending   map[[2]netip.AddrPort]*pendingUDPFlow
+	lastPrune time.Time
+
+	mu    sync.Mutex
+	flows map[[2]netip.AddrPort]*udpFlowState
+}
+
+// udpFlowState is one client/destination pair past sniffing: opening while
+// neither flow nor refusedUntil is set, then relaying or refused.
+type udpFlowState struct {
+	flow         *udpFlow
+	queued       [][]byte
+	refusedUntil time.Time
+}
+
+func newUDPFlowTable(open func(src, dst netip.AddrPort, name string) (*udpFlow, error)) *udpFlowTable {
+	return &udpFlowTable{
+		open:    open,
+		pending: make(map[[2]netip.AddrPort]*pendingUDPFlow),
+		flows:   make(map[[2]netip.AddrPort]*udpFlowState),
+	}
+}
+
+// dispatch relays, queues or drops one datagram; datagram is only valid
+// for the call.
+func (t *udpFlowTable) dispatch(src, dst netip.AddrPort, datagram []byte) {
+	key := [2]netip.AddrPort{src, dst}
+	now := time.Now()
+	t.mu.Lock()
+	st := t.flows[key]
+	switch {
+	case st == nil:
+	case st.flow != nil:
+		flow := st.flow
+		t.mu.Unlock()
+		flow.lastSeen.Store(now.UnixNano())
+		flow.write(datagram)
+		return
+	case st.refusedUntil.IsZero():
+		if len(st.queued) < maxQueuedUDPDatagrams {
+			st.queued = append(st.queued, bytes.Clone(datagram))
+		}
+		t.mu.Unlock()
+		return
+	case now.Before(st.refusedUntil):
+		t.mu.Unlock()
+		return
+	default:
+		delete(t.flows, key)
+	}
+	t.mu.Unlock()
+
+	p := t.pending[key]
+	if p == nil {
+		t.prune(now)
+		p = &pendingUDPFlow{started: now}
+	}
+	p.datagrams = append(p.datagrams, bytes.Clone(datagram))
+	name, done, err := p.sniffer.Add(datagram)
+	if err == nil && !done && len(p.datagrams) < quicSniffDatagrams {
+		t.pending[key] = p
+		return
+	}
+	delete(t.pending, key)
+
+	st = &udpFlowState{queued: p.datagrams}
+	t.mu.Lock()
+	t.flows[key] = st
+	t.mu.Unlock()
+	go t.run(key, st, name)
+}
+
+// run opens the flow of key, flushes the datagrams queued meanwhile and
+// relays replies until the flow idles out.
+func (t *udpFlowTable) run(key [2]netip.AddrPort, st *udpFlowState, name string) {
+	src, dst := key[0], key[1]
+	flow, err := t.open(src, dst, name)
+	t.mu.Lock()
+	if err != nil {
+		if stderrors.Is(err, router.ErrBlocked) || stderrors.Is(err, router.ErrUDPNotProxied) {
+			st.queued, st.refusedUntil = nil, time.Now().Add(transparentUDPIdleTimeout)
+		} else {
+			slog.Debug("open transparent udp flow", "error", err, "client", src, "dst", dst)
+			delete(t.flows, key)
+		}
+		t.mu.Unlock()
+		return
+	}
+	st.flow = flow
+	for _, datagram := range st.queued {
+		flow.write(datagram)
+	}
+	st.queued = nil
+	t.mu.Unlock()
+
+	flow.relayReplies()
+	t.mu.Lock()
+	if t.flows[key] == st {
+		delete(t.flows, key)
+	}
+	t.mu.Unlock()
+}
+
+// prune drops flows whose ClientHello never completed, such as clients
+// that went away mid-handshake, and refusals that expired. It runs at most
+// once a second.
+func (t *udpFlowTable) prune(now time.Time) {
+	if now.Sub(t.lastPrune) < time.Second {
+		return
+	}
+	t.lastPrune = now
+	for key, p := range t.pending {
+		if now.Sub(p.started) > transparentUDPIdleTimeout {
+			delete(t.pending, key)
+		}
+	}
+	t.mu.Lock()
+	for key, st := range t.flows {
+		if !st.refusedUntil.IsZero() && now.After(st.refusedUntil) {
+			delete(t.flows, key)
+		}
+	}
+	t.mu.Unlock()
+}
+
+func newUDPFlow(r *router.Router, src, dst netip.AddrPort, sniff sniffOptions, name string) (*udpFlow, error) {
+	host, dialHost := sniff.sniffTarget(r, dst.Addr().Unmap().String(), name)
+	upstream, err := r.DialUDP(host, dialHost, dst.Port())
+	if err != nil {
+		return nil, err
+	}
+	reply, err := listenTransparentUDPFrom(dst)
+	if err != nil {
+		_ = upstream.Close()
+		return nil, fmt.Errorf("bind udp reply address %s: %w", dst, err)
+	}
+	flow := &udpFlow{upstream: upstream, reply: reply, client: src}
+	flow.lastSeen.Store(time.Now().UnixNano())
+	return flow, nil
+}
+
+func (f *udpFlow) write(datagram []byte) {
+	if _, err := f.upstream.Write(datagram); err != nil {
+		slog.Debug("write transparent udp", "error", err, "client", f.client)
+	}
+}
+
+// relayReplies copies upstream datagrams back to the client until the flow
+// has been idle for transparentUDPIdleTimeout, then closes it.
+func (f *udpFlow) relayReplies() {
+	defer f.upstream.Close()
+	defer f.reply.Close()
+
+	buf := make([]byte, maxUDPDatagramLen)
+	for {
+		_ = f.upstream.SetReadDeadline(time.Unix(0, f.lastSeen.Load()).Add(transparentUDPIdleTimeout))
+		n, err := f.upstream.Read(buf)
+		if err != nil {
+			var ne net.Error
+			if stderrors.As(err, &ne) && ne.Timeout() &&
+				time.Since(time.Unix(0, f.lastSeen.Load())) < transparentUDPIdleTimeout {
+				continue // the client sent since the deadline was set
+			}
+			return
+		}
+		f.lastSeen.Store(time.Now().UnixNano())
+		if _, err := f.reply.WriteToUDPAddrPort(buf[:n], f.client); err != nil {
+			slog.Debug("write transparent udp reply", "error", err, "client", f.client)
+		}
+	}
+}
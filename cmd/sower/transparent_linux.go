@@ -0,0 +1,182 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// soOriginalDst is SO_ORIGINAL_DST (linux/netfilter_ipv4.h), which shares
+// its value with IP6T_SO_ORIGINAL_DST (linux/netfilter_ipv6/ip6_tables.h).
+const soOriginalDst = 80
+
+// listenTransparent listens for redirected TCP connections. TPROXY delivers
+// packets addressed to foreign IPs, which the socket accepts only with
+// IP_TRANSPARENT set.
+func listenTransparent(addr string, tproxy bool) (net.Listener, error) {
+	var lc net.ListenConfig
+	if tproxy {
+		lc.Control = transparentControl(false, false)
+	}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
+
+// listenTransparentUDP listens for TPROXY UDP and asks for each datagram's
+// original destination in its control messages.
+func listenTransparentUDP(addr string) (*net.UDPConn, error) {
+	lc := net.ListenConfig{Control: transparentControl(true, false)}
+	pc, err := lc.ListenPacket(context.Background(), "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return pc.(*net.UDPConn), nil
+}
+
+// listenTransparentUDPFrom binds a socket to dst, a foreign address, to send
+// replies from it. Flows to the same destination share the address.
+func listenTransparentUDPFrom(dst netip.AddrPort) (*net.UDPConn, error) {
+	network := "udp6"
+	if dst.Addr().Unmap().Is4() {
+		network = "udp4"
+		dst = netip.AddrPortFrom(dst.Addr().Unmap(), dst.Port())
+	}
+	lc := net.ListenConfig{Control: transparentControl(false, true)}
+	pc, err := lc.ListenPacket(context.Background(), network, dst.String())
+	if err != nil {
+		return nil, err
+	}
+	return pc.(*net.UDPConn), nil
+}
+
+func transparentControl(recvOrigDst, reuseAddr bool) func(network, address string, c syscall.RawConn) error {
+	return func(network, _ string, c syscall.RawConn) error {
+		v4 := !strings.HasSuffix(network, "6")
+		v6 := !strings.HasSuffix(network, "4")
+		var sockErr error
+		set := func(fd int, level, opt int) {
+			if sockErr == nil {
+				sockErr = unix.SetsockoptInt(fd, level, opt, 1)
+			}
+		}
+		err := c.Control(func(fd uintptr) {
+			if reuseAddr {
+				set(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR)
+			}
+			if v4 {
+				set(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT)
+				if recvOrigDst {
+					set(int(fd), unix.SOL_IP, unix.IP_RECVORIGDSTADDR)
+				}
+			}
+			if v6 {
+				set(int(fd), unix.SOL_IPV6, unix.IPV6_TRANSPARENT)
+				if recvOrigDst {
+					set(int(fd), unix.SOL_IPV6, unix.IPV6_RECVORIGDSTADDR)
+				}
+			}
+		})
+		if err != nil {
+			return err
+		}
+		if sockErr != nil {
+			return fmt.Errorf("set transparent socket option (needs CAP_NET_ADMIN): %w", sockErr)
+		}
+		return nil
+	}
+}
+
+// originalDst returns the destination a client connected to before it was
+// redirected. REDIRECT/DNAT rewrites it, and conntrack reports the original
+// through SO_ORIGINAL_DST; without NAT (TPROXY, or no redirect at all) it
+// reports ENOENT and the local address already is the destination. Any
+// other error is returned rather than routing to the listener itself.
+func originalDst(conn net.Conn) (netip.AddrPort, error) {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return netip.AddrPort{}, fmt.Errorf("unexpected connection type %T", conn)
+	}
+	local := tc.LocalAddr().(*net.TCPAddr).AddrPort()
+	raw, err := tc.SyscallConn()
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+
+	var (
+		dst     netip.AddrPort
+		sockErr error
+	)
+	err = raw.Control(func(fd uintptr) {
+		if local.Addr().Unmap().Is4() {
+			// The 16-byte sockaddr_in lands in IPv6Mreq.Multiaddr:
+			// family, big-endian port, address.
+			var mreq *unix.IPv6Mreq
+			mreq, sockErr = unix.GetsockoptIPv6Mreq(int(fd), unix.SOL_IP, soOriginalDst)
+			if sockErr == nil {
+				sa := mreq.Multiaddr
+				dst = netip.AddrPortFrom(netip.AddrFrom4([4]byte(sa[4:8])), binary.BigEndian.Uint16(sa[2:4]))
+			}
+			return
+		}
+		var info *unix.IPv6MTUInfo
+		info, sockErr = unix.GetsockoptIPv6MTUInfo(int(fd), unix.SOL_IPV6, soOriginalDst)
+		if sockErr == nil {
+			dst = netip.AddrPortFrom(netip.AddrFrom16(info.Addr.Addr), ntohs(info.Addr.Port))
+		}
+	})
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	switch {
+	case errors.Is(sockErr, unix.ENOENT):
+		// No conntrack NAT entry: TPROXY or no redirect.
+		return local, nil
+	case sockErr != nil:
+		return netip.AddrPort{}, fmt.Errorf("get SO_ORIGINAL_DST: %w", sockErr)
+	}
+	return dst, nil
+}
+
+// ntohs converts a port that the kernel stored in network byte order into a
+// native-endian struct field.
+func ntohs(port uint16) uint16 {
+	var b [2]byte
+	binary.NativeEndian.PutUint16(b[:], port)
+	return binary.BigEndian.Uint16(b[:])
+}
+
+func readTransparentUDP(pc *net.UDPConn, buf, oob []byte) (n int, src, dst netip.AddrPort, err error) {
+	n, oobn, _, src, err := pc.ReadMsgUDPAddrPort(buf, oob)
+	if err != nil {
+		return 0, src, dst, err
+	}
+	dst, err = parseOrigDstAddr(oob[:oobn])
+	return n, src, dst, err
+}
+
+// parseOrigDstAddr extracts IP_ORIGDSTADDR or IPV6_ORIGDSTADDR, a raw
+// sockaddr, from a datagram's control messages.
+func parseOrigDstAddr(oob []byte) (netip.AddrPort, error) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("parse control message: %w", err)
+	}
+	for _, msg := range msgs {
+		data := msg.Data
+		switch {
+		case msg.Header.Level == unix.SOL_IP && msg.Header.Type == unix.IP_ORIGDSTADDR && len(data) >= unix.SizeofSockaddrInet4:
+			return netip.AddrPortFrom(netip.AddrFrom4([4]byte(data[4:8])), binary.BigEndian.Uint16(data[2:4])), nil
+		case msg.Header.Level == unix.SOL_IPV6 && msg.Header.Type == unix.IPV6_ORIGDSTADDR && len(data) >= unix.SizeofSockaddrInet6:
+			return netip.AddrPortFrom(netip.AddrFrom16([16]byte(data[8:24])), binary.BigEndian.Uint16(data[2:4])), nil
+		}
+	}
+	return netip.AddrPort{}, fmt.Errorf("original destination missing from control message")
+}
@@ -0,0 +1,82 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"testing"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestParseOrigDstAddr(t *testing.T) {
+	t.Parallel()
+
+	cmsg := func(level, typ int32, sa []byte) []byte {
+		b := make([]byte, unix.CmsgSpace(len(sa)))
+		h := (*unix.Cmsghdr)(unsafe.Pointer(&b[0]))
+		h.Level, h.Type = level, typ
+		h.SetLen(unix.CmsgLen(len(sa)))
+		copy(b[unix.CmsgLen(0):], sa)
+		return b
+	}
+
+	sa4 := make([]byte, unix.SizeofSockaddrInet4)
+	binary.NativeEndian.PutUint16(sa4[0:2], unix.AF_INET)
+	binary.BigEndian.PutUint16(sa4[2:4], 443)
+	copy(sa4[4:8], []byte{203, 0, 113, 10})
+	got, err := parseOrigDstAddr(cmsg(unix.SOL_IP, unix.IP_ORIGDSTADDR, sa4))
+	if err != nil || got != netip.MustParseAddrPort("203.0.113.10:443") {
+		t.Fatalf("ipv4 original destination = %v, %v", got, err)
+	}
+
+	sa6 := make([]byte, unix.SizeofSockaddrInet6)
+	binary.NativeEndian.PutUint16(sa6[0:2], unix.AF_INET6)
+	binary.BigEndian.PutUint16(sa6[2:4], 53)
+	ip6 := netip.MustParseAddr("2001:db8::53").As16()
+	copy(sa6[8:24], ip6[:])
+	got, err = parseOrigDstAddr(cmsg(unix.SOL_IPV6, unix.IPV6_ORIGDSTADDR, sa6))
+	if err != nil || got != netip.MustParseAddrPort("[2001:db8::53]:53") {
+		t.Fatalf("ipv6 original destination = %v, %v", got, err)
+	}
+
+	if _, err := parseOrigDstAddr(nil); err == nil {
+		t.Fatal("expected error without an original destination")
+	}
+}
+
+func TestOriginalDstWithoutRedirectIsLocalAddr(t *testing.T) {
+	t.Parallel()
+
+	ln, err := listenTransparent("127.0.0.1:0", false)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+
+	go func() {
+		if c, err := net.Dial("tcp", ln.Addr().String()); err == nil {
+			defer c.Close()
+			_, _ = c.Read(make([]byte, 1))
+		}
+	}()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+	defer conn.Close()
+
+	dst, err := originalDst(conn)
+	if err != nil {
+		t.Fatalf("original destination: %v", err)
+	}
+	if dst.String() != ln.Addr().String() {
+		t.Fatalf("original destination = %s, want listener %s", dst, ln.Addr())
+	}
+	if !isListenerAddr(dst, ln.Addr()) {
+		t.Fatal("unredirected connection not recognized as the listener")
+	}
+}
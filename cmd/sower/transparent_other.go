@@ -0,0 +1,28 @@
+//go:build !linux
+
+package main
+
+import (
+	"net"
+	"net/netip"
+)
+
+func listenTransparent(string, bool) (net.Listener, error) {
+	return nil, errTransparentUnsupported
+}
+
+func listenTransparentUDP(string) (*net.UDPConn, error) {
+	return nil, errTransparentUnsupported
+}
+
+func listenTransparentUDPFrom(netip.AddrPort) (*net.UDPConn, error) {
+	return nil, errTransparentUnsupported
+}
+
+func originalDst(net.Conn) (netip.AddrPort, error) {
+	return netip.AddrPort{}, errTransparentUnsupported
+}
+
+func readTransparentUDP(*net.UDPConn, []byte, []byte) (int, netip.AddrPort, netip.AddrPort, error) {
+	return 0, netip.AddrPort{}, netip.AddrPort{}, errTransparentUnsupported
+}
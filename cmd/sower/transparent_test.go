@@ -0,0 +1,242 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sower-proxy/sower/router"
+)
+
+// runTransparent serves one redirected connection for dst and returns the
+// client end and the proxy target the router dialed.
+func runTransparent(t *testing.T, dst string, r *router.Router) (client net.Conn, upstream net.Conn, target <-chan string, wg *sync.WaitGroup) {
+	t.Helper()
+
+	downstreamServer, downstreamClient := net.Pipe()
+	upstreamClient, upstreamServer := net.Pipe()
+	targetCh := make(chan string, 1)
+	r.ProxyDial = func(network, host string, port uint16) (net.Conn, error) {
+		targetCh <- net.JoinHostPort(host, strconv.Itoa(int(port)))
+		return upstreamClient, nil
+	}
+
+	wg = &sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		handleTransparentConn(downstreamServer, netip.MustParseAddrPort(dst), r, newTestStats(t), sniffOptions{enable: true, dialDomain: true})
+	}()
+	t.Cleanup(func() {
+		_ = downstreamClient.Close()
+		_ = upstreamServer.Close()
+	})
+	return downstreamClient, upstreamServer, targetCh, wg
+}
+
+func TestHandleTransparentConnRoutesOnTLSServerName(t *testing.T) {
+	t.Parallel()
+
+	r := newTestRouter()
+	r.ProxyRule = router.NewRuleSet("**.example.org")
+	client, upstream, target, wg := runTransparent(t, "203.0.113.10:8443", r)
+
+	hello := generateTLSClientHelloRecord(t, "www.example.org")
+	go func() { _, _ = client.Write(hello) }()
+
+	gotHello := make([]byte, len(hello))
+	_ = upstream.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(upstream, gotHello); err != nil {
+		t.Fatalf("read upstream client hello: %v", err)
+	}
+	if string(gotHello) != string(hello) {
+		t.Fatal("client hello was not relayed intact")
+	}
+	if got := <-target; got != "www.example.org:8443" {
+		t.Fatalf("proxy target = %s, want www.example.org:8443", got)
+	}
+
+	_ = client.Close()
+	_ = upstream.Close()
+	waitForHandler(t, wg)
+}
+
+func TestHandleTransparentConnRoutesOnHTTPHost(t *testing.T) {
+	t.Parallel()
+
+	r := newTestRouter()
+	r.ProxyRule = router.NewRuleSet("**.example.org")
+	client, upstream, target, wg := runTransparent(t, "203.0.113.10:80", r)
+
+	req := "GET / HTTP/1.1\r\nHost: www.example.org\r\n\r\n"
+	go func() { _, _ = client.Write([]byte(req)) }()
+
+	got := make([]byte, len(req))
+	_ = upstream.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(upstream, got); err != nil {
+		t.Fatalf("read upstream request: %v", err)
+	}
+	if string(got) != req {
+		t.Fatalf("upstream request = %q, want %q", got, req)
+	}
+	if got := <-target; got != "www.example.org:80" {
+		t.Fatalf("proxy target = %s, want www.example.org:80", got)
+	}
+
+	_ = client.Close()
+	_ = upstream.Close()
+	waitForHandler(t, wg)
+}
+
+func TestHandleTransparentConnRoutesSilentClientByIP(t *testing.T) {
+	t.Parallel()
+
+	// A server-first protocol: the client waits for the greeting, so nothing
+	// can be sniffed and the destination IP is routed.
+	client, upstream, target, wg := runTransparent(t, "203.0.113.10:25", newTestRouter())
+
+	select {
+	case got := <-target:
+		if got != "203.0.113.10:25" {
+			t.Fatalf("proxy target = %s, want 203.0.113.10:25", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("silent client was not routed after the sniff timeout")
+	}
+
+	greeting := "220 mail.example.org ESMTP\r\n"
+	go func() { _, _ = upstream.Write([]byte(greeting)) }()
+	got := make([]byte, len(greeting))
+	_ = client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(client, got); err != nil {
+		t.Fatalf("read greeting: %v", err)
+	}
+
+	_ = client.Close()
+	_ = upstream.Close()
+	waitForHandler(t, wg)
+}
+
+func TestIsListenerAddr(t *testing.T) {
+	t.Parallel()
+
+	ln := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 12345}
+	if !isListenerAddr(netip.MustParseAddrPort("10.0.0.1:12345"), ln) {
+		t.Fatal("listener address not detected")
+	}
+	if isListenerAddr(netip.MustParseAddrPort("203.0.113.10:12345"), ln) {
+		t.Fatal("foreign destination on the listener port treated as the listener")
+	}
+	if isListenerAddr(netip.MustParseAddrPort("10.0.0.1:443"), ln) {
+		t.Fatal("other port treated as the listener")
+	}
+	if !isListenerAddr(netip.MustParseAddrPort("127.0.0.1:12345"), &net.TCPAddr{IP: net.IPv4zero, Port: 12345}) {
+		t.Fatal("loopback destination not detected for a wildcard listener")
+	}
+}
+
+// newTestUDPFlow returns a flow for client whose upstream is a loopback
+// socket, and that socket.
+func newTestUDPFlow(t *testing.T, client netip.AddrPort) (*udpFlow, *net.UDPConn) {
+	t.Helper()
+
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen upstream: %v", err)
+	}
+	upstream, err := net.DialUDP("udp", nil, server.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("dial upstream: %v", err)
+	}
+	reply, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen reply: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = server.Close()
+		_ = upstream.Close()
+	})
+	flow := &udpFlow{upstream: upstream, reply: reply, client: client}
+	flow.lastSeen.Store(time.Now().UnixNano())
+	return flow, server
+}
+
+func readUDP(t *testing.T, pc *net.UDPConn) string {
+	t.Helper()
+
+	buf := make([]byte, 64)
+	_ = pc.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := pc.Read(buf)
+	if err != nil {
+		t.Fatalf("read upstream datagram: %v", err)
+	}
+	return string(buf[:n])
+}
+
+func TestUDPFlowTableRemembersRefusedFlows(t *testing.T) {
+	t.Parallel()
+
+	opened := make(chan struct{}, 16)
+	flows := newUDPFlowTable(func(src, dst netip.AddrPort, name string) (*udpFlow, error) {
+		opened <- struct{}{}
+		return nil, router.ErrBlocked
+	})
+	src := netip.MustParseAddrPort("192.168.1.10:50000")
+	dst := netip.MustParseAddrPort("203.0.113.1:443")
+
+	flows.dispatch(src, dst, []byte("first"))
+	<-opened
+	for range 10 {
+		flows.dispatch(src, dst, []byte("again"))
+	}
+	// Another client to the same destination is routed on its own.
+	flows.dispatch(netip.MustParseAddrPort("192.168.1.11:50000"), dst, []byte("other"))
+	<-opened
+
+	select {
+	case <-opened:
+		t.Fatal("refused flow was routed again")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestUDPFlowTableOpensFlowsConcurrently(t *testing.T) {
+	t.Parallel()
+
+	slowSrc := netip.MustParseAddrPort("192.168.1.10:50000")
+	fastSrc := netip.MustParseAddrPort("192.168.1.11:50000")
+	dst := netip.MustParseAddrPort("203.0.113.1:443")
+	slowFlow, slowUpstream := newTestUDPFlow(t, slowSrc)
+	fastFlow, fastUpstream := newTestUDPFlow(t, fastSrc)
+	release := make(chan struct{})
+	flows := newUDPFlowTable(func(src, _ netip.AddrPort, _ string) (*udpFlow, error) {
+		if src == slowSrc {
+			<-release
+			return slowFlow, nil
+		}
+		return fastFlow, nil
+	})
+
+	flows.dispatch(slowSrc, dst, []byte("slow-1"))
+	flows.dispatch(slowSrc, dst, []byte("slow-2"))
+	flows.dispatch(fastSrc, dst, []byte("fast"))
+	if got := readUDP(t, fastUpstream); got != "fast" {
+		t.Fatalf("fast flow relayed %q while another flow was opening", got)
+	}
+
+	// The slow flow's datagrams were queued and go out in order.
+	close(release)
+	for _, want := range []string{"slow-1", "slow-2"} {
+		if got := readUDP(t, slowUpstream); got != want {
+			t.Fatalf("slow flow relayed %q, want %q", got, want)
+		}
+	}
+	flows.dispatch(slowSrc, dst, []byte("slow-3"))
+	if got := readUDP(t, slowUpstream); got != "slow-3" {
+		t.Fatalf("opened flow relayed %q, want slow-3", got)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/sower-proxy/sower/config"
+	"github.com/sower-proxy/sower/internal/admin"
+)
+
+const (
+	// usageRollInterval is the finest usage rollup resolution.
+	usageRollInterval = time.Minute
+	// usageSaveInterval bounds how much history a crash can lose.
+	usageSaveInterval = 5 * time.Minute
+)
+
+// newUsageStore builds the traffic history rollups behind the console's
+// ranged reports, nil when the console is disabled.
+func newUsageStore(cfg config.SowerConfig) *admin.UsageStore {
+	if cfg.Admin.Disable {
+		return nil
+	}
+	h := cfg.Admin.History
+	return admin.NewUsageStore(admin.UsageOptions{
+		File:        h.File,
+		KeepMinutes: h.KeepMinutes,
+		KeepHours:   h.KeepHours,
+		KeepDays:    h.KeepDays,
+	})
+}
+
+// runUsageRoller closes a usage interval every minute and saves the
+// rollups periodically until ctx is done. It returns immediately without
+// a store.
+func runUsageRoller(ctx context.Context, stats *admin.Stats, u *admin.UsageStore) {
+	if u == nil {
+		return
+	}
+	roll := time.NewTicker(usageRollInterval)
+	defer roll.Stop()
+	save := time.NewTicker(usageSaveInterval)
+	defer save.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-roll.C:
+			stats.RollUsage()
+		case <-save.C:
+			saveUsage(u)
+		}
+	}
+}
+
+// flushUsage closes the open usage interval and saves the rollups, for
+// shutdown and restart.
+func flushUsage(stats *admin.Stats, u *admin.UsageStore) {
+	if u == nil {
+		return
+	}
+	stats.RollUsage()
+	saveUsage(u)
+}
+
+// saveUsage saves the rollups, logging instead of failing: a lost save
+// only drops the history recorded since the last one.
+func saveUsage(u *admin.UsageStore) {
+	if err := u.Save(); err != nil {
+		slog.Warn("save traffic history", "error", err)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log/slog"
 	"net"
+	"net/netip"
 	"strings"
 
 	"github.com/sower-proxy/deferlog/v2"
@@ -28,6 +29,71 @@ type RemoteConfig struct {
 	TLS      RemoteTLSConfig `flag:"tls"`
 }
 
+// ProxyListener is one SOCKS5 or HTTP proxy listener. Mode routes every
+// connection the listener accepts: "smart" applies the rules and detection,
+// "proxy" and "direct" force one path, and "remote" proxies through Remote
+// instead of the main upstream. Block rules apply in every mode. Allow
+// lists the client CIDRs accepted; empty accepts any client.
+type ProxyListener struct {
+	Name            string
+	Disable         bool
+	Addr            string
+	Mode            string
+	Remote          *RemoteConfig
+	Username        string
+	Password        string
+	Allow           []string
+	Sniff           bool
+	SniffDialDomain bool
+}
+
+// ClientACL is the client access control list of a listener group. Deny
+// wins over Allow, and an empty Allow admits every client not denied.
+// Entries are CIDRs or IPs.
+type ClientACL struct {
+	Allow []string `usage:"client CIDRs or IPs admitted, empty admits any"`
+	Deny  []string `usage:"client CIDRs or IPs refused, even when allowed"`
+}
+
+// DomainLimit caps the bandwidth of connections to domains matching
+// Pattern, a rule in the router rule syntax (e.g. **.example.com). All
+// matching connections share the cap.
+type DomainLimit struct {
+	Pattern string
+	RateKB  int
+}
+
+// ClientQuota is the data budget of the clients in Client, a CIDR or IP,
+// counted in both directions and reset each Period (daily or monthly).
+// Once used up the clients are cut off (Action block) or no longer proxied
+// (Action direct). A CIDR shares one budget among its clients.
+type ClientQuota struct {
+	Client  string
+	LimitMB int
+	Period  string
+	Action  string
+}
+
+// Client quota periods and actions.
+const (
+	QuotaDaily   = "daily"
+	QuotaMonthly = "monthly"
+	QuotaBlock   = "block"
+	QuotaDirect  = "direct"
+)
+
+// Proxy listener modes.
+const (
+	ListenerModeSmart  = "smart"
+	ListenerModeProxy  = "proxy"
+	ListenerModeDirect = "direct"
+	ListenerModeRemote = "remote"
+)
+
+// maxDNSQueryLogSize caps the in-memory DNS query log; at a few hundred bytes
+// per entry it stays within tens of MiB.
+const maxDNSQueryLogSize = 100_000
+
 // SowerConfig represents the configuration for sower client
 type SowerConfig struct {
 	LogLevel slog.Level `default:"info" usage:"log level: debug, info, warn, error"`
@@ -35,6 +101,10 @@ type SowerConfig struct {
 	// IgnoreAdminState skips the admin state file at startup. It is the
 	// escape hatch when a persisted override breaks the service.
 	IgnoreAdminState bool `flag:"ignore-admin-state" usage:"ignore the admin state file at startup"`
+	// AdminStateRevision boots from an earlier retained admin state
+	// revision, made current as a new revision, instead of discarding the
+	// whole state file.
+	AdminStateRevision int `flag:"admin-state-revision" default:"-1" usage:"boot from this retained admin state revision; -1 uses the latest"`
 
 	Remote RemoteConfig
 
@@ -50,11 +120,117 @@ type SowerConfig struct {
 		// dnsmasq) so LAN leases and tailnet names resolve; empty disables
 		// reverse lookups and the console shows raw IPs.
 		Reverse string `usage:"reverse dns server for client hostname lookup"`
+		// BlockMode selects the answer for names matched by a block rule.
+		// "sower" answers the serve IP so plain-HTTP visits get a block page
+		// naming the rule; HTTPS visits to such names are refused.
+		BlockMode string `default:"nxdomain" usage:"answer for blocked names: nxdomain, refused, null (0.0.0.0 and ::), sower (serve ip with a block page)"`
+		// Poison detects injected answers for directly resolved names and
+		// requeries them over TCP through the proxy to Trusted. Answers are
+		// poisoned when they contain a BogusIPs entry, or when they arrive
+		// from a public upstream faster than MinRTTMs and disagree with
+		// Trusted. Detected domains are reported as proxy-rule candidates.
+		Poison struct {
+			Trusted  string   `usage:"resolver queried through the proxy to verify and requery poisoned answers, eg: 8.8.8.8; empty disables detection"`
+			BogusIPs []string `toml:"bogus_ips" usage:"IPs or CIDRs that mark a direct DNS answer as poisoned"`
+			MinRTTMs int      `toml:"min_rtt_ms" default:"0" usage:"verify public upstream answers faster than this many milliseconds; 0 disables"`
+		}
+		// QueryLog keeps the most recent answered queries for the admin
+		// console, with the decision, upstream, rcode, and latency of each.
+		// File additionally appends every entry as one JSON line, rotated by
+		// size.
+		QueryLog struct {
+			Size       int    `default:"1000" usage:"number of recent DNS queries kept in memory"`
+			File       string `usage:"append DNS queries as JSON lines to this file, empty disables"`
+			MaxSizeMB  int    `default:"16" usage:"rotate the DNS query log file at this size in MiB"`
+			MaxBackups int    `default:"3" usage:"number of rotated DNS query log files to keep"`
+		}
+		// FakeIP answers proxy-routed A/AAAA queries with a unique address
+		// from Range instead of the serve IP. Connections to that address,
+		// on any port, through SOCKS5 or a transparent listener are mapped
+		// back to the domain and proxied. Range must be routed to sower.
+		FakeIP struct {
+			Range string `usage:"fake ip range for proxy-routed domains, eg: 198.18.0.0/15; empty disables"`
+			File  string `default:"/etc/sower/fakeip.json" usage:"persist fake ip mappings to this file, empty disables persistence"`
+		}
 	}
+	// DHCP runs an authoritative DHCPv4 server on Iface for subnets whose
+	// router cannot point its own DHCP at sower. Leases carry dns.serve as
+	// the DNS server and Gateway as the default route; any other DHCP
+	// server on the subnet must be turned off.
+	DHCP struct {
+		Enable     bool   `default:"false" usage:"run the built-in DHCPv4 server"`
+		Iface      string `usage:"interface to serve DHCP on, eg: eth0"`
+		RangeStart string `usage:"first address handed out, eg: 192.168.1.100"`
+		RangeEnd   string `usage:"last address handed out, eg: 192.168.1.199"`
+		Gateway    string `usage:"default gateway handed to clients, typically the ISP router"`
+		Netmask    string `usage:"subnet mask handed to clients; empty uses the mask of dns.serve on iface"`
+		LeaseHours int    `default:"12" usage:"lease duration in hours"`
+		LeaseFile  string `default:"/etc/sower/dhcp-leases.json" usage:"persist DHCP leases to this file, empty disables persistence"`
+	} `flag:"dhcp"`
+	// Transparent accepts TCP connections that iptables/nftables on Linux
+	// redirect to Addr, making sower a gateway for every port rather than
+	// only 80/443 via DNS. Mode "redirect" recovers the destination with
+	// SO_ORIGINAL_DST (REDIRECT/DNAT); "tproxy" binds with IP_TRANSPARENT
+	// and takes it from the socket, which also allows relaying UDP. Each
+	// connection is routed on its sniffed HTTP Host or TLS SNI, else the
+	// destination IP.
+	Transparent struct {
+		Enable bool   `default:"false" usage:"run the linux transparent proxy listener"`
+		Addr   string `default:"0.0.0.0:12345" usage:"transparent proxy listen address, the iptables/nftables redirect target"`
+		Mode   string `default:"redirect" usage:"how connections are redirected: redirect (REDIRECT/DNAT) or tproxy (TPROXY)"`
+		UDP    bool   `toml:"udp" default:"false" usage:"also relay UDP in tproxy mode; proxy-routed flows are dropped so clients fall back to TCP"`
+		// SniffDialDomain dials the sniffed name rather than the original
+		// destination IP, so the upstream resolves it. LAN clients of a
+		// gateway often resolve through a poisoned resolver, hence the
+		// default.
+		SniffDialDomain bool `default:"true" usage:"dial the sniffed domain instead of the original destination IP"`
+	} `flag:"transparent"`
+	// Socks5 also serves HTTP proxy requests on the same port. Sniff routes
+	// tunnels whose target is an IP literal, as sent by clients that resolve
+	// locally, on the TLS SNI or HTTP Host of their first bytes. Mode,
+	// Username, Password and Allow are as for ProxyListener; a file with
+	// [[socks_5]] entries instead disables this listener and fills
+	// Socks5Listeners.
 	Socks5 struct {
-		Disable bool   `default:"false" usage:"disable sock5 proxy"`
-		Addr    string `default:"127.0.0.1:1080" usage:"socks5 listen address"`
+		Disable         bool     `default:"false" usage:"disable sock5 proxy"`
+		Addr            string   `default:"127.0.0.1:1080" usage:"socks5 listen address"`
+		Mode            string   `default:"smart" usage:"routing mode: smart, proxy (force proxy) or direct (force direct)"`
+		Username        string   `usage:"require this username from socks5 and http proxy clients"`
+		Password        string   `usage:"require this password from socks5 and http proxy clients"`
+		Allow           []string `usage:"client CIDRs allowed to connect, empty allows any"`
+		Sniff           bool     `default:"false" usage:"route IP-literal targets on the sniffed TLS SNI or HTTP Host"`
+		SniffDialDomain bool     `default:"false" usage:"dial the sniffed domain instead of the requested IP"`
 	} `flag:"socks5"`
+	// Socks5Listeners are additional SOCKS5 (and HTTP) proxy listeners,
+	// written as [[socks_5]] entries.
+	Socks5Listeners []ProxyListener `toml:"socks_5_listeners" flag:"-"`
+	// HTTPProxy are HTTP-only proxy listeners, written as [[http_proxy]]
+	// entries.
+	HTTPProxy []ProxyListener `toml:"http_proxy" flag:"-"`
+
+	// ACL restricts the clients of each listener group: the DNS-mode dns,
+	// http (80) and https (443) listeners, every SOCKS5 and HTTP proxy
+	// listener (on top of its own Allow), and the transparent listener.
+	// The lists can be edited from the admin console without a restart.
+	ACL struct {
+		DNS         ClientACL
+		HTTP        ClientACL
+		HTTPS       ClientACL
+		Socks5      ClientACL
+		Transparent ClientACL
+	} `flag:"acl"`
+
+	// Limits shapes relayed bandwidth with token buckets, per direction in
+	// KiB/s (0 disables a cap), and meters client data quotas. Domain caps
+	// and quotas are written as [[limits.domains]] and [[limits.quotas]]
+	// entries; the first matching entry applies.
+	Limits struct {
+		RateKB       int           `toml:"rate_kb" default:"0" usage:"global bandwidth cap per direction in KiB/s, 0 disables"`
+		ClientRateKB int           `toml:"client_rate_kb" default:"0" usage:"bandwidth cap per client IP (IPv6: per /64) and direction in KiB/s, 0 disables"`
+		Domains      []DomainLimit `flag:"-"`
+		Quotas       []ClientQuota `flag:"-"`
+		QuotaFile    string        `default:"/etc/sower/quota.json" usage:"persist client quota usage to this file, empty disables persistence"`
+	} `flag:"limits"`
 
 	Admin struct {
 		Disable bool   `default:"true" usage:"disable admin web server"`
@@ -68,6 +244,25 @@ type SowerConfig struct {
 		DisableSessionPersistence bool              `default:"false" usage:"disable admin session persistence"`
 		CookieSecure              bool              `default:"false" usage:"set Secure on admin session cookies behind a TLS-terminating proxy"`
 		StateFile                 string            `default:"/etc/sower/admin-state.json" usage:"persist admin rule and config changes to this file, empty disables persistence"`
+		StateRevisions            int               `default:"20" usage:"admin state revisions kept for diffs and rollbacks"`
+
+		// History keeps minute, hour and day traffic rollups for ranged
+		// history and usage reports; a zero keep drops that resolution.
+		History struct {
+			File        string `default:"/etc/sower/history.json" usage:"persist traffic history rollups to this file, empty keeps them in memory"`
+			KeepMinutes int    `default:"1440" usage:"minute rollups kept"`
+			KeepHours   int    `default:"720" usage:"hour rollups kept"`
+			KeepDays    int    `default:"365" usage:"day rollups kept"`
+		}
+		// Audit records admin mutations and login attempts with the caller
+		// and a before/after diff. File appends every entry as one JSON
+		// line, rotated by size so the trail stays bounded.
+		Audit struct {
+			Size       int    `default:"1000" usage:"number of recent audit entries kept in memory"`
+			File       string `default:"/etc/sower/audit.jsonl" usage:"append admin audit entries to this file, empty keeps them in memory"`
+			MaxSizeMB  int    `default:"4" usage:"rotate the admin audit file at this size in MiB"`
+			MaxBackups int    `default:"2" usage:"number of rotated admin audit files to keep"`
+		}
 	} `flag:"admin"`
 
 	Router struct {
@@ -96,6 +291,11 @@ type SowerConfig struct {
 			FilePrefix string   `default:"" usage:"parsed as '<prefix>line_text'"`
 			Rules      []string `usage:"CIDR list rules"`
 		}
+		// AccessCache keeps the verdicts of the access probe, which sends
+		// unmatched 80/443 sites direct when they answer, across restarts.
+		AccessCache struct {
+			File string `default:"/etc/sower/access-cache.json" usage:"persist access probe verdicts to this file, empty disables persistence"`
+		}
 	}
 }
 
@@ -176,14 +376,95 @@ func (c *SowerConfig) Validate() error {
 		return err
 	}
 
+	// Matches router.ParseDNSBlockMode, which the value is handed to.
+	switch strings.ToLower(strings.TrimSpace(c.DNS.BlockMode)) {
+	case "", "nxdomain", "refused", "null", "sower":
+	default:
+		return fmt.Errorf("unsupported dns block mode %q", c.DNS.BlockMode)
+	}
+	if err := validatePoison(c.DNS.Poison.Trusted, c.DNS.Poison.BogusIPs, c.DNS.Poison.MinRTTMs); err != nil {
+		return err
+	}
+	if c.DNS.QueryLog.Size < 0 || c.DNS.QueryLog.Size > maxDNSQueryLogSize {
+		return fmt.Errorf("dns query_log size must be between 0 and %d", maxDNSQueryLogSize)
+	}
+	if c.DNS.QueryLog.MaxSizeMB < 0 || c.DNS.QueryLog.MaxBackups < 0 {
+		return fmt.Errorf("dns query_log rotation settings must not be negative")
+	}
+
+	if c.DNS.FakeIP.Range != "" {
+		_, ipnet, err := net.ParseCIDR(c.DNS.FakeIP.Range)
+		if err != nil {
+			return fmt.Errorf("invalid dns fake ip range %q: %w", c.DNS.FakeIP.Range, err)
+		}
+		for _, serve := range []string{c.DNS.Serve, c.DNS.Serve6} {
+			if ip := net.ParseIP(serve); ip != nil && ipnet.Contains(ip) {
+				return fmt.Errorf("dns fake ip range %q contains serve ip %s", c.DNS.FakeIP.Range, serve)
+			}
+		}
+	}
+
 	if !c.DNS.Disable && c.DNS.Serve == "" {
 		return fmt.Errorf("dns serve ip and serve interface not set")
 	}
+	if c.DHCP.Enable {
+		if err := c.validateDHCP(); err != nil {
+			return err
+		}
+	}
+	if c.Transparent.Enable {
+		if _, _, err := net.SplitHostPort(c.Transparent.Addr); err != nil {
+			return fmt.Errorf("invalid transparent listen address %q: %w", c.Transparent.Addr, err)
+		}
+		switch c.Transparent.Mode {
+		case "redirect":
+			if c.Transparent.UDP {
+				// REDIRECT rewrites UDP destinations without a way to read
+				// them back per datagram.
+				return fmt.Errorf("transparent udp requires mode = \"tproxy\"")
+			}
+		case "tproxy":
+		default:
+			return fmt.Errorf("unsupported transparent mode %q", c.Transparent.Mode)
+		}
+	}
 	if !c.Socks5.Disable {
 		if _, _, err := net.SplitHostPort(c.Socks5.Addr); err != nil {
 			return fmt.Errorf("invalid socks5 listen address %q: %w", c.Socks5.Addr, err)
 		}
 	}
+	for _, acl := range []struct {
+		name string
+		ClientACL
+	}{
+		{"dns", c.ACL.DNS}, {"http", c.ACL.HTTP}, {"https", c.ACL.HTTPS},
+		{"socks5", c.ACL.Socks5}, {"transparent", c.ACL.Transparent},
+	} {
+		if _, err := ParseClientPrefixes(acl.Allow); err != nil {
+			return fmt.Errorf("acl %s allow: %w", acl.name, err)
+		}
+		if _, err := ParseClientPrefixes(acl.Deny); err != nil {
+			return fmt.Errorf("acl %s deny: %w", acl.name, err)
+		}
+	}
+	if err := c.validateLimits(); err != nil {
+		return err
+	}
+	socks5Listeners, httpListeners := c.ProxyListeners()
+	names := make(map[string]bool)
+	for _, l := range append(socks5Listeners, httpListeners...) {
+		if names[l.Name] {
+			return fmt.Errorf("duplicate proxy listener name %q", l.Name)
+		}
+		names[l.Name] = true
+		if err := l.validate(); err != nil {
+			return fmt.Errorf("proxy listener %q: %w", l.Name, err)
+		}
+		if l.Mode == ListenerModeRemote {
+			host, _ := validateRemoteAddr(l.Remote.Type, l.Remote.Addr)
+			c.Router.Direct.Rules = append(c.Router.Direct.Rules, host)
+		}
+	}
 
 	if !c.Admin.Disable && c.Admin.Addr != "" {
 		host, port, err := net.SplitHostPort(c.Admin.Addr)
@@ -200,6 +481,18 @@ func (c *SowerConfig) Validate() error {
 			}
 		}
 	}
+	if h := c.Admin.History; h.KeepMinutes < 0 || h.KeepHours < 0 || h.KeepDays < 0 {
+		return fmt.Errorf("admin history retention must not be negative")
+	}
+	if a := c.Admin.Audit; a.Size < 0 || a.MaxSizeMB < 0 || a.MaxBackups < 0 {
+		return fmt.Errorf("admin audit settings must not be negative")
+	}
+	if c.Admin.StateRevisions < 0 {
+		return fmt.Errorf("admin state_revisions must not be negative")
+	}
+	if c.AdminStateRevision >= 0 && c.IgnoreAdminState {
+		return fmt.Errorf("admin-state-revision cannot be combined with ignore-admin-state")
+	}
 
 	c.Router.Direct.Rules = append(c.Router.Direct.Rules,
 		remoteHost, "**.in-addr.arpa", "**.ip6.arpa")
@@ -207,6 +500,185 @@ func (c *SowerConfig) Validate() error {
 	return nil
 }
 
+// ClientACL returns the ACL of the named listener group (dns, http, https,
+// socks5 or transparent), or nil for an unknown group.
+func (c *SowerConfig) ClientACL(group string) *ClientACL {
+	switch group {
+	case "dns":
+		return &c.ACL.DNS
+	case "http":
+		return &c.ACL.HTTP
+	case "https":
+		return &c.ACL.HTTPS
+	case "socks5":
+		return &c.ACL.Socks5
+	case "transparent":
+		return &c.ACL.Transparent
+	}
+	return nil
+}
+
+// ProxyListeners returns the enabled SOCKS5 listeners, the [socks_5] table
+// first, and the enabled HTTP proxy listeners. Unnamed entries are named
+// after their address, an empty mode is smart and an empty remote type is
+// sower.
+func (c SowerConfig) ProxyListeners() (socks5, http []ProxyListener) {
+	if !c.Socks5.Disable {
+		socks5 = append(socks5, ProxyListener{
+			Name:            "socks5",
+			Addr:            c.Socks5.Addr,
+			Mode:            c.Socks5.Mode,
+			Username:        c.Socks5.Username,
+			Password:        c.Socks5.Password,
+			Allow:           c.Socks5.Allow,
+			Sniff:           c.Socks5.Sniff,
+			SniffDialDomain: c.Socks5.SniffDialDomain,
+		})
+	}
+	enabled := func(dst, entries []ProxyListener) []ProxyListener {
+		for _, l := range entries {
+			if l.Disable {
+				continue
+			}
+			if l.Name == "" {
+				l.Name = l.Addr
+			}
+			if l.Mode == "" {
+				l.Mode = ListenerModeSmart
+			}
+			if l.Remote != nil && l.Remote.Type == "" {
+				// Copy: the remote table is shared with the config.
+				remote := *l.Remote
+				remote.Type = "sower"
+				l.Remote = &remote
+			}
+			dst = append(dst, l)
+		}
+		return dst
+	}
+	return enabled(socks5, c.Socks5Listeners), enabled(http, c.HTTPProxy)
+}
+
+func (l ProxyListener) validate() error {
+	if _, _, err := net.SplitHostPort(l.Addr); err != nil {
+		return fmt.Errorf("invalid listen address %q: %w", l.Addr, err)
+	}
+	switch l.Mode {
+	case ListenerModeSmart, ListenerModeProxy, ListenerModeDirect:
+	case ListenerModeRemote:
+		if l.Remote == nil {
+			return fmt.Errorf("mode %q requires a remote table", l.Mode)
+		}
+		if l.Remote.Type != "sower" && l.Remote.Type != "socks5" {
+			return fmt.Errorf("unsupported remote type %q", l.Remote.Type)
+		}
+		if l.Remote.Type == "socks5" && l.Remote.Password != "" {
+			return fmt.Errorf("remote password is not supported for socks5 upstreams")
+		}
+		if _, err := validateRemoteAddr(l.Remote.Type, l.Remote.Addr); err != nil {
+			return err
+		}
+		if l.Remote.TLS.ClientHello != "" {
+			if err := upstreamtls.ValidateClientHello(l.Remote.TLS.ClientHello); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported mode %q", l.Mode)
+	}
+	if (l.Username == "") != (l.Password == "") {
+		return fmt.Errorf("username and password must be set together")
+	}
+	if _, err := ParseClientPrefixes(l.Allow); err != nil {
+		return fmt.Errorf("allow: %w", err)
+	}
+	return nil
+}
+
+// ParseClientPrefixes parses client CIDR entries, taking a bare IP as its
+// single-address prefix. Empty entries are skipped.
+func ParseClientPrefixes(entries []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, entry := range entries {
+		if entry == "" {
+			continue // an empty TOML array decodes as [""]
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			addr, err := netip.ParseAddr(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid entry %q: want a CIDR or IP", entry)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+func (c *SowerConfig) validateLimits() error {
+	if c.Limits.RateKB < 0 || c.Limits.ClientRateKB < 0 {
+		return fmt.Errorf("limits rates must not be negative")
+	}
+	for i, d := range c.Limits.Domains {
+		if d.Pattern == "" || d.RateKB <= 0 {
+			return fmt.Errorf("limits domain entry %d: pattern and a positive rate_kb are required", i+1)
+		}
+	}
+	for i := range c.Limits.Quotas {
+		q := &c.Limits.Quotas[i]
+		if _, err := ParseClientPrefixes([]string{q.Client}); err != nil || q.Client == "" {
+			return fmt.Errorf("limits quota entry %d: invalid client %q: want a CIDR or IP", i+1, q.Client)
+		}
+		if q.LimitMB <= 0 {
+			return fmt.Errorf("limits quota %q: limit_mb must be positive", q.Client)
+		}
+		if q.Period == "" {
+			q.Period = QuotaMonthly
+		}
+		if q.Action == "" {
+			q.Action = QuotaBlock
+		}
+		if q.Period != QuotaDaily && q.Period != QuotaMonthly {
+			return fmt.Errorf("limits quota %q: unsupported period %q", q.Client, q.Period)
+		}
+		if q.Action != QuotaBlock && q.Action != QuotaDirect {
+			return fmt.Errorf("limits quota %q: unsupported action %q", q.Client, q.Action)
+		}
+	}
+	return nil
+}
+
+func (c *SowerConfig) validateDHCP() error {
+	if c.DHCP.Iface == "" {
+		return fmt.Errorf("dhcp iface not set")
+	}
+	// Leases hand out dns.serve as the DNS server, so the DNS proxy must run
+	// on an IPv4 address.
+	if c.DNS.Disable || net.ParseIP(c.DNS.Serve).To4() == nil {
+		return fmt.Errorf("dhcp requires the dns proxy serving on an IPv4 dns.serve")
+	}
+	for _, field := range []struct{ name, value string }{
+		{"range_start", c.DHCP.RangeStart},
+		{"range_end", c.DHCP.RangeEnd},
+		{"gateway", c.DHCP.Gateway},
+	} {
+		if net.ParseIP(field.value).To4() == nil {
+			return fmt.Errorf("invalid dhcp %s %q: must be an IPv4 address", field.name, field.value)
+		}
+	}
+	if c.DHCP.Netmask != "" {
+		mask := net.IPMask(net.ParseIP(c.DHCP.Netmask).To4())
+		if ones, bits := mask.Size(); mask == nil || (ones == 0 && bits == 0) {
+			return fmt.Errorf("invalid dhcp netmask %q", c.DHCP.Netmask)
+		}
+	}
+	if c.DHCP.LeaseHours <= 0 {
+		return fmt.Errorf("dhcp lease_hours must be positive")
+	}
+	return nil
+}
+
 func validateRemoteAddr(remoteType, addr string) (string, error) {
 	switch remoteType {
 	case "socks5":
@@ -266,3 +738,28 @@ func validateRequiredIP(name, value string) error {
 	}
 	return nil
 }
+
+func validatePoison(trusted string, bogus []string, minRTTMs int) error {
+	if trusted != "" {
+		host := trusted
+		if h, _, err := net.SplitHostPort(trusted); err == nil {
+			host = h
+		}
+		if host == "" {
+			return fmt.Errorf("invalid dns poison trusted resolver %q", trusted)
+		}
+	}
+	for _, s := range bogus {
+		// aconfig decodes an empty TOML array as one empty element.
+		if s == "" || net.ParseIP(s) != nil {
+			continue
+		}
+		if _, _, err := net.ParseCIDR(s); err != nil {
+			return fmt.Errorf("invalid dns poison bogus ip %q", s)
+		}
+	}
+	if minRTTMs < 0 {
+		return fmt.Errorf("dns poison min_rtt_ms must not be negative")
+	}
+	return nil
+}
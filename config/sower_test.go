@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"log/slog"
 	"os"
+	"slices"
 	"strings"
 	"testing"
 
@@ -242,6 +243,263 @@ file_skip_rules = ["t.co"]
 	}
 }
 
+func TestSowerConfigLoadsDNSFakeIP(t *testing.T) {
+	t.Parallel()
+
+	path := t.TempDir() + "/sower.toml"
+	if err := os.WriteFile(path, []byte(`
+[remote]
+type = "sower"
+addr = "example.com"
+
+[dns]
+serve = "127.0.0.1"
+
+[dns.fake_ip]
+range = "198.18.0.0/15"
+file = "/var/lib/sower/fakeip.json"
+`), 0o600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+
+	var cfg SowerConfig
+	if err := aconfig.LoaderFor(&cfg, aconfig.Config{
+		SkipEnv:   true,
+		SkipFlags: true,
+		Files:     []string{path},
+		FileDecoders: map[string]aconfig.FileDecoder{
+			".toml": aconfigtoml.New(),
+		},
+	}).Load(); err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	if cfg.DNS.FakeIP.Range != "198.18.0.0/15" {
+		t.Fatalf("dns.fake_ip.range = %q, want 198.18.0.0/15", cfg.DNS.FakeIP.Range)
+	}
+	if cfg.DNS.FakeIP.File != "/var/lib/sower/fakeip.json" {
+		t.Fatalf("dns.fake_ip.file = %q, want /var/lib/sower/fakeip.json", cfg.DNS.FakeIP.File)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("validate config: %v", err)
+	}
+}
+
+func TestSowerConfigLoadsSniff(t *testing.T) {
+	t.Parallel()
+
+	path := t.TempDir() + "/sower.toml"
+	if err := os.WriteFile(path, []byte(`
+[remote]
+type = "sower"
+addr = "example.com"
+
+[socks_5]
+sniff = true
+`), 0o600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+
+	var cfg SowerConfig
+	if err := aconfig.LoaderFor(&cfg, aconfig.Config{
+		SkipEnv:   true,
+		SkipFlags: true,
+		Files:     []string{path},
+		FileDecoders: map[string]aconfig.FileDecoder{
+			".toml": aconfigtoml.New(),
+		},
+	}).Load(); err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	if !cfg.Socks5.Sniff {
+		t.Fatal("socks_5.sniff = false, want true")
+	}
+	if cfg.Socks5.SniffDialDomain {
+		t.Fatal("socks_5.sniff_dial_domain = true, want the requested IP dialed by default")
+	}
+	if !cfg.Transparent.SniffDialDomain {
+		t.Fatal("transparent.sniff_dial_domain = false, want the sniffed domain dialed by default")
+	}
+}
+
+func TestSowerConfigLoadsProxyListeners(t *testing.T) {
+	t.Parallel()
+
+	path := t.TempDir() + "/sower.toml"
+	if err := os.WriteFile(path, []byte(`
+[remote]
+type = "sower"
+addr = "example.com"
+
+[dns]
+disable = true
+
+[[socks_5]]
+name = "lan"
+addr = "0.0.0.0:1080"
+allow = ["192.168.1.0/24", "10.0.0.1"]
+sniff_dial_domain = true
+
+[[socks_5]]
+addr = "127.0.0.1:1081"
+mode = "remote"
+username = "alice"
+password = "secret"
+[socks_5.remote]
+addr = "other.example.com:8443"
+[socks_5.remote.tls]
+server_name = "cdn.example.com"
+
+[[http_proxy]]
+addr = "127.0.0.1:8080"
+mode = "direct"
+`), 0o600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+
+	var cfg SowerConfig
+	if err := aconfig.LoaderFor(&cfg, aconfig.Config{
+		SkipEnv:   true,
+		SkipFlags: true,
+		Files:     []string{path},
+		FileDecoders: map[string]aconfig.FileDecoder{
+			".toml": NewTOMLDecoder(),
+		},
+	}).Load(); err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("validate config: %v", err)
+	}
+
+	socks5, http := cfg.ProxyListeners()
+	if len(socks5) != 2 || len(http) != 1 {
+		t.Fatalf("listeners = %+v / %+v, want the [socks_5] default replaced by two entries and one http proxy", socks5, http)
+	}
+	lan, remote := socks5[0], socks5[1]
+	if lan.Name != "lan" || lan.Mode != ListenerModeSmart || !lan.SniffDialDomain || len(lan.Allow) != 2 {
+		t.Fatalf("first socks_5 entry = %+v", lan)
+	}
+	if remote.Name != "127.0.0.1:1081" || remote.Username != "alice" || remote.Remote == nil ||
+		remote.Remote.Type != "sower" || remote.Remote.TLS.ServerName != "cdn.example.com" {
+		t.Fatalf("second socks_5 entry = %+v", remote)
+	}
+	if typ := cfg.Socks5Listeners[1].Remote.Type; typ != "" {
+		t.Fatalf("configured remote type = %q, want the default applied to the copy only", typ)
+	}
+	if http[0].Mode != ListenerModeDirect {
+		t.Fatalf("http_proxy mode = %q, want direct", http[0].Mode)
+	}
+	if !slices.Contains(cfg.Router.Direct.Rules, "other.example.com") {
+		t.Fatalf("listener remote host missing from direct rules: %v", cfg.Router.Direct.Rules)
+	}
+}
+
+func TestSowerConfigValidateProxyListeners(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		name     string
+		listener ProxyListener
+	}{
+		{name: "mode", listener: ProxyListener{Addr: "127.0.0.1:1081", Mode: "fast"}},
+		{name: "remote missing", listener: ProxyListener{Addr: "127.0.0.1:1081", Mode: ListenerModeRemote}},
+		{name: "allow", listener: ProxyListener{Addr: "127.0.0.1:1081", Allow: []string{"lan"}}},
+		{name: "username only", listener: ProxyListener{Addr: "127.0.0.1:1081", Username: "alice"}},
+		{name: "addr", listener: ProxyListener{Addr: "1081"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			cfg := SowerConfig{}
+			cfg.Remote.Type = "sower"
+			cfg.Remote.Addr = "example.com"
+			cfg.DNS.Disable = true
+			cfg.DNS.Fallback = "223.5.5.5"
+			cfg.Socks5.Disable = true
+			cfg.HTTPProxy = []ProxyListener{tt.listener}
+			if err := cfg.Validate(); err == nil {
+				t.Fatal("Validate accepted an invalid listener")
+			}
+		})
+	}
+}
+
+func TestSowerConfigValidateRejectsFakeIPRangeWithServeIP(t *testing.T) {
+	t.Parallel()
+
+	for _, fakeRange := range []string{"198.18.0.0", "10.0.0.0/8"} {
+		cfg := SowerConfig{}
+		cfg.Remote.Type = "sower"
+		cfg.Remote.Addr = "example.com"
+		cfg.DNS.Serve = "10.0.0.1"
+		cfg.DNS.Fallback = "223.5.5.5"
+		cfg.DNS.FakeIP.Range = fakeRange
+
+		if err := cfg.Validate(); err == nil {
+			t.Fatalf("expected validation error for fake ip range %q", fakeRange)
+		}
+	}
+}
+
+func TestSowerConfigValidateDNSBlockMode(t *testing.T) {
+	t.Parallel()
+
+	for mode, wantErr := range map[string]bool{
+		"":         false,
+		"nxdomain": false,
+		"refused":  false,
+		"null":     false,
+		"sower":    false,
+		"drop":     true,
+		"NXDOMAIN": false,
+		" Sower ":  false,
+	} {
+		cfg := SowerConfig{}
+		cfg.Remote.Type = "sower"
+		cfg.Remote.Addr = "example.com"
+		cfg.DNS.Serve = "10.0.0.1"
+		cfg.DNS.Fallback = "223.5.5.5"
+		cfg.Socks5.Disable = true
+		cfg.DNS.BlockMode = mode
+
+		if err := cfg.Validate(); (err != nil) != wantErr {
+			t.Fatalf("block mode %q: validate error = %v, want error %v", mode, err, wantErr)
+		}
+	}
+}
+
+func TestSowerConfigValidateTransparent(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		addr, mode string
+		udp        bool
+		wantErr    bool
+	}{
+		{addr: "0.0.0.0:12345", mode: "redirect"},
+		{addr: "0.0.0.0:12345", mode: "tproxy", udp: true},
+		{addr: "0.0.0.0:12345", mode: "redirect", udp: true, wantErr: true},
+		{addr: "0.0.0.0:12345", mode: "tun", wantErr: true},
+		{addr: "12345", mode: "redirect", wantErr: true},
+	}
+	for _, tt := range tests {
+		cfg := SowerConfig{}
+		cfg.Remote.Type = "sower"
+		cfg.Remote.Addr = "example.com"
+		cfg.DNS.Serve = "10.0.0.1"
+		cfg.DNS.Fallback = "223.5.5.5"
+		cfg.Socks5.Disable = true
+		cfg.Transparent.Enable = true
+		cfg.Transparent.Addr = tt.addr
+		cfg.Transparent.Mode = tt.mode
+		cfg.Transparent.UDP = tt.udp
+
+		if err := cfg.Validate(); (err != nil) != tt.wantErr {
+			t.Fatalf("transparent %+v: validate error = %v, want error %v", tt, err, tt.wantErr)
+		}
+	}
+}
+
 func TestSowerConfigLoadsPackagedExamples(t *testing.T) {
 	t.Parallel()
 
@@ -453,3 +711,299 @@ func TestSplitRemoteAddrBareIPv6(t *testing.T) {
 		t.Fatal("garbage address must be rejected")
 	}
 }
+
+func TestSowerConfigLoadsDNSQueryLog(t *testing.T) {
+	t.Parallel()
+
+	path := t.TempDir() + "/sower.toml"
+	if err := os.WriteFile(path, []byte(`
+[remote]
+type = "sower"
+addr = "example.com"
+
+[dns]
+disable = true
+
+[dns.query_log]
+size = 500
+file = "/var/log/sower/dns.jsonl"
+max_size_mb = 4
+max_backups = 7
+`), 0o600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+
+	var cfg SowerConfig
+	if err := aconfig.LoaderFor(&cfg, aconfig.Config{
+		SkipEnv:   true,
+		SkipFlags: true,
+		Files:     []string{path},
+		FileDecoders: map[string]aconfig.FileDecoder{
+			".toml": aconfigtoml.New(),
+		},
+	}).Load(); err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	q := cfg.DNS.QueryLog
+	if q.Size != 500 || q.File != "/var/log/sower/dns.jsonl" || q.MaxSizeMB != 4 || q.MaxBackups != 7 {
+		t.Fatalf("unexpected query log config: %+v", q)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("validate config: %v", err)
+	}
+
+	cfg.DNS.QueryLog.Size = maxDNSQueryLogSize + 1
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("expected validation error for an oversized query log")
+	}
+}
+
+func TestSowerConfigLoadsDHCP(t *testing.T) {
+	t.Parallel()
+
+	path := t.TempDir() + "/sower.toml"
+	if err := os.WriteFile(path, []byte(`
+[remote]
+type = "sower"
+addr = "example.com"
+
+[dns]
+serve = "192.168.1.2"
+
+[dhcp]
+enable = true
+iface = "eth0"
+range_start = "192.168.1.100"
+range_end = "192.168.1.199"
+gateway = "192.168.1.1"
+lease_hours = 24
+`), 0o600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+
+	var cfg SowerConfig
+	if err := aconfig.LoaderFor(&cfg, aconfig.Config{
+		SkipEnv:   true,
+		SkipFlags: true,
+		Files:     []string{path},
+		FileDecoders: map[string]aconfig.FileDecoder{
+			".toml": aconfigtoml.New(),
+		},
+	}).Load(); err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	if !cfg.DHCP.Enable || cfg.DHCP.Iface != "eth0" || cfg.DHCP.RangeStart != "192.168.1.100" ||
+		cfg.DHCP.RangeEnd != "192.168.1.199" || cfg.DHCP.Gateway != "192.168.1.1" || cfg.DHCP.LeaseHours != 24 {
+		t.Fatalf("unexpected dhcp config: %+v", cfg.DHCP)
+	}
+	if cfg.DHCP.LeaseFile != "/etc/sower/dhcp-leases.json" {
+		t.Fatalf("dhcp.lease_file default = %q", cfg.DHCP.LeaseFile)
+	}
+	cfg.Socks5.Disable = true
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("validate config: %v", err)
+	}
+
+	cfg.DHCP.Gateway = "fe80::1"
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("expected validation error for an IPv6 gateway")
+	}
+}
+
+func TestSowerConfigLoadsACL(t *testing.T) {
+	t.Parallel()
+
+	path := t.TempDir() + "/sower.toml"
+	if err := os.WriteFile(path, []byte(`
+[remote]
+type = "sower"
+addr = "example.com"
+
+[dns]
+disable = true
+
+[acl.dns]
+allow = ["192.168.1.0/24"]
+deny = ["192.168.1.13"]
+
+[acl.socks_5]
+deny = ["10.0.0.0/8"]
+`), 0o600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+
+	var cfg SowerConfig
+	if err := aconfig.LoaderFor(&cfg, aconfig.Config{
+		SkipEnv:   true,
+		SkipFlags: true,
+		Files:     []string{path},
+		FileDecoders: map[string]aconfig.FileDecoder{
+			".toml": NewTOMLDecoder(),
+		},
+	}).Load(); err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	if !slices.Equal(cfg.ACL.DNS.Allow, []string{"192.168.1.0/24"}) || !slices.Equal(cfg.ACL.DNS.Deny, []string{"192.168.1.13"}) {
+		t.Fatalf("dns acl = %+v", cfg.ACL.DNS)
+	}
+	if !slices.Equal(cfg.ACL.Socks5.Deny, []string{"10.0.0.0/8"}) {
+		t.Fatalf("socks5 acl = %+v", cfg.ACL.Socks5)
+	}
+
+	cfg.ACL.HTTPS.Deny = []string{"lan"}
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("Validate accepted an invalid acl entry")
+	}
+}
+
+func TestSowerConfigLoadsLimits(t *testing.T) {
+	t.Parallel()
+
+	path := t.TempDir() + "/sower.toml"
+	if err := os.WriteFile(path, []byte(`
+[remote]
+type = "sower"
+addr = "example.com"
+
+[dns]
+disable = true
+
+[limits]
+client_rate_kb = 2048
+
+[[limits.domains]]
+pattern = "**.googlevideo.com"
+rate_kb = 1024
+
+[[limits.quotas]]
+client = "192.168.1.20"
+limit_mb = 10240
+action = "direct"
+
+[[limits.quotas]]
+client = "192.168.1.0/24"
+limit_mb = 512
+period = "daily"
+`), 0o600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+
+	var cfg SowerConfig
+	if err := aconfig.LoaderFor(&cfg, aconfig.Config{
+		SkipEnv:   true,
+		SkipFlags: true,
+		Files:     []string{path},
+		FileDecoders: map[string]aconfig.FileDecoder{
+			".toml": NewTOMLDecoder(),
+		},
+	}).Load(); err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+	if cfg.Limits.RateKB != 0 || cfg.Limits.ClientRateKB != 2048 {
+		t.Fatalf("rates = %d, %d", cfg.Limits.RateKB, cfg.Limits.ClientRateKB)
+	}
+	if len(cfg.Limits.Domains) != 1 || cfg.Limits.Domains[0] != (DomainLimit{Pattern: "**.googlevideo.com", RateKB: 1024}) {
+		t.Fatalf("domains = %+v", cfg.Limits.Domains)
+	}
+	want := []ClientQuota{
+		{Client: "192.168.1.20", LimitMB: 10240, Period: QuotaMonthly, Action: QuotaDirect},
+		{Client: "192.168.1.0/24", LimitMB: 512, Period: QuotaDaily, Action: QuotaBlock},
+	}
+	if !slices.Equal(cfg.Limits.Quotas, want) {
+		t.Fatalf("quotas = %+v, want %+v", cfg.Limits.Quotas, want)
+	}
+
+	cfg.Limits.Quotas[0].Period = "weekly"
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("Validate accepted an unsupported quota period")
+	}
+}
+
+func TestSowerConfigLoadsAdminHistory(t *testing.T) {
+	t.Parallel()
+
+	path := t.TempDir() + "/sower.toml"
+	if err := os.WriteFile(path, []byte(`
+[remote]
+type = "sower"
+addr = "example.com"
+
+[dns]
+disable = true
+
+[admin.history]
+keep_days = 90
+`), 0o600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+
+	var cfg SowerConfig
+	if err := aconfig.LoaderFor(&cfg, aconfig.Config{
+		SkipEnv:   true,
+		SkipFlags: true,
+		Files:     []string{path},
+		FileDecoders: map[string]aconfig.FileDecoder{
+			".toml": NewTOMLDecoder(),
+		},
+	}).Load(); err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+	h := cfg.Admin.History
+	if h.File != "/etc/sower/history.json" || h.KeepMinutes != 1440 || h.KeepHours != 720 || h.KeepDays != 90 {
+		t.Fatalf("history = %+v", h)
+	}
+
+	cfg.Admin.History.KeepHours = -1
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("Validate accepted a negative history retention")
+	}
+}
+
+func TestSowerConfigAdminAuditDefaults(t *testing.T) {
+	t.Parallel()
+
+	path := t.TempDir() + "/sower.toml"
+	if err := os.WriteFile(path, []byte(`
+[remote]
+type = "sower"
+addr = "example.com"
+
+[dns]
+disable = true
+
+[admin.audit]
+max_backups = 5
+`), 0o600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+
+	var cfg SowerConfig
+	if err := aconfig.LoaderFor(&cfg, aconfig.Config{
+		SkipEnv:   true,
+		SkipFlags: true,
+		Files:     []string{path},
+		FileDecoders: map[string]aconfig.FileDecoder{
+			".toml": NewTOMLDecoder(),
+		},
+	}).Load(); err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+	a := cfg.Admin.Audit
+	if a.Size != 1000 || a.File != "/etc/sower/audit.jsonl" || a.MaxSizeMB != 4 || a.MaxBackups != 5 {
+		t.Fatalf("audit = %+v", a)
+	}
+
+	cfg.Admin.Audit.Size = -1
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("Validate accepted a negative audit size")
+	}
+}
@@ -0,0 +1,162 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"unicode"
+
+	"github.com/cristalhq/aconfig/aconfigtoml"
+)
+
+// TOMLDecoder decodes sower config files for aconfig. It extends aconfigtoml
+// with the arrays of tables (proxy listeners, limits), which aconfig cannot
+// load on its own: a [[socks_5]] array shares its key with the [socks_5]
+// table, and aconfig matches the keys inside array entries to Go field
+// names rather than snake_case ones.
+type TOMLDecoder struct {
+	*aconfigtoml.Decoder
+}
+
+// NewTOMLDecoder returns the decoder for sower config files.
+func NewTOMLDecoder() *TOMLDecoder {
+	return &TOMLDecoder{Decoder: aconfigtoml.New()}
+}
+
+// DecodeFile implements aconfig.FileDecoder.
+func (d *TOMLDecoder) DecodeFile(filename string) (map[string]any, error) {
+	raw, err := d.Decoder.DecodeFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	if socks5, ok := raw["socks_5"]; ok {
+		if _, table := socks5.(map[string]any); !table {
+			entries, err := tableEntries("socks_5", socks5, proxyListenerType)
+			if err != nil {
+				return nil, err
+			}
+			// The entries replace the [socks_5] listener rather than add
+			// to its default address.
+			raw["socks_5"] = map[string]any{"disable": true}
+			raw["socks_5_listeners"] = entries
+		}
+	}
+	if httpProxy, ok := raw["http_proxy"]; ok {
+		entries, err := tableEntries("http_proxy", httpProxy, proxyListenerType)
+		if err != nil {
+			return nil, err
+		}
+		raw["http_proxy"] = entries
+	}
+	if limits, ok := raw["limits"].(map[string]any); ok {
+		for key, t := range map[string]reflect.Type{"domains": domainLimitType, "quotas": clientQuotaType} {
+			if value, ok := limits[key]; ok {
+				entries, err := tableEntries("limits."+key, value, t)
+				if err != nil {
+					return nil, err
+				}
+				limits[key] = entries
+			}
+		}
+	}
+	return raw, nil
+}
+
+var (
+	proxyListenerType = reflect.TypeOf(ProxyListener{})
+	domainLimitType   = reflect.TypeOf(DomainLimit{})
+	clientQuotaType   = reflect.TypeOf(ClientQuota{})
+)
+
+// tableEntries returns the entries of an array of tables for elements of
+// type t with their keys renamed to field names. A single table is taken
+// as a one-entry array.
+func tableEntries(key string, value any, t reflect.Type) ([]map[string]any, error) {
+	var entries []map[string]any
+	switch v := value.(type) {
+	case map[string]any:
+		entries = []map[string]any{v}
+	case []map[string]any:
+		entries = v
+	case []any:
+		for _, e := range v {
+			m, ok := e.(map[string]any)
+			if !ok {
+				return nil, fmt.Errorf("%s: entries must be tables, got %T", key, e)
+			}
+			entries = append(entries, m)
+		}
+	default:
+		return nil, fmt.Errorf("%s: must be a table or an array of tables, got %T", key, value)
+	}
+
+	for i, entry := range entries {
+		if err := fieldNameKeys(entry, t); err != nil {
+			return nil, fmt.Errorf("%s entry %d: %w", key, i+1, err)
+		}
+	}
+	return entries, nil
+}
+
+// fieldNameKeys renames the snake_case keys of m to the names of the fields
+// of t they address, recursing into nested tables.
+func fieldNameKeys(m map[string]any, t reflect.Type) error {
+	renamed := make(map[string]any, len(m))
+	for key, value := range m {
+		field, ok := fieldForKey(t, key)
+		if !ok {
+			return fmt.Errorf("unknown field %q", key)
+		}
+		ft := field.Type
+		if ft.Kind() == reflect.Pointer {
+			ft = ft.Elem()
+		}
+		if nested, ok := value.(map[string]any); ok && ft.Kind() == reflect.Struct {
+			if err := fieldNameKeys(nested, ft); err != nil {
+				return fmt.Errorf("%s: %w", key, err)
+			}
+		}
+		renamed[field.Name] = value
+	}
+	clear(m)
+	for key, value := range renamed {
+		m[key] = value
+	}
+	return nil
+}
+
+func fieldForKey(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name := field.Tag.Get("toml")
+		if name == "" {
+			name = snakeCase(field.Name)
+		}
+		if name == key {
+			return field, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// snakeCase converts a field name the way aconfig derives file keys, so
+// acronyms stay whole: SniffDialDomain is sniff_dial_domain, TLS is tls.
+func snakeCase(name string) string {
+	runes := []rune(name)
+	var b strings.Builder
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) {
+			prevLower := !unicode.IsUpper(runes[i-1])
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if prevLower || nextLower {
+				b.WriteByte('_')
+			}
+		}
+		b.WriteRune(unicode.ToLower(r))
+	}
+	return b.String()
+}
@@ -0,0 +1,115 @@
+package admin
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AccessEntry is one access probe verdict: whether Domain:Port answered
+// the probe that sends unmatched sites direct. At is when it was probed or
+// pinned and Age the seconds since. Pinned verdicts hold until evicted;
+// the others expire at Expires.
+type AccessEntry struct {
+	Domain    string     `json:"domain"`
+	Port      uint16     `json:"port"`
+	Reachable bool       `json:"reachable"`
+	Pinned    bool       `json:"pinned"`
+	At        time.Time  `json:"at"`
+	Age       int64      `json:"age"`
+	Expires   *time.Time `json:"expires,omitempty"`
+}
+
+// AccessCache is the router's access probe cache, behind the
+// /api/rules/access endpoints.
+type AccessCache interface {
+	AccessEntries() []AccessEntry
+	// EvictAccess drops one verdict, pinned or not, and reports whether
+	// there was one.
+	EvictAccess(domain string, port uint16) bool
+	// FlushAccess drops every verdict and returns how many there were.
+	FlushAccess() int
+	// PinAccess fixes a verdict until it is evicted.
+	PinAccess(domain string, port uint16, reachable bool) error
+}
+
+func (s *Server) handleAccessList(w http.ResponseWriter, r *http.Request) {
+	entries := s.opts.Access.AccessEntries()
+	if entries == nil {
+		entries = []AccessEntry{}
+	}
+	now := time.Now()
+	for i := range entries {
+		entries[i].Age = int64(now.Sub(entries[i].At) / time.Second)
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+// handleAccessPin serves PUT /api/rules/access, pinning a verdict.
+func (s *Server) handleAccessPin(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Domain    string `json:"domain"`
+		Port      uint16 `json:"port"`
+		Reachable bool   `json:"reachable"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	domain, ok := accessTarget(w, req.Domain, req.Port)
+	if !ok {
+		return
+	}
+	if err := s.opts.Access.PinAccess(domain, req.Port, req.Reachable); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	target := net.JoinHostPort(domain, strconv.Itoa(int(req.Port)))
+	slog.Info("admin pinned access verdict", "target", target, "reachable", req.Reachable)
+	s.audit(r, AuditAccessPin, target, nil, map[string]bool{"reachable": req.Reachable})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleAccessEvict serves DELETE /api/rules/access?domain=&port=.
+func (s *Server) handleAccessEvict(w http.ResponseWriter, r *http.Request) {
+	port, err := strconv.ParseUint(r.URL.Query().Get("port"), 10, 16)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid port")
+		return
+	}
+	domain, ok := accessTarget(w, r.URL.Query().Get("domain"), uint16(port))
+	if !ok {
+		return
+	}
+	if !s.opts.Access.EvictAccess(domain, uint16(port)) {
+		writeError(w, http.StatusNotFound, "no cached verdict")
+		return
+	}
+	s.audit(r, AuditAccessEvict, net.JoinHostPort(domain, strconv.FormatUint(port, 10)), nil, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleAccessFlush(w http.ResponseWriter, r *http.Request) {
+	n := s.opts.Access.FlushAccess()
+	slog.Info("admin flushed access cache", "count", n)
+	s.audit(r, AuditAccessFlush, "all", map[string]int{"count": n}, nil)
+	writeJSON(w, http.StatusOK, map[string]int{"flushed": n})
+}
+
+// accessTarget validates a verdict's domain and port, writing a 400 when
+// either is bad. Only ports 80 and 443 are ever probed.
+func accessTarget(w http.ResponseWriter, domain string, port uint16) (string, bool) {
+	domain = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(domain), "."))
+	if err := checkRule(domain); err != nil || strings.Contains(domain, "*") {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid domain %q", truncate(domain, maxRuleLength)))
+		return "", false
+	}
+	if port != 80 && port != 443 {
+		writeError(w, http.StatusBadRequest, "port must be 80 or 443")
+		return "", false
+	}
+	return domain, true
+}
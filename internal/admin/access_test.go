@@ -0,0 +1,113 @@
+package admin
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func accessKey(domain string, port uint16) string {
+	return net.JoinHostPort(domain, strconv.Itoa(int(port)))
+}
+
+type fakeAccess struct {
+	entries map[string]AccessEntry
+}
+
+func (f *fakeAccess) AccessEntries() []AccessEntry {
+	out := make([]AccessEntry, 0, len(f.entries))
+	for _, e := range f.entries {
+		out = append(out, e)
+	}
+	return out
+}
+
+func (f *fakeAccess) EvictAccess(domain string, port uint16) bool {
+	key := accessKey(domain, port)
+	_, ok := f.entries[key]
+	delete(f.entries, key)
+	return ok
+}
+
+func (f *fakeAccess) FlushAccess() int {
+	n := len(f.entries)
+	clear(f.entries)
+	return n
+}
+
+func (f *fakeAccess) PinAccess(domain string, port uint16, reachable bool) error {
+	f.entries[accessKey(domain, port)] = AccessEntry{Domain: domain, Port: port, Reachable: reachable, Pinned: true, At: time.Now()}
+	return nil
+}
+
+func TestAccessCacheEndpoints(t *testing.T) {
+	access := &fakeAccess{entries: map[string]AccessEntry{
+		"example.org:443": {Domain: "example.org", Port: 443, Reachable: true, At: time.Now().Add(-90 * time.Second)},
+	}}
+	audit, err := NewAuditLog(AuditOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(Options{Password: "secret", Rules: newFakeRules(), Stats: newTestStats(t), Audit: audit, Access: access})
+	ts := httptest.NewServer(s.http.Handler)
+	t.Cleanup(ts.Close)
+	cookie := login(t, ts, "secret")
+
+	list := func() []AccessEntry {
+		t.Helper()
+		resp := authedRequest(t, ts, http.MethodGet, "/api/rules/access", cookie, "")
+		defer resp.Body.Close()
+		var entries []AccessEntry
+		if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		return entries
+	}
+	if entries := list(); len(entries) != 1 || entries[0].Age < 89 || !entries[0].Reachable {
+		t.Fatalf("entries = %+v", entries)
+	}
+
+	resp := authedRequest(t, ts, http.MethodPut, "/api/rules/access", cookie, `{"domain":"Example.COM.","port":443,"reachable":false}`)
+	resp.Body.Close()
+	if e, ok := access.entries["example.com:443"]; resp.StatusCode != http.StatusNoContent || !ok || e.Reachable {
+		t.Fatalf("pin = %d, entries %+v", resp.StatusCode, access.entries)
+	}
+	for _, body := range []string{`{"domain":"example.com","port":8443}`, `{"domain":"**.example.com","port":443}`, `{"domain":"","port":80}`} {
+		resp := authedRequest(t, ts, http.MethodPut, "/api/rules/access", cookie, body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("pin %s = %d, want 400", body, resp.StatusCode)
+		}
+	}
+
+	resp = authedRequest(t, ts, http.MethodDelete, "/api/rules/access?domain=example.com&port=443", cookie, "")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent || len(access.entries) != 1 {
+		t.Fatalf("evict = %d, entries %+v", resp.StatusCode, access.entries)
+	}
+	resp = authedRequest(t, ts, http.MethodDelete, "/api/rules/access?domain=example.com&port=443", cookie, "")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("evict missing = %d, want 404", resp.StatusCode)
+	}
+
+	resp = authedRequest(t, ts, http.MethodPost, "/api/rules/access/flush", cookie, "")
+	var flushed map[string]int
+	if err := json.NewDecoder(resp.Body).Decode(&flushed); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	resp.Body.Close()
+	if flushed["flushed"] != 1 || len(list()) != 0 {
+		t.Fatalf("flush = %v, entries %+v", flushed, access.entries)
+	}
+
+	for action, target := range map[string]string{AuditAccessPin: "example.com:443", AuditAccessEvict: "example.com:443", AuditAccessFlush: "all"} {
+		if entries := audit.Query(AuditFilter{Action: action}, 10); len(entries) != 1 || entries[0].Target != target {
+			t.Errorf("audit %s = %+v", action, entries)
+		}
+	}
+}
@@ -0,0 +1,323 @@
+package admin
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultAuditSize = 1000
+	// maxAuditLogin bounds the attempted user name kept for failed logins,
+	// which is attacker-controlled.
+	maxAuditLogin = 64
+)
+
+// Audit actions. Dotted actions group under their prefix for filtering.
+const (
+	AuditLogin           = "login"
+	AuditLoginFailed     = "login.failed"
+	AuditLogout          = "logout"
+	AuditRulesAdd        = "rules.add"
+	AuditRulesRemove     = "rules.remove"
+	AuditRulesReset      = "rules.reset"
+	AuditRulesImport     = "rules.import"
+	AuditRulesAccept     = "rules.accept"
+	AuditRulesExpire     = "rules.expire"
+	AuditAccessPin       = "access.pin"
+	AuditAccessEvict     = "access.evict"
+	AuditAccessFlush     = "access.flush"
+	AuditConfigUpdate    = "config.update"
+	AuditStateRollback   = "state.rollback"
+	AuditRestart         = "restart"
+	AuditTokenCreate     = "token.create"
+	AuditTokenRevoke     = "token.revoke"
+	AuditUserAdd         = "user.add"
+	AuditUserUpdate      = "user.update"
+	AuditUserDelete      = "user.delete"
+	AuditConnectionClose = "connection.close"
+)
+
+// AuditEntry is one admin mutation or login attempt. User is empty for the
+// shared admin password, Token names the bearer token of API calls, and
+// Session is a short fingerprint tying entries of one login together.
+// Before and After hold only what the action changed. IP is empty for
+// changes the server makes on its own, such as expiring temporary rules.
+type AuditEntry struct {
+	Time    time.Time `json:"time"`
+	IP      string    `json:"ip"`
+	User    string    `json:"user,omitempty"`
+	Token   string    `json:"token,omitempty"`
+	Session string    `json:"session,omitempty"`
+	Action  string    `json:"action"`
+	Target  string    `json:"target,omitempty"`
+	Before  any       `json:"before,omitempty"`
+	After   any       `json:"after,omitempty"`
+}
+
+// AuditFilter selects entries for /api/audit. Empty fields match everything;
+// Action also matches the actions grouped under it ("rules" matches
+// "rules.add").
+type AuditFilter struct {
+	User   string
+	Action string
+	Since  time.Time
+}
+
+func (f AuditFilter) match(e AuditEntry) bool {
+	return (f.User == "" || e.User == f.User) &&
+		(f.Action == "" || e.Action == f.Action || strings.HasPrefix(e.Action, f.Action+".")) &&
+		(f.Since.IsZero() || !e.Time.Before(f.Since))
+}
+
+// AuditOptions configures the audit trail. An empty File keeps it in memory
+// only.
+type AuditOptions struct {
+	Size       int
+	File       string
+	MaxBytes   int64
+	MaxBackups int
+}
+
+// AuditLog is the append-only admin audit trail. The newest Size entries
+// stay in memory for queries; with a file every entry is also appended as
+// one JSON line before the request returns, and the file is rotated by size
+// so the trail on disk stays bounded too.
+type AuditLog struct {
+	mu      sync.Mutex
+	size    int
+	entries []AuditEntry // oldest first
+	file    *rotatingFile
+	failing bool
+}
+
+// NewAuditLog creates the audit trail, reloading the newest entries from
+// the file and its first backup so the console keeps its history across
+// restarts.
+func NewAuditLog(opts AuditOptions) (*AuditLog, error) {
+	if opts.Size <= 0 {
+		opts.Size = defaultAuditSize
+	}
+	l := &AuditLog{size: opts.Size}
+	if opts.File == "" {
+		return l, nil
+	}
+	for _, path := range []string{opts.File + ".1", opts.File} {
+		l.loadFile(path)
+	}
+	w, err := newRotatingFile(opts.File, opts.MaxBytes, opts.MaxBackups)
+	if err != nil {
+		return nil, err
+	}
+	l.file = w
+	return l, nil
+}
+
+func (l *AuditLog) loadFile(path string) {
+	f, err := os.Open(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			slog.Warn("read audit log", "path", path, "error", err)
+		}
+		return
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 0, 64<<10), maxBodyBytes*4)
+	for sc.Scan() {
+		var e AuditEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			// A torn last line from a crash is expected; skip it.
+			continue
+		}
+		l.appendLocked(e)
+	}
+	if err := sc.Err(); err != nil {
+		slog.Warn("read audit log", "path", path, "error", err)
+	}
+}
+
+func (l *AuditLog) appendLocked(e AuditEntry) {
+	l.entries = append(l.entries, e)
+	if len(l.entries) > l.size {
+		l.entries = slices.Delete(l.entries, 0, len(l.entries)-l.size)
+	}
+}
+
+// Record appends one entry, writing it to the file synchronously. A write
+// failure is logged; the entry stays in memory.
+func (l *AuditLog) Record(e AuditEntry) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.appendLocked(e)
+	if l.file == nil {
+		return
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		slog.Warn("encode audit entry", "action", e.Action, "error", err)
+		return
+	}
+	err = l.file.Write(append(line, '\n'))
+	switch {
+	case err != nil && !l.failing:
+		slog.Warn("write audit log", "error", err)
+		l.failing = true
+	case err == nil && l.failing:
+		slog.Info("audit log writes recovered")
+		l.failing = false
+	}
+}
+
+// Query returns up to limit matching entries, newest first.
+func (l *AuditLog) Query(f AuditFilter, limit int) []AuditEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := make([]AuditEntry, 0, min(limit, len(l.entries)))
+	for i := len(l.entries) - 1; i >= 0 && len(out) < limit; i-- {
+		if f.match(l.entries[i]) {
+			out = append(out, l.entries[i])
+		}
+	}
+	return out
+}
+
+// Close closes the file. Later entries stay in memory only.
+func (l *AuditLog) Close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return
+	}
+	if err := l.file.Close(); err != nil {
+		slog.Warn("close audit log", "error", err)
+	}
+	l.file = nil
+}
+
+// auditActor is who made an authenticated request, attached to its context
+// by auth.
+type auditActor struct {
+	user    string
+	token   string
+	session string
+}
+
+type auditActorKey struct{}
+
+func withAuditActor(r *http.Request, a auditActor) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), auditActorKey{}, a))
+}
+
+// sessionFingerprint identifies a session in the audit trail without
+// revealing its token.
+func sessionFingerprint(token string) string {
+	return hashToken(token)[:12]
+}
+
+// audit records an action of the request's caller. It is a no-op without an
+// audit log.
+func (s *Server) audit(r *http.Request, action, target string, before, after any) {
+	if s.opts.Audit == nil {
+		return
+	}
+	a, _ := r.Context().Value(auditActorKey{}).(auditActor)
+	s.opts.Audit.Record(AuditEntry{
+		IP:      remoteIP(r.RemoteAddr),
+		User:    a.user,
+		Token:   a.token,
+		Session: a.session,
+		Action:  action,
+		Target:  target,
+		Before:  before,
+		After:   after,
+	})
+}
+
+// configDiff returns the config fields whose value differs between two
+// views. Secret fields report whether they are configured, never a value.
+func configDiff(before, after ConfigView) (map[string]string, map[string]string) {
+	value := func(f ConfigField) string {
+		if f.Secret {
+			return strconv.FormatBool(f.Configured)
+		}
+		return f.Value
+	}
+	old := make(map[string]string)
+	for _, sec := range before.Sections {
+		for _, f := range sec.Fields {
+			old[f.Key] = value(f)
+		}
+	}
+	from, to := make(map[string]string), make(map[string]string)
+	for _, sec := range after.Sections {
+		for _, f := range sec.Fields {
+			if v := value(f); v != old[f.Key] {
+				from[f.Key], to[f.Key] = old[f.Key], v
+			}
+		}
+	}
+	return from, to
+}
+
+// changedConfigKeys lists the PATCH fields a request set, sorted.
+func changedConfigKeys(c ConfigChanges) string {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return ""
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return ""
+	}
+	keys := make([]string, 0, len(fields))
+	for k, v := range fields {
+		if k != "acl" && string(v) != "null" {
+			keys = append(keys, k)
+		}
+	}
+	for group, acl := range c.ACL {
+		for name, entries := range acl.lists() {
+			if entries != nil {
+				keys = append(keys, "acl_"+group+"_"+name)
+			}
+		}
+	}
+	slices.Sort(keys)
+	return strings.Join(keys, ",")
+}
+
+func (s *Server) handleAudit(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	limit := defaultPageSize
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			writeError(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+		limit = min(n, maxPageSize)
+	}
+	f := AuditFilter{User: q.Get("user"), Action: q.Get("action")}
+	if v := q.Get("since"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid since, want RFC 3339")
+			return
+		}
+		f.Since = t
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"entries": s.opts.Audit.Query(f, limit)})
+}
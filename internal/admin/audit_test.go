@@ -0,0 +1,132 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuditLogBoundedAndReloaded(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "audit.jsonl")
+	l, err := NewAuditLog(AuditOptions{Size: 3, File: file})
+	if err != nil {
+		t.Fatalf("new: %v", err)
+	}
+	for _, a := range []string{AuditLogin, AuditRulesAdd, AuditRulesRemove, AuditRestart} {
+		l.Record(AuditEntry{IP: "10.0.0.1", User: "alice", Action: a})
+	}
+	l.Close()
+
+	got := l.Query(AuditFilter{}, 10)
+	if len(got) != 3 || got[0].Action != AuditRestart || got[2].Action != AuditRulesAdd {
+		t.Fatalf("entries = %+v", got)
+	}
+	if got[0].Time.IsZero() {
+		t.Fatal("Record did not stamp the entry")
+	}
+	if rules := l.Query(AuditFilter{Action: "rules"}, 10); len(rules) != 2 {
+		t.Fatalf("rules entries = %+v", rules)
+	}
+	if none := l.Query(AuditFilter{User: "bob"}, 10); len(none) != 0 {
+		t.Fatalf("bob entries = %+v", none)
+	}
+	if recent := l.Query(AuditFilter{Since: time.Now().Add(time.Minute)}, 10); len(recent) != 0 {
+		t.Fatalf("future entries = %+v", recent)
+	}
+
+	reloaded, err := NewAuditLog(AuditOptions{Size: 2, File: file})
+	if err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	defer reloaded.Close()
+	got = reloaded.Query(AuditFilter{}, 10)
+	if len(got) != 2 || got[0].Action != AuditRestart || got[1].Action != AuditRulesRemove {
+		t.Fatalf("reloaded entries = %+v", got)
+	}
+}
+
+func TestConfigDiff(t *testing.T) {
+	view := func(level string, configured bool) ConfigView {
+		return ConfigView{Sections: []ConfigSection{{Fields: []ConfigField{
+			{Key: "log_level", Value: level},
+			{Key: "dns.upstream", Value: "1.1.1.1"},
+			{Key: "remote.password", Secret: true, Configured: configured},
+		}}}}
+	}
+	from, to := configDiff(view("info", false), view("debug", true))
+	if len(from) != 2 || from["log_level"] != "info" || to["log_level"] != "debug" || to["remote.password"] != "true" {
+		t.Fatalf("diff = %v -> %v", from, to)
+	}
+	level, upstream := "debug", "8.8.8.8"
+	if got := changedConfigKeys(ConfigChanges{LogLevel: &level, DNSUpstream: &upstream}); got != "dns_upstream,log_level" {
+		t.Fatalf("changed keys = %q", got)
+	}
+	deny := []string{"10.0.0.0/8"}
+	if got := changedConfigKeys(ConfigChanges{ACL: map[string]ACLOverride{"dns": {Deny: &deny}}}); got != "acl_dns_deny" {
+		t.Fatalf("changed acl keys = %q", got)
+	}
+}
+
+func TestAuditEndpoint(t *testing.T) {
+	audit, err := NewAuditLog(AuditOptions{})
+	if err != nil {
+		t.Fatalf("new: %v", err)
+	}
+	state := LoadStateStore("")
+	s := NewServer(Options{Password: "secret", Rules: newFakeRules(), Stats: newTestStats(t), State: state, Audit: audit})
+	ts := httptest.NewServer(s.http.Handler)
+	t.Cleanup(ts.Close)
+
+	if _, code := loginUser(t, ts, "", "wrong"); code != http.StatusUnauthorized {
+		t.Fatalf("wrong login = %d", code)
+	}
+	admin := login(t, ts, "secret")
+	resp := authedRequest(t, ts, http.MethodPost, "/api/rules", admin, `{"category":"block","rules":["ads.example.com"]}`)
+	resp.Body.Close()
+	resp = authedRequest(t, ts, http.MethodDelete, "/api/rules", admin, `{"category":"block","rules":["ads.example.com","missing.example.com"]}`)
+	resp.Body.Close()
+	resp = authedRequest(t, ts, http.MethodPost, "/api/users", admin, `{"name":"viewer","password":"password1","role":"viewer"}`)
+	resp.Body.Close()
+
+	resp = authedRequest(t, ts, http.MethodGet, "/api/audit?limit=10", admin, "")
+	var body struct{ Entries []AuditEntry }
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	resp.Body.Close()
+	var actions []string
+	for _, e := range body.Entries {
+		actions = append(actions, e.Action)
+	}
+	want := []string{AuditUserAdd, AuditRulesRemove, AuditRulesAdd, AuditLogin, AuditLoginFailed}
+	if strings.Join(actions, " ") != strings.Join(want, " ") {
+		t.Fatalf("actions = %v, want %v", actions, want)
+	}
+	add, remove := body.Entries[2], body.Entries[1]
+	if add.Target != "block" || add.IP != "127.0.0.1" || add.Session == "" || add.Session != body.Entries[3].Session {
+		t.Fatalf("rules.add entry = %+v", add)
+	}
+	if removed, ok := remove.Before.([]any); !ok || len(removed) != 1 || removed[0] != "ads.example.com" {
+		t.Fatalf("rules.remove before = %#v", remove.Before)
+	}
+
+	viewer, _ := loginUser(t, ts, "viewer", "password1")
+	resp = authedRequest(t, ts, http.MethodGet, "/api/audit", viewer, "")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("viewer audit = %d, want 403", resp.StatusCode)
+	}
+	resp = authedRequest(t, ts, http.MethodGet, "/api/audit?action=login&user=viewer", admin, "")
+	body.Entries = nil
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	resp.Body.Close()
+	if len(body.Entries) != 1 || body.Entries[0].User != "viewer" {
+		t.Fatalf("viewer logins = %+v", body.Entries)
+	}
+}
@@ -13,12 +13,32 @@ import (
 	"net/http"
 	"net/url"
 	"os"
-	"path/filepath"
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/sower-proxy/sower/internal/fsutil"
 )
 
+// session is a console login: its server-side expiry and the user it is
+// bound to, empty for the shared admin password.
+type session struct {
+	Expires time.Time `json:"expires"`
+	User    string    `json:"user,omitempty"`
+}
+
+// UnmarshalJSON also reads the bare expiry timestamps of session files
+// written before sessions were bound to users; those belong to the shared
+// admin password.
+func (s *session) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		*s = session{}
+		return json.Unmarshal(data, &s.Expires)
+	}
+	type plain session
+	return json.Unmarshal(data, (*plain)(s))
+}
+
 // loadSessions restores persisted sessions at startup, dropping any that
 // already expired while the process was down.
 func (s *Server) loadSessions() {
@@ -32,7 +52,7 @@ func (s *Server) loadSessions() {
 		}
 		return
 	}
-	var stored map[string]time.Time
+	var stored map[string]session
 	if err := json.Unmarshal(data, &stored); err != nil {
 		slog.Warn("parse session file", "error", err)
 		return
@@ -40,9 +60,9 @@ func (s *Server) loadSessions() {
 	now := time.Now()
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	for token, exp := range stored {
-		if now.Before(exp) {
-			s.sessions[token] = exp
+	for token, sess := range stored {
+		if now.Before(sess.Expires) {
+			s.sessions[token] = sess
 		}
 	}
 	if len(s.sessions) > 0 {
@@ -53,7 +73,7 @@ func (s *Server) loadSessions() {
 // persistLocked writes the supplied session snapshot to disk atomically with
 // 0600 permissions. It must be called with s.mu held. IO errors are returned
 // so callers can keep memory and durable state consistent.
-func (s *Server) persistLocked(sessions map[string]time.Time) error {
+func (s *Server) persistLocked(sessions map[string]session) error {
 	if s.sessionFile == "" {
 		return nil
 	}
@@ -61,43 +81,15 @@ func (s *Server) persistLocked(sessions map[string]time.Time) error {
 	if err != nil {
 		return fmt.Errorf("marshal sessions for %s: %w", s.sessionFile, err)
 	}
-	dir := filepath.Dir(s.sessionFile)
-	if err := os.MkdirAll(dir, 0o700); err != nil {
-		return fmt.Errorf("create session directory %s: %w", dir, err)
-	}
-	tmp, err := os.CreateTemp(dir, ".sessions-*.tmp")
-	if err != nil {
-		return fmt.Errorf("create session temp file in %s: %w", dir, err)
-	}
-	tmpName := tmp.Name()
-	defer func() { _ = os.Remove(tmpName) }()
-	if _, err := tmp.Write(data); err != nil {
-		_ = tmp.Close()
-		return fmt.Errorf("write session temp file %s: %w", tmpName, err)
-	}
-	if err := tmp.Sync(); err != nil {
-		_ = tmp.Close()
-		return fmt.Errorf("fsync session temp file %s: %w", tmpName, err)
-	}
-	if err := tmp.Close(); err != nil {
-		return fmt.Errorf("close session temp file %s: %w", tmpName, err)
-	}
-	if err := os.Chmod(tmpName, 0o600); err != nil {
-		return fmt.Errorf("chmod session temp file %s: %w", tmpName, err)
-	}
-	if err := os.Rename(tmpName, s.sessionFile); err != nil {
-		return fmt.Errorf("rename session file %s: %w", s.sessionFile, err)
-	}
-	if d, err := os.Open(dir); err == nil {
-		_ = d.Sync()
-		_ = d.Close()
+	if err := fsutil.WriteFileAtomic(s.sessionFile, data); err != nil {
+		return fmt.Errorf("write sessions: %w", err)
 	}
 	return nil
 }
 
-func purgeExpired(sessions map[string]time.Time, now time.Time) {
-	for token, exp := range sessions {
-		if now.After(exp) {
+func purgeExpired(sessions map[string]session, now time.Time) {
+	for token, sess := range sessions {
+		if now.After(sess.Expires) {
 			delete(sessions, token)
 		}
 	}
@@ -187,20 +179,36 @@ func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var body struct {
+		Username string `json:"username"`
 		Password string `json:"password"`
 	}
 	if !decodeJSON(w, r, &body) {
 		return
 	}
-	if !secureEqual(body.Password, s.opts.Password) {
+	// Without a user name the shared admin password logs in as the
+	// implicit admin.
+	var ok bool
+	if body.Username == "" {
+		ok = secureEqual(body.Password, s.opts.Password)
+	} else {
+		ok = s.opts.State != nil && s.opts.State.UserAuthenticate(body.Username, body.Password)
+	}
+	if !ok {
 		s.throttle.fail(ip)
-		writeError(w, http.StatusUnauthorized, "invalid password")
+		attempted := body.Username
+		if len(attempted) > maxAuditLogin {
+			attempted = attempted[:maxAuditLogin]
+		}
+		s.audit(withAuditActor(r, auditActor{user: attempted}), AuditLoginFailed, "", nil, nil)
+		writeError(w, http.StatusUnauthorized, "invalid user name or password")
 		return
 	}
 	s.throttle.success(ip)
-	if !s.issueSession(w, r) {
+	token, ok := s.issueSession(w, r, body.Username)
+	if !ok {
 		return
 	}
+	s.audit(withAuditActor(r, auditActor{user: body.Username, session: sessionFingerprint(token)}), AuditLogin, "", nil, nil)
 	w.WriteHeader(http.StatusNoContent)
 }
 
@@ -212,11 +220,15 @@ func (s *Server) handleSession(w http.ResponseWriter, _ *http.Request) {
 func (s *Server) handleLogout(w http.ResponseWriter, r *http.Request) {
 	if c, err := r.Cookie(sessionCookieName); err == nil {
 		s.mu.Lock()
+		sess, ok := s.sessions[c.Value]
 		delete(s.sessions, c.Value)
 		if err := s.persistLocked(s.sessions); err != nil {
 			slog.Error("persist admin logout session", "error", err)
 		}
 		s.mu.Unlock()
+		if ok {
+			s.audit(withAuditActor(r, auditActor{user: sess.User, session: sessionFingerprint(c.Value)}), AuditLogout, "", nil, nil)
+		}
 	}
 
 	http.SetCookie(w, s.sessionCookie("", -1, s.cookieSecure(r)))
@@ -242,12 +254,14 @@ func (s *Server) cookieSecure(r *http.Request) bool {
 	return r.TLS != nil || s.opts.CookieSecure
 }
 
-func (s *Server) issueSession(w http.ResponseWriter, r *http.Request) bool {
+// issueSession stores a new session for user and sets its cookie, returning
+// the session token.
+func (s *Server) issueSession(w http.ResponseWriter, r *http.Request, user string) (string, bool) {
 	var token [32]byte
 	if _, err := rand.Read(token[:]); err != nil {
 		slog.Error("generate session token", "error", err)
 		writeError(w, http.StatusInternalServerError, "failed to issue session")
-		return false
+		return "", false
 	}
 	value := hex.EncodeToString(token[:])
 
@@ -261,16 +275,16 @@ func (s *Server) issueSession(w http.ResponseWriter, r *http.Request) bool {
 		s.mu.Unlock()
 		slog.Warn("admin session limit reached, login rejected")
 		writeError(w, http.StatusServiceUnavailable, "session limit reached, try later")
-		return false
+		return "", false
 	}
-	s.sessions[value] = time.Now().Add(sessionTTL)
+	s.sessions[value] = session{Expires: time.Now().Add(sessionTTL), User: user}
 	if err := s.persistLocked(s.sessions); err != nil {
 		slog.Error("persist admin login session", "error", err)
 	}
 	s.mu.Unlock()
 
 	http.SetCookie(w, s.sessionCookie(value, int(sessionCookieMaxAge.Seconds()), s.cookieSecure(r)))
-	return true
+	return value, true
 }
 
 // validSession returns the token, whether it is valid, and whether its
@@ -283,20 +297,21 @@ func (s *Server) validSession(r *http.Request) (string, bool, bool) {
 	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	exp, ok := s.sessions[c.Value]
+	sess, ok := s.sessions[c.Value]
 	if !ok {
 		return "", false, false
 	}
 	now := time.Now()
-	if now.After(exp) {
+	if now.After(sess.Expires) {
 		delete(s.sessions, c.Value)
 		if err := s.persistLocked(s.sessions); err != nil {
 			slog.Warn("persist expired admin session cleanup", "error", err)
 		}
 		return "", false, false
 	}
-	if exp.Sub(now) < sessionTTL/2 {
-		s.sessions[c.Value] = now.Add(sessionTTL)
+	if sess.Expires.Sub(now) < sessionTTL/2 {
+		sess.Expires = now.Add(sessionTTL)
+		s.sessions[c.Value] = sess
 		if err := s.persistLocked(s.sessions); err != nil {
 			slog.Warn("renew admin session", "error", err)
 		}
@@ -305,17 +320,53 @@ func (s *Server) validSession(r *http.Request) (string, bool, bool) {
 	return c.Value, true, false
 }
 
-// auth rejects requests without a valid session cookie and renews the
-// browser's Max-Age for every authenticated HTTP response.
+// revalidate re-checks the credential of a long-lived request such as an
+// SSE stream: its bearer token when it carries one, else its session.
+// renewed reports a session renewal the browser must pick up.
+func (s *Server) revalidate(r *http.Request) (valid, renewed bool) {
+	if _, ok := bearerToken(r); ok {
+		_, valid = s.tokenAuthorized(r)
+		return valid, false
+	}
+	token, valid, renewed := s.validSession(r)
+	if valid {
+		_, _, valid = s.sessionRole(token)
+	}
+	return valid, renewed
+}
+
+// auth rejects requests without a valid session cookie or a bearer token
+// scoped for the endpoint, refuses sessions whose user role does not permit
+// the endpoint, and renews the browser's Max-Age for every
+// session-authenticated HTTP response. The caller is attached to the request
+// for the audit trail.
 func (s *Server) auth(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := bearerToken(r); ok {
+			name, ok := s.tokenAuthorized(r)
+			if !ok {
+				writeError(w, http.StatusUnauthorized, "unauthorized")
+				return
+			}
+			next(w, withAuditActor(r, auditActor{token: name}))
+			return
+		}
 		token, valid, _ := s.validSession(r)
+		var user string
+		var role Role
+		if valid {
+			user, role, valid = s.sessionRole(token)
+		}
 		if !valid {
 			writeError(w, http.StatusUnauthorized, "unauthorized")
 			return
 		}
+		if !role.permits(requiredScope(r)) {
+			writeError(w, http.StatusForbidden, fmt.Sprintf("role %s may not call this endpoint", role))
+			return
+		}
 		http.SetCookie(w, s.sessionCookie(token, int(sessionCookieMaxAge.Seconds()), s.cookieSecure(r)))
-		next(w, r)
+		next(w, withAuditActor(r, auditActor{user: user, session: sessionFingerprint(token)}))
 	}
 }
 
@@ -6,6 +6,8 @@ import (
 	"log/slog"
 	"net"
 	"net/http"
+	"net/netip"
+	"slices"
 	"strconv"
 	"strings"
 
@@ -64,8 +66,8 @@ type ConfigView struct {
 
 // ConfigChanges is the whitelisted PATCH payload. A nil pointer leaves the
 // override unchanged; a non-nil empty string clears it, reverting the field
-// to the file/flag configuration. List fields (rule sources) follow the
-// same rule with slices.
+// to the file/flag configuration. List fields (rule sources, client ACLs)
+// follow the same rule with slices.
 type ConfigChanges struct {
 	LogLevel    *string `json:"log_level"`
 	DNSUpstream *string `json:"dns_upstream"`
@@ -103,6 +105,10 @@ type ConfigChanges struct {
 	RouterCountryMMDB         *string   `json:"router_country_mmdb"`
 	RouterCountryFile         *string   `json:"router_country_file"`
 	RouterCountryRules        *[]string `json:"router_country_rules"`
+
+	// ACL changes the client ACL of the listener groups it names; within
+	// a group each list follows the rule above.
+	ACL map[string]ACLOverride `json:"acl"`
 }
 
 // Validate checks all supplied values. Clearing an override (empty string
@@ -196,9 +202,38 @@ func (c ConfigChanges) Validate() error {
 			return err
 		}
 	}
+	for group, acl := range c.ACL {
+		if !slices.Contains(ACLGroups, group) {
+			return fmt.Errorf("unknown acl listener group %q", group)
+		}
+		for name, entries := range acl.lists() {
+			if entries == nil {
+				continue
+			}
+			for _, e := range *entries {
+				if !validClientPrefix(e) {
+					return fmt.Errorf("invalid acl.%s.%s entry %q: want a CIDR or IP", group, name, e)
+				}
+			}
+		}
+	}
 	return nil
 }
 
+// lists maps the lists of an ACL override to their JSON names.
+func (o ACLOverride) lists() map[string]*[]string {
+	return map[string]*[]string{"allow": o.Allow, "deny": o.Deny}
+}
+
+// validClientPrefix accepts a CIDR or a bare IP, the client ACL entry forms.
+func validClientPrefix(s string) bool {
+	if _, err := netip.ParsePrefix(s); err == nil {
+		return true
+	}
+	_, err := netip.ParseAddr(s)
+	return err == nil
+}
+
 // validRemoteAddr mirrors the dialer's upstream address acceptance: host:port
 // with both parts present, a bare hostname, or a bare IPv6 literal. Anything
 // the dialer would reject at startup (and thus crash-loop the process after a
@@ -274,6 +309,7 @@ func (s *Server) handleConfigPatch(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusBadRequest, err.Error())
 		return
 	}
+	before := s.opts.Config.ConfigView()
 	view, err := s.opts.Config.ApplyConfigChanges(req.Changes, req.Revision)
 	if errors.Is(err, ErrRevisionMismatch) {
 		writeError(w, http.StatusConflict, "config changed since load; refresh and retry")
@@ -283,6 +319,8 @@ func (s *Server) handleConfigPatch(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
+	from, to := configDiff(before, view)
+	s.audit(r, AuditConfigUpdate, changedConfigKeys(req.Changes), from, to)
 	writeJSON(w, http.StatusOK, view)
 }
 
@@ -294,6 +332,8 @@ func (s *Server) handleRestart(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusNotImplemented, "restart unavailable")
 		return
 	}
+	// Record first: the process may exit before a later write lands.
+	s.audit(r, AuditRestart, "", nil, nil)
 	if err := s.opts.Restart(); err != nil {
 		writeError(w, http.StatusInternalServerError, err.Error())
 		return
@@ -0,0 +1,197 @@
+package admin
+
+import (
+	"cmp"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/sower-proxy/sower/router"
+)
+
+// ConnStat is one open client connection as listed by /api/connections.
+// Domain, Port and Route stay empty until the connection is bound to a
+// target and dialed.
+type ConnStat struct {
+	ID        uint64    `json:"id"`
+	Kind      string    `json:"kind"`
+	Listener  string    `json:"listener,omitempty"`
+	Client    string    `json:"client"`
+	Hostname  string    `json:"hostname"`
+	Domain    string    `json:"domain"`
+	Port      uint16    `json:"port"`
+	Route     string    `json:"route"`
+	Start     time.Time `json:"start"`
+	BytesUp   uint64    `json:"bytesUp"`
+	BytesDown uint64    `json:"bytesDown"`
+}
+
+// connUpstream is the connection dialed for a client connection.
+type connUpstream struct {
+	conn net.Conn
+	port uint16
+}
+
+func (s *Stats) openConn(cc *countingConn) {
+	cc.id = s.connSeq.Add(1)
+	s.connMu.Lock()
+	if s.openConns == nil {
+		s.openConns = make(map[uint64]*countingConn)
+	}
+	s.openConns[cc.id] = cc
+	s.connMu.Unlock()
+}
+
+func (s *Stats) closeConn(cc *countingConn) {
+	s.connMu.Lock()
+	delete(s.openConns, cc.id)
+	s.connMu.Unlock()
+}
+
+// BindUpstream records upstream, dialed to port, as the connection serving
+// a wrapped client connection, replacing any earlier one. Connections reads
+// its route with router.RouteOf on every listing, so a direct connection
+// that fell back to the proxy shows up as proxied. CloseConnection closes
+// it together with the client side. It is a no-op when conn was not
+// created by WrapConn.
+func (s *Stats) BindUpstream(conn, upstream net.Conn, port uint16) {
+	cc, ok := conn.(*countingConn)
+	if !ok {
+		return
+	}
+	cc.upstream.Store(&connUpstream{conn: upstream, port: port})
+}
+
+// Connections lists the open connections, newest first. A non-empty client
+// keeps only that client IP's connections.
+func (s *Stats) Connections(client string) []ConnStat {
+	s.connMu.Lock()
+	open := make([]*countingConn, 0, len(s.openConns))
+	for _, cc := range s.openConns {
+		if client == "" || cc.clientIP == client {
+			open = append(open, cc)
+		}
+	}
+	s.connMu.Unlock()
+
+	out := make([]ConnStat, 0, len(open))
+	for _, cc := range open {
+		c := ConnStat{
+			ID:        cc.id,
+			Kind:      cc.kind,
+			Listener:  cc.listenerName,
+			Client:    cc.clientIP,
+			Start:     cc.created,
+			BytesUp:   cc.bytesUp.Load(),
+			BytesDown: cc.bytesDown.Load(),
+		}
+		c.Domain, _ = cc.domain.Load().(string)
+		if up := cc.upstream.Load(); up != nil {
+			c.Port, c.Route = up.port, string(router.RouteOf(up.conn))
+		}
+		out = append(out, c)
+	}
+	slices.SortFunc(out, func(a, b ConnStat) int {
+		return cmp.Or(b.Start.Compare(a.Start), cmp.Compare(b.ID, a.ID))
+	})
+	return out
+}
+
+// CloseConnection closes an open connection and its upstream, reporting
+// whether id was open.
+func (s *Stats) CloseConnection(id uint64) bool {
+	s.connMu.Lock()
+	cc := s.openConns[id]
+	s.connMu.Unlock()
+	if cc == nil {
+		return false
+	}
+	if up := cc.upstream.Load(); up != nil {
+		_ = up.conn.Close()
+	}
+	_ = cc.Close()
+	return true
+}
+
+func (s *Server) handleConnections(w http.ResponseWriter, r *http.Request) {
+	if s.opts.Stats == nil {
+		writeError(w, http.StatusInternalServerError, "stats unavailable")
+		return
+	}
+	writeJSON(w, http.StatusOK, s.connections(r.URL.Query().Get("client")))
+}
+
+// handleConnectionsStream pushes the open-connection list every tick,
+// revalidating the session like handleStream.
+func (s *Server) handleConnectionsStream(w http.ResponseWriter, r *http.Request) {
+	if s.opts.Stats == nil {
+		writeError(w, http.StatusInternalServerError, "stats unavailable")
+		return
+	}
+	client := r.URL.Query().Get("client")
+	send, ok := startSSE(w)
+	if !ok {
+		return
+	}
+	if !send("connections", s.connections(client)) {
+		return
+	}
+
+	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+			valid, renewed := s.revalidate(r)
+			if !valid {
+				send("auth", map[string]any{"status": http.StatusUnauthorized})
+				return
+			}
+			if renewed {
+				send("renew", map[string]any{})
+				return
+			}
+			if !send("connections", s.connections(client)) {
+				return
+			}
+		}
+	}
+}
+
+func (s *Server) handleConnectionClose(w http.ResponseWriter, r *http.Request) {
+	if s.opts.Stats == nil {
+		writeError(w, http.StatusInternalServerError, "stats unavailable")
+		return
+	}
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid connection id")
+		return
+	}
+	if !s.opts.Stats.CloseConnection(id) {
+		writeError(w, http.StatusNotFound, "connection not found")
+		return
+	}
+	slog.Info("admin closed connection", "id", id, "client", remoteIP(r.RemoteAddr))
+	s.audit(r, AuditConnectionClose, r.PathValue("id"), nil, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// connections lists the open connections with client hostnames attached.
+func (s *Server) connections(client string) []ConnStat {
+	conns := s.opts.Stats.Connections(client)
+	clients := make([]ClientStat, len(conns))
+	for i := range conns {
+		clients[i].IP = conns[i].Client
+	}
+	s.attachHostnames(clients)
+	for i := range conns {
+		conns[i].Hostname = clients[i].Hostname
+	}
+	return conns
+}
@@ -0,0 +1,123 @@
+package admin
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/sower-proxy/sower/router"
+)
+
+type closeRecorder struct {
+	net.Conn
+	closed atomic.Bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed.Store(true)
+	return nil
+}
+
+// routedUpstream returns upstream as a Router's proxy dial hands it out,
+// tagged with its route.
+func routedUpstream(t *testing.T, upstream net.Conn) net.Conn {
+	t.Helper()
+	r := &router.Router{ProxyDial: func(string, string, uint16) (net.Conn, error) { return upstream, nil }}
+	conn, err := r.DialProxyOnly("tcp", "example.com", 443)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	return conn
+}
+
+func TestStatsConnectionsRegistry(t *testing.T) {
+	s := newTestStats(t)
+	s.AddListener("lan", "socks5", "127.0.0.1:1080", "smart")
+
+	first := s.WrapConn(&fakeConn{readBuf: []byte("hello")}, "https")
+	second := s.WrapListenerConn(&fakeConn{}, "socks5", "lan")
+	s.BindConn(first, "example.com")
+	s.BindUpstream(first, routedUpstream(t, &closeRecorder{}), 443)
+	if _, err := first.Read(make([]byte, 8)); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	s.BindUpstream(&fakeConn{}, &closeRecorder{}, 80) // unwrapped: ignored
+
+	conns := s.Connections("")
+	if len(conns) != 2 {
+		t.Fatalf("connections = %+v, want 2", conns)
+	}
+	// Newest first.
+	if conns[0].Kind != "socks5" || conns[0].Listener != "lan" || conns[0].Domain != "" || conns[0].Route != "" {
+		t.Fatalf("newest = %+v", conns[0])
+	}
+	got := conns[1]
+	if got.Kind != "https" || got.Client != "192.0.2.1" || got.Domain != "example.com" ||
+		got.Port != 443 || got.Route != "proxy" || got.BytesUp != 5 || got.Start.IsZero() {
+		t.Fatalf("bound connection = %+v", got)
+	}
+	if len(s.Connections("198.51.100.1")) != 0 {
+		t.Fatal("client filter kept another client's connections")
+	}
+
+	_ = second.Close()
+	if conns := s.Connections(""); len(conns) != 1 || conns[0].ID != got.ID {
+		t.Fatalf("after close = %+v", conns)
+	}
+}
+
+func TestConnectionsEndpoints(t *testing.T) {
+	stats := newTestStats(t)
+	s := NewServer(Options{Password: "secret", Version: "v1.2.3", Date: "2026-01-01", Rules: newFakeRules(), Stats: stats})
+	ts := httptest.NewServer(s.http.Handler)
+	t.Cleanup(ts.Close)
+	cookie := login(t, ts, "secret")
+
+	conn := stats.WrapConn(&fakeConn{}, "http")
+	stats.BindConn(conn, "example.com")
+	upstream := &closeRecorder{}
+	stats.BindUpstream(conn, routedUpstream(t, upstream), 80)
+
+	resp := authedRequest(t, ts, http.MethodGet, "/api/connections", cookie, "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("list status = %d", resp.StatusCode)
+	}
+	var conns []ConnStat
+	if err := json.NewDecoder(resp.Body).Decode(&conns); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	resp.Body.Close()
+	if len(conns) != 1 || conns[0].Domain != "example.com" || conns[0].Route != "proxy" {
+		t.Fatalf("connections = %+v", conns)
+	}
+
+	for _, test := range []struct {
+		path string
+		want int
+	}{
+		{path: "/api/connections/abc", want: http.StatusBadRequest},
+		{path: "/api/connections/999", want: http.StatusNotFound},
+	} {
+		resp := authedRequest(t, ts, http.MethodDelete, test.path, cookie, "")
+		resp.Body.Close()
+		if resp.StatusCode != test.want {
+			t.Fatalf("DELETE %s = %d, want %d", test.path, resp.StatusCode, test.want)
+		}
+	}
+
+	resp = authedRequest(t, ts, http.MethodDelete, "/api/connections/"+strconv.FormatUint(conns[0].ID, 10), cookie, "")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("DELETE status = %d", resp.StatusCode)
+	}
+	if !upstream.closed.Load() {
+		t.Fatal("upstream left open")
+	}
+	if len(stats.Connections("")) != 0 {
+		t.Fatal("closed connection still listed")
+	}
+}
@@ -15,6 +15,21 @@ type countingConn struct {
 	created  time.Time
 	domain   atomic.Value // string; empty until BindConn
 	closed   atomic.Bool
+	// listener is the named proxy listener that accepted the connection,
+	// nil for the DNS-mode and transparent listeners.
+	listenerName string
+	listener     *listenerStat
+	// limits shapes the connection and meters its client quota; nil when
+	// no limit applies.
+	limits *connLimits
+	// id keys the connection in the open-connection registry; upstream is
+	// the connection dialed for it, set by BindUpstream.
+	id       uint64
+	upstream atomic.Pointer[connUpstream]
+	// bytesUp and bytesDown are the connection's own totals, for the
+	// open-connection list.
+	bytesUp   atomic.Uint64
+	bytesDown atomic.Uint64
 
 	// Per-direction pending byte batches. Read and Write run on different
 	// relay goroutines, so each direction is owned by one goroutine and the
@@ -35,20 +50,42 @@ const (
 	flushInterval = 500 * time.Millisecond
 )
 
+// Read and Write refuse I/O once the client's block-action quota is used
+// up, and wait after each transfer until the rate limits admit it.
 func (c *countingConn) Read(p []byte) (int, error) {
+	if c.limits != nil && c.limits.blocked() {
+		return 0, ErrQuotaExhausted
+	}
 	n, err := c.Conn.Read(p)
 	if n > 0 {
 		c.stats.bytesUp.Add(uint64(n))
+		c.bytesUp.Add(uint64(n))
+		if c.listener != nil {
+			c.listener.bytesUp.Add(uint64(n))
+		}
 		c.addBytes(true, uint64(n))
+		if c.limits != nil {
+			c.limits.account(true, n)
+		}
 	}
 	return n, err
 }
 
 func (c *countingConn) Write(p []byte) (int, error) {
+	if c.limits != nil && c.limits.blocked() {
+		return 0, ErrQuotaExhausted
+	}
 	n, err := c.Conn.Write(p)
 	if n > 0 {
 		c.stats.bytesDown.Add(uint64(n))
+		c.bytesDown.Add(uint64(n))
+		if c.listener != nil {
+			c.listener.bytesDown.Add(uint64(n))
+		}
 		c.addBytes(false, uint64(n))
+		if c.limits != nil {
+			c.limits.account(false, n)
+		}
 	}
 	return n, err
 }
@@ -65,17 +102,36 @@ func (c *countingConn) Close() error {
 			c.stats.activeHTTPS.Add(^uint64(0))
 		case "socks5":
 			c.stats.activeSocks.Add(^uint64(0))
+		case "transparent":
+			c.stats.activeTransparent.Add(^uint64(0))
+		}
+		if c.listener != nil {
+			c.listener.active.Add(^uint64(0))
 		}
 		c.stats.metrics.ConnClosed(c.kind)
 		c.stats.metrics.RecordConnDuration(time.Since(c.created))
 		c.flush(true, c.pendingUp.Swap(0))
 		c.flush(false, c.pendingDown.Swap(0))
+		c.stats.closeConn(c)
+		if c.limits != nil {
+			c.limits.release()
+		}
 	}
 	return c.Conn.Close()
 }
 
+// bind attributes the connection's bytes to domain from now on. Rebinding
+// to another domain, as a keep-alive HTTP connection does per request,
+// first flushes the batch counted for the previous one.
 func (c *countingConn) bind(domain string) {
+	if prev, _ := c.domain.Load().(string); prev != "" && prev != domain {
+		c.flush(true, c.pendingUp.Swap(0))
+		c.flush(false, c.pendingDown.Swap(0))
+	}
 	c.domain.Store(domain)
+	if c.limits != nil {
+		c.limits.bind(domain)
+	}
 }
 
 // addBytes accumulates payload bytes per direction and flushes the batch
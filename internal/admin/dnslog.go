@@ -0,0 +1,364 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultDNSLogSize = 1000
+	// dnsLogSinkQueue bounds entries waiting for the file sink. A stalled
+	// disk drops entries (counted) instead of back-pressuring DNS serving.
+	dnsLogSinkQueue = 1024
+	// dnsLogSubscriberQueue bounds entries buffered per live stream; a slow
+	// console misses entries rather than slowing the recorder.
+	dnsLogSubscriberQueue = 256
+	maxDNSLogSubscribers  = 16
+)
+
+// DNSLogEntry is one answered DNS query.
+type DNSLogEntry struct {
+	Time     time.Time `json:"time"`
+	Client   string    `json:"client"`
+	Domain   string    `json:"domain"`
+	Type     string    `json:"type"`
+	Decision string    `json:"decision"`
+	Upstream string    `json:"upstream,omitempty"`
+	Rcode    string    `json:"rcode"`
+	// DurationMs is the time from receiving the query to writing the reply.
+	DurationMs float64 `json:"durationMs"`
+}
+
+// DNSLogFilter selects entries for the query and stream endpoints. Empty
+// fields match everything; Domain is a case-insensitive substring, the rest
+// are exact (Rcode case-insensitive).
+type DNSLogFilter struct {
+	Client   string
+	Domain   string
+	Decision string
+	Rcode    string
+}
+
+func (f DNSLogFilter) match(e DNSLogEntry) bool {
+	return (f.Client == "" || e.Client == f.Client) &&
+		(f.Domain == "" || strings.Contains(e.Domain, strings.ToLower(f.Domain))) &&
+		(f.Decision == "" || e.Decision == f.Decision) &&
+		(f.Rcode == "" || strings.EqualFold(e.Rcode, f.Rcode))
+}
+
+// DNSLogOptions configures the optional JSONL file sink. An empty File keeps
+// the log in memory only.
+type DNSLogOptions struct {
+	Size       int
+	File       string
+	MaxBytes   int64
+	MaxBackups int
+}
+
+// DNSLog keeps the most recent DNS queries in a bounded ring, fans them out to
+// live subscribers, and optionally appends them to a size-rotated JSONL file.
+type DNSLog struct {
+	mu      sync.Mutex
+	entries []DNSLogEntry // ring, next is the oldest slot once full
+	next    int
+	full    bool
+	subs    map[chan DNSLogEntry]struct{}
+
+	sink    chan DNSLogEntry
+	closed  bool // guarded by mu
+	done    chan struct{}
+	dropped atomic.Uint64
+}
+
+// NewDNSLog creates a query log. A non-empty opts.File starts the file sink;
+// the file is opened up front so a bad path fails at startup.
+func NewDNSLog(opts DNSLogOptions) (*DNSLog, error) {
+	if opts.Size <= 0 {
+		opts.Size = defaultDNSLogSize
+	}
+	l := &DNSLog{
+		entries: make([]DNSLogEntry, opts.Size),
+		subs:    make(map[chan DNSLogEntry]struct{}),
+	}
+	if opts.File != "" {
+		w, err := newRotatingFile(opts.File, opts.MaxBytes, opts.MaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		l.sink = make(chan DNSLogEntry, dnsLogSinkQueue)
+		l.done = make(chan struct{})
+		go l.runSink(w)
+	}
+	return l, nil
+}
+
+// Record appends one entry. It never blocks on the file sink or subscribers.
+func (l *DNSLog) Record(e DNSLogEntry) {
+	e.Domain = normalizeDomain(e.Domain)
+
+	l.mu.Lock()
+	l.entries[l.next] = e
+	l.next++
+	if l.next == len(l.entries) {
+		l.next = 0
+		l.full = true
+	}
+	for ch := range l.subs {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+	if l.sink != nil && !l.closed {
+		select {
+		case l.sink <- e:
+		default:
+			l.dropped.Add(1)
+		}
+	}
+	l.mu.Unlock()
+}
+
+// Query returns up to limit matching entries, newest first.
+func (l *DNSLog) Query(f DNSLogFilter, limit int) []DNSLogEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	n := l.next
+	if l.full {
+		n = len(l.entries)
+	}
+	out := make([]DNSLogEntry, 0, min(limit, n))
+	for i := 0; i < n && len(out) < limit; i++ {
+		e := l.entries[(l.next-1-i+len(l.entries))%len(l.entries)]
+		if f.match(e) {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// Subscribe registers a live subscriber. The returned cancel func must be
+// called to release it. ok is false when the subscriber limit is reached.
+func (l *DNSLog) Subscribe() (<-chan DNSLogEntry, func(), bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.subs) >= maxDNSLogSubscribers {
+		return nil, nil, false
+	}
+	ch := make(chan DNSLogEntry, dnsLogSubscriberQueue)
+	l.subs[ch] = struct{}{}
+	return ch, func() {
+		l.mu.Lock()
+		delete(l.subs, ch)
+		l.mu.Unlock()
+	}, true
+}
+
+// Dropped returns how many entries the file sink had to drop.
+func (l *DNSLog) Dropped() uint64 {
+	return l.dropped.Load()
+}
+
+// Close drains the file sink and closes the file. Entries recorded
+// afterwards stay in memory only.
+func (l *DNSLog) Close() {
+	if l.sink == nil {
+		return
+	}
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return
+	}
+	l.closed = true
+	close(l.sink)
+	l.mu.Unlock()
+	<-l.done
+}
+
+func (l *DNSLog) runSink(w *rotatingFile) {
+	defer close(l.done)
+	defer func() {
+		if err := w.Close(); err != nil {
+			slog.Warn("close dns query log", "error", err)
+		}
+	}()
+
+	var failing bool
+	for e := range l.sink {
+		line, err := json.Marshal(e)
+		if err != nil {
+			continue
+		}
+		err = w.Write(append(line, '\n'))
+		// Log only transitions so a full disk does not flood the log.
+		switch {
+		case err != nil && !failing:
+			slog.Warn("write dns query log", "error", err)
+			failing = true
+		case err == nil && failing:
+			slog.Info("dns query log writes recovered")
+			failing = false
+		}
+	}
+}
+
+// rotatingFile appends to path and rotates it to path.1 … path.N once it
+// would exceed maxBytes. Rotation is size-based only; maxBytes <= 0 disables
+// it.
+type rotatingFile struct {
+	path       string
+	maxBytes   int64
+	maxBackups int
+	f          *os.File
+	size       int64
+}
+
+func newRotatingFile(path string, maxBytes int64, maxBackups int) (*rotatingFile, error) {
+	w := &rotatingFile{path: path, maxBytes: maxBytes, maxBackups: maxBackups}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *rotatingFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(w.path), 0o700); err != nil {
+		return fmt.Errorf("create log dir: %w", err)
+	}
+	f, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("open log %s: %w", w.path, err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return fmt.Errorf("stat log %s: %w", w.path, err)
+	}
+	w.f, w.size = f, info.Size()
+	return nil
+}
+
+func (w *rotatingFile) Write(p []byte) error {
+	if w.f == nil {
+		// A previous rotation failed to reopen; retry on every write.
+		if err := w.open(); err != nil {
+			return err
+		}
+	}
+	if w.maxBytes > 0 && w.size > 0 && w.size+int64(len(p)) > w.maxBytes {
+		if err := w.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := w.f.Write(p)
+	w.size += int64(n)
+	return err
+}
+
+func (w *rotatingFile) rotate() error {
+	if err := w.f.Close(); err != nil {
+		slog.Debug("close log for rotation", "path", w.path, "error", err)
+	}
+	w.f = nil
+	if w.maxBackups <= 0 {
+		_ = os.Remove(w.path)
+	} else {
+		for i := w.maxBackups - 1; i >= 1; i-- {
+			_ = os.Rename(fmt.Sprintf("%s.%d", w.path, i), fmt.Sprintf("%s.%d", w.path, i+1))
+		}
+		if err := os.Rename(w.path, w.path+".1"); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("rotate log %s: %w", w.path, err)
+		}
+	}
+	return w.open()
+}
+
+func (w *rotatingFile) Close() error {
+	if w.f == nil {
+		return nil
+	}
+	return w.f.Close()
+}
+
+// parseDNSLogQuery extracts the filters shared by /api/dns/log and its
+// stream.
+func parseDNSLogQuery(r *http.Request) DNSLogFilter {
+	q := r.URL.Query()
+	return DNSLogFilter{
+		Client:   q.Get("client"),
+		Domain:   q.Get("domain"),
+		Decision: q.Get("decision"),
+		Rcode:    q.Get("rcode"),
+	}
+}
+
+func (s *Server) handleDNSLog(w http.ResponseWriter, r *http.Request) {
+	limit := defaultPageSize
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			writeError(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+		limit = min(n, maxPageSize)
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"entries": s.opts.DNSLog.Query(parseDNSLogQuery(r), limit),
+		"dropped": s.opts.DNSLog.Dropped(),
+	})
+}
+
+// handleDNSLogStream pushes matching queries as they are answered. It opens
+// with the latest matching entries, then sends one "dns" event per query and
+// revalidates the session on the same cadence as the traffic stream.
+func (s *Server) handleDNSLogStream(w http.ResponseWriter, r *http.Request) {
+	filter := parseDNSLogQuery(r)
+	entries, cancel, ok := s.opts.DNSLog.Subscribe()
+	if !ok {
+		writeError(w, http.StatusServiceUnavailable, "too many DNS log streams")
+		return
+	}
+	defer cancel()
+
+	send, ok := startSSE(w)
+	if !ok {
+		return
+	}
+	if !send("log", s.opts.DNSLog.Query(filter, defaultPageSize)) {
+		return
+	}
+
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+			valid, renewed := s.revalidate(r)
+			if !valid {
+				send("auth", map[string]any{"status": http.StatusUnauthorized})
+				return
+			}
+			if renewed {
+				send("renew", map[string]any{})
+				return
+			}
+		case e := <-entries:
+			if filter.match(e) && !send("dns", e) {
+				return
+			}
+		}
+	}
+}
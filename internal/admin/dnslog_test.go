@@ -0,0 +1,205 @@
+package admin
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestDNSLog(t *testing.T, opts DNSLogOptions) *DNSLog {
+	t.Helper()
+	l, err := NewDNSLog(opts)
+	if err != nil {
+		t.Fatalf("new dns log: %v", err)
+	}
+	t.Cleanup(l.Close)
+	return l
+}
+
+func TestDNSLogRingKeepsNewestFirst(t *testing.T) {
+	t.Parallel()
+
+	l := newTestDNSLog(t, DNSLogOptions{Size: 3})
+	for _, d := range []string{"a.com.", "b.com.", "c.com.", "d.com."} {
+		l.Record(DNSLogEntry{Domain: d, Decision: "forwarded", Rcode: "NOERROR"})
+	}
+
+	got := l.Query(DNSLogFilter{}, 10)
+	var domains []string
+	for _, e := range got {
+		domains = append(domains, e.Domain)
+	}
+	if strings.Join(domains, ",") != "d.com,c.com,b.com" {
+		t.Fatalf("ring contents = %v, want newest three first", domains)
+	}
+	if got := l.Query(DNSLogFilter{}, 1); len(got) != 1 || got[0].Domain != "d.com" {
+		t.Fatalf("limit 1 = %v", got)
+	}
+}
+
+func TestDNSLogFilters(t *testing.T) {
+	t.Parallel()
+
+	l := newTestDNSLog(t, DNSLogOptions{Size: 10})
+	l.Record(DNSLogEntry{Client: "10.0.0.2", Domain: "ads.example.com.", Decision: "block", Rcode: "NXDOMAIN"})
+	l.Record(DNSLogEntry{Client: "10.0.0.3", Domain: "www.example.com.", Decision: "forwarded", Rcode: "NOERROR"})
+	l.Record(DNSLogEntry{Client: "10.0.0.2", Domain: "video.test.", Decision: "proxy-local", Rcode: "NOERROR"})
+
+	for _, test := range []struct {
+		name   string
+		filter DNSLogFilter
+		want   int
+	}{
+		{"client", DNSLogFilter{Client: "10.0.0.2"}, 2},
+		{"domain substring", DNSLogFilter{Domain: "EXAMPLE"}, 2},
+		{"decision", DNSLogFilter{Decision: "block"}, 1},
+		{"rcode case-insensitive", DNSLogFilter{Rcode: "noerror"}, 2},
+		{"combined", DNSLogFilter{Client: "10.0.0.2", Rcode: "NOERROR"}, 1},
+	} {
+		if got := l.Query(test.filter, 10); len(got) != test.want {
+			t.Fatalf("%s: got %d entries, want %d", test.name, len(got), test.want)
+		}
+	}
+}
+
+func TestDNSLogFileSinkRotates(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "dns.jsonl")
+	l, err := NewDNSLog(DNSLogOptions{Size: 10, File: path, MaxBytes: 200, MaxBackups: 2})
+	if err != nil {
+		t.Fatalf("new dns log: %v", err)
+	}
+	for range 10 {
+		l.Record(DNSLogEntry{Domain: "www.example.com.", Decision: "forwarded", Rcode: "NOERROR"})
+	}
+	l.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read log: %v", err)
+	}
+	if len(data) > 200 {
+		t.Fatalf("active log grew past the rotation size: %d bytes", len(data))
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var e DNSLogEntry
+		if err := json.Unmarshal([]byte(line), &e); err != nil || e.Domain != "www.example.com" {
+			t.Fatalf("bad JSONL line %q: %v", line, err)
+		}
+	}
+	for _, backup := range []string{path + ".1", path + ".2"} {
+		if _, err := os.Stat(backup); err != nil {
+			t.Fatalf("expected rotated file %s: %v", backup, err)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("kept more backups than configured: %v", err)
+	}
+
+	// Recording after Close must not panic on the closed sink.
+	l.Record(DNSLogEntry{Domain: "late.example.com."})
+}
+
+func TestDNSLogEndpoint(t *testing.T) {
+	l := newTestDNSLog(t, DNSLogOptions{Size: 10})
+	l.Record(DNSLogEntry{Client: "10.0.0.2", Domain: "ads.example.com.", Decision: "block", Rcode: "NXDOMAIN"})
+	l.Record(DNSLogEntry{Client: "10.0.0.3", Domain: "www.example.com.", Decision: "forwarded", Upstream: "8.8.8.8:53", Rcode: "NOERROR"})
+
+	s := NewServer(Options{Password: "secret", Rules: newFakeRules(), Stats: newTestStats(t), DNSLog: l})
+	ts := httptest.NewServer(s.http.Handler)
+	t.Cleanup(ts.Close)
+	cookie := login(t, ts, "secret")
+
+	resp := authedRequest(t, ts, http.MethodGet, "/api/dns/log?decision=forwarded", cookie, "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d", resp.StatusCode)
+	}
+	body := decodeBody(t, resp)
+	entries, _ := body["entries"].([]any)
+	if len(entries) != 1 {
+		t.Fatalf("entries = %v, want one forwarded entry", body["entries"])
+	}
+	if e := entries[0].(map[string]any); e["upstream"] != "8.8.8.8:53" || e["domain"] != "www.example.com" {
+		t.Fatalf("unexpected entry: %v", e)
+	}
+
+	resp = authedRequest(t, ts, http.MethodGet, "/api/dns/log?limit=0", cookie, "")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("limit=0 status = %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestDNSLogEndpointAbsentWithoutLog(t *testing.T) {
+	ts := newTestServer(t, newFakeRules())
+	cookie := login(t, ts, "secret")
+
+	resp := authedRequest(t, ts, http.MethodGet, "/api/dns/log", cookie, "")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("status = %d, want 404 when the query log is off", resp.StatusCode)
+	}
+}
+
+func TestDNSLogStreamPushesMatchingEntries(t *testing.T) {
+	l := newTestDNSLog(t, DNSLogOptions{Size: 10})
+	s := NewServer(Options{Password: "secret", Rules: newFakeRules(), Stats: newTestStats(t), DNSLog: l})
+	ts := httptest.NewServer(s.http.Handler)
+	t.Cleanup(ts.Close)
+	cookie := login(t, ts, "secret")
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/api/dns/log/stream?decision=block", nil)
+	if err != nil {
+		t.Fatalf("new request: %v", err)
+	}
+	req.Header.Set("Cookie", sessionCookieName+"="+cookie)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("get stream: %v", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/event-stream") {
+		t.Fatalf("expected text/event-stream, got %q", ct)
+	}
+
+	lines := make(chan string, 16)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+
+	// Wait for the initial backlog event so the subscription is live.
+	waitFor := func(prefix string) string {
+		t.Helper()
+		deadline := time.After(3 * time.Second)
+		for {
+			select {
+			case <-deadline:
+				t.Fatalf("timed out waiting for %q", prefix)
+			case line := <-lines:
+				if strings.HasPrefix(line, prefix) {
+					return line
+				}
+			}
+		}
+	}
+	waitFor("event: log")
+
+	l.Record(DNSLogEntry{Domain: "www.example.com.", Decision: "forwarded", Rcode: "NOERROR"})
+	l.Record(DNSLogEntry{Domain: "ads.example.com.", Decision: "block", Rcode: "NXDOMAIN"})
+
+	waitFor("event: dns")
+	data := waitFor("data: ")
+	if !strings.Contains(data, `"ads.example.com"`) {
+		t.Fatalf("stream sent a non-matching entry: %s", data)
+	}
+}
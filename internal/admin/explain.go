@@ -0,0 +1,99 @@
+package admin
+
+import (
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// RouteExplain traces the routing decision for one destination: the checks
+// DialSmart evaluates in order, the resolved IPs with their country data,
+// the route and upstream it arrives at, and what ServeDNS answers for the
+// same name. Pending marks a route that hinges on an access probe not
+// cached yet; Route is then the outcome should the probe fail.
+type RouteExplain struct {
+	Domain       string        `json:"domain"`
+	Port         uint16        `json:"port"`
+	Client       string        `json:"client,omitempty"`
+	Steps        []ExplainStep `json:"steps"`
+	IPs          []ExplainIP   `json:"ips"`
+	ResolveError string        `json:"resolveError,omitempty"`
+	Route        string        `json:"route"`
+	Pending      bool          `json:"pending,omitempty"`
+	Upstream     string        `json:"upstream,omitempty"`
+	DNS          DNSExplain    `json:"dns"`
+	// ACL tells per listener group whether Client may use it.
+	ACL []ACLVerdict `json:"acl,omitempty"`
+}
+
+// ExplainStep is one check of a RouteExplain, e.g. "block-rule" or
+// "access-probe". Rule is the matching rule of a rule check.
+type ExplainStep struct {
+	Check   string `json:"check"`
+	Matched bool   `json:"matched"`
+	Skipped bool   `json:"skipped,omitempty"`
+	Rule    string `json:"rule,omitempty"`
+	Detail  string `json:"detail,omitempty"`
+}
+
+// ExplainIP is one resolved address: the country CIDR containing it or its
+// GeoIP country, and whether that makes it a local site.
+type ExplainIP struct {
+	IP      string `json:"ip"`
+	CIDR    string `json:"cidr,omitempty"`
+	Country string `json:"country,omitempty"`
+	Local   bool   `json:"local"`
+	Error   string `json:"error,omitempty"`
+}
+
+// DNSExplain is the ServeDNS decision for an A query of the name.
+type DNSExplain struct {
+	Decision string `json:"decision"`
+	Rule     string `json:"rule,omitempty"`
+	Answer   string `json:"answer,omitempty"`
+	Upstream string `json:"upstream,omitempty"`
+	Poisoned bool   `json:"poisoned,omitempty"`
+}
+
+// ACLVerdict is a client ACL decision for one listener group.
+type ACLVerdict struct {
+	Listener string `json:"listener"`
+	Allowed  bool   `json:"allowed"`
+}
+
+// RouteExplainer traces routing decisions without dialing.
+type RouteExplainer interface {
+	// ExplainRoute traces domain:port; a valid client adds its ACL verdicts.
+	ExplainRoute(domain string, port uint16, client netip.Addr) RouteExplain
+}
+
+// handleRulesExplain serves GET /api/rules/explain?domain=&port=&client=.
+// The port defaults to 443.
+func (s *Server) handleRulesExplain(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	domain := strings.TrimSpace(q.Get("domain"))
+	if domain == "" || len(domain) > maxRuleLength {
+		writeError(w, http.StatusBadRequest, "domain is required")
+		return
+	}
+	port := uint16(443)
+	if raw := q.Get("port"); raw != "" {
+		n, err := strconv.ParseUint(raw, 10, 16)
+		if err != nil || n == 0 {
+			writeError(w, http.StatusBadRequest, "invalid port")
+			return
+		}
+		port = uint16(n)
+	}
+	var client netip.Addr
+	if raw := strings.TrimSpace(q.Get("client")); raw != "" {
+		addr, err := netip.ParseAddr(raw)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid client IP")
+			return
+		}
+		client = addr.Unmap()
+	}
+	writeJSON(w, http.StatusOK, s.opts.Explain.ExplainRoute(domain, port, client))
+}
@@ -0,0 +1,53 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+type fakeExplainer struct {
+	domain string
+	port   uint16
+	client netip.Addr
+}
+
+func (f *fakeExplainer) ExplainRoute(domain string, port uint16, client netip.Addr) RouteExplain {
+	f.domain, f.port, f.client = domain, port, client
+	return RouteExplain{Domain: domain, Port: port, Route: "proxy", Steps: []ExplainStep{{Check: "fallback", Matched: true}}}
+}
+
+func TestRulesExplainEndpoint(t *testing.T) {
+	ex := &fakeExplainer{}
+	s := NewServer(Options{Password: "secret", Rules: newFakeRules(), Stats: newTestStats(t), Explain: ex})
+	ts := httptest.NewServer(s.http.Handler)
+	t.Cleanup(ts.Close)
+	cookie := login(t, ts, "secret")
+
+	resp := authedRequest(t, ts, http.MethodGet, "/api/rules/explain?domain=example.com&client=::ffff:192.168.1.20", cookie, "")
+	var got RouteExplain
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	resp.Body.Close()
+	if got.Route != "proxy" || ex.domain != "example.com" || ex.port != 443 || ex.client != netip.MustParseAddr("192.168.1.20") {
+		t.Fatalf("explain = %+v, called with %+v", got, ex)
+	}
+
+	for _, query := range []string{"", "domain=example.com&port=0", "domain=example.com&port=70000", "domain=example.com&client=nope"} {
+		resp := authedRequest(t, ts, http.MethodGet, "/api/rules/explain?"+query, cookie, "")
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%q = %d, want 400", query, resp.StatusCode)
+		}
+	}
+
+	ts2 := newTestServer(t, newFakeRules())
+	resp = authedRequest(t, ts2, http.MethodGet, "/api/rules/explain?domain=example.com", login(t, ts2, "secret"), "")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("without explainer = %d, want 404", resp.StatusCode)
+	}
+}
@@ -0,0 +1,422 @@
+package admin
+
+import (
+	"container/list"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sower-proxy/sower/internal/fsutil"
+	"github.com/sower-proxy/sower/pkg/ratelimit"
+)
+
+// Quota periods and the actions taken once a quota is used up.
+const (
+	QuotaDaily   = "daily"
+	QuotaMonthly = "monthly"
+
+	// QuotaBlock cuts the client off, open connections included.
+	QuotaBlock = "block"
+	// QuotaDirect stops proxying the client's new connections.
+	QuotaDirect = "direct"
+)
+
+// maxRateClients bounds the per-client bucket map. Once full, the bucket
+// idle longest is evicted; a client with open connections keeps its bucket,
+// so it never gets a second one beside it.
+const maxRateClients = 4096
+
+// ErrQuotaExhausted is returned by the I/O of a connection whose client
+// has used up a block-action quota.
+var ErrQuotaExhausted = errors.New("client data quota exhausted")
+
+// DomainRate caps the bandwidth of connections bound to a domain matching
+// Pattern. All matching connections share the one budget.
+type DomainRate struct {
+	Pattern     string
+	Match       func(domain string) bool
+	BytesPerSec int64
+}
+
+// QuotaRule is the data budget of the clients in Prefix, counted in both
+// directions and reset at the start of each day or month (local time).
+// Client is the rule as configured and keys its persisted usage; a prefix
+// wider than one address shares the budget among its clients.
+type QuotaRule struct {
+	Client string
+	Prefix netip.Prefix
+	Limit  uint64
+	Period string
+	Action string
+}
+
+// LimitOptions configures a Limiter. Rates are bytes per second in each
+// direction; zero disables the cap. ClientBytesPerSec applies per client
+// address, and per /64 to IPv6 clients.
+type LimitOptions struct {
+	BytesPerSec       int64
+	ClientBytesPerSec int64
+	Domains           []DomainRate
+	Quotas            []QuotaRule
+	// QuotaFile persists quota usage across restarts; empty keeps it in
+	// memory only.
+	QuotaFile string
+}
+
+// QuotaStat is the console view of one client quota.
+type QuotaStat struct {
+	Client    string    `json:"client"`
+	Used      uint64    `json:"used"`
+	Limit     uint64    `json:"limit"`
+	Period    string    `json:"period"`
+	Action    string    `json:"action"`
+	ResetAt   time.Time `json:"resetAt"`
+	Exhausted bool      `json:"exhausted"`
+}
+
+// Limiter shapes relayed bandwidth with token buckets and meters client
+// data quotas. Stats applies it to every wrapped connection.
+type Limiter struct {
+	global     *bucketPair
+	clientRate int64
+	clientMu   sync.Mutex
+	clients    map[string]*clientBucket
+	idle       *list.List // of *clientBucket without open connections, most recent first
+	domains    []domainLimit
+	quotas     []*quotaUsage
+	file       string
+	dirty      atomic.Bool
+	now        func() time.Time
+}
+
+type bucketPair struct {
+	up, down *ratelimit.Bucket
+}
+
+func newBucketPair(bytesPerSec int64) *bucketPair {
+	return &bucketPair{up: ratelimit.New(bytesPerSec), down: ratelimit.New(bytesPerSec)}
+}
+
+func (b *bucketPair) wait(up bool, n int) {
+	if up {
+		b.up.Wait(n)
+	} else {
+		b.down.Wait(n)
+	}
+}
+
+// clientBucket is the bucket pair of one client key, shared by the
+// client's open connections.
+type clientBucket struct {
+	*bucketPair
+	key   string
+	conns int           // open connections, under clientMu
+	idle  *list.Element // position in Limiter.idle while conns is zero
+}
+
+type domainLimit struct {
+	DomainRate
+	buckets *bucketPair
+}
+
+type quotaUsage struct {
+	rule    QuotaRule
+	used    atomic.Uint64
+	resetAt atomic.Int64 // unix nanos at which the current period ends
+}
+
+// NewLimiter builds a limiter and restores the persisted quota usage of
+// the current periods. An unreadable usage file is logged and ignored so
+// it never blocks startup.
+func NewLimiter(opts LimitOptions) *Limiter {
+	l := &Limiter{
+		clientRate: opts.ClientBytesPerSec,
+		clients:    make(map[string]*clientBucket),
+		idle:       list.New(),
+		file:       opts.QuotaFile,
+		now:        time.Now,
+	}
+	if opts.BytesPerSec > 0 {
+		l.global = newBucketPair(opts.BytesPerSec)
+	}
+	for _, d := range opts.Domains {
+		if d.BytesPerSec > 0 && d.Match != nil {
+			l.domains = append(l.domains, domainLimit{DomainRate: d, buckets: newBucketPair(d.BytesPerSec)})
+		}
+	}
+	now := l.now()
+	for _, rule := range opts.Quotas {
+		q := &quotaUsage{rule: rule}
+		q.resetAt.Store(nextQuotaReset(rule.Period, now).UnixNano())
+		l.quotas = append(l.quotas, q)
+	}
+	if err := l.load(); err != nil {
+		slog.Warn("load quota usage", "file", l.file, "error", err)
+	}
+	return l
+}
+
+// nextQuotaReset returns the start of the period after the one holding now.
+func nextQuotaReset(period string, now time.Time) time.Time {
+	y, m, d := now.Date()
+	if period == QuotaDaily {
+		return time.Date(y, m, d+1, 0, 0, 0, 0, now.Location())
+	}
+	return time.Date(y, m+1, 1, 0, 0, 0, 0, now.Location())
+}
+
+// current rolls the quota into the period holding now and returns its
+// usage.
+func (q *quotaUsage) current(now time.Time) uint64 {
+	reset := q.resetAt.Load()
+	if now.UnixNano() >= reset && q.resetAt.CompareAndSwap(reset, nextQuotaReset(q.rule.Period, now).UnixNano()) {
+		q.used.Store(0)
+	}
+	return q.used.Load()
+}
+
+func (q *quotaUsage) exhausted(now time.Time) bool {
+	return q.current(now) >= q.rule.Limit
+}
+
+// connLimits are the buckets and quota one connection is subject to.
+type connLimits struct {
+	limiter *Limiter
+	buckets []*bucketPair
+	client  *clientBucket // released when the connection closes
+	domain  atomic.Pointer[bucketPair]
+	quota   *quotaUsage
+}
+
+// forConn returns the limits of a connection from clientIP, nil when
+// none apply.
+func (l *Limiter) forConn(clientIP string) *connLimits {
+	if l == nil {
+		return nil
+	}
+	cl := &connLimits{limiter: l}
+	if l.global != nil {
+		cl.buckets = append(cl.buckets, l.global)
+	}
+	if l.clientRate > 0 && clientIP != "" {
+		cl.client = l.acquireClient(clientIP)
+		cl.buckets = append(cl.buckets, cl.client.bucketPair)
+	}
+	if len(l.quotas) > 0 {
+		cl.quota = l.quotaFor(clientIP)
+	}
+	if len(cl.buckets) == 0 && cl.quota == nil && len(l.domains) == 0 {
+		return nil
+	}
+	return cl
+}
+
+// acquireClient returns the bucket of clientIP's key for one more open
+// connection. The map only grows past maxRateClients while that many
+// clients have connections open.
+func (l *Limiter) acquireClient(clientIP string) *clientBucket {
+	key := clientKey(clientIP)
+	l.clientMu.Lock()
+	defer l.clientMu.Unlock()
+	b := l.clients[key]
+	if b == nil {
+		if len(l.clients) >= maxRateClients {
+			if e := l.idle.Back(); e != nil {
+				delete(l.clients, l.idle.Remove(e).(*clientBucket).key)
+			}
+		}
+		b = &clientBucket{bucketPair: newBucketPair(l.clientRate), key: key}
+		l.clients[key] = b
+	}
+	if b.idle != nil {
+		l.idle.Remove(b.idle)
+		b.idle = nil
+	}
+	b.conns++
+	return b
+}
+
+// releaseClient drops one open connection from b; the last one makes it
+// evictable.
+func (l *Limiter) releaseClient(b *clientBucket) {
+	l.clientMu.Lock()
+	defer l.clientMu.Unlock()
+	if b.conns--; b.conns == 0 {
+		b.idle = l.idle.PushFront(b)
+	}
+}
+
+// clientKey is the rate-limit key of a client: its address, or its /64
+// for IPv6, where one host can rotate through privacy addresses at will.
+func clientKey(clientIP string) string {
+	ip, err := netip.ParseAddr(clientIP)
+	if err != nil {
+		return clientIP
+	}
+	if ip = ip.Unmap(); ip.Is6() {
+		return netip.PrefixFrom(ip, 64).Masked().String()
+	}
+	return ip.String()
+}
+
+// quotaFor returns the first quota whose prefix holds clientIP.
+func (l *Limiter) quotaFor(clientIP string) *quotaUsage {
+	ip, err := netip.ParseAddr(clientIP)
+	if err != nil {
+		return nil
+	}
+	ip = ip.Unmap()
+	for _, q := range l.quotas {
+		if q.rule.Prefix.Contains(ip) {
+			return q
+		}
+	}
+	return nil
+}
+
+// bind switches the domain bucket to the one matching domain, if any.
+func (cl *connLimits) bind(domain string) {
+	for i := range cl.limiter.domains {
+		if d := &cl.limiter.domains[i]; d.Match(domain) {
+			cl.domain.Store(d.buckets)
+			return
+		}
+	}
+	cl.domain.Store(nil)
+}
+
+// release gives the connection's client bucket back when the connection
+// closes.
+func (cl *connLimits) release() {
+	if cl.client != nil {
+		cl.limiter.releaseClient(cl.client)
+	}
+}
+
+// blocked reports whether the connection's block-action quota is used up.
+func (cl *connLimits) blocked() bool {
+	return cl.quota != nil && cl.quota.rule.Action == QuotaBlock && cl.quota.exhausted(cl.limiter.now())
+}
+
+// account meters n relayed bytes against the quota, then waits until the
+// rate buckets admit them.
+func (cl *connLimits) account(up bool, n int) {
+	if cl.quota != nil {
+		cl.quota.current(cl.limiter.now())
+		cl.quota.used.Add(uint64(n))
+		cl.limiter.dirty.Store(true)
+	}
+	for _, b := range cl.buckets {
+		b.wait(up, n)
+	}
+	if b := cl.domain.Load(); b != nil {
+		b.wait(up, n)
+	}
+}
+
+// SetLimiter applies l to the connections wrapped from now on. It must be
+// called before the listeners start serving.
+func (s *Stats) SetLimiter(l *Limiter) {
+	s.limiter = l
+}
+
+// ExhaustedQuota returns the action of the used-up quota of a wrapped
+// connection's client, or "" while its quota lasts.
+func (s *Stats) ExhaustedQuota(conn net.Conn) string {
+	cc, ok := conn.(*countingConn)
+	if !ok || cc.limits == nil || cc.limits.quota == nil {
+		return ""
+	}
+	if !cc.limits.quota.exhausted(cc.limits.limiter.now()) {
+		return ""
+	}
+	return cc.limits.quota.rule.Action
+}
+
+// QuotaStats returns the quotas in configuration order.
+func (l *Limiter) QuotaStats() []QuotaStat {
+	if l == nil {
+		return nil
+	}
+	now := l.now()
+	out := make([]QuotaStat, 0, len(l.quotas))
+	for _, q := range l.quotas {
+		used := q.current(now)
+		out = append(out, QuotaStat{
+			Client:    q.rule.Client,
+			Used:      used,
+			Limit:     q.rule.Limit,
+			Period:    q.rule.Period,
+			Action:    q.rule.Action,
+			ResetAt:   time.Unix(0, q.resetAt.Load()),
+			Exhausted: used >= q.rule.Limit,
+		})
+	}
+	return out
+}
+
+// quotaFile is the on-disk quota usage document, keyed by QuotaRule.Client.
+type quotaFile struct {
+	Version int                       `json:"version"`
+	Usage   map[string]quotaFileEntry `json:"usage"`
+}
+
+type quotaFileEntry struct {
+	ResetAt time.Time `json:"resetAt"`
+	Used    uint64    `json:"used"`
+}
+
+// load restores usage recorded for the current period of each quota;
+// usage of an elapsed period is dropped.
+func (l *Limiter) load() error {
+	if l.file == "" || len(l.quotas) == 0 {
+		return nil
+	}
+	data, err := os.ReadFile(l.file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var f quotaFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return fmt.Errorf("decode: %w", err)
+	}
+	for _, q := range l.quotas {
+		e, ok := f.Usage[q.rule.Client]
+		if ok && e.ResetAt.UnixNano() == q.resetAt.Load() {
+			q.used.Store(e.Used)
+		}
+	}
+	return nil
+}
+
+// Save writes the quota usage when it changed since the last save.
+func (l *Limiter) Save() error {
+	if l == nil || l.file == "" || !l.dirty.Swap(false) {
+		return nil
+	}
+	now := l.now()
+	f := quotaFile{Version: 1, Usage: make(map[string]quotaFileEntry, len(l.quotas))}
+	for _, q := range l.quotas {
+		used := q.current(now)
+		f.Usage[q.rule.Client] = quotaFileEntry{ResetAt: time.Unix(0, q.resetAt.Load()), Used: used}
+	}
+	data, err := json.Marshal(f)
+	if err == nil {
+		err = fsutil.WriteFileAtomic(l.file, data)
+	}
+	if err != nil {
+		l.dirty.Store(true)
+		return fmt.Errorf("save quota usage %s: %w", l.file, err)
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNextQuotaReset(t *testing.T) {
+	now := time.Date(2026, time.December, 31, 15, 4, 5, 0, time.UTC)
+	if got, want := nextQuotaReset(QuotaDaily, now), time.Date(2027, time.January, 1, 0, 0, 0, 0, time.UTC); !got.Equal(want) {
+		t.Fatalf("daily reset = %v, want %v", got, want)
+	}
+	if got, want := nextQuotaReset(QuotaMonthly, now), time.Date(2027, time.January, 1, 0, 0, 0, 0, time.UTC); !got.Equal(want) {
+		t.Fatalf("monthly reset = %v, want %v", got, want)
+	}
+	now = time.Date(2026, time.March, 10, 0, 0, 0, 0, time.UTC)
+	if got, want := nextQuotaReset(QuotaMonthly, now), time.Date(2026, time.April, 1, 0, 0, 0, 0, time.UTC); !got.Equal(want) {
+		t.Fatalf("monthly reset = %v, want %v", got, want)
+	}
+}
+
+func TestLimiterBlockQuota(t *testing.T) {
+	s := newTestStats(t)
+	l := NewLimiter(LimitOptions{Quotas: []QuotaRule{{
+		Client: "192.0.2.0/24",
+		Prefix: netip.MustParsePrefix("192.0.2.0/24"),
+		Limit:  8,
+		Period: QuotaDaily,
+		Action: QuotaBlock,
+	}}})
+	now := time.Now()
+	l.now = func() time.Time { return now }
+	s.SetLimiter(l)
+
+	wrapped := s.WrapConn(&fakeConn{readBuf: []byte("0123456789")}, "http")
+	if got := s.ExhaustedQuota(wrapped); got != "" {
+		t.Fatalf("fresh quota exhausted with action %q", got)
+	}
+	buf := make([]byte, 16)
+	if n, err := wrapped.Read(buf); n != 10 || err != nil {
+		t.Fatalf("first read = %d, %v", n, err)
+	}
+	if got := s.ExhaustedQuota(wrapped); got != QuotaBlock {
+		t.Fatalf("ExhaustedQuota = %q, want block", got)
+	}
+	if _, err := wrapped.Write([]byte("x")); !errors.Is(err, ErrQuotaExhausted) {
+		t.Fatalf("write past quota = %v, want ErrQuotaExhausted", err)
+	}
+	stats := l.QuotaStats()
+	if len(stats) != 1 || stats[0].Used != 10 || !stats[0].Exhausted {
+		t.Fatalf("quota stats = %+v", stats)
+	}
+
+	// The next day starts a fresh period.
+	now = now.Add(24 * time.Hour)
+	if got := s.ExhaustedQuota(wrapped); got != "" {
+		t.Fatalf("quota still exhausted after reset: %q", got)
+	}
+	if stats := l.QuotaStats(); stats[0].Used != 0 {
+		t.Fatalf("used after reset = %d", stats[0].Used)
+	}
+}
+
+func TestLimiterQuotaSkipsOtherClients(t *testing.T) {
+	s := newTestStats(t)
+	s.SetLimiter(NewLimiter(LimitOptions{Quotas: []QuotaRule{{
+		Client: "198.51.100.7",
+		Prefix: netip.MustParsePrefix("198.51.100.7/32"),
+		Limit:  1,
+		Period: QuotaMonthly,
+		Action: QuotaDirect,
+	}}}))
+	wrapped := s.WrapConn(&fakeConn{readBuf: []byte("hello")}, "http")
+	if _, err := wrapped.Read(make([]byte, 8)); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if got := s.ExhaustedQuota(wrapped); got != "" {
+		t.Fatalf("quota of another client applied: %q", got)
+	}
+}
+
+func TestLimiterPersistsQuotaUsage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quota.json")
+	rules := []QuotaRule{
+		{Client: "192.0.2.1", Prefix: netip.MustParsePrefix("192.0.2.1/32"), Limit: 1 << 20, Period: QuotaMonthly, Action: QuotaDirect},
+		{Client: "192.0.2.2", Prefix: netip.MustParsePrefix("192.0.2.2/32"), Limit: 1 << 20, Period: QuotaDaily, Action: QuotaBlock},
+	}
+	l := NewLimiter(LimitOptions{Quotas: rules, QuotaFile: path})
+	l.quotas[0].used.Store(100)
+	l.quotas[1].used.Store(200)
+	l.dirty.Store(true)
+	if err := l.Save(); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	restored := NewLimiter(LimitOptions{Quotas: rules, QuotaFile: path})
+	stats := restored.QuotaStats()
+	if stats[0].Used != 100 || stats[1].Used != 200 {
+		t.Fatalf("restored usage = %d, %d, want 100, 200", stats[0].Used, stats[1].Used)
+	}
+
+	// Usage recorded for an elapsed period is dropped.
+	stale, err := json.Marshal(quotaFile{Version: 1, Usage: map[string]quotaFileEntry{
+		"192.0.2.1": {ResetAt: time.Now().AddDate(0, -1, 0), Used: 100},
+	}})
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	if err := os.WriteFile(path, stale, 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	restored = NewLimiter(LimitOptions{Quotas: rules, QuotaFile: path})
+	if stats := restored.QuotaStats(); stats[0].Used != 0 {
+		t.Fatalf("usage of an elapsed period restored: %+v", stats[0])
+	}
+}
+
+func TestLimiterBindsDomainBuckets(t *testing.T) {
+	s := newTestStats(t)
+	l := NewLimiter(LimitOptions{Domains: []DomainRate{{
+		Pattern:     "video.example",
+		Match:       func(domain string) bool { return domain == "video.example" },
+		BytesPerSec: 64 << 10,
+	}}})
+	s.SetLimiter(l)
+
+	wrapped := s.WrapConn(&fakeConn{}, "https")
+	limits := wrapped.(*countingConn).limits
+	if limits == nil {
+		t.Fatal("no limits for a limiter with domain rates")
+	}
+	s.BindConn(wrapped, "video.example")
+	if limits.domain.Load() != l.domains[0].buckets {
+		t.Fatal("matching domain not bound to its bucket")
+	}
+	s.BindConn(wrapped, "other.example")
+	if limits.domain.Load() != nil {
+		t.Fatal("rebinding kept the previous domain bucket")
+	}
+
+	var none *Limiter
+	if none.forConn("192.0.2.1") != nil || none.QuotaStats() != nil || none.Save() != nil {
+		t.Fatal("nil limiter is not inert")
+	}
+}
+
+func TestLimiterKeepsBusyClientBucketsWhenFull(t *testing.T) {
+	l := NewLimiter(LimitOptions{ClientBytesPerSec: 1 << 20})
+	busy := l.forConn("10.0.0.1")
+	for i := range maxRateClients {
+		addr := netip.AddrFrom4([4]byte{10, 1, byte(i >> 8), byte(i)})
+		l.forConn(addr.String()).release()
+	}
+	if len(l.clients) != maxRateClients {
+		t.Fatalf("client buckets = %d, want %d", len(l.clients), maxRateClients)
+	}
+	// The client with an open connection kept its bucket; the idle one
+	// seen first was evicted.
+	if again := l.forConn("10.0.0.1"); again.buckets[0] != busy.buckets[0] {
+		t.Fatal("busy client got a second bucket")
+	}
+	if _, ok := l.clients["10.1.0.0"]; ok {
+		t.Fatal("least recently used idle bucket not evicted")
+	}
+}
+
+func TestLimiterKeysIPv6ClientsByPrefix(t *testing.T) {
+	l := NewLimiter(LimitOptions{ClientBytesPerSec: 1 << 20})
+	a, b := l.forConn("2001:db8::1"), l.forConn("2001:db8::abcd:2")
+	if a.buckets[0] != b.buckets[0] {
+		t.Fatal("addresses of one /64 got separate buckets")
+	}
+	if c := l.forConn("2001:db8:0:1::1"); c.buckets[0] == a.buckets[0] {
+		t.Fatal("another /64 shares the bucket")
+	}
+	if d := l.forConn("::ffff:192.0.2.1"); d.buckets[0] != l.forConn("192.0.2.1").buckets[0] {
+		t.Fatal("mapped IPv4 client keyed apart from its IPv4 address")
+	}
+}
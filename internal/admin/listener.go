@@ -0,0 +1,91 @@
+package admin
+
+import (
+	"net"
+	"sort"
+	"sync/atomic"
+)
+
+// ListenerStat aggregates the connections and payload bytes of one named
+// proxy listener. Kind is the listener protocol, socks5 (which also serves
+// HTTP proxy requests) or http, and Mode its routing mode.
+type ListenerStat struct {
+	Name      string `json:"name"`
+	Kind      string `json:"kind"`
+	Addr      string `json:"addr"`
+	Mode      string `json:"mode"`
+	Conns     uint64 `json:"conns"`
+	Active    uint64 `json:"active"`
+	BytesUp   uint64 `json:"bytesUp"`
+	BytesDown uint64 `json:"bytesDown"`
+	// Rejected counts connections refused by the listener's client CIDRs
+	// or credentials.
+	Rejected uint64 `json:"rejected"`
+}
+
+type listenerStat struct {
+	kind, addr, mode string
+
+	conns     atomic.Uint64
+	active    atomic.Uint64
+	bytesUp   atomic.Uint64
+	bytesDown atomic.Uint64
+	rejected  atomic.Uint64
+}
+
+// AddListener registers a proxy listener so it is listed before its first
+// connection. Registering a name again replaces its counters.
+func (s *Stats) AddListener(name, kind, addr, mode string) {
+	s.listenerMu.Lock()
+	defer s.listenerMu.Unlock()
+	if s.listeners == nil {
+		s.listeners = make(map[string]*listenerStat)
+	}
+	s.listeners[name] = &listenerStat{kind: kind, addr: addr, mode: mode}
+}
+
+// WrapListenerConn is WrapConn for a connection accepted by the named proxy
+// listener, whose counters it also feeds. An unregistered name counts only
+// toward kind.
+func (s *Stats) WrapListenerConn(conn net.Conn, kind, listener string) net.Conn {
+	s.listenerMu.RLock()
+	ls := s.listeners[listener]
+	s.listenerMu.RUnlock()
+	if ls != nil {
+		ls.conns.Add(1)
+		ls.active.Add(1)
+	}
+	return s.wrapConn(conn, kind, listener, ls)
+}
+
+// RecordListenerReject counts a connection the named listener refused.
+func (s *Stats) RecordListenerReject(listener string) {
+	s.listenerMu.RLock()
+	ls := s.listeners[listener]
+	s.listenerMu.RUnlock()
+	if ls != nil {
+		ls.rejected.Add(1)
+	}
+}
+
+// listenerStats returns the registered listeners ordered by name.
+func (s *Stats) listenerStats() []ListenerStat {
+	s.listenerMu.RLock()
+	out := make([]ListenerStat, 0, len(s.listeners))
+	for name, ls := range s.listeners {
+		out = append(out, ListenerStat{
+			Name:      name,
+			Kind:      ls.kind,
+			Addr:      ls.addr,
+			Mode:      ls.mode,
+			Conns:     ls.conns.Load(),
+			Active:    ls.active.Load(),
+			BytesUp:   ls.bytesUp.Load(),
+			BytesDown: ls.bytesDown.Load(),
+			Rejected:  ls.rejected.Load(),
+		})
+	}
+	s.listenerMu.RUnlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
@@ -0,0 +1,324 @@
+package admin
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// DefaultStateRevisions is how many revisions a StateStore retains unless
+// configured otherwise.
+const DefaultStateRevisions = 20
+
+// ErrRevisionNotFound reports a revision that is not (or no longer)
+// retained.
+var ErrRevisionNotFound = errors.New("revision not retained")
+
+// StateRevision is the rule deltas and config overrides as of one revision.
+// Tokens and users are credentials, not configuration, and are never
+// versioned.
+type StateRevision struct {
+	Revision  uint64                  `json:"revision"`
+	UpdatedAt time.Time               `json:"updatedAt"`
+	Rules     map[Category]*RuleDelta `json:"rules"`
+	Config    ConfigOverrides         `json:"config"`
+}
+
+// RevisionInfo summarizes a retained revision for the console.
+type RevisionInfo struct {
+	Revision    uint64    `json:"revision"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+	Current     bool      `json:"current"`
+	RuleAdds    int       `json:"ruleAdds"`
+	RuleRemoves int       `json:"ruleRemoves"`
+	ConfigKeys  int       `json:"configKeys"`
+}
+
+// RuleDiff lists the rules effective in the newer revision but not the
+// older one (Added) and the reverse (Removed).
+type RuleDiff struct {
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+}
+
+// ConfigValueDiff is one override's value in two revisions; an absent side
+// means no override, i.e. the file/flag configuration.
+type ConfigValueDiff struct {
+	From json.RawMessage `json:"from,omitempty"`
+	To   json.RawMessage `json:"to,omitempty"`
+}
+
+// RevisionDiff is the change from revision From to revision To.
+type RevisionDiff struct {
+	From   uint64                     `json:"from"`
+	To     uint64                     `json:"to"`
+	Rules  map[Category]RuleDiff      `json:"rules"`
+	Config map[string]ConfigValueDiff `json:"config"`
+}
+
+// SetRevisionLimit sets how many revisions are retained; n <= 0 keeps the
+// default. Older revisions are dropped on the next mutation.
+func (st *StateStore) SetRevisionLimit(n int) {
+	if n <= 0 {
+		n = DefaultStateRevisions
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.revisionLimit = n
+}
+
+// snapshot deep-copies the versioned part of s. The config overrides go
+// through JSON so no pointer is shared with the live state.
+func snapshot(s State) StateRevision {
+	rev := StateRevision{
+		Revision:  s.Revision,
+		UpdatedAt: s.UpdatedAt,
+		Rules:     make(map[Category]*RuleDelta, len(s.Rules)),
+	}
+	for cat, d := range s.Rules {
+		rev.Rules[cat] = d.clone()
+	}
+	if data, err := json.Marshal(s.Config); err == nil {
+		_ = json.Unmarshal(data, &rev.Config)
+	}
+	return rev
+}
+
+// bumpLocked advances the revision of a mutated candidate and retains its
+// snapshot.
+func (st *StateStore) bumpLocked(s *State) {
+	s.bump()
+	st.retainLocked(s)
+}
+
+// retainLocked appends the snapshot of s, replacing one of the same
+// revision, and trims the oldest beyond the limit.
+func (st *StateStore) retainLocked(s *State) {
+	revs := slices.DeleteFunc(slices.Clone(s.Revisions), func(r StateRevision) bool {
+		return r.Revision == s.Revision
+	})
+	revs = append(revs, snapshot(*s))
+	limit := cmp.Or(st.revisionLimit, DefaultStateRevisions)
+	if len(revs) > limit {
+		revs = slices.Delete(revs, 0, len(revs)-limit)
+	}
+	s.Revisions = revs
+}
+
+func (st *StateStore) revisionLocked(revision uint64) (StateRevision, bool) {
+	i := slices.IndexFunc(st.state.Revisions, func(r StateRevision) bool { return r.Revision == revision })
+	if i < 0 {
+		return StateRevision{}, false
+	}
+	return st.state.Revisions[i], true
+}
+
+// Revisions lists the retained revisions, newest first.
+func (st *StateStore) Revisions() []RevisionInfo {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	out := make([]RevisionInfo, 0, len(st.state.Revisions))
+	for _, r := range slices.Backward(st.state.Revisions) {
+		info := RevisionInfo{Revision: r.Revision, UpdatedAt: r.UpdatedAt, Current: r.Revision == st.state.Revision}
+		for _, d := range r.Rules {
+			info.RuleAdds += len(d.Add)
+			info.RuleRemoves += len(d.Remove)
+		}
+		info.ConfigKeys = len(overrideFields(r.Config))
+		out = append(out, info)
+	}
+	return out
+}
+
+// RevisionDiff compares two retained revisions.
+func (st *StateStore) RevisionDiff(from, to uint64) (RevisionDiff, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	a, ok := st.revisionLocked(from)
+	if !ok {
+		return RevisionDiff{}, fmt.Errorf("revision %d: %w", from, ErrRevisionNotFound)
+	}
+	b, ok := st.revisionLocked(to)
+	if !ok {
+		return RevisionDiff{}, fmt.Errorf("revision %d: %w", to, ErrRevisionNotFound)
+	}
+	diff := RevisionDiff{From: from, To: to, Rules: make(map[Category]RuleDiff, 3), Config: make(map[string]ConfigValueDiff)}
+	for _, cat := range []Category{CategoryBlock, CategoryDirect, CategoryProxy} {
+		diff.Rules[cat] = st.ruleDiffLocked(cat, deltaOf(a.Rules, cat), deltaOf(b.Rules, cat))
+	}
+	av, bv := overrideFields(a.Config), overrideFields(b.Config)
+	for k, v := range av {
+		if !bytes.Equal(v, bv[k]) {
+			diff.Config[k] = ConfigValueDiff{From: v, To: bv[k]}
+		}
+	}
+	for k, v := range bv {
+		if _, ok := av[k]; !ok {
+			diff.Config[k] = ConfigValueDiff{To: v}
+		}
+	}
+	return diff, nil
+}
+
+func deltaOf(rules map[Category]*RuleDelta, cat Category) RuleDelta {
+	if d := rules[cat]; d != nil {
+		return *d
+	}
+	return RuleDelta{}
+}
+
+// ruleDiffLocked compares the effective rules of two deltas. Only rules in
+// either delta can differ. A tombstoned rule is a baseline rule even when
+// the baseline is not known yet.
+func (st *StateStore) ruleDiffLocked(cat Category, a, b RuleDelta) RuleDiff {
+	effective := func(d RuleDelta, rule string) bool {
+		_, inBase := st.baseline[cat][rule]
+		inBase = inBase || slices.Contains(a.Remove, rule) || slices.Contains(b.Remove, rule)
+		return slices.Contains(d.Add, rule) || inBase && !slices.Contains(d.Remove, rule)
+	}
+	out := RuleDiff{Added: []string{}, Removed: []string{}}
+	seen := make(map[string]struct{})
+	for _, list := range [][]string{a.Add, a.Remove, b.Add, b.Remove} {
+		for _, rule := range list {
+			if _, ok := seen[rule]; ok {
+				continue
+			}
+			seen[rule] = struct{}{}
+			switch was, is := effective(a, rule), effective(b, rule); {
+			case is && !was:
+				out.Added = append(out.Added, rule)
+			case was && !is:
+				out.Removed = append(out.Removed, rule)
+			}
+		}
+	}
+	slices.Sort(out.Added)
+	slices.Sort(out.Removed)
+	return out
+}
+
+// overrideFields maps the set overrides to their JSON values.
+func overrideFields(o ConfigOverrides) map[string]json.RawMessage {
+	fields := make(map[string]json.RawMessage)
+	if data, err := json.Marshal(o); err == nil {
+		_ = json.Unmarshal(data, &fields)
+	}
+	return fields
+}
+
+// Checkout makes a retained revision current again as a new revision, so a
+// rollback can itself be rolled back. Tokens and users are kept. It returns
+// the new revision, or the current one when revision already is current.
+// Callers must rebuild the runtime rule sets and config afterwards.
+func (st *StateStore) Checkout(revision uint64) (uint64, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if revision == st.state.Revision {
+		return revision, nil
+	}
+	return st.checkoutLocked(revision, st.cloneLocked())
+}
+
+// CheckoutOnce is Checkout for the revision chosen at startup. It records
+// the revision in the state and does nothing when called again with the
+// same one, so a restart that repeats the startup flag keeps the changes
+// made since. It reports whether it checked the revision out.
+func (st *StateStore) CheckoutOnce(revision uint64) (uint64, bool, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if b := st.state.BootCheckout; b != nil && *b == revision {
+		return st.state.Revision, false, nil
+	}
+	cand := st.cloneLocked()
+	cand.BootCheckout = &revision
+	if revision == st.state.Revision {
+		if err := st.persistLocked(cand); err != nil {
+			return 0, false, err
+		}
+		st.state = cand
+		return revision, true, nil
+	}
+	newRevision, err := st.checkoutLocked(revision, cand)
+	return newRevision, err == nil, err
+}
+
+// checkoutLocked makes revision current in cand, a clone of the state, as
+// a new revision.
+func (st *StateStore) checkoutLocked(revision uint64, cand State) (uint64, error) {
+	rev, ok := st.revisionLocked(revision)
+	if !ok {
+		return 0, fmt.Errorf("revision %d: %w", revision, ErrRevisionNotFound)
+	}
+	old := snapshot(State{Rules: rev.Rules, Config: rev.Config})
+	cand.Rules, cand.Config = old.Rules, old.Config
+	st.bumpLocked(&cand)
+	if err := st.persistLocked(cand); err != nil {
+		return 0, err
+	}
+	st.state = cand
+	return cand.Revision, nil
+}
+
+func (s *Server) handleRevisions(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"current":   s.opts.State.Revision(),
+		"revisions": s.opts.State.Revisions(),
+	})
+}
+
+// handleRevisionDiff compares two revisions; to defaults to the current
+// one.
+func (s *Server) handleRevisionDiff(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	from, err := strconv.ParseUint(q.Get("from"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid from revision")
+		return
+	}
+	to := s.opts.State.Revision()
+	if v := q.Get("to"); v != "" {
+		if to, err = strconv.ParseUint(v, 10, 64); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid to revision")
+			return
+		}
+	}
+	diff, err := s.opts.State.RevisionDiff(from, to)
+	if errors.Is(err, ErrRevisionNotFound) {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, diff)
+}
+
+// handleRollback restores a retained revision's rules and config overrides
+// through the Rollback callback, which also rebuilds the runtime.
+func (s *Server) handleRollback(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Revision uint64 `json:"revision"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	before := s.opts.State.Revision()
+	revision, err := s.opts.Rollback(req.Revision)
+	switch {
+	case errors.Is(err, ErrRevisionNotFound):
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	case err != nil:
+		slog.Error("roll back admin state", "revision", req.Revision, "error", err)
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	slog.Info("rolled back admin state", "to", req.Revision, "revision", revision)
+	s.audit(r, AuditStateRollback, strconv.FormatUint(req.Revision, 10),
+		map[string]uint64{"revision": before}, map[string]uint64{"revision": revision})
+	writeJSON(w, http.StatusOK, map[string]uint64{"revision": revision})
+}
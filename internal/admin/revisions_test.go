@@ -0,0 +1,136 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestStateStoreRevisions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	st := LoadStateStore(path)
+	st.SetBaseline(map[Category][]string{CategoryBlock: {"ads.example.com"}})
+	st.SetRevisionLimit(3)
+
+	if _, err := st.RuleAdd(CategoryProxy, "**.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.RuleRemoveBatch(CategoryBlock, "ads.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	level := "debug"
+	if _, err := st.ApplyConfig(ConfigOverrides{LogLevel: &level}, st.Revision()); err != nil {
+		t.Fatal(err)
+	}
+
+	revs := LoadStateStore(path).Revisions()
+	if len(revs) != 3 || revs[0].Revision != 3 || !revs[0].Current || revs[2].Revision != 1 {
+		t.Fatalf("revisions = %+v", revs)
+	}
+	if revs[0].ConfigKeys != 1 || revs[0].RuleAdds != 1 || revs[0].RuleRemoves != 1 {
+		t.Fatalf("newest summary = %+v", revs[0])
+	}
+
+	diff, err := st.RevisionDiff(1, 3)
+	if err != nil {
+		t.Fatalf("diff: %v", err)
+	}
+	if got := diff.Rules[CategoryBlock]; len(got.Removed) != 1 || got.Removed[0] != "ads.example.com" || len(got.Added) != 0 {
+		t.Fatalf("block diff = %+v", got)
+	}
+	if got := diff.Rules[CategoryProxy]; len(got.Added) != 0 || len(got.Removed) != 0 {
+		t.Fatalf("proxy diff = %+v", got)
+	}
+	if c, ok := diff.Config["log_level"]; !ok || c.From != nil || string(c.To) != `"debug"` {
+		t.Fatalf("config diff = %+v", diff.Config)
+	}
+	if _, err := st.RevisionDiff(0, 3); err == nil {
+		t.Fatal("diff against a trimmed revision succeeded")
+	}
+
+	revision, err := st.Checkout(1)
+	if err != nil {
+		t.Fatalf("checkout: %v", err)
+	}
+	if revision != 4 || st.ConfigOverrides().LogLevel != nil || len(st.Delta(CategoryBlock).Remove) != 0 || len(st.Delta(CategoryProxy).Add) != 1 {
+		t.Fatalf("after checkout: revision %d, config %+v, block %+v", revision, st.ConfigOverrides(), st.Delta(CategoryBlock))
+	}
+	// The checked-out state must not share memory with the retained snapshot.
+	if _, err := st.RuleAdd(CategoryProxy, "**.example.org"); err != nil {
+		t.Fatal(err)
+	}
+	diff, err = st.RevisionDiff(4, 5)
+	if err != nil {
+		t.Fatalf("diff: %v", err)
+	}
+	if got := diff.Rules[CategoryProxy]; len(got.Added) != 1 || got.Added[0] != "**.example.org" {
+		t.Fatalf("retained revision changed after checkout: %+v", got)
+	}
+}
+
+func TestRevisionEndpoints(t *testing.T) {
+	state := LoadStateStore("")
+	var rolledBack uint64
+	s := NewServer(Options{Password: "secret", Rules: newFakeRules(), Stats: newTestStats(t), State: state,
+		Rollback: func(revision uint64) (uint64, error) {
+			rolledBack = revision
+			return state.Checkout(revision)
+		}})
+	ts := httptest.NewServer(s.http.Handler)
+	t.Cleanup(ts.Close)
+	cookie := login(t, ts, "secret")
+
+	level := "warn"
+	if _, err := state.ApplyConfig(ConfigOverrides{LogLevel: &level}, 0); err != nil {
+		t.Fatal(err)
+	}
+	resp := authedRequest(t, ts, http.MethodGet, "/api/state/revisions/diff?from=0", cookie, "")
+	var diff RevisionDiff
+	if err := json.NewDecoder(resp.Body).Decode(&diff); err != nil {
+		t.Fatalf("decode diff: %v", err)
+	}
+	resp.Body.Close()
+	if diff.From != 0 || diff.To != 1 || len(diff.Config) != 1 {
+		t.Fatalf("diff = %+v", diff)
+	}
+
+	resp = authedRequest(t, ts, http.MethodPost, "/api/state/rollback", cookie, `{"revision":0}`)
+	var body map[string]uint64
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("decode rollback: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || body["revision"] != 2 || rolledBack != 0 {
+		t.Fatalf("rollback = %d %v", resp.StatusCode, body)
+	}
+
+	for _, test := range []struct {
+		method, path, body string
+		want               int
+	}{
+		{http.MethodGet, "/api/state/revisions/diff?from=x", "", http.StatusBadRequest},
+		{http.MethodGet, "/api/state/revisions/diff?from=9", "", http.StatusNotFound},
+		{http.MethodPost, "/api/state/rollback", `{"revision":9}`, http.StatusNotFound},
+	} {
+		resp := authedRequest(t, ts, test.method, test.path, cookie, test.body)
+		resp.Body.Close()
+		if resp.StatusCode != test.want {
+			t.Errorf("%s %s = %d, want %d", test.method, test.path, resp.StatusCode, test.want)
+		}
+	}
+
+	resp = authedRequest(t, ts, http.MethodGet, "/api/state/revisions", cookie, "")
+	var list struct {
+		Current   uint64
+		Revisions []RevisionInfo
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		t.Fatalf("decode list: %v", err)
+	}
+	resp.Body.Close()
+	if list.Current != 2 || len(list.Revisions) != 3 || !list.Revisions[0].Current {
+		t.Fatalf("list = %+v", list)
+	}
+}
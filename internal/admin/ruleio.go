@@ -0,0 +1,392 @@
+package admin
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/sower-proxy/sower/router"
+)
+
+const (
+	// maxImportBytes bounds an uploaded rule file; it is far larger than
+	// maxBodyBytes because a migration carries whole rule lists.
+	maxImportBytes = 1 << 20
+	maxImportRules = 20000
+	// maxAuditImportRules bounds the rules listed in an import's audit
+	// entry so one import cannot produce an oversized audit line.
+	maxAuditImportRules = maxRulesPerBatch
+)
+
+// Rule file formats for export and import.
+const (
+	RuleFormatText  = "text"  // one rule per line, # comments
+	RuleFormatJSON  = "json"  // RuleExport, or a plain array of rules
+	RuleFormatClash = "clash" // rule-provider payload, domain or classical
+)
+
+// RuleExport is one category's effective rules and how they came about:
+// Rules is Baseline minus Tombstones plus Additions, in runtime order.
+type RuleExport struct {
+	Category   Category `json:"category"`
+	Rules      []string `json:"rules"`
+	Baseline   []string `json:"baseline"`
+	Additions  []string `json:"additions"`
+	Tombstones []string `json:"tombstones"`
+}
+
+// part returns the list a text or Clash export writes.
+func (e RuleExport) part(name string) ([]string, bool) {
+	switch name {
+	case "", "rules":
+		return e.Rules, true
+	case "baseline":
+		return e.Baseline, true
+	case "additions":
+		return e.Additions, true
+	case "tombstones":
+		return e.Tombstones, true
+	default:
+		return nil, false
+	}
+}
+
+// RuleConflict is an imported rule overlapping another category: Existing
+// is the rule there that matches it, the imported rule itself or a
+// wildcard covering it.
+type RuleConflict struct {
+	Rule     string   `json:"rule"`
+	Category Category `json:"category"`
+	Existing string   `json:"existing"`
+}
+
+// InvalidRule is an import line that is not a usable rule. Line is 1-based;
+// for JSON it is the index in the rule array.
+type InvalidRule struct {
+	Line  int    `json:"line"`
+	Text  string `json:"text"`
+	Error string `json:"error"`
+}
+
+// RuleImport previews or reports an import into one category. Only New is
+// applied: duplicates are already effective in the category (or repeat in
+// the file), and conflicts are left for the operator to resolve.
+type RuleImport struct {
+	Category   Category       `json:"category"`
+	New        []string       `json:"new"`
+	Duplicates []string       `json:"duplicates"`
+	Conflicts  []RuleConflict `json:"conflicts"`
+	Invalid    []InvalidRule  `json:"invalid"`
+	Applied    bool           `json:"applied"`
+}
+
+// handleRulesExport downloads one category as text, JSON or a Clash rule
+// provider. Text and Clash write the effective rules unless part selects
+// the baseline, additions or tombstones; JSON always carries all of them.
+func (s *Server) handleRulesExport(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	category := Category(q.Get("category"))
+	format := cmp.Or(q.Get("format"), RuleFormatText)
+	if !category.valid() {
+		writeError(w, http.StatusBadRequest, "invalid category")
+		return
+	}
+	if format != RuleFormatText && format != RuleFormatJSON && format != RuleFormatClash {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid format %q: want text, json or clash", format))
+		return
+	}
+	export, err := s.opts.Rules.RuleExport(category)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	name := "sower-" + string(category)
+	if format == RuleFormatJSON {
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+`.json"`)
+		writeJSON(w, http.StatusOK, export)
+		return
+	}
+	part := q.Get("part")
+	rules, ok := export.part(part)
+	if !ok {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid part %q: want rules, baseline, additions or tombstones", part))
+		return
+	}
+	if part != "" && part != "rules" {
+		name += "-" + part
+	}
+
+	var buf bytes.Buffer
+	if format == RuleFormatClash {
+		buf.WriteString("payload:\n")
+		for _, rule := range rules {
+			fmt.Fprintf(&buf, "  - '%s'\n", toClashDomain(rule))
+		}
+		w.Header().Set("Content-Type", "application/yaml; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+`.yaml"`)
+	} else {
+		for _, rule := range rules {
+			buf.WriteString(rule)
+			buf.WriteByte('\n')
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+`.txt"`)
+	}
+	_, _ = w.Write(buf.Bytes())
+}
+
+// handleRulesImport classifies an uploaded rule file against the effective
+// rules and, unless dry_run is set, adds the new rules in one state
+// mutation. The body is the raw file; a JSON RuleExport may supply the
+// category itself.
+func (s *Server) handleRulesImport(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	category := Category(q.Get("category"))
+	format := cmp.Or(q.Get("format"), RuleFormatText)
+	dryRun, _ := strconv.ParseBool(q.Get("dry_run"))
+	if category != "" && !category.valid() {
+		writeError(w, http.StatusBadRequest, "invalid category")
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxImportBytes))
+	if err != nil {
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("rule file too large, max %d bytes", maxImportBytes))
+		return
+	}
+	lines, fileCategory, err := parseRuleFile(format, body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	category = cmp.Or(category, fileCategory)
+	if !category.valid() {
+		writeError(w, http.StatusBadRequest, "category is required")
+		return
+	}
+
+	res, err := s.classifyImport(category, lines)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if dryRun || len(res.New) == 0 {
+		writeJSON(w, http.StatusOK, res)
+		return
+	}
+	if err := s.opts.Rules.RuleAdd(category, res.New...); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	res.Applied = true
+	s.audit(r, AuditRulesImport, string(category), nil, map[string]any{
+		"count": len(res.New),
+		"rules": res.New[:min(len(res.New), maxAuditImportRules)],
+	})
+	writeJSON(w, http.StatusOK, res)
+}
+
+// classifyImport sorts parsed lines into new rules, duplicates, conflicts
+// with the other categories and invalid lines. Rules compare without case
+// or a trailing dot; a conflict is any rule of another category matching
+// the imported one, wildcards included.
+func (s *Server) classifyImport(category Category, lines []ruleLine) (RuleImport, error) {
+	effective := make(map[string]struct{})
+	others := make(map[Category]*router.RuleSet, 2)
+	for _, cat := range []Category{CategoryBlock, CategoryDirect, CategoryProxy} {
+		export, err := s.opts.Rules.RuleExport(cat)
+		if err != nil {
+			return RuleImport{}, err
+		}
+		if cat != category {
+			others[cat] = router.NewRuleSet(export.Rules...)
+			continue
+		}
+		for _, rule := range export.Rules {
+			effective[normalizeDomain(rule)] = struct{}{}
+		}
+	}
+
+	res := RuleImport{Category: category, New: []string{}, Duplicates: []string{}, Conflicts: []RuleConflict{}, Invalid: []InvalidRule{}}
+	seen := make(map[string]struct{}, len(lines))
+	for _, l := range lines {
+		if l.err != nil {
+			res.Invalid = append(res.Invalid, InvalidRule{Line: l.line, Text: truncate(l.text, maxRuleLength), Error: l.err.Error()})
+			continue
+		}
+		if _, ok := seen[l.rule]; ok {
+			res.Duplicates = append(res.Duplicates, l.rule)
+			continue
+		}
+		seen[l.rule] = struct{}{}
+		if _, ok := effective[l.rule]; ok {
+			res.Duplicates = append(res.Duplicates, l.rule)
+			continue
+		}
+		conflict := false
+		for _, cat := range []Category{CategoryBlock, CategoryDirect, CategoryProxy} {
+			// The tree lookup keeps a large import against large lists
+			// cheap; it matches exactly what MatchRule would.
+			if existing, ok := others[cat].MatchRuleFast(l.rule); ok {
+				res.Conflicts = append(res.Conflicts, RuleConflict{Rule: l.rule, Category: cat, Existing: existing})
+				conflict = true
+			}
+		}
+		if !conflict {
+			res.New = append(res.New, l.rule)
+		}
+	}
+	return res, nil
+}
+
+// ruleLine is one entry of an uploaded rule file: a rule, or the reason the
+// text is not one.
+type ruleLine struct {
+	line int
+	text string
+	rule string
+	err  error
+}
+
+// parseRuleFile splits a rule file into entries, skipping blank lines and
+// comments. For JSON it also returns the category of a RuleExport document.
+func parseRuleFile(format string, data []byte) ([]ruleLine, Category, error) {
+	var lines []ruleLine
+	var category Category
+	add := func(n int, text string, convert func(string) (string, error)) error {
+		if len(lines) >= maxImportRules {
+			return fmt.Errorf("too many rules, max %d", maxImportRules)
+		}
+		l := ruleLine{line: n, text: text}
+		l.rule, l.err = convert(text)
+		if l.err == nil {
+			l.err = checkRule(l.rule)
+		}
+		lines = append(lines, l)
+		return nil
+	}
+
+	switch format {
+	case RuleFormatJSON:
+		var rules []string
+		if err := json.Unmarshal(data, &rules); err != nil {
+			var export RuleExport
+			if err := json.Unmarshal(data, &export); err != nil {
+				return nil, "", errors.New("invalid JSON: want a rule array or an export document")
+			}
+			rules, category = export.Rules, export.Category
+		}
+		for i, rule := range rules {
+			if err := add(i+1, rule, trimRule); err != nil {
+				return nil, "", err
+			}
+		}
+	case RuleFormatText, RuleFormatClash:
+		convert := trimRule
+		if format == RuleFormatClash {
+			convert = fromClash
+		}
+		sc := bufio.NewScanner(bytes.NewReader(data))
+		sc.Buffer(make([]byte, 0, 4096), maxImportBytes)
+		for n := 1; sc.Scan(); n++ {
+			text := strings.TrimSpace(sc.Text())
+			if text == "" || strings.HasPrefix(text, "#") || format == RuleFormatClash && text == "payload:" {
+				continue
+			}
+			if err := add(n, text, convert); err != nil {
+				return nil, "", err
+			}
+		}
+		if err := sc.Err(); err != nil {
+			return nil, "", fmt.Errorf("read rule file: %w", err)
+		}
+	default:
+		return nil, "", fmt.Errorf("invalid format %q: want text, json or clash", format)
+	}
+	return lines, category, nil
+}
+
+// trimRule normalizes a rule like normalizeDomain, so an import compares
+// and stores rules without case or a trailing dot.
+func trimRule(text string) (string, error) {
+	return normalizeDomain(text), nil
+}
+
+// fromClash converts a rule-provider entry: domain behavior ("+.x", ".x",
+// "*.x", "x") or classical DOMAIN / DOMAIN-SUFFIX lines. Clash's ".x"
+// excludes x itself; sower has no such rule, so it widens to "**.x".
+func fromClash(text string) (string, error) {
+	text = strings.TrimSpace(strings.TrimPrefix(text, "-"))
+	text = strings.Trim(text, `'"`)
+	if typ, rest, ok := strings.Cut(text, ","); ok {
+		value, _, _ := strings.Cut(rest, ",") // drop a trailing policy
+		value = strings.TrimSpace(value)
+		switch strings.ToUpper(strings.TrimSpace(typ)) {
+		case "DOMAIN":
+			return trimRule(value)
+		case "DOMAIN-SUFFIX":
+			return trimRule("**." + value)
+		default:
+			return "", fmt.Errorf("unsupported Clash rule type %s", typ)
+		}
+	}
+	switch {
+	case strings.HasPrefix(text, "+."):
+		return trimRule("**." + text[2:])
+	case strings.HasPrefix(text, "."):
+		return trimRule("**" + text)
+	}
+	return trimRule(text)
+}
+
+// toClashDomain writes a rule in rule-provider domain syntax.
+func toClashDomain(rule string) string {
+	if rest, ok := strings.CutPrefix(rule, "**."); ok {
+		return "+." + rest
+	}
+	return rule
+}
+
+// checkRule validates an imported rule: dot-separated labels of letters,
+// digits, '-' and '_', where a label may be "*" and only the first may be
+// "**".
+func checkRule(rule string) error {
+	switch {
+	case rule == "":
+		return errors.New("empty rule")
+	case len(rule) > maxRuleLength:
+		return fmt.Errorf("rule too long, max %d bytes", maxRuleLength)
+	}
+	for i, label := range strings.Split(rule, ".") {
+		switch {
+		case label == "":
+			return errors.New("empty label")
+		case label == "*":
+		case label == "**":
+			if i != 0 {
+				return errors.New(`"**" is only allowed as the first label`)
+			}
+		default:
+			for _, c := range label {
+				if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+					return fmt.Errorf("invalid character %q", c)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n]
+}
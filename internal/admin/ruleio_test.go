@@ -0,0 +1,182 @@
+package admin
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestFromClash(t *testing.T) {
+	t.Parallel()
+	for _, test := range []struct {
+		in, want string
+		bad      bool
+	}{
+		{in: "- '+.example.com'", want: "**.example.com"},
+		{in: `- ".example.org"`, want: "**.example.org"},
+		{in: "- '*.cdn.example.net'", want: "*.cdn.example.net"},
+		{in: "example.io", want: "example.io"},
+		{in: "- DOMAIN-SUFFIX,google.com,Proxy", want: "**.google.com"},
+		{in: "DOMAIN,api.example.com", want: "api.example.com"},
+		{in: "- IP-CIDR,10.0.0.0/8", bad: true},
+	} {
+		got, err := fromClash(test.in)
+		if test.bad != (err != nil) || got != test.want {
+			t.Errorf("fromClash(%q) = %q, %v", test.in, got, err)
+		}
+	}
+	if got := toClashDomain("**.example.com"); got != "+.example.com" {
+		t.Errorf("toClashDomain = %q", got)
+	}
+}
+
+func TestCheckRule(t *testing.T) {
+	t.Parallel()
+	for rule, ok := range map[string]bool{
+		"example.com":       true,
+		"**.example.com":    true,
+		"*.cdn.example.com": true,
+		"a.*.example.com":   true,
+		"cdn.**.example":    false,
+		"exa mple.com":      false,
+		"a..com":            false,
+		"example.com/path":  false,
+		"":                  false,
+	} {
+		if err := checkRule(rule); (err == nil) != ok {
+			t.Errorf("checkRule(%q) = %v, want ok %v", rule, err, ok)
+		}
+	}
+}
+
+func TestRulesExport(t *testing.T) {
+	rules := newFakeRules()
+	rules.lists[CategoryProxy] = []string{"**.google.com", "github.com"}
+	s := NewServer(Options{Password: "secret", Rules: rules, Stats: newTestStats(t)})
+	ts := httptest.NewServer(s.http.Handler)
+	t.Cleanup(ts.Close)
+	cookie := login(t, ts, "secret")
+
+	for _, test := range []struct {
+		query, want, file string
+	}{
+		{"format=text", "**.google.com\ngithub.com\n", "sower-proxy.txt"},
+		{"format=clash", "payload:\n  - '+.google.com'\n  - 'github.com'\n", "sower-proxy.yaml"},
+		{"format=text&part=tombstones", "", "sower-proxy-tombstones.txt"},
+	} {
+		resp := authedRequest(t, ts, http.MethodGet, "/api/rules/export?category=proxy&"+test.query, cookie, "")
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || string(body) != test.want {
+			t.Errorf("%s = %d %q, want %q", test.query, resp.StatusCode, body, test.want)
+		}
+		if cd := resp.Header.Get("Content-Disposition"); !strings.Contains(cd, test.file) {
+			t.Errorf("%s disposition = %q, want %s", test.query, cd, test.file)
+		}
+	}
+
+	resp := authedRequest(t, ts, http.MethodGet, "/api/rules/export?category=proxy&format=json", cookie, "")
+	var export RuleExport
+	if err := json.NewDecoder(resp.Body).Decode(&export); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	resp.Body.Close()
+	if export.Category != CategoryProxy || !slices.Equal(export.Rules, rules.lists[CategoryProxy]) || export.Tombstones == nil {
+		t.Fatalf("json export = %+v", export)
+	}
+
+	for _, query := range []string{"category=nope", "category=proxy&format=xml", "category=proxy&part=nope"} {
+		resp := authedRequest(t, ts, http.MethodGet, "/api/rules/export?"+query, cookie, "")
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s = %d, want 400", query, resp.StatusCode)
+		}
+	}
+}
+
+func TestRulesImport(t *testing.T) {
+	rules := newFakeRules()
+	rules.lists[CategoryProxy] = []string{"github.com"}
+	rules.lists[CategoryDirect] = []string{"**.example.cn"}
+	audit, err := NewAuditLog(AuditOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(Options{Password: "secret", Rules: rules, Stats: newTestStats(t), State: LoadStateStore(""), Audit: audit})
+	ts := httptest.NewServer(s.http.Handler)
+	t.Cleanup(ts.Close)
+	cookie := login(t, ts, "secret")
+
+	file := strings.Join([]string{
+		"# migrated from the router",
+		"**.google.com",
+		"GitHub.com.",
+		"",
+		"**.example.cn",
+		"bad rule",
+		"cdn.example.cn",
+		"**.google.com",
+		"youtube.com.",
+	}, "\n")
+	importRules := func(query string) RuleImport {
+		t.Helper()
+		resp := authedRequest(t, ts, http.MethodPost, "/api/rules/import?"+query, cookie, file)
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("import %s = %d", query, resp.StatusCode)
+		}
+		var res RuleImport
+		if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		return res
+	}
+
+	preview := importRules("category=proxy&dry_run=true")
+	if preview.Applied || !slices.Equal(preview.New, []string{"**.google.com", "youtube.com"}) {
+		t.Fatalf("preview new = %v, applied %v", preview.New, preview.Applied)
+	}
+	if !slices.Equal(preview.Duplicates, []string{"github.com", "**.google.com"}) {
+		t.Fatalf("preview duplicates = %v", preview.Duplicates)
+	}
+	if !slices.Equal(preview.Conflicts, []RuleConflict{
+		{Rule: "**.example.cn", Category: CategoryDirect, Existing: "**.example.cn"},
+		{Rule: "cdn.example.cn", Category: CategoryDirect, Existing: "**.example.cn"},
+	}) {
+		t.Fatalf("preview conflicts = %+v", preview.Conflicts)
+	}
+	if len(preview.Invalid) != 1 || preview.Invalid[0].Line != 6 || preview.Invalid[0].Text != "bad rule" {
+		t.Fatalf("preview invalid = %+v", preview.Invalid)
+	}
+	if len(rules.lists[CategoryProxy]) != 1 {
+		t.Fatalf("dry run changed rules: %v", rules.lists[CategoryProxy])
+	}
+
+	applied := importRules("category=proxy")
+	if !applied.Applied || !slices.Equal(rules.lists[CategoryProxy], []string{"github.com", "**.google.com", "youtube.com"}) {
+		t.Fatalf("apply = %+v, rules %v", applied, rules.lists[CategoryProxy])
+	}
+	if entries := audit.Query(AuditFilter{Action: AuditRulesImport}, 10); len(entries) != 1 || entries[0].Target != "proxy" {
+		t.Fatalf("audit = %+v", entries)
+	}
+	if again := importRules("category=proxy"); again.Applied || len(again.New) != 0 {
+		t.Fatalf("re-import = %+v", again)
+	}
+
+	resp := authedRequest(t, ts, http.MethodPost, "/api/rules/import?format=json", cookie, `{"category":"block","rules":["ads.example.com"]}`)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !slices.Equal(rules.lists[CategoryBlock], []string{"ads.example.com"}) {
+		t.Fatalf("json import = %d, block %v", resp.StatusCode, rules.lists[CategoryBlock])
+	}
+	for _, query := range []string{"format=text", "category=proxy&format=json", "category=proxy&format=xml"} {
+		resp := authedRequest(t, ts, http.MethodPost, "/api/rules/import?"+query, cookie, "example.com")
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s = %d, want 400", query, resp.StatusCode)
+		}
+	}
+}
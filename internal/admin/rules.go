@@ -9,9 +9,15 @@ import (
 	"time"
 )
 
+// maxRuleTTL bounds temporary rule changes; anything meant to last longer
+// should be made permanent.
+const maxRuleTTL = 90 * 24 * time.Hour
+
 type rulesRequest struct {
 	Category Category `json:"category"`
 	Rules    []string `json:"rules"`
+	// TTL makes the change temporary, as a Go duration ("1h", "30m").
+	TTL string `json:"ttl,omitempty"`
 }
 
 // RuleSort selects the ordering of a rule listing.
@@ -56,11 +62,12 @@ func defaultDir(s RuleSort) SortDir {
 
 // RuleEntry is one retained rule in a listing, with its hit count and most
 // recent hit time. Count is zero and LastSeen nil for rules that never
-// matched a routed connection.
+// matched a routed connection. Expires is set on temporary additions.
 type RuleEntry struct {
 	Rule     string     `json:"rule"`
 	Count    uint64     `json:"count"`
 	LastSeen *time.Time `json:"lastSeen,omitempty"`
+	Expires  *time.Time `json:"expires,omitempty"`
 }
 
 // CategoryTest reports whether one rule category matched a tested domain and
@@ -83,9 +90,47 @@ type DomainTest struct {
 
 // RuleHit aggregates block decisions attributed to one rule.
 type RuleHit struct {
-	Rule     string    `json:"rule"`
-	Count    uint64    `json:"count"`
-	LastSeen time.Time `json:"lastSeen"`
+	Rule  string `json:"rule"`
+	Count uint64 `json:"count"`
+	// The remaining counters only appear on rule-miss entries. Direct and
+	// Proxy split Count by the route detection chose, the Failed counters
+	// are dials of that route that errored, and Poisoned counts poisoned
+	// direct DNS answers.
+	Direct       uint64    `json:"direct,omitempty"`
+	DirectFailed uint64    `json:"directFailed,omitempty"`
+	Proxy        uint64    `json:"proxy,omitempty"`
+	ProxyFailed  uint64    `json:"proxyFailed,omitempty"`
+	Poisoned     uint64    `json:"poisoned,omitempty"`
+	LastSeen     time.Time `json:"lastSeen"`
+}
+
+// RuleExpirer is the optional RuleManager extension behind temporary rule
+// changes, i.e. the ttl field of POST and DELETE /api/rules.
+type RuleExpirer interface {
+	// RuleAddUntil adds rules that are removed again at expires.
+	RuleAddUntil(category Category, expires time.Time, rules ...string) error
+	// RuleRemoveUntil tombstones baseline rules until expires and returns
+	// the effective runtime removals.
+	RuleRemoveUntil(category Category, expires time.Time, rules ...string) ([]string, error)
+}
+
+// ruleExpiry resolves the expiry of a rules request: zero for a permanent
+// change, or now plus its TTL. ok is false once an error was written.
+func (s *Server) ruleExpiry(w http.ResponseWriter, req rulesRequest) (RuleExpirer, time.Time, bool) {
+	if req.TTL == "" {
+		return nil, time.Time{}, true
+	}
+	ttl, err := time.ParseDuration(req.TTL)
+	if err != nil || ttl < time.Minute || ttl > maxRuleTTL {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("ttl must be a duration between 1m and %.0fh", maxRuleTTL.Hours()))
+		return nil, time.Time{}, false
+	}
+	exp, ok := s.opts.Rules.(RuleExpirer)
+	if !ok {
+		writeError(w, http.StatusNotFound, "temporary rules unavailable")
+		return nil, time.Time{}, false
+	}
+	return exp, time.Now().Add(ttl).Truncate(time.Second), true
 }
 
 // RuleMissProvider exposes per-domain access stats for connections that
@@ -181,10 +226,20 @@ func (s *Server) handleRulesAdd(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	req.Rules = validated
-	if err := s.opts.Rules.RuleAdd(req.Category, req.Rules...); err != nil {
+	exp, expires, ok := s.ruleExpiry(w, req)
+	if !ok {
+		return
+	}
+	if exp != nil {
+		err = exp.RuleAddUntil(req.Category, expires, req.Rules...)
+	} else {
+		err = s.opts.Rules.RuleAdd(req.Category, req.Rules...)
+	}
+	if err != nil {
 		writeError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
+	s.audit(r, AuditRulesAdd, string(req.Category), nil, auditRules(req.Rules, expires))
 	w.WriteHeader(http.StatusNoContent)
 }
 
@@ -199,13 +254,37 @@ func (s *Server) handleRulesRemove(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	req.Rules = validated
-	if _, err := s.opts.Rules.RuleRemoveMany(req.Category, req.Rules...); err != nil {
+	exp, expires, ok := s.ruleExpiry(w, req)
+	if !ok {
+		return
+	}
+	var removed []string
+	if exp != nil {
+		removed, err = exp.RuleRemoveUntil(req.Category, expires, req.Rules...)
+	} else {
+		removed, err = s.opts.Rules.RuleRemoveMany(req.Category, req.Rules...)
+	}
+	if err != nil {
 		writeError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
+	var after any
+	if !expires.IsZero() {
+		after = map[string]time.Time{"expires": expires}
+	}
+	s.audit(r, AuditRulesRemove, string(req.Category), removed, after)
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// auditRules is the audit view of added rules: the plain list, or the list
+// with its expiry for a temporary addition.
+func auditRules(rules []string, expires time.Time) any {
+	if expires.IsZero() {
+		return rules
+	}
+	return map[string]any{"rules": rules, "expires": expires}
+}
+
 // handleRulesChanges returns the persisted rule deltas relative to the boot
 // baseline, so the console can show what was customized and offer a reset.
 func (s *Server) handleRulesChanges(w http.ResponseWriter, r *http.Request) {
@@ -226,10 +305,15 @@ func (s *Server) handleRulesReset(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusBadRequest, "invalid category")
 		return
 	}
+	before := s.opts.Rules.RuleChanges().Rules
+	if req.Category != "" {
+		before = map[Category]RuleDelta{req.Category: before[req.Category]}
+	}
 	if err := s.opts.Rules.RuleReset(req.Category); err != nil {
 		writeError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
+	s.audit(r, AuditRulesReset, string(req.Category), before, nil)
 	w.WriteHeader(http.StatusNoContent)
 }
 
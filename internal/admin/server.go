@@ -75,6 +75,9 @@ type RuleManager interface {
 	// RuleReset clears the deltas of one category, or of all categories when
 	// category is empty, rebuilding the runtime rule sets to the baseline.
 	RuleReset(category Category) error
+	// RuleExport returns the category's effective rules together with the
+	// baseline and deltas they derive from.
+	RuleExport(category Category) (RuleExport, error)
 	TestDomain(domain string) (DomainTest, error)
 }
 
@@ -97,12 +100,29 @@ type Options struct {
 	// Hostnames resolves client IPs to hostnames for the traffic console;
 	// reverse lookups are skipped when nil.
 	Hostnames HostnameResolver
+	// DNSLog enables the DNS query log endpoints when non-nil.
+	DNSLog *DNSLog
+	// State enables bearer API tokens and named console users, kept in the
+	// admin state file, when non-nil.
+	State *StateStore
+	// Audit records admin mutations and login attempts and enables
+	// /api/audit when non-nil.
+	Audit *AuditLog
+	// Rollback makes a retained State revision current again and rebuilds
+	// the runtime rule sets and config from it, returning the new revision.
+	// The rollback endpoint needs it and State; listing and diffing
+	// revisions only need State.
+	Rollback func(revision uint64) (uint64, error)
+	// Explain enables /api/rules/explain when non-nil.
+	Explain RouteExplainer
+	// Access enables the access probe cache endpoints when non-nil.
+	Access AccessCache
 }
 
 // Server serves the admin API and the embedded frontend on one listener.
 type Server struct {
 	opts        Options
-	sessions    map[string]time.Time
+	sessions    map[string]session
 	sessionFile string
 	mu          sync.Mutex
 	trafficMu   sync.Mutex
@@ -120,7 +140,7 @@ type cachedTraffic struct {
 func NewServer(opts Options) *Server {
 	s := &Server{
 		opts:        opts,
-		sessions:    make(map[string]time.Time),
+		sessions:    make(map[string]session),
 		sessionFile: opts.SessionFile,
 		throttle:    newLoginThrottle(),
 	}
@@ -137,22 +157,62 @@ func NewServer(opts Options) *Server {
 	mux.HandleFunc("GET /api/session", s.mutateGuard(s.auth(s.handleSession)))
 	mux.HandleFunc("DELETE /api/session", s.handleLogout)
 	mux.HandleFunc("GET /api/login-info", s.handleLoginInfo)
+	mux.HandleFunc("GET /api/me", s.mutateGuard(s.auth(s.handleMe)))
 	mux.HandleFunc("GET /api/status", s.mutateGuard(s.auth(s.handleStatus)))
 	mux.HandleFunc("GET /api/rules", s.mutateGuard(s.auth(s.handleRulesList)))
 	mux.HandleFunc("POST /api/rules", s.mutateGuard(s.auth(s.handleRulesAdd)))
 	mux.HandleFunc("DELETE /api/rules", s.mutateGuard(s.auth(s.handleRulesRemove)))
 	mux.HandleFunc("GET /api/rules/changes", s.mutateGuard(s.auth(s.handleRulesChanges)))
 	mux.HandleFunc("POST /api/rules/reset", s.mutateGuard(s.auth(s.handleRulesReset)))
+	mux.HandleFunc("GET /api/rules/export", s.mutateGuard(s.auth(s.handleRulesExport)))
+	mux.HandleFunc("POST /api/rules/import", s.mutateGuard(s.auth(s.handleRulesImport)))
 	mux.HandleFunc("GET /api/rules/test", s.mutateGuard(s.auth(s.handleRulesTest)))
 	mux.HandleFunc("GET /api/rules/miss", s.mutateGuard(s.auth(s.handleRuleMiss)))
+	if s.opts.Explain != nil {
+		mux.HandleFunc("GET /api/rules/explain", s.mutateGuard(s.auth(s.handleRulesExplain)))
+	}
+	if s.opts.Access != nil {
+		mux.HandleFunc("GET /api/rules/access", s.mutateGuard(s.auth(s.handleAccessList)))
+		mux.HandleFunc("PUT /api/rules/access", s.mutateGuard(s.auth(s.handleAccessPin)))
+		mux.HandleFunc("DELETE /api/rules/access", s.mutateGuard(s.auth(s.handleAccessEvict)))
+		mux.HandleFunc("POST /api/rules/access/flush", s.mutateGuard(s.auth(s.handleAccessFlush)))
+	}
+	mux.HandleFunc("GET /api/rules/suggestions", s.mutateGuard(s.auth(s.handleRuleSuggestions)))
+	mux.HandleFunc("POST /api/rules/suggestions/accept", s.mutateGuard(s.auth(s.handleRuleSuggestionsAccept)))
 	mux.HandleFunc("GET /api/traffic", s.mutateGuard(s.auth(s.handleTraffic)))
 	mux.HandleFunc("GET /api/totals", s.mutateGuard(s.auth(s.handleTotals)))
 	mux.HandleFunc("GET /api/history", s.mutateGuard(s.auth(s.handleHistory)))
+	mux.HandleFunc("GET /api/usage", s.mutateGuard(s.auth(s.handleUsage)))
+	mux.HandleFunc("GET /api/usage/export", s.mutateGuard(s.auth(s.handleUsageExport)))
 	mux.HandleFunc("GET /api/stream", s.mutateGuard(s.auth(s.handleStream)))
+	mux.HandleFunc("GET /api/connections", s.mutateGuard(s.auth(s.handleConnections)))
+	mux.HandleFunc("GET /api/connections/stream", s.mutateGuard(s.auth(s.handleConnectionsStream)))
+	mux.HandleFunc("DELETE /api/connections/{id}", s.mutateGuard(s.auth(s.handleConnectionClose)))
+	if s.opts.DNSLog != nil {
+		mux.HandleFunc("GET /api/dns/log", s.mutateGuard(s.auth(s.handleDNSLog)))
+		mux.HandleFunc("GET /api/dns/log/stream", s.mutateGuard(s.auth(s.handleDNSLogStream)))
+	}
 	if s.opts.Config != nil {
 		mux.HandleFunc("GET /api/config", s.mutateGuard(s.auth(s.handleConfigGet)))
 		mux.HandleFunc("PATCH /api/config", s.mutateGuard(s.auth(s.handleConfigPatch)))
 	}
+	if s.opts.State != nil {
+		mux.HandleFunc("GET /api/tokens", s.mutateGuard(s.auth(s.handleTokensList)))
+		mux.HandleFunc("POST /api/tokens", s.mutateGuard(s.auth(s.handleTokenCreate)))
+		mux.HandleFunc("DELETE /api/tokens/{id}", s.mutateGuard(s.auth(s.handleTokenRevoke)))
+		mux.HandleFunc("GET /api/users", s.mutateGuard(s.auth(s.handleUsersList)))
+		mux.HandleFunc("POST /api/users", s.mutateGuard(s.auth(s.handleUserAdd)))
+		mux.HandleFunc("PATCH /api/users/{name}", s.mutateGuard(s.auth(s.handleUserUpdate)))
+		mux.HandleFunc("DELETE /api/users/{name}", s.mutateGuard(s.auth(s.handleUserDelete)))
+		mux.HandleFunc("GET /api/state/revisions", s.mutateGuard(s.auth(s.handleRevisions)))
+		mux.HandleFunc("GET /api/state/revisions/diff", s.mutateGuard(s.auth(s.handleRevisionDiff)))
+		if s.opts.Rollback != nil {
+			mux.HandleFunc("POST /api/state/rollback", s.mutateGuard(s.auth(s.handleRollback)))
+		}
+	}
+	if s.opts.Audit != nil {
+		mux.HandleFunc("GET /api/audit", s.mutateGuard(s.auth(s.handleAudit)))
+	}
 	if s.opts.Restart != nil {
 		mux.HandleFunc("POST /api/restart", s.mutateGuard(s.auth(s.handleRestart)))
 	}
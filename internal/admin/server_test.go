@@ -24,8 +24,12 @@ type fakeRules struct {
 	lists map[Category][]string
 	hits  []RuleHit
 	miss  []RuleHit
+	// suggestions is served by RuleSuggestions.
+	suggestions []RuleSuggestion
 	// errAdd makes RuleAdd fail, simulating a state persistence failure.
 	errAdd error
+	// expires records the expiry of temporary changes.
+	expires map[string]time.Time
 }
 
 func (f *fakeRules) RuleMiss(byCount bool, limit int) []RuleHit {
@@ -124,6 +128,26 @@ func (f *fakeRules) RuleAdd(c Category, rules ...string) error {
 	return nil
 }
 
+func (f *fakeRules) RuleAddUntil(c Category, expires time.Time, rules ...string) error {
+	if f.expires == nil {
+		f.expires = make(map[string]time.Time)
+	}
+	for _, rule := range rules {
+		f.expires[rule] = expires
+	}
+	return f.RuleAdd(c, rules...)
+}
+
+func (f *fakeRules) RuleRemoveUntil(c Category, expires time.Time, rules ...string) ([]string, error) {
+	if f.expires == nil {
+		f.expires = make(map[string]time.Time)
+	}
+	for _, rule := range rules {
+		f.expires[rule] = expires
+	}
+	return f.RuleRemoveMany(c, rules...)
+}
+
 func (f *fakeRules) RuleRemove(c Category, rule string) (bool, error) {
 	for i, r := range f.lists[c] {
 		if r == rule {
@@ -176,6 +200,27 @@ func (f *fakeRules) RuleReset(c Category) error {
 	return nil
 }
 
+func (f *fakeRules) RuleExport(c Category) (RuleExport, error) {
+	if !c.valid() {
+		return RuleExport{}, fmt.Errorf("invalid category")
+	}
+	rules := append([]string{}, f.lists[c]...)
+	return RuleExport{Category: c, Rules: rules, Baseline: rules, Additions: []string{}, Tombstones: []string{}}, nil
+}
+
+func (f *fakeRules) RuleSuggestions(limit int) []RuleSuggestion {
+	return f.suggestions
+}
+
+func (f *fakeRules) RuleAddSet(rules map[Category][]string) (map[Category][]string, error) {
+	for c, list := range rules {
+		if err := f.RuleAdd(c, list...); err != nil {
+			return nil, err
+		}
+	}
+	return rules, nil
+}
+
 func (f *fakeRules) TestDomain(domain string) (DomainTest, error) {
 	domain = strings.ToLower(strings.TrimSpace(strings.TrimSuffix(domain, ".")))
 	if domain == "" {
@@ -572,6 +617,35 @@ func TestRulesCRUD(t *testing.T) {
 	}
 }
 
+func TestRulesTTL(t *testing.T) {
+	fr := newFakeRules()
+	ts := newTestServer(t, fr)
+	cookie := login(t, ts, "secret")
+
+	start := time.Now()
+	resp := authedRequest(t, ts, http.MethodPost, "/api/rules", cookie, `{"category":"proxy","rules":["example.com"],"ttl":"1h"}`)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("temporary add status: %d", resp.StatusCode)
+	}
+	if exp := fr.expires["example.com"]; exp.Before(start.Add(time.Hour-time.Second)) || exp.After(time.Now().Add(time.Hour)) {
+		t.Fatalf("expiry = %v, want about an hour from now", exp)
+	}
+	resp = authedRequest(t, ts, http.MethodDelete, "/api/rules", cookie, `{"category":"proxy","rules":["example.com"],"ttl":"30m"}`)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent || fr.expires["example.com"].After(time.Now().Add(30*time.Minute)) {
+		t.Fatalf("temporary remove status: %d, expiry %v", resp.StatusCode, fr.expires["example.com"])
+	}
+
+	for _, ttl := range []string{"soon", "30s", "-1h", "2200h"} {
+		resp := authedRequest(t, ts, http.MethodPost, "/api/rules", cookie, `{"category":"proxy","rules":["example.org"],"ttl":"`+ttl+`"}`)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("ttl %q = %d, want 400", ttl, resp.StatusCode)
+		}
+	}
+}
+
 func TestRulesListPaginationAndSearch(t *testing.T) {
 	ts := newTestServer(t, newFakeRules())
 	cookie := login(t, ts, "secret")
@@ -1278,7 +1352,7 @@ func TestSessionSlidingExpiry(t *testing.T) {
 	func() {
 		s.mu.Lock()
 		defer s.mu.Unlock()
-		s.sessions["token"] = time.Now().Add(sessionTTL / 4) // less than half TTL remaining
+		s.sessions["token"] = session{Expires: time.Now().Add(sessionTTL / 4)} // less than half TTL remaining
 	}()
 	ts := httptest.NewServer(s.http.Handler)
 	t.Cleanup(ts.Close)
@@ -1306,7 +1380,7 @@ func TestSessionSlidingExpiry(t *testing.T) {
 	func() {
 		s.mu.Lock()
 		defer s.mu.Unlock()
-		exp = s.sessions["token"]
+		exp = s.sessions["token"].Expires
 	}()
 	if remaining := time.Until(exp); remaining < sessionTTL/2 {
 		t.Fatalf("expected sliding expiry to refresh TTL, remaining %v", remaining)
@@ -1538,7 +1612,7 @@ func TestStreamSessionRenewalClosesWithoutAuth(t *testing.T) {
 	func() {
 		s.mu.Lock()
 		defer s.mu.Unlock()
-		s.sessions[cookie] = time.Now().Add(sessionTTL / 4)
+		s.sessions[cookie] = session{Expires: time.Now().Add(sessionTTL / 4)}
 	}()
 
 	deadline := time.After(8 * time.Second)
@@ -1653,7 +1727,7 @@ func (f *failingFlusher) FlushError() error {
 func TestStreamHandlerExitsOnWriteFailure(t *testing.T) {
 	s := NewServer(Options{Password: "secret", Rules: newFakeRules(), Stats: newTestStats(t)})
 	s.mu.Lock()
-	s.sessions["token"] = time.Now().Add(time.Hour)
+	s.sessions["token"] = session{Expires: time.Now().Add(time.Hour)}
 	s.mu.Unlock()
 
 	req := httptest.NewRequest(http.MethodGet, "/api/stream", nil)
@@ -1748,6 +1822,19 @@ func TestConfigPatchValidationAndRevision(t *testing.T) {
 	}
 	resp.Body.Close()
 
+	// acl entries must be CIDRs or IPs of a known listener group
+	for _, changes := range []string{
+		`{"acl":{"dns":{"allow":["lan"]}}}`,
+		`{"acl":{"ftp":{"deny":["10.0.0.0/8"]}}}`,
+	} {
+		resp = authedRequest(t, ts, http.MethodPatch, "/api/config", cookie,
+			`{"revision":0,"changes":`+changes+`}`)
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("expected 400 for %s, got %d", changes, resp.StatusCode)
+		}
+		resp.Body.Close()
+	}
+
 	// unknown fields are rejected by the strict decoder
 	resp = authedRequest(t, ts, http.MethodPatch, "/api/config", cookie,
 		`{"revision":0,"changes":{"remote_password":"x"}}`)
@@ -29,16 +29,21 @@ func (s *Stats) Snapshot(sort DomainSort, source Source, client string) TrafficS
 	snap.Conns.HTTP = s.connsHTTP.Load()
 	snap.Conns.HTTPS = s.connsHTTPS.Load()
 	snap.Conns.Socks5 = s.connsSocks.Load()
+	snap.Conns.Transparent = s.connsTransparent.Load()
 	snap.Active.HTTP = s.activeHTTP.Load()
 	snap.Active.HTTPS = s.activeHTTPS.Load()
 	snap.Active.Socks5 = s.activeSocks.Load()
+	snap.Active.Transparent = s.activeTransparent.Load()
 	snap.RuleHits.Block = s.ruleBlock.Load()
 	snap.RuleHits.Direct = s.ruleDirect.Load()
 	snap.RuleHits.Proxy = s.ruleProxy.Load()
 	snap.Errors.Dial = s.dialFailed.Load()
 	snap.Errors.DNS = s.dnsFailed.Load()
 	snap.Errors.Accept = s.acceptFailed.Load()
+	snap.Errors.ACL = s.aclRefused.Load()
 	snap.Events = s.recentErrorEvents()
+	snap.Listeners = s.listenerStats()
+	snap.Quotas = s.limiter.QuotaStats()
 	snap.Rates.BytesUpPerSec, snap.Rates.BytesDownPerSec, snap.Rates.DNSPerSec, snap.Rates.ConnsPerSec = s.rates()
 	snap.System.Goroutines = uint64(goroutineCount())
 	snap.System.HeapAlloc = heapAlloc()
@@ -361,7 +366,7 @@ func (s *Stats) sample() {
 		bytesUp:   s.bytesUp.Load(),
 		bytesDown: s.bytesDown.Load(),
 		dns:       s.dnsQueries.Load(),
-		conns:     s.connsHTTP.Load() + s.connsHTTPS.Load() + s.connsSocks.Load(),
+		conns:     s.connsHTTP.Load() + s.connsHTTPS.Load() + s.connsSocks.Load() + s.connsTransparent.Load(),
 		block:     s.ruleBlock.Load(),
 		direct:    s.ruleDirect.Load(),
 		proxy:     s.ruleProxy.Load(),
@@ -379,11 +384,12 @@ func (s *Stats) sample() {
 	}
 
 	sample := HistorySample{
-		At:          now,
-		Active:      s.activeHTTP.Load() + s.activeHTTPS.Load() + s.activeSocks.Load(),
-		ActiveHTTP:  s.activeHTTP.Load(),
-		ActiveHTTPS: s.activeHTTPS.Load(),
-		ActiveSocks: s.activeSocks.Load(),
+		At:                now,
+		Active:            s.activeHTTP.Load() + s.activeHTTPS.Load() + s.activeSocks.Load() + s.activeTransparent.Load(),
+		ActiveHTTP:        s.activeHTTP.Load(),
+		ActiveHTTPS:       s.activeHTTPS.Load(),
+		ActiveSocks:       s.activeSocks.Load(),
+		ActiveTransparent: s.activeTransparent.Load(),
 	}
 	if now.Sub(prev.at) <= historyMaxGap {
 		sample.BytesUp = cur.bytesUp - prev.bytesUp
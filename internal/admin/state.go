@@ -5,11 +5,13 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"maps"
 	"os"
-	"path/filepath"
 	"slices"
 	"sync"
 	"time"
+
+	"github.com/sower-proxy/sower/internal/fsutil"
 )
 
 const stateVersion = 1
@@ -17,9 +19,41 @@ const stateVersion = 1
 // RuleDelta records admin-side rule changes relative to the boot baseline:
 // Add holds rules absent from the baseline, Remove holds tombstoned baseline
 // rules. Both lists are deduplicated and a rule never appears in both.
+// Expires holds the expiry of temporary entries of either list; the rule
+// reaper reverts them once due, see StateStore.RuleExpire.
 type RuleDelta struct {
-	Add    []string `json:"add"`
-	Remove []string `json:"remove"`
+	Add     []string             `json:"add"`
+	Remove  []string             `json:"remove"`
+	Expires map[string]time.Time `json:"expires,omitempty"`
+}
+
+func (d *RuleDelta) clone() *RuleDelta {
+	return &RuleDelta{Add: slices.Clone(d.Add), Remove: slices.Clone(d.Remove), Expires: maps.Clone(d.Expires)}
+}
+
+// setExpiry records the expiry of a delta entry; a zero expires makes the
+// entry permanent.
+func (d *RuleDelta) setExpiry(rule string, expires time.Time) {
+	if expires.IsZero() {
+		delete(d.Expires, rule)
+		if len(d.Expires) == 0 {
+			d.Expires = nil
+		}
+		return
+	}
+	if d.Expires == nil {
+		d.Expires = make(map[string]time.Time)
+	}
+	d.Expires[rule] = expires
+}
+
+// pruneExpires drops the expiries of rules that left both lists.
+func (d *RuleDelta) pruneExpires() {
+	for rule := range d.Expires {
+		if !slices.Contains(d.Add, rule) && !slices.Contains(d.Remove, rule) {
+			d.setExpiry(rule, time.Time{})
+		}
+	}
 }
 
 // ConfigOverrides holds the whitelisted config fields editable through the
@@ -27,7 +61,7 @@ type RuleDelta struct {
 // previous override) from an explicit change: a non-empty value sets the
 // override, and a non-nil empty value/empty list clears it so the
 // file/flag configuration takes over again. Secrets must never be added
-// here. List fields (rule sources) hold the full inline lists.
+// here. List fields (rule sources, client ACLs) hold the full lists.
 type ConfigOverrides struct {
 	LogLevel    *string `json:"log_level,omitempty"`
 	DNSUpstream *string `json:"dns_upstream,omitempty"`
@@ -65,16 +99,38 @@ type ConfigOverrides struct {
 	RouterCountryMMDB         *string   `json:"router_country_mmdb,omitempty"`
 	RouterCountryFile         *string   `json:"router_country_file,omitempty"`
 	RouterCountryRules        *[]string `json:"router_country_rules,omitempty"`
+
+	// ACL holds the client ACL overrides keyed by listener group (see
+	// ACLGroups). The map is shared with retained revisions: replace it,
+	// never modify it in place.
+	ACL map[string]ACLOverride `json:"acl,omitempty"`
+}
+
+// ACLGroups names the listener groups whose client ACL can be overridden.
+var ACLGroups = []string{"dns", "http", "https", "socks5", "transparent"}
+
+// ACLOverride is the client ACL override of one listener group. Each list
+// follows the other list overrides: nil keeps the file/flag list.
+type ACLOverride struct {
+	Allow *[]string `json:"allow,omitempty"`
+	Deny  *[]string `json:"deny,omitempty"`
 }
 
-// State is the on-disk admin state document. Revision bumps on every
-// mutation and drives optimistic concurrency for config PATCHes.
+// State is the on-disk admin state document. Revision bumps on every rule
+// or config mutation and drives optimistic concurrency for config PATCHes;
+// Revisions retains the snapshots of the latest ones for diffs and
+// rollbacks.
 type State struct {
 	Version   int                     `json:"version"`
 	Revision  uint64                  `json:"revision"`
 	UpdatedAt time.Time               `json:"updatedAt"`
 	Rules     map[Category]*RuleDelta `json:"rules"`
 	Config    ConfigOverrides         `json:"config"`
+	Tokens    []*StoredToken          `json:"tokens,omitempty"`
+	Users     []*StoredUser           `json:"users,omitempty"`
+	Revisions []StateRevision         `json:"revisions,omitempty"`
+	// BootCheckout is the revision last checked out by CheckoutOnce.
+	BootCheckout *uint64 `json:"bootCheckout,omitempty"`
 }
 
 // RuleChangeSet is the API view of the current rule deltas.
@@ -94,10 +150,11 @@ var ErrRevisionMismatch = errors.New("state revision mismatch")
 // write, so a persist failure leaves the previous state intact and callers
 // must not apply the corresponding runtime change.
 type StateStore struct {
-	mu       sync.Mutex
-	path     string
-	state    State
-	baseline map[Category]map[string]struct{}
+	mu            sync.Mutex
+	path          string
+	state         State
+	baseline      map[Category]map[string]struct{}
+	revisionLimit int
 }
 
 // LoadStateStore opens the state file at path. An empty path yields an
@@ -106,6 +163,9 @@ type StateStore struct {
 // starts empty as well, so a bad state file never blocks startup.
 func LoadStateStore(path string) *StateStore {
 	st := &StateStore{path: path, state: newState()}
+	// The revision loaded (or the empty start) is retained too, so the
+	// first change can be rolled back.
+	defer st.retainLocked(&st.state)
 	if path == "" {
 		return st
 	}
@@ -133,14 +193,26 @@ func newState() State {
 
 // normalizeState repairs load-time inconsistencies: nil maps, duplicate
 // delta entries, and rules present in both Add and Remove (Add wins: the
-// most recent mutation appended it there).
+// most recent mutation appended it there). Retained revisions get the same
+// repair; one naming an unknown category is dropped.
 func normalizeState(s State) State {
-	if s.Rules == nil {
-		s.Rules = make(map[Category]*RuleDelta)
+	s.Rules = normalizeRules(s.Rules)
+	s.Revisions = slices.DeleteFunc(s.Revisions, func(r StateRevision) bool {
+		return !validStateCategories(r.Rules)
+	})
+	for i := range s.Revisions {
+		s.Revisions[i].Rules = normalizeRules(s.Revisions[i].Rules)
+	}
+	return s
+}
+
+func normalizeRules(rules map[Category]*RuleDelta) map[Category]*RuleDelta {
+	if rules == nil {
+		rules = make(map[Category]*RuleDelta)
 	}
-	for cat, d := range s.Rules {
+	for cat, d := range rules {
 		if d == nil {
-			delete(s.Rules, cat)
+			delete(rules, cat)
 			continue
 		}
 		d.Add = dedupeStrings(d.Add)
@@ -153,11 +225,12 @@ func normalizeState(s State) State {
 			_, ok := keep[r]
 			return ok
 		})
+		d.pruneExpires()
 		if len(d.Add) == 0 && len(d.Remove) == 0 {
-			delete(s.Rules, cat)
+			delete(rules, cat)
 		}
 	}
-	return s
+	return rules
 }
 
 func validStateCategories(rules map[Category]*RuleDelta) bool {
@@ -231,6 +304,7 @@ func (st *StateStore) SetBaseline(baseline map[Category][]string) {
 			changed = true
 		}
 		d.Add, d.Remove = adds, rems
+		d.pruneExpires()
 		if len(d.Add) == 0 && len(d.Remove) == 0 {
 			delete(cand.Rules, cat)
 		}
@@ -262,7 +336,7 @@ func (st *StateStore) ApplyConfig(o ConfigOverrides, revision uint64) (uint64, e
 	}
 	cand := st.cloneLocked()
 	cand.Config = o
-	cand.bump()
+	st.bumpLocked(&cand)
 	if err := st.persistLocked(cand); err != nil {
 		return 0, err
 	}
@@ -280,34 +354,67 @@ func (st *StateStore) Revision() uint64 {
 // RuleAdd records rules as additions (or restores tombstoned baseline rules)
 // and persists. It returns the rules that must enter the runtime rule set;
 // rules already effective are dropped from the result. A nil result with nil
-// error means the call was a no-op.
+// error means the runtime rule set stays as it is.
 func (st *StateStore) RuleAdd(category Category, rules ...string) ([]string, error) {
+	return st.RuleAddUntil(category, time.Time{}, rules...)
+}
+
+// RuleAddUntil is RuleAdd for temporary additions that the rule reaper
+// removes again at expires; a zero expires adds them permanently. Re-adding
+// an existing addition replaces its expiry. A restored tombstoned baseline
+// rule is permanent either way.
+func (st *StateStore) RuleAddUntil(category Category, expires time.Time, rules ...string) ([]string, error) {
+	added, err := st.ruleAddSet(map[Category][]string{category: rules}, expires)
+	return added[category], err
+}
+
+// RuleAddSet is RuleAdd for several categories in one revision: either all
+// additions persist or none do. The result maps each category to its
+// runtime additions and omits categories without any.
+func (st *StateStore) RuleAddSet(rules map[Category][]string) (map[Category][]string, error) {
+	return st.ruleAddSet(rules, time.Time{})
+}
+
+func (st *StateStore) ruleAddSet(rules map[Category][]string, expires time.Time) (map[Category][]string, error) {
 	st.mu.Lock()
 	defer st.mu.Unlock()
 
 	cand := st.cloneLocked()
-	d := cand.delta(category)
-	var runtimeAdd []string
-	for _, rule := range rules {
-		_, inBase := st.baseline[category][rule]
-		switch {
-		case inBase && slices.Contains(d.Remove, rule):
-			d.Remove = removeString(d.Remove, rule)
-			runtimeAdd = append(runtimeAdd, rule)
-		case inBase, slices.Contains(d.Add, rule):
-			// already effective
-		default:
-			d.Add = append(d.Add, rule)
-			runtimeAdd = append(runtimeAdd, rule)
+	runtimeAdd := make(map[Category][]string)
+	changed := false
+	for category, list := range rules {
+		if !category.valid() {
+			return nil, fmt.Errorf("invalid rule category %q", category)
+		}
+		d := cand.delta(category)
+		for _, rule := range list {
+			_, inBase := st.baseline[category][rule]
+			switch {
+			case inBase && slices.Contains(d.Remove, rule):
+				d.Remove = removeString(d.Remove, rule)
+				d.setExpiry(rule, time.Time{})
+				runtimeAdd[category] = append(runtimeAdd[category], rule)
+			case inBase:
+				// already effective
+			case slices.Contains(d.Add, rule):
+				if !d.Expires[rule].Equal(expires) {
+					d.setExpiry(rule, expires)
+					changed = true
+				}
+			default:
+				d.Add = append(d.Add, rule)
+				d.setExpiry(rule, expires)
+				runtimeAdd[category] = append(runtimeAdd[category], rule)
+			}
+		}
+		if len(d.Add) == 0 && len(d.Remove) == 0 {
+			delete(cand.Rules, category)
 		}
 	}
-	if len(runtimeAdd) == 0 {
+	if len(runtimeAdd) == 0 && !changed {
 		return nil, nil
 	}
-	if len(d.Add) == 0 && len(d.Remove) == 0 {
-		delete(cand.Rules, category)
-	}
-	cand.bump()
+	st.bumpLocked(&cand)
 	if err := st.persistLocked(cand); err != nil {
 		return nil, err
 	}
@@ -326,12 +433,21 @@ func (st *StateStore) RuleRemove(category Category, rule string) (bool, error) {
 // persists once. Unknown rules and duplicates are ignored. The returned list
 // is the exact runtime work that may be applied after persistence succeeds.
 func (st *StateStore) RuleRemoveBatch(category Category, rules ...string) ([]string, error) {
+	return st.RuleRemoveUntil(category, time.Time{}, rules...)
+}
+
+// RuleRemoveUntil is RuleRemoveBatch with baseline rules tombstoned only
+// until expires, when the rule reaper restores them; a zero expires removes
+// them permanently. Removing a tombstoned rule again replaces its expiry.
+// Additions are always removed for good.
+func (st *StateStore) RuleRemoveUntil(category Category, expires time.Time, rules ...string) ([]string, error) {
 	st.mu.Lock()
 	defer st.mu.Unlock()
 
 	cand := st.cloneLocked()
 	d := cand.delta(category)
 	removed := make([]string, 0, len(rules))
+	changed := false
 	seen := make(map[string]struct{}, len(rules))
 	for _, rule := range rules {
 		if _, ok := seen[rule]; ok {
@@ -342,19 +458,24 @@ func (st *StateStore) RuleRemoveBatch(category Category, rules ...string) ([]str
 		switch {
 		case slices.Contains(d.Add, rule):
 			d.Add = removeString(d.Add, rule)
+			d.setExpiry(rule, time.Time{})
 			removed = append(removed, rule)
 		case inBase && !slices.Contains(d.Remove, rule):
 			d.Remove = append(d.Remove, rule)
+			d.setExpiry(rule, expires)
 			removed = append(removed, rule)
+		case inBase && !d.Expires[rule].Equal(expires):
+			d.setExpiry(rule, expires)
+			changed = true
 		}
 	}
-	if len(removed) == 0 {
+	if len(removed) == 0 && !changed {
 		return nil, nil
 	}
 	if len(d.Add) == 0 && len(d.Remove) == 0 {
 		delete(cand.Rules, category)
 	}
-	cand.bump()
+	st.bumpLocked(&cand)
 	if err := st.persistLocked(cand); err != nil {
 		return nil, err
 	}
@@ -379,7 +500,7 @@ func (st *StateStore) RuleReset(categories ...Category) error {
 	if !changed {
 		return nil
 	}
-	cand.bump()
+	st.bumpLocked(&cand)
 	if err := st.persistLocked(cand); err != nil {
 		return err
 	}
@@ -387,6 +508,55 @@ func (st *StateStore) RuleReset(categories ...Category) error {
 	return nil
 }
 
+// RuleExpire reverts the delta entries whose expiry is not after now, as
+// one revision: expired additions leave and expired tombstones are
+// restored. It returns the reverted entries per category, sorted, or nil
+// when nothing was due.
+func (st *StateStore) RuleExpire(now time.Time) (map[Category]RuleDelta, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	cand := st.cloneLocked()
+	var expired map[Category]RuleDelta
+	for cat, d := range cand.Rules {
+		var out RuleDelta
+		for rule, at := range d.Expires {
+			if at.After(now) {
+				continue
+			}
+			if slices.Contains(d.Add, rule) {
+				d.Add = removeString(d.Add, rule)
+				out.Add = append(out.Add, rule)
+			} else {
+				d.Remove = removeString(d.Remove, rule)
+				out.Remove = append(out.Remove, rule)
+			}
+			d.setExpiry(rule, time.Time{})
+		}
+		if len(out.Add) == 0 && len(out.Remove) == 0 {
+			continue
+		}
+		slices.Sort(out.Add)
+		slices.Sort(out.Remove)
+		if expired == nil {
+			expired = make(map[Category]RuleDelta)
+		}
+		expired[cat] = out
+		if len(d.Add) == 0 && len(d.Remove) == 0 {
+			delete(cand.Rules, cat)
+		}
+	}
+	if expired == nil {
+		return nil, nil
+	}
+	st.bumpLocked(&cand)
+	if err := st.persistLocked(cand); err != nil {
+		return nil, err
+	}
+	st.state = cand
+	return expired, nil
+}
+
 // Changes returns a snapshot of the current rule deltas. All three
 // categories are always present so clients can render unconditionally.
 func (st *StateStore) Changes() RuleChangeSet {
@@ -401,8 +571,9 @@ func (st *StateStore) Changes() RuleChangeSet {
 	for _, cat := range []Category{CategoryBlock, CategoryDirect, CategoryProxy} {
 		if d, ok := st.state.Rules[cat]; ok {
 			out.Rules[cat] = RuleDelta{
-				Add:    nonNilStrings(d.Add),
-				Remove: nonNilStrings(d.Remove),
+				Add:     nonNilStrings(d.Add),
+				Remove:  nonNilStrings(d.Remove),
+				Expires: maps.Clone(d.Expires),
 			}
 		} else {
 			out.Rules[cat] = RuleDelta{Add: []string{}, Remove: []string{}}
@@ -425,7 +596,7 @@ func (st *StateStore) Delta(category Category) RuleDelta {
 	st.mu.Lock()
 	defer st.mu.Unlock()
 	if d, ok := st.state.Rules[category]; ok {
-		return RuleDelta{Add: nonNilStrings(d.Add), Remove: nonNilStrings(d.Remove)}
+		return RuleDelta{Add: nonNilStrings(d.Add), Remove: nonNilStrings(d.Remove), Expires: maps.Clone(d.Expires)}
 	}
 	return RuleDelta{}
 }
@@ -434,10 +605,20 @@ func (st *StateStore) cloneLocked() State {
 	cand := st.state
 	cand.Rules = make(map[Category]*RuleDelta, len(st.state.Rules))
 	for cat, d := range st.state.Rules {
-		cand.Rules[cat] = &RuleDelta{
-			Add:    slices.Clone(d.Add),
-			Remove: slices.Clone(d.Remove),
-		}
+		cand.Rules[cat] = d.clone()
+	}
+	cand.Tokens = make([]*StoredToken, len(st.state.Tokens))
+	for i, t := range st.state.Tokens {
+		c := *t
+		c.TokenInfo = t.TokenInfo.clone()
+		cand.Tokens[i] = &c
+	}
+	// Retained snapshots are never modified in place.
+	cand.Revisions = slices.Clone(st.state.Revisions)
+	cand.Users = make([]*StoredUser, len(st.state.Users))
+	for i, u := range st.state.Users {
+		c := *u
+		cand.Users[i] = &c
 	}
 	return cand
 }
@@ -463,9 +644,8 @@ func removeString(list []string, s string) []string {
 	return list
 }
 
-// persistLocked writes the state atomically: a temp file in the same
-// directory, fsync, rename, then a directory fsync so the rename itself is
-// durable. It is a no-op for in-memory stores.
+// persistLocked writes the state atomically. It is a no-op for in-memory
+// stores.
 func (st *StateStore) persistLocked(s State) error {
 	if st.path == "" {
 		return nil
@@ -475,38 +655,8 @@ func (st *StateStore) persistLocked(s State) error {
 		return fmt.Errorf("marshal admin state: %w", err)
 	}
 
-	dir := filepath.Dir(st.path)
-	if err := os.MkdirAll(dir, 0o700); err != nil {
-		return fmt.Errorf("create admin state dir: %w", err)
-	}
-	tmp, err := os.CreateTemp(dir, ".admin-state-*.tmp")
-	if err != nil {
-		return fmt.Errorf("create admin state temp file: %w", err)
-	}
-	tmpName := tmp.Name()
-	defer func() { _ = os.Remove(tmpName) }()
-
-	if _, err := tmp.Write(data); err != nil {
-		_ = tmp.Close()
-		return fmt.Errorf("write admin state temp file: %w", err)
-	}
-	if err := tmp.Sync(); err != nil {
-		_ = tmp.Close()
-		return fmt.Errorf("fsync admin state temp file: %w", err)
-	}
-	if err := tmp.Close(); err != nil {
-		return fmt.Errorf("close admin state temp file: %w", err)
-	}
-	if err := os.Chmod(tmpName, 0o600); err != nil {
-		return fmt.Errorf("chmod admin state temp file: %w", err)
-	}
-	if err := os.Rename(tmpName, st.path); err != nil {
-		return fmt.Errorf("rename admin state file: %w", err)
-	}
-
-	if d, err := os.Open(dir); err == nil {
-		_ = d.Sync()
-		_ = d.Close()
+	if err := fsutil.WriteFileAtomic(st.path, data); err != nil {
+		return fmt.Errorf("write admin state: %w", err)
 	}
 	return nil
 }
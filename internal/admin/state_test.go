@@ -8,6 +8,7 @@ import (
 	"slices"
 	"sync"
 	"testing"
+	"time"
 )
 
 func testBaseline() map[Category][]string {
@@ -325,3 +326,93 @@ func TestStateStoreRuleRemoveBatchIsAtomic(t *testing.T) {
 		t.Fatalf("no-op batch changed revision: before=%d after=%d", before, st.Revision())
 	}
 }
+
+func TestStateStoreRuleAddSetIsOneRevision(t *testing.T) {
+	t.Parallel()
+	st := LoadStateStore(stateFilePath(t))
+	st.SetBaseline(testBaseline())
+	if _, err := st.RuleRemove(CategoryDirect, "internal.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	before := st.Revision()
+
+	added, err := st.RuleAddSet(map[Category][]string{
+		CategoryProxy:  {"**.example.org", "**.google.com"},
+		CategoryDirect: {"internal.example.com", "**.example.cn"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(added[CategoryProxy], []string{"**.example.org"}) ||
+		!slices.Equal(added[CategoryDirect], []string{"internal.example.com", "**.example.cn"}) {
+		t.Fatalf("runtime additions = %v", added)
+	}
+	if st.Revision() != before+1 {
+		t.Fatalf("set must bump revision once: before=%d after=%d", before, st.Revision())
+	}
+	if d := st.Delta(CategoryDirect); len(d.Remove) != 0 || !slices.Equal(d.Add, []string{"**.example.cn"}) {
+		t.Fatalf("direct delta = %+v", d)
+	}
+
+	before = st.Revision()
+	if _, err := st.RuleAddSet(map[Category][]string{CategoryProxy: {"**.example.net"}, "nope": {"x.example"}}); err == nil {
+		t.Fatal("invalid category accepted")
+	}
+	if st.Revision() != before || slices.Contains(st.Delta(CategoryProxy).Add, "**.example.net") {
+		t.Fatal("failed set changed state")
+	}
+}
+
+func TestStateStoreRuleExpiry(t *testing.T) {
+	t.Parallel()
+	path := stateFilePath(t)
+	st := LoadStateStore(path)
+	st.SetBaseline(testBaseline())
+	now := time.Now().Truncate(time.Second)
+	hour := now.Add(time.Hour)
+
+	if _, err := st.RuleAddUntil(CategoryProxy, hour, "**.example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.RuleAdd(CategoryProxy, "**.example.net"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.RuleRemoveUntil(CategoryBlock, hour, "ads.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	// Re-adding extends a temporary addition without touching the runtime.
+	before := st.Revision()
+	added, err := st.RuleAddUntil(CategoryProxy, hour.Add(time.Hour), "**.example.org")
+	if err != nil || added != nil || st.Revision() != before+1 {
+		t.Fatalf("extend = %v, %v, revision %d -> %d", added, err, before, st.Revision())
+	}
+	if got := readStateFile(t, path).Rules[CategoryProxy].Expires; len(got) != 1 || !got["**.example.org"].Equal(hour.Add(time.Hour)) {
+		t.Fatalf("persisted expires = %v", got)
+	}
+
+	if expired, err := st.RuleExpire(now); err != nil || expired != nil {
+		t.Fatalf("early expire = %v, %v", expired, err)
+	}
+	before = st.Revision()
+	expired, err := st.RuleExpire(hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expired) != 1 || !slices.Equal(expired[CategoryBlock].Remove, []string{"ads.example.com"}) {
+		t.Fatalf("expired = %+v", expired)
+	}
+	if st.Revision() != before+1 {
+		t.Fatalf("expire must bump revision once: before=%d after=%d", before, st.Revision())
+	}
+	if d := st.Delta(CategoryBlock); len(d.Remove) != 0 || d.Expires != nil {
+		t.Fatalf("block delta after expiry = %+v", d)
+	}
+
+	expired, err = st.RuleExpire(hour.Add(time.Hour))
+	if err != nil || !slices.Equal(expired[CategoryProxy].Add, []string{"**.example.org"}) {
+		t.Fatalf("expired = %+v, %v", expired, err)
+	}
+	if d := LoadStateStore(path).Delta(CategoryProxy); !slices.Equal(d.Add, []string{"**.example.net"}) || d.Expires != nil {
+		t.Fatalf("reloaded proxy delta = %+v", d)
+	}
+}
@@ -81,12 +81,14 @@ const (
 	SourceHTTP   Source = "http"
 	SourceHTTPS  Source = "https"
 	SourceSocks5 Source = "socks5"
-	SourceDNS    Source = "dns"
+	// SourceTransparent is the Linux REDIRECT/TPROXY listener.
+	SourceTransparent Source = "transparent"
+	SourceDNS         Source = "dns"
 )
 
 func (s Source) valid() bool {
 	switch s {
-	case SourceAll, SourceHTTP, SourceHTTPS, SourceSocks5, SourceDNS:
+	case SourceAll, SourceHTTP, SourceHTTPS, SourceSocks5, SourceTransparent, SourceDNS:
 		return true
 	default:
 		return false
@@ -114,14 +116,16 @@ type TrafficSnapshot struct {
 	Uptime     int64  `json:"uptime"`
 	DNSQueries uint64 `json:"dnsQueries"`
 	Conns      struct {
-		HTTP   uint64 `json:"http"`
-		HTTPS  uint64 `json:"https"`
-		Socks5 uint64 `json:"socks5"`
+		HTTP        uint64 `json:"http"`
+		HTTPS       uint64 `json:"https"`
+		Socks5      uint64 `json:"socks5"`
+		Transparent uint64 `json:"transparent"`
 	} `json:"conns"`
 	Active struct {
-		HTTP   uint64 `json:"http"`
-		HTTPS  uint64 `json:"https"`
-		Socks5 uint64 `json:"socks5"`
+		HTTP        uint64 `json:"http"`
+		HTTPS       uint64 `json:"https"`
+		Socks5      uint64 `json:"socks5"`
+		Transparent uint64 `json:"transparent"`
 	} `json:"active"`
 	Rates struct {
 		BytesUpPerSec   float64 `json:"bytesUpPerSec"`
@@ -136,20 +140,27 @@ type TrafficSnapshot struct {
 	} `json:"ruleHits"`
 	// Errors aggregates from-start proxy-side failures by kind. Blocked
 	// connections are deliberate routing decisions and are never counted
-	// here; only dial, DNS, and accept failures are.
+	// here; only dial, DNS, and accept failures are, along with clients
+	// refused by a listener ACL.
 	Errors struct {
 		Dial   uint64 `json:"dial"`
 		DNS    uint64 `json:"dns"`
 		Accept uint64 `json:"accept"`
+		ACL    uint64 `json:"acl"`
 	} `json:"errors"`
 	// Events is the recent error event ring, newest first, capped at
-	// maxErrorEvents entries. It carries the same kinds as Errors.
+	// maxErrorEvents entries. It carries the same kinds as Errors except
+	// acl: refusals only count, so a scanner cannot flush real failures out.
 	Events []ErrorEvent `json:"events"`
 	// Blocked is the from-start per-domain block counter, ordered by count.
 	// It is independent of the domain map: blocked connections never carry
 	// traffic, so they would otherwise be invisible to the traffic view.
 	Blocked []BlockedStat `json:"blocked"`
-	System  struct {
+	// Listeners breaks connections and bytes down by named proxy listener.
+	Listeners []ListenerStat `json:"listeners"`
+	// Quotas is the usage of the configured client data quotas.
+	Quotas []QuotaStat `json:"quotas"`
+	System struct {
 		Goroutines uint64 `json:"goroutines"`
 		HeapAlloc  uint64 `json:"heapAlloc"`
 	} `json:"system"`
@@ -182,22 +193,25 @@ type ClientStat struct {
 // Active fields are instantaneous connection counts. History lives in process
 // memory and is lost on restart.
 type HistorySample struct {
-	At          time.Time `json:"at"`
-	BytesUp     uint64    `json:"bytesUp"`
-	BytesDown   uint64    `json:"bytesDown"`
-	DNS         uint64    `json:"dns"`
-	Conns       uint64    `json:"conns"`
-	Active      uint64    `json:"active"`
-	ActiveHTTP  uint64    `json:"activeHttp"`
-	ActiveHTTPS uint64    `json:"activeHttps"`
-	ActiveSocks uint64    `json:"activeSocks"`
-	Block       uint64    `json:"block"`
-	Direct      uint64    `json:"direct"`
-	Proxy       uint64    `json:"proxy"`
+	At                time.Time `json:"at"`
+	BytesUp           uint64    `json:"bytesUp"`
+	BytesDown         uint64    `json:"bytesDown"`
+	DNS               uint64    `json:"dns"`
+	Conns             uint64    `json:"conns"`
+	Active            uint64    `json:"active"`
+	ActiveHTTP        uint64    `json:"activeHttp"`
+	ActiveHTTPS       uint64    `json:"activeHttps"`
+	ActiveSocks       uint64    `json:"activeSocks"`
+	ActiveTransparent uint64    `json:"activeTransparent"`
+	Block             uint64    `json:"block"`
+	Direct            uint64    `json:"direct"`
+	Proxy             uint64    `json:"proxy"`
 }
 
-// History is the bounded in-process time series served by /api/history.
+// History is the time series served by /api/history: the bounded
+// in-process ring, or usage rollups of Step when a range is requested.
 type History struct {
+	Step    string          `json:"step,omitempty"`
 	Samples []HistorySample `json:"samples"`
 }
 
@@ -221,21 +235,36 @@ type Stats struct {
 	start   time.Time
 	metrics *metrics.Metrics
 
-	dnsQueries   atomic.Uint64
-	connsHTTP    atomic.Uint64
-	connsHTTPS   atomic.Uint64
-	connsSocks   atomic.Uint64
-	activeHTTP   atomic.Uint64
-	activeHTTPS  atomic.Uint64
-	activeSocks  atomic.Uint64
-	bytesUp      atomic.Uint64
-	bytesDown    atomic.Uint64
-	ruleBlock    atomic.Uint64
-	ruleDirect   atomic.Uint64
-	ruleProxy    atomic.Uint64
-	dialFailed   atomic.Uint64
-	dnsFailed    atomic.Uint64
-	acceptFailed atomic.Uint64
+	dnsQueries        atomic.Uint64
+	connsHTTP         atomic.Uint64
+	connsHTTPS        atomic.Uint64
+	connsSocks        atomic.Uint64
+	connsTransparent  atomic.Uint64
+	activeHTTP        atomic.Uint64
+	activeHTTPS       atomic.Uint64
+	activeSocks       atomic.Uint64
+	activeTransparent atomic.Uint64
+	bytesUp           atomic.Uint64
+	bytesDown         atomic.Uint64
+	ruleBlock         atomic.Uint64
+	ruleDirect        atomic.Uint64
+	ruleProxy         atomic.Uint64
+	dialFailed        atomic.Uint64
+	dnsFailed         atomic.Uint64
+	acceptFailed      atomic.Uint64
+	aclRefused        atomic.Uint64
+
+	// limiter shapes and meters wrapped connections; nil disables both.
+	limiter *Limiter
+	// usage keeps the persistent rollups behind ranged history and usage
+	// reports; nil disables them.
+	usage *UsageStore
+
+	// openConns registers every wrapped connection until it closes, for
+	// the console's connection list.
+	connMu    sync.Mutex
+	openConns map[uint64]*countingConn
+	connSeq   atomic.Uint64
 
 	errMu     sync.Mutex
 	errEvents []ErrorEvent
@@ -253,6 +282,11 @@ type Stats struct {
 	histMu     sync.Mutex
 	history    []HistorySample
 	lastSample sampleCounters
+
+	// listeners holds the per-listener counters of the named proxy
+	// listeners, keyed by name.
+	listenerMu sync.RWMutex
+	listeners  map[string]*listenerStat
 }
 
 // sampleCounters is the cumulative counter state at one sampling point.
@@ -374,6 +408,14 @@ func (s *Stats) RecordProxyError(kind string, detail string) {
 	s.errMu.Unlock()
 }
 
+// RecordACLRefusal counts one client refused by a listener ACL. Unlike
+// RecordProxyError it leaves the event ring alone: one LAN scanner or
+// looping DNS client would otherwise evict every real failure from it.
+func (s *Stats) RecordACLRefusal() {
+	s.aclRefused.Add(1)
+	s.metrics.RecordProxyError("acl")
+}
+
 // cleanErrorDetail bounds an error detail to the byte budget without
 // splitting a UTF-8 rune (a host can be an IDN in Chinese), and collapses
 // line breaks so a multiline error cannot break the console alert layout.
@@ -433,6 +475,12 @@ func (s *Stats) recordBlock(domain string) {
 // handshake bytes are counted. The per-kind connection counter is bumped
 // immediately; per-domain attribution happens later via BindConn.
 func (s *Stats) WrapConn(conn net.Conn, kind string) net.Conn {
+	return s.wrapConn(conn, kind, "", nil)
+}
+
+// wrapConn wraps conn for kind and the named listener, if any, and
+// registers it as open.
+func (s *Stats) wrapConn(conn net.Conn, kind, listener string, ls *listenerStat) *countingConn {
 	switch kind {
 	case "http":
 		s.connsHTTP.Add(1)
@@ -443,15 +491,24 @@ func (s *Stats) WrapConn(conn net.Conn, kind string) net.Conn {
 	case "socks5":
 		s.connsSocks.Add(1)
 		s.activeSocks.Add(1)
+	case "transparent":
+		s.connsTransparent.Add(1)
+		s.activeTransparent.Add(1)
 	}
 	s.metrics.ConnOpened(kind)
-	return &countingConn{
-		Conn:     conn,
-		stats:    s,
-		kind:     kind,
-		clientIP: ClientIPOf(conn.RemoteAddr()),
-		created:  time.Now(),
+	clientIP := ClientIPOf(conn.RemoteAddr())
+	cc := &countingConn{
+		Conn:         conn,
+		stats:        s,
+		kind:         kind,
+		clientIP:     clientIP,
+		created:      time.Now(),
+		listenerName: listener,
+		listener:     ls,
+		limits:       s.limiter.forConn(clientIP),
 	}
+	s.openConn(cc)
+	return cc
 }
 
 // BindConn attributes an already-wrapped connection to a domain and bumps the
@@ -483,6 +540,7 @@ func (s *Stats) BindConn(conn net.Conn, domain string) {
 // guard. The deltas also feed the independent cumulative client table, so
 // client totals are exact regardless of domain eviction.
 func (s *Stats) record(domain string, source Source, clientIP string, conns, up, down uint64, update func(*domainStat, *sourceStat, *clientStat)) {
+	s.usage.record(domain, clientIP, conns, up, down)
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	d := s.domains[domain]
@@ -151,6 +151,72 @@ func TestCountingConnBatchWindow(t *testing.T) {
 	}
 }
 
+// TestCountingConnRebindFlushesPreviousDomain: a keep-alive connection
+// rebound per request keeps each request's pending bytes on its own domain.
+func TestCountingConnRebindFlushesPreviousDomain(t *testing.T) {
+	s := newTestStats(t)
+	wrapped := s.WrapConn(&fakeConn{readBuf: bytes.Repeat([]byte("x"), 64)}, "http")
+	s.BindConn(wrapped, "a.example.com")
+
+	buf := make([]byte, 1)
+	for range 3 { // the first flushes at once, the rest stay pending
+		if _, err := wrapped.Read(buf); err != nil {
+			t.Fatalf("read: %v", err)
+		}
+	}
+	s.BindConn(wrapped, "b.example.com")
+	if _, err := wrapped.Read(buf); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if err := wrapped.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	got := map[string]uint64{}
+	for _, d := range s.Snapshot(DomainSortBytes, SourceAll, "").Domains {
+		got[d.Domain] = d.BytesUp
+	}
+	if got["a.example.com"] != 3 || got["b.example.com"] != 1 {
+		t.Fatalf("bytes up per domain = %v, want a=3 b=1", got)
+	}
+}
+
+// TestListenerStats: connections accepted by a named listener count toward
+// it as well as their kind, and close releases its active slot.
+func TestListenerStats(t *testing.T) {
+	s := newTestStats(t)
+	s.AddListener("lan", "socks5", "0.0.0.0:1080", "proxy")
+	s.AddListener("idle", "http", "127.0.0.1:8080", "smart")
+
+	wrapped := s.WrapListenerConn(&fakeConn{readBuf: []byte("hello")}, "socks5", "lan")
+	if _, err := wrapped.Read(make([]byte, 5)); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if _, err := wrapped.Write([]byte("hi")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	s.RecordListenerReject("lan")
+
+	snap := s.Snapshot(DomainSortBytes, SourceAll, "")
+	if snap.Active.Socks5 != 1 || len(snap.Listeners) != 2 {
+		t.Fatalf("active socks5 = %d, listeners = %+v", snap.Active.Socks5, snap.Listeners)
+	}
+	lan := snap.Listeners[1]
+	if lan.Name != "lan" || lan.Conns != 1 || lan.Active != 1 || lan.BytesUp != 5 || lan.BytesDown != 2 || lan.Rejected != 1 {
+		t.Fatalf("lan listener = %+v", lan)
+	}
+	if idle := snap.Listeners[0]; idle.Name != "idle" || idle.Conns != 0 {
+		t.Fatalf("idle listener = %+v", idle)
+	}
+
+	if err := wrapped.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if got := s.Snapshot(DomainSortBytes, SourceAll, "").Listeners[1].Active; got != 0 {
+		t.Fatalf("lan active after close = %d, want 0", got)
+	}
+}
+
 // TestCountingConnBatchThreshold: sustained traffic flushes at the byte
 // threshold without waiting for Close.
 func TestCountingConnBatchThreshold(t *testing.T) {
@@ -484,6 +550,22 @@ func TestStatsRecordProxyErrorCountsAndRings(t *testing.T) {
 	}
 }
 
+func TestStatsRecordACLRefusalSkipsEventRing(t *testing.T) {
+	s := newTestStats(t)
+	s.RecordProxyError("dial", "example.com: refused")
+	for range maxErrorEvents + 1 {
+		s.RecordACLRefusal()
+	}
+
+	snap := s.Snapshot(DomainSortBytes, SourceAll, "")
+	if snap.Errors.ACL != maxErrorEvents+1 || snap.Errors.Dial != 1 {
+		t.Fatalf("unexpected error counts: %+v", snap.Errors)
+	}
+	if len(snap.Events) != 1 || snap.Events[0].Kind != "dial" {
+		t.Fatalf("unexpected events: %+v", snap.Events)
+	}
+}
+
 func TestStatsErrorEventRingIsBounded(t *testing.T) {
 	s := newTestStats(t)
 	for i := 0; i < maxErrorEvents+20; i++ {
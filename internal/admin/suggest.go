@@ -0,0 +1,124 @@
+package admin
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Reasons a rule is suggested, strongest first.
+const (
+	// SuggestPoisoned: direct DNS answers for the group were poisoned.
+	SuggestPoisoned = "poisoned"
+	// SuggestDirectFailed: detection chose direct, but the dials failed.
+	SuggestDirectFailed = "direct_failed"
+	// SuggestProxied: detection mostly found the sites unreachable directly.
+	SuggestProxied = "proxied"
+	// SuggestDirect: detection mostly went direct and the dials worked.
+	SuggestDirect = "direct"
+)
+
+// RuleSuggestion proposes one rule for a registrable domain whose names
+// keep missing every rule, with the rule-miss counters of the whole group.
+// Samples lists the busiest missed names. Overlaps lists the block and
+// proxy rules inside a direct suggestion's suffix, which the operator
+// should weigh before accepting it.
+type RuleSuggestion struct {
+	Rule         string         `json:"rule"`
+	Category     Category       `json:"category"`
+	Reason       string         `json:"reason"`
+	Domain       string         `json:"domain"`
+	Domains      int            `json:"domains"`
+	Samples      []string       `json:"samples"`
+	Count        uint64         `json:"count"`
+	Direct       uint64         `json:"direct"`
+	DirectFailed uint64         `json:"directFailed"`
+	Proxy        uint64         `json:"proxy"`
+	ProxyFailed  uint64         `json:"proxyFailed"`
+	Poisoned     uint64         `json:"poisoned"`
+	LastSeen     time.Time      `json:"lastSeen"`
+	Overlaps     []CategoryRule `json:"overlaps,omitempty"`
+}
+
+// CategoryRule is one retained rule and its category.
+type CategoryRule struct {
+	Category Category `json:"category"`
+	Rule     string   `json:"rule"`
+}
+
+// RuleSuggester is the optional RuleManager extension behind the rule
+// suggestion endpoints.
+type RuleSuggester interface {
+	// RuleSuggestions returns up to limit suggestions, busiest first.
+	RuleSuggestions(limit int) []RuleSuggestion
+	// RuleAddSet adds rules to several categories in one state revision
+	// and returns the rules that took effect.
+	RuleAddSet(rules map[Category][]string) (map[Category][]string, error)
+}
+
+func (s *Server) suggester(w http.ResponseWriter) RuleSuggester {
+	sg, ok := s.opts.Rules.(RuleSuggester)
+	if !ok {
+		writeError(w, http.StatusNotFound, "rule suggestions unavailable")
+	}
+	return sg
+}
+
+func (s *Server) handleRuleSuggestions(w http.ResponseWriter, r *http.Request) {
+	sg := s.suggester(w)
+	if sg == nil {
+		return
+	}
+	limit := 0
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		if n, err := strconv.Atoi(raw); err == nil && n > 0 {
+			limit = n
+		}
+	}
+	writeJSON(w, http.StatusOK, sg.RuleSuggestions(limit))
+}
+
+// handleRuleSuggestionsAccept applies the selected suggestions, possibly
+// spanning categories, as one state revision.
+func (s *Server) handleRuleSuggestionsAccept(w http.ResponseWriter, r *http.Request) {
+	sg := s.suggester(w)
+	if sg == nil {
+		return
+	}
+	var req struct {
+		Rules []struct {
+			Category Category `json:"category"`
+			Rule     string   `json:"rule"`
+		} `json:"rules"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if len(req.Rules) == 0 || len(req.Rules) > maxRulesPerBatch {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("want 1 to %d rules", maxRulesPerBatch))
+		return
+	}
+	rules := make(map[Category][]string)
+	for _, sel := range req.Rules {
+		if !sel.Category.valid() {
+			writeError(w, http.StatusBadRequest, "invalid category")
+			return
+		}
+		if err := checkRule(sel.Rule); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("rule %q: %v", truncate(sel.Rule, maxRuleLength), err))
+			return
+		}
+		rules[sel.Category] = append(rules[sel.Category], sel.Rule)
+	}
+	added, err := sg.RuleAddSet(rules)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if added == nil {
+		added = map[Category][]string{}
+	}
+	s.audit(r, AuditRulesAccept, "suggestions", nil, added)
+	writeJSON(w, http.StatusOK, map[string]any{"added": added})
+}
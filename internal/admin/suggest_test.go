@@ -0,0 +1,57 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestRuleSuggestionEndpoints(t *testing.T) {
+	rules := newFakeRules()
+	rules.suggestions = []RuleSuggestion{{Rule: "**.example.org", Category: CategoryProxy, Reason: SuggestPoisoned, Domain: "example.org", Count: 3}}
+	audit, err := NewAuditLog(AuditOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(Options{Password: "secret", Rules: rules, Stats: newTestStats(t), State: LoadStateStore(""), Audit: audit})
+	ts := httptest.NewServer(s.http.Handler)
+	t.Cleanup(ts.Close)
+	cookie := login(t, ts, "secret")
+
+	resp := authedRequest(t, ts, http.MethodGet, "/api/rules/suggestions", cookie, "")
+	var got []RuleSuggestion
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	resp.Body.Close()
+	if len(got) != 1 || got[0].Rule != "**.example.org" {
+		t.Fatalf("suggestions = %+v", got)
+	}
+
+	resp = authedRequest(t, ts, http.MethodPost, "/api/rules/suggestions/accept", cookie,
+		`{"rules":[{"category":"proxy","rule":"**.example.org"},{"category":"direct","rule":"**.example.cn"}]}`)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("accept = %d", resp.StatusCode)
+	}
+	if !slices.Equal(rules.lists[CategoryProxy], []string{"**.example.org"}) || !slices.Equal(rules.lists[CategoryDirect], []string{"**.example.cn"}) {
+		t.Fatalf("rules after accept = %v", rules.lists)
+	}
+	if entries := audit.Query(AuditFilter{Action: AuditRulesAccept}, 10); len(entries) != 1 {
+		t.Fatalf("audit = %+v", entries)
+	}
+
+	for _, body := range []string{
+		`{"rules":[]}`,
+		`{"rules":[{"category":"nope","rule":"**.example.org"}]}`,
+		`{"rules":[{"category":"proxy","rule":"bad rule"}]}`,
+	} {
+		resp := authedRequest(t, ts, http.MethodPost, "/api/rules/suggestions/accept", cookie, body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s = %d, want 400", body, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,335 @@
+package admin
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// TokenScope grants a bearer token one class of admin API calls.
+type TokenScope string
+
+const (
+	// ScopeRead allows every read-only endpoint: stats, rules, config view.
+	ScopeRead TokenScope = "read"
+	// ScopeRules allows rule additions, removals and resets.
+	ScopeRules TokenScope = "rules"
+	// ScopeConfig allows config override changes and state rollbacks.
+	ScopeConfig TokenScope = "config"
+	// ScopeRestart allows the process restart endpoint.
+	ScopeRestart TokenScope = "restart"
+)
+
+func (sc TokenScope) valid() bool {
+	switch sc {
+	case ScopeRead, ScopeRules, ScopeConfig, ScopeRestart:
+		return true
+	default:
+		return false
+	}
+}
+
+const (
+	// tokenPrefix marks sower admin tokens so secret scanners and users can
+	// tell them apart from session cookies.
+	tokenPrefix  = "sower_"
+	maxTokens    = 64
+	maxTokenName = 64
+	// tokenTouchInterval bounds how often a token's last-used time is
+	// written to the state file; the in-memory value is always current.
+	tokenTouchInterval = time.Minute
+)
+
+// TokenInfo is the API view of a bearer token. The secret is only ever
+// returned once, by TokenCreate.
+type TokenInfo struct {
+	ID        string       `json:"id"`
+	Name      string       `json:"name"`
+	Scopes    []TokenScope `json:"scopes"`
+	CreatedAt time.Time    `json:"createdAt"`
+	ExpiresAt time.Time    `json:"expiresAt,omitzero"`
+	LastUsed  time.Time    `json:"lastUsed,omitzero"`
+}
+
+// StoredToken is a bearer token in the state file: the SHA-256 of the
+// secret, never the secret itself.
+type StoredToken struct {
+	TokenInfo
+	Hash string `json:"hash"`
+	// persistedUse is the last-used time last written to disk.
+	persistedUse time.Time
+}
+
+func (t *StoredToken) expired(now time.Time) bool {
+	return !t.ExpiresAt.IsZero() && now.After(t.ExpiresAt)
+}
+
+func (t *StoredToken) allows(scope TokenScope) bool {
+	return slices.Contains(t.Scopes, scope)
+}
+
+func (t TokenInfo) clone() TokenInfo {
+	t.Scopes = slices.Clone(t.Scopes)
+	return t
+}
+
+var (
+	// ErrTokenLimit is returned when the state already holds maxTokens.
+	ErrTokenLimit = errors.New("token limit reached")
+	// ErrTokenNotFound is returned when revoking an unknown token.
+	ErrTokenNotFound = errors.New("token not found")
+)
+
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// Tokens lists the stored tokens, oldest first.
+func (st *StateStore) Tokens() []TokenInfo {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	out := make([]TokenInfo, 0, len(st.state.Tokens))
+	for _, t := range st.state.Tokens {
+		out = append(out, t.TokenInfo.clone())
+	}
+	return out
+}
+
+// TokenCreate stores a new token and returns it with its secret. A zero
+// expiresAt never expires. Token changes do not bump the revision: they are
+// not part of the rule and config state a revision describes.
+func (st *StateStore) TokenCreate(name string, scopes []TokenScope, expiresAt time.Time) (TokenInfo, string, error) {
+	var id [6]byte
+	var secret [32]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return TokenInfo{}, "", fmt.Errorf("generate token id: %w", err)
+	}
+	if _, err := rand.Read(secret[:]); err != nil {
+		return TokenInfo{}, "", fmt.Errorf("generate token secret: %w", err)
+	}
+	value := tokenPrefix + hex.EncodeToString(secret[:])
+	t := &StoredToken{
+		TokenInfo: TokenInfo{
+			ID:        hex.EncodeToString(id[:]),
+			Name:      name,
+			Scopes:    slices.Clone(scopes),
+			CreatedAt: time.Now(),
+			ExpiresAt: expiresAt,
+		},
+		Hash: hashToken(value),
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if len(st.state.Tokens) >= maxTokens {
+		return TokenInfo{}, "", ErrTokenLimit
+	}
+	cand := st.cloneLocked()
+	cand.Tokens = append(cand.Tokens, t)
+	cand.UpdatedAt = time.Now()
+	if err := st.persistLocked(cand); err != nil {
+		return TokenInfo{}, "", err
+	}
+	st.state = cand
+	return t.TokenInfo.clone(), value, nil
+}
+
+// TokenRevoke deletes a token by ID.
+func (st *StateStore) TokenRevoke(id string) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	i := slices.IndexFunc(st.state.Tokens, func(t *StoredToken) bool { return t.ID == id })
+	if i < 0 {
+		return ErrTokenNotFound
+	}
+	cand := st.cloneLocked()
+	cand.Tokens = slices.Delete(cand.Tokens, i, i+1)
+	cand.UpdatedAt = time.Now()
+	if err := st.persistLocked(cand); err != nil {
+		return err
+	}
+	st.state = cand
+	return nil
+}
+
+// TokenAuthorize reports whether secret is a live token carrying scope,
+// recording the use. The last-used time is persisted at most every
+// tokenTouchInterval; a failed write is logged and retried on a later use.
+func (st *StateStore) TokenAuthorize(secret string, scope TokenScope) bool {
+	_, ok := st.tokenAuthorize(secret, scope)
+	return ok
+}
+
+// tokenAuthorize is TokenAuthorize that also returns the token's name for
+// the audit trail.
+func (st *StateStore) tokenAuthorize(secret string, scope TokenScope) (string, bool) {
+	if !strings.HasPrefix(secret, tokenPrefix) {
+		return "", false
+	}
+	hash := hashToken(secret)
+	now := time.Now()
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	var t *StoredToken
+	for _, c := range st.state.Tokens {
+		if subtle.ConstantTimeCompare([]byte(c.Hash), []byte(hash)) == 1 {
+			t = c
+		}
+	}
+	if t == nil || t.expired(now) || !t.allows(scope) {
+		return "", false
+	}
+	t.LastUsed = now
+	if now.Sub(t.persistedUse) >= tokenTouchInterval {
+		if err := st.persistLocked(st.state); err != nil {
+			slog.Warn("persist admin token use", "token", t.ID, "error", err)
+		} else {
+			t.persistedUse = now
+		}
+	}
+	return t.Name, true
+}
+
+// bearerToken returns the token of an "Authorization: Bearer" header.
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
+
+// requiredScope maps a request to the token scope it needs, which also
+// decides the console roles allowed to make it. An empty scope means the
+// endpoint is reserved for admin sessions: tokens cannot manage tokens or
+// users, read the audit trail, or close connections.
+func requiredScope(r *http.Request) TokenScope {
+	path := r.URL.Path
+	switch {
+	case path == "/api/tokens" || strings.HasPrefix(path, "/api/tokens/"),
+		path == "/api/users" || strings.HasPrefix(path, "/api/users/"),
+		path == "/api/audit":
+		return ""
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		return ScopeRead
+	case path == "/api/rules" || strings.HasPrefix(path, "/api/rules/"):
+		return ScopeRules
+	case path == "/api/config", path == "/api/state/rollback":
+		return ScopeConfig
+	case path == "/api/restart":
+		return ScopeRestart
+	default:
+		return ""
+	}
+}
+
+// tokenAuthorized reports whether the request carries a bearer token with
+// the scope its endpoint needs, and the token's name.
+func (s *Server) tokenAuthorized(r *http.Request) (string, bool) {
+	secret, ok := bearerToken(r)
+	if !ok || s.opts.State == nil {
+		return "", false
+	}
+	scope := requiredScope(r)
+	if scope == "" {
+		return "", false
+	}
+	return s.opts.State.tokenAuthorize(secret, scope)
+}
+
+type tokenCreateRequest struct {
+	Name   string       `json:"name"`
+	Scopes []TokenScope `json:"scopes"`
+	// ExpiresIn is the lifetime in days; 0 never expires.
+	ExpiresIn int `json:"expiresIn"`
+}
+
+type tokenCreateResponse struct {
+	TokenInfo
+	Token string `json:"token"`
+}
+
+func (s *Server) handleTokensList(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.opts.State.Tokens())
+}
+
+func (s *Server) handleTokenCreate(w http.ResponseWriter, r *http.Request) {
+	var req tokenCreateRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > maxTokenName {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("name must be 1 to %d characters", maxTokenName))
+		return
+	}
+	if len(req.Scopes) == 0 {
+		writeError(w, http.StatusBadRequest, "at least one scope is required")
+		return
+	}
+	for _, sc := range req.Scopes {
+		if !sc.valid() {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("unknown scope %q", sc))
+			return
+		}
+	}
+	if req.ExpiresIn < 0 {
+		writeError(w, http.StatusBadRequest, "expiresIn must not be negative")
+		return
+	}
+	var expiresAt time.Time
+	if req.ExpiresIn > 0 {
+		expiresAt = time.Now().AddDate(0, 0, req.ExpiresIn)
+	}
+	info, secret, err := s.opts.State.TokenCreate(req.Name, dedupeScopes(req.Scopes), expiresAt)
+	switch {
+	case errors.Is(err, ErrTokenLimit):
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	case err != nil:
+		slog.Error("create admin token", "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to persist token")
+		return
+	}
+	slog.Info("admin token created", "id", info.ID, "name", info.Name, "scopes", info.Scopes)
+	s.audit(r, AuditTokenCreate, info.Name, nil, info)
+	writeJSON(w, http.StatusCreated, tokenCreateResponse{TokenInfo: info, Token: secret})
+}
+
+func (s *Server) handleTokenRevoke(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	err := s.opts.State.TokenRevoke(id)
+	switch {
+	case errors.Is(err, ErrTokenNotFound):
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	case err != nil:
+		slog.Error("revoke admin token", "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to persist token revocation")
+		return
+	}
+	slog.Info("admin token revoked", "id", id)
+	s.audit(r, AuditTokenRevoke, id, nil, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func dedupeScopes(in []TokenScope) []TokenScope {
+	out := make([]TokenScope, 0, len(in))
+	for _, sc := range in {
+		if !slices.Contains(out, sc) {
+			out = append(out, sc)
+		}
+	}
+	return out
+}
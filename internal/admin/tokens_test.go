@@ -0,0 +1,162 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStateStoreTokens(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	st := LoadStateStore(path)
+
+	info, secret, err := st.TokenCreate("ha", []TokenScope{ScopeRead}, time.Time{})
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if !strings.HasPrefix(secret, tokenPrefix) || info.ID == "" {
+		t.Fatalf("token = %+v, secret %q", info, secret)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read state: %v", err)
+	}
+	if strings.Contains(string(data), secret) || !strings.Contains(string(data), hashToken(secret)) {
+		t.Fatal("state file must hold the token hash, not the secret")
+	}
+	if st.Revision() != 0 {
+		t.Fatalf("token create bumped the revision to %d", st.Revision())
+	}
+
+	if !st.TokenAuthorize(secret, ScopeRead) {
+		t.Fatal("read token refused a read")
+	}
+	if st.TokenAuthorize(secret, ScopeRules) {
+		t.Fatal("read token allowed a rule change")
+	}
+	if st.TokenAuthorize(secret+"0", ScopeRead) {
+		t.Fatal("wrong secret accepted")
+	}
+
+	reloaded := LoadStateStore(path)
+	tokens := reloaded.Tokens()
+	if len(tokens) != 1 || tokens[0].LastUsed.IsZero() || !reloaded.TokenAuthorize(secret, ScopeRead) {
+		t.Fatalf("reloaded tokens = %+v", tokens)
+	}
+
+	if err := reloaded.TokenRevoke(info.ID); err != nil {
+		t.Fatalf("revoke: %v", err)
+	}
+	if reloaded.TokenAuthorize(secret, ScopeRead) {
+		t.Fatal("revoked token accepted")
+	}
+	if err := reloaded.TokenRevoke(info.ID); err != ErrTokenNotFound {
+		t.Fatalf("second revoke = %v, want ErrTokenNotFound", err)
+	}
+
+	_, expired, err := st.TokenCreate("old", []TokenScope{ScopeRead}, time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatalf("create expired: %v", err)
+	}
+	if st.TokenAuthorize(expired, ScopeRead) {
+		t.Fatal("expired token accepted")
+	}
+}
+
+func TestTokenEndpoints(t *testing.T) {
+	rules := newFakeRules()
+	s := NewServer(Options{Password: "secret", Version: "v1.2.3", Date: "2026-01-01", Rules: rules, Stats: newTestStats(t), State: LoadStateStore("")})
+	ts := httptest.NewServer(s.http.Handler)
+	t.Cleanup(ts.Close)
+	cookie := login(t, ts, "secret")
+
+	create := func(body string) tokenCreateResponse {
+		t.Helper()
+		resp := authedRequest(t, ts, http.MethodPost, "/api/tokens", cookie, body)
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("create status = %d", resp.StatusCode)
+		}
+		var created tokenCreateResponse
+		if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		return created
+	}
+	reader := create(`{"name":"grafana","scopes":["read"]}`)
+	editor := create(`{"name":"cron","scopes":["rules","rules"],"expiresIn":30}`)
+	if len(editor.Scopes) != 1 || editor.ExpiresAt.IsZero() {
+		t.Fatalf("editor token = %+v", editor.TokenInfo)
+	}
+
+	bearer := func(method, path, token, body string) int {
+		t.Helper()
+		req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("new request: %v", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	addRule := `{"category":"block","rules":["ads.example.com"]}`
+	for _, test := range []struct {
+		method, path, token, body string
+		want                      int
+	}{
+		{http.MethodGet, "/api/traffic", reader.Token, "", http.StatusOK},
+		{http.MethodPost, "/api/rules", reader.Token, addRule, http.StatusUnauthorized},
+		{http.MethodPost, "/api/rules", editor.Token, addRule, http.StatusNoContent},
+		{http.MethodGet, "/api/traffic", editor.Token, "", http.StatusUnauthorized},
+		{http.MethodGet, "/api/tokens", reader.Token, "", http.StatusUnauthorized},
+		{http.MethodGet, "/api/traffic", "sower_bogus", "", http.StatusUnauthorized},
+	} {
+		if got := bearer(test.method, test.path, test.token, test.body); got != test.want {
+			t.Errorf("%s %s with %s token = %d, want %d", test.method, test.path, test.token[:10], got, test.want)
+		}
+	}
+	if len(rules.lists[CategoryBlock]) != 1 {
+		t.Fatalf("block rules = %v", rules.lists[CategoryBlock])
+	}
+
+	resp := authedRequest(t, ts, http.MethodGet, "/api/tokens", cookie, "")
+	var tokens []TokenInfo
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		t.Fatalf("decode list: %v", err)
+	}
+	resp.Body.Close()
+	if len(tokens) != 2 || tokens[0].LastUsed.IsZero() {
+		t.Fatalf("tokens = %+v", tokens)
+	}
+
+	for _, body := range []string{
+		`{"name":"","scopes":["read"]}`,
+		`{"name":"x","scopes":[]}`,
+		`{"name":"x","scopes":["admin"]}`,
+		`{"name":"x","scopes":["read"],"expiresIn":-1}`,
+	} {
+		resp := authedRequest(t, ts, http.MethodPost, "/api/tokens", cookie, body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("create %s = %d, want 400", body, resp.StatusCode)
+		}
+	}
+
+	resp = authedRequest(t, ts, http.MethodDelete, "/api/tokens/"+reader.ID, cookie, "")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("revoke status = %d", resp.StatusCode)
+	}
+	if got := bearer(http.MethodGet, "/api/traffic", reader.Token, ""); got != http.StatusUnauthorized {
+		t.Fatalf("revoked token = %d, want 401", got)
+	}
+}
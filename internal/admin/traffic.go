@@ -58,6 +58,10 @@ func (s *Server) handleHistory(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusInternalServerError, "stats unavailable")
 		return
 	}
+	if hasUsageRange(r) {
+		s.handleUsageHistory(w, r)
+		return
+	}
 	writeJSON(w, http.StatusOK, s.opts.Stats.History())
 }
 
@@ -112,42 +116,12 @@ func (s *Server) handleStream(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusInternalServerError, "stats unavailable")
 		return
 	}
-	rc := http.NewResponseController(w)
 	sort, source, client := parseTrafficQuery(r)
-
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
-	w.Header().Set("X-Accel-Buffering", "no")
-	fmt.Fprintln(w, "retry: 5000")
-	fmt.Fprintln(w)
-	// A writer that cannot flush (buffered proxy, unsupported transport)
-	// cannot carry the stream; the error-returning form also surfaces dead
-	// connections here.
-	if err := rc.Flush(); err != nil {
-		writeError(w, http.StatusInternalServerError, "streaming unsupported")
+	send, ok := startSSE(w)
+	if !ok {
 		return
 	}
 
-	// send writes one event and reports whether the connection is still
-	// usable; the caller tears the stream down on the first failure. A
-	// non-writable transport (HTTP/2) degrades to unbounded writes instead
-	// of failing the stream.
-	send := func(event string, v any) bool {
-		if err := rc.SetWriteDeadline(time.Now().Add(sseWriteTimeout)); err != nil {
-			slog.Debug("set sse write deadline", "error", err)
-		}
-		data, err := json.Marshal(v)
-		if err != nil {
-			slog.Debug("marshal sse event", "error", err)
-			return true
-		}
-		if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data); err != nil {
-			return false
-		}
-		return rc.Flush() == nil
-	}
-
 	if !send("status", s.statusPayload()) ||
 		!send("traffic", s.streamTrafficSnapshot(sort, source, client)) ||
 		!send("history", s.opts.Stats.History()) ||
@@ -167,7 +141,7 @@ func (s *Server) handleStream(w http.ResponseWriter, r *http.Request) {
 		case <-r.Context().Done():
 			return
 		case <-ticker.C:
-			_, valid, renewed := s.validSession(r)
+			valid, renewed := s.revalidate(r)
 			if !valid {
 				send("auth", map[string]any{"status": http.StatusUnauthorized})
 				return
@@ -190,3 +164,42 @@ func (s *Server) handleStream(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 }
+
+// startSSE writes the event-stream headers and returns the event writer.
+// ok is false, with an error response already written, when the transport
+// cannot flush. The returned send writes one event and reports whether the
+// connection is still usable; callers tear the stream down on the first
+// failure. Every write carries a deadline (see sseWriteTimeout); a
+// non-writable transport (HTTP/2) degrades to unbounded writes instead of
+// failing the stream.
+func startSSE(w http.ResponseWriter) (send func(event string, v any) bool, ok bool) {
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	fmt.Fprintln(w, "retry: 5000")
+	fmt.Fprintln(w)
+	// A writer that cannot flush (buffered proxy, unsupported transport)
+	// cannot carry the stream; the error-returning form also surfaces dead
+	// connections here.
+	if err := rc.Flush(); err != nil {
+		writeError(w, http.StatusInternalServerError, "streaming unsupported")
+		return nil, false
+	}
+
+	return func(event string, v any) bool {
+		if err := rc.SetWriteDeadline(time.Now().Add(sseWriteTimeout)); err != nil {
+			slog.Debug("set sse write deadline", "error", err)
+		}
+		data, err := json.Marshal(v)
+		if err != nil {
+			slog.Debug("marshal sse event", "error", err)
+			return true
+		}
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data); err != nil {
+			return false
+		}
+		return rc.Flush() == nil
+	}, true
+}
@@ -0,0 +1,676 @@
+package admin
+
+import (
+	"cmp"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sower-proxy/sower/internal/fsutil"
+)
+
+// Usage rollup resolutions.
+const (
+	StepMinute = "minute"
+	StepHour   = "hour"
+	StepDay    = "day"
+)
+
+const (
+	// maxRollupKeys bounds the domains and the clients kept per hour or day
+	// rollup and per report: the largest by bytes stay, the rest is folded
+	// into otherUsageKey so the totals still add up.
+	maxRollupKeys = 100
+	otherUsageKey = "(other)"
+	// defaultUsageRange is the report range when a request names none.
+	defaultUsageRange = 24 * time.Hour
+)
+
+// UsageOptions configures a UsageStore. Keep* are the numbers of minute,
+// hour and day rollups kept; older ones are dropped as time advances.
+type UsageOptions struct {
+	// File persists the rollups across restarts; empty keeps them in
+	// memory only.
+	File        string
+	KeepMinutes int
+	KeepHours   int
+	KeepDays    int
+}
+
+// UsageCounters are the traffic totals of one rollup or report range.
+type UsageCounters struct {
+	BytesUp   uint64 `json:"bytesUp"`
+	BytesDown uint64 `json:"bytesDown"`
+	DNS       uint64 `json:"dns"`
+	Conns     uint64 `json:"conns"`
+	Block     uint64 `json:"block"`
+	Direct    uint64 `json:"direct"`
+	Proxy     uint64 `json:"proxy"`
+}
+
+func (c *UsageCounters) add(o UsageCounters) {
+	c.BytesUp += o.BytesUp
+	c.BytesDown += o.BytesDown
+	c.DNS += o.DNS
+	c.Conns += o.Conns
+	c.Block += o.Block
+	c.Direct += o.Direct
+	c.Proxy += o.Proxy
+}
+
+// usageEntry is the attribution of one domain or client within a rollup.
+type usageEntry struct {
+	Conns     uint64 `json:"conns"`
+	BytesUp   uint64 `json:"bytesUp"`
+	BytesDown uint64 `json:"bytesDown"`
+}
+
+// usageBucket is one rollup. Minute rollups carry totals only; hour and day
+// rollups also attribute bytes to domains and clients.
+type usageBucket struct {
+	At time.Time `json:"at"`
+	UsageCounters
+	Domains map[string]*usageEntry `json:"domains,omitempty"`
+	Clients map[string]*usageEntry `json:"clients,omitempty"`
+}
+
+// UsageReport sums the rollups of a range. Domains and clients are ranked
+// by bytes.
+type UsageReport struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+	Step string    `json:"step"`
+	UsageCounters
+	Domains []DomainStat `json:"domains"`
+	Clients []ClientStat `json:"clients"`
+}
+
+// UsageStore keeps minute, hour and day rollups of the traffic counters.
+// Stats feeds it per-domain and per-client attribution as it happens and
+// closes an interval with RollUsage; the rollups survive restarts through
+// Save.
+type UsageStore struct {
+	opts UsageOptions
+	now  func() time.Time
+
+	mu             sync.Mutex
+	pendingDomains map[string]*usageEntry
+	pendingClients map[string]*usageEntry
+	// last is the cumulative counter state at the previous roll.
+	last    UsageCounters
+	lastAt  time.Time
+	minutes []*usageBucket
+	hours   []*usageBucket
+	days    []*usageBucket
+	dirty   bool
+}
+
+// NewUsageStore builds a store and restores the persisted rollups. An
+// unreadable file is logged and ignored so it never blocks startup.
+func NewUsageStore(opts UsageOptions) *UsageStore {
+	u := &UsageStore{
+		opts:           opts,
+		now:            time.Now,
+		pendingDomains: make(map[string]*usageEntry),
+		pendingClients: make(map[string]*usageEntry),
+	}
+	u.lastAt = u.now()
+	if err := u.load(); err != nil {
+		slog.Warn("load usage history", "file", opts.File, "error", err)
+	}
+	return u
+}
+
+// bucketStart returns the start of the step holding t, in local time.
+func bucketStart(step string, t time.Time) time.Time {
+	y, m, d := t.Date()
+	switch step {
+	case StepDay:
+		return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+	case StepHour:
+		return time.Date(y, m, d, t.Hour(), 0, 0, 0, t.Location())
+	default:
+		return time.Date(y, m, d, t.Hour(), t.Minute(), 0, 0, t.Location())
+	}
+}
+
+func stepDuration(step string) time.Duration {
+	switch step {
+	case StepDay:
+		return 24 * time.Hour
+	case StepHour:
+		return time.Hour
+	default:
+		return time.Minute
+	}
+}
+
+// addEntry attributes to key in m.
+func addEntry(m map[string]*usageEntry, key string, e usageEntry) {
+	cur := m[key]
+	if cur == nil {
+		cur = &usageEntry{}
+		m[key] = cur
+	}
+	cur.Conns += e.Conns
+	cur.BytesUp += e.BytesUp
+	cur.BytesDown += e.BytesDown
+}
+
+// foldEntries keeps the maxRollupKeys keys of m with the most bytes and
+// folds the rest into otherUsageKey.
+func foldEntries(m map[string]*usageEntry) {
+	if len(m) <= maxRollupKeys {
+		return
+	}
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		if key != otherUsageKey {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) <= maxRollupKeys {
+		return
+	}
+	slices.SortFunc(keys, func(a, b string) int {
+		ea, eb := m[a], m[b]
+		return cmp.Or(cmp.Compare(eb.BytesUp+eb.BytesDown, ea.BytesUp+ea.BytesDown), strings.Compare(a, b))
+	})
+	for _, key := range keys[maxRollupKeys:] {
+		addEntry(m, otherUsageKey, *m[key])
+		delete(m, key)
+	}
+}
+
+// record attributes traffic to a domain and client until the next roll.
+func (u *UsageStore) record(domain, clientIP string, conns, up, down uint64) {
+	if u == nil {
+		return
+	}
+	e := usageEntry{Conns: conns, BytesUp: up, BytesDown: down}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	addEntry(u.pendingDomains, domain, e)
+	if clientIP != "" {
+		addEntry(u.pendingClients, clientIP, e)
+	}
+}
+
+// roll credits the counters accumulated since the previous roll, given as
+// cumulative totals, and the pending attribution to the rollups holding
+// the start of the interval.
+func (u *UsageStore) roll(total UsageCounters) {
+	now := u.now()
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	delta := UsageCounters{
+		BytesUp:   total.BytesUp - u.last.BytesUp,
+		BytesDown: total.BytesDown - u.last.BytesDown,
+		DNS:       total.DNS - u.last.DNS,
+		Conns:     total.Conns - u.last.Conns,
+		Block:     total.Block - u.last.Block,
+		Direct:    total.Direct - u.last.Direct,
+		Proxy:     total.Proxy - u.last.Proxy,
+	}
+	at := u.lastAt
+	u.last, u.lastAt = total, now
+
+	u.minutes = addBucket(u.minutes, bucketStart(StepMinute, at), delta, nil, nil)
+	u.hours = addBucket(u.hours, bucketStart(StepHour, at), delta, u.pendingDomains, u.pendingClients)
+	u.days = addBucket(u.days, bucketStart(StepDay, at), delta, u.pendingDomains, u.pendingClients)
+	clear(u.pendingDomains)
+	clear(u.pendingClients)
+	u.prune(now)
+	u.dirty = true
+}
+
+// addBucket adds to the rollup starting at at, appending it when it is
+// newer than the last one. A rollup older than the last (the clock went
+// back) is credited to the last.
+func addBucket(buckets []*usageBucket, at time.Time, delta UsageCounters, domains, clients map[string]*usageEntry) []*usageBucket {
+	var b *usageBucket
+	if n := len(buckets); n > 0 && !buckets[n-1].At.Before(at) {
+		b = buckets[n-1]
+	} else {
+		b = &usageBucket{At: at}
+		buckets = append(buckets, b)
+	}
+	b.UsageCounters.add(delta)
+	for key, e := range domains {
+		if b.Domains == nil {
+			b.Domains = make(map[string]*usageEntry)
+		}
+		addEntry(b.Domains, key, *e)
+	}
+	for key, e := range clients {
+		if b.Clients == nil {
+			b.Clients = make(map[string]*usageEntry)
+		}
+		addEntry(b.Clients, key, *e)
+	}
+	foldEntries(b.Domains)
+	foldEntries(b.Clients)
+	return buckets
+}
+
+// prune drops the rollups past their retention.
+func (u *UsageStore) prune(now time.Time) {
+	u.minutes = pruneBuckets(u.minutes, now.Add(-time.Duration(u.opts.KeepMinutes)*time.Minute))
+	u.hours = pruneBuckets(u.hours, now.Add(-time.Duration(u.opts.KeepHours)*time.Hour))
+	u.days = pruneBuckets(u.days, now.AddDate(0, 0, -u.opts.KeepDays))
+}
+
+func pruneBuckets(buckets []*usageBucket, cutoff time.Time) []*usageBucket {
+	i := 0
+	for i < len(buckets) && buckets[i].At.Before(cutoff) {
+		i++
+	}
+	if i == 0 {
+		return buckets
+	}
+	return slices.Clone(buckets[i:])
+}
+
+func (u *UsageStore) bucketsLocked(step string) []*usageBucket {
+	switch step {
+	case StepDay:
+		return u.days
+	case StepHour:
+		return u.hours
+	default:
+		return u.minutes
+	}
+}
+
+// inRange returns the rollups of step overlapping [from, to).
+func (u *UsageStore) inRange(step string, from, to time.Time) []*usageBucket {
+	from = bucketStart(step, from)
+	var out []*usageBucket
+	for _, b := range u.bucketsLocked(step) {
+		if !b.At.Before(from) && b.At.Before(to) {
+			out = append(out, b)
+		}
+	}
+	return out
+}
+
+// seriesStep picks the finest resolution that is still retained at from
+// and keeps the series to a few thousand points.
+func (u *UsageStore) seriesStep(from, to time.Time) string {
+	now := u.now()
+	span := to.Sub(from)
+	if span <= 48*time.Hour && !from.Before(now.Add(-time.Duration(u.opts.KeepMinutes)*time.Minute)) {
+		return StepMinute
+	}
+	return u.reportStep(from, to)
+}
+
+// reportStep picks hours while they are retained at from and the range
+// spans at most a few months, days otherwise.
+func (u *UsageStore) reportStep(from, to time.Time) string {
+	now := u.now()
+	if to.Sub(from) <= 93*24*time.Hour && !from.Before(now.Add(-time.Duration(u.opts.KeepHours)*time.Hour)) {
+		return StepHour
+	}
+	return StepDay
+}
+
+// Series returns the rollups of step overlapping [from, to) as history
+// samples; an empty step picks one for the range.
+func (u *UsageStore) Series(step string, from, to time.Time) History {
+	if step == "" {
+		step = u.seriesStep(from, to)
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	buckets := u.inRange(step, from, to)
+	out := History{Step: step, Samples: make([]HistorySample, 0, len(buckets))}
+	for _, b := range buckets {
+		out.Samples = append(out.Samples, HistorySample{
+			At:        b.At,
+			BytesUp:   b.BytesUp,
+			BytesDown: b.BytesDown,
+			DNS:       b.DNS,
+			Conns:     b.Conns,
+			Block:     b.Block,
+			Direct:    b.Direct,
+			Proxy:     b.Proxy,
+		})
+	}
+	return out
+}
+
+// Report sums the rollups overlapping [from, to).
+func (u *UsageStore) Report(from, to time.Time) UsageReport {
+	step := u.reportStep(from, to)
+	report := UsageReport{From: from, To: to, Step: step}
+	domains := make(map[string]*usageEntry)
+	clients := make(map[string]*usageEntry)
+
+	u.mu.Lock()
+	for _, b := range u.inRange(step, from, to) {
+		report.UsageCounters.add(b.UsageCounters)
+		for key, e := range b.Domains {
+			addEntry(domains, key, *e)
+		}
+		for key, e := range b.Clients {
+			addEntry(clients, key, *e)
+		}
+	}
+	u.mu.Unlock()
+	foldEntries(domains)
+	foldEntries(clients)
+
+	for key, e := range domains {
+		report.Domains = append(report.Domains, DomainStat{Domain: key, Conns: e.Conns, BytesUp: e.BytesUp, BytesDown: e.BytesDown})
+	}
+	for key, e := range clients {
+		report.Clients = append(report.Clients, ClientStat{IP: key, Conns: e.Conns, BytesUp: e.BytesUp, BytesDown: e.BytesDown})
+	}
+	slices.SortFunc(report.Domains, func(a, b DomainStat) int {
+		return cmp.Or(cmp.Compare(b.BytesUp+b.BytesDown, a.BytesUp+a.BytesDown), strings.Compare(a.Domain, b.Domain))
+	})
+	slices.SortFunc(report.Clients, func(a, b ClientStat) int {
+		return cmp.Or(cmp.Compare(b.BytesUp+b.BytesDown, a.BytesUp+a.BytesDown), strings.Compare(a.IP, b.IP))
+	})
+	if report.Domains == nil {
+		report.Domains = []DomainStat{}
+	}
+	if report.Clients == nil {
+		report.Clients = []ClientStat{}
+	}
+	return report
+}
+
+// usageFile is the on-disk rollup document.
+type usageFile struct {
+	Version int            `json:"version"`
+	Minutes []*usageBucket `json:"minutes"`
+	Hours   []*usageBucket `json:"hours"`
+	Days    []*usageBucket `json:"days"`
+}
+
+func (u *UsageStore) load() error {
+	if u.opts.File == "" {
+		return nil
+	}
+	data, err := os.ReadFile(u.opts.File)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var f usageFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return fmt.Errorf("decode: %w", err)
+	}
+	for _, buckets := range [][]*usageBucket{f.Minutes, f.Hours, f.Days} {
+		for _, b := range buckets {
+			b.At = b.At.Local()
+		}
+	}
+	u.minutes, u.hours, u.days = f.Minutes, f.Hours, f.Days
+	u.prune(u.now())
+	return nil
+}
+
+// Save writes the rollups when they changed since the last save.
+func (u *UsageStore) Save() error {
+	if u == nil || u.opts.File == "" {
+		return nil
+	}
+	u.mu.Lock()
+	if !u.dirty {
+		u.mu.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(usageFile{Version: 1, Minutes: u.minutes, Hours: u.hours, Days: u.days})
+	u.dirty = false
+	u.mu.Unlock()
+	if err == nil {
+		err = fsutil.WriteFileAtomic(u.opts.File, data)
+	}
+	if err != nil {
+		u.mu.Lock()
+		u.dirty = true
+		u.mu.Unlock()
+		return fmt.Errorf("save usage history %s: %w", u.opts.File, err)
+	}
+	return nil
+}
+
+// SetUsage records traffic into u from now on. It must be called before
+// the listeners start serving.
+func (s *Stats) SetUsage(u *UsageStore) {
+	s.usage = u
+}
+
+// RollUsage closes the current usage interval, crediting the counters since
+// the previous call to the usage rollups. It is a no-op without a store.
+func (s *Stats) RollUsage() {
+	if s.usage == nil {
+		return
+	}
+	s.usage.roll(UsageCounters{
+		BytesUp:   s.bytesUp.Load(),
+		BytesDown: s.bytesDown.Load(),
+		DNS:       s.dnsQueries.Load(),
+		Conns:     s.connsHTTP.Load() + s.connsHTTPS.Load() + s.connsSocks.Load() + s.connsTransparent.Load(),
+		Block:     s.ruleBlock.Load(),
+		Direct:    s.ruleDirect.Load(),
+		Proxy:     s.ruleProxy.Load(),
+	})
+}
+
+// parseUsageRange reads the report range of a request: range (a duration
+// such as "6h", or days such as "30d") back from now, or from and to as
+// RFC 3339 times. It defaults to the last defaultUsageRange.
+func parseUsageRange(r *http.Request, now time.Time) (from, to time.Time, err error) {
+	q := r.URL.Query()
+	to = now
+	if v := q.Get("to"); v != "" {
+		if to, err = time.Parse(time.RFC3339, v); err != nil {
+			return from, to, errors.New("invalid to: want an RFC 3339 time")
+		}
+	}
+	switch {
+	case q.Get("from") != "":
+		if from, err = time.Parse(time.RFC3339, q.Get("from")); err != nil {
+			return from, to, errors.New("invalid from: want an RFC 3339 time")
+		}
+	case q.Get("range") != "":
+		d, err := parseRangeDuration(q.Get("range"))
+		if err != nil {
+			return from, to, err
+		}
+		from = to.Add(-d)
+	default:
+		from = to.Add(-defaultUsageRange)
+	}
+	if !from.Before(to) {
+		return from, to, errors.New("invalid range: from must be before to")
+	}
+	return from.Local(), to.Local(), nil
+}
+
+func parseRangeDuration(v string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(v, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid range %q", v)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid range %q", v)
+	}
+	return d, nil
+}
+
+func validStep(step string) bool {
+	return step == "" || step == StepMinute || step == StepHour || step == StepDay
+}
+
+// hasUsageRange reports whether a history request asks for a range rather
+// than the live ring.
+func hasUsageRange(r *http.Request) bool {
+	q := r.URL.Query()
+	return q.Has("range") || q.Has("from") || q.Has("to") || q.Has("step")
+}
+
+// handleUsageHistory serves /api/history for a range from the rollups.
+func (s *Server) handleUsageHistory(w http.ResponseWriter, r *http.Request) {
+	usage := s.usageStore(w)
+	if usage == nil {
+		return
+	}
+	from, to, err := parseUsageRange(r, usage.now())
+	step := r.URL.Query().Get("step")
+	if err == nil && !validStep(step) {
+		err = fmt.Errorf("invalid step %q", step)
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, usage.Series(step, from, to))
+}
+
+// handleUsage serves the per-domain and per-client report of a range.
+func (s *Server) handleUsage(w http.ResponseWriter, r *http.Request) {
+	usage := s.usageStore(w)
+	if usage == nil {
+		return
+	}
+	from, to, err := parseUsageRange(r, usage.now())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	report := usage.Report(from, to)
+	s.attachHostnames(report.Clients)
+	writeJSON(w, http.StatusOK, report)
+}
+
+// handleUsageExport downloads a range as CSV or JSON: the totals series by
+// default, or one row per step and domain or client with by=domain or
+// by=client.
+func (s *Server) handleUsageExport(w http.ResponseWriter, r *http.Request) {
+	usage := s.usageStore(w)
+	if usage == nil {
+		return
+	}
+	q := r.URL.Query()
+	from, to, err := parseUsageRange(r, usage.now())
+	step, by, format := q.Get("step"), q.Get("by"), cmp.Or(q.Get("format"), "csv")
+	switch {
+	case err != nil:
+	case !validStep(step):
+		err = fmt.Errorf("invalid step %q", step)
+	case by != "" && by != "domain" && by != "client":
+		err = fmt.Errorf("invalid by %q: want domain or client", by)
+	case by != "" && step == StepMinute:
+		err = fmt.Errorf("minute rollups carry no %s breakdown", by)
+	case format != "csv" && format != "json":
+		err = fmt.Errorf("invalid format %q: want csv or json", format)
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if step == "" {
+		step = usage.seriesStep(from, to)
+		if by != "" {
+			step = usage.reportStep(from, to)
+		}
+	}
+
+	header, rows := usage.exportRows(step, by, from, to)
+	name := "sower-usage-" + step
+	if by != "" {
+		name += "-" + by
+	}
+	if format == "json" {
+		records := make([]map[string]any, 0, len(rows))
+		for _, row := range rows {
+			rec := make(map[string]any, len(header))
+			for i, col := range header {
+				rec[col] = row[i]
+			}
+			records = append(records, rec)
+		}
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+`.json"`)
+		writeJSON(w, http.StatusOK, records)
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`.csv"`)
+	cw := csv.NewWriter(w)
+	_ = cw.Write(header)
+	for _, row := range rows {
+		rec := make([]string, len(row))
+		for i, v := range row {
+			rec[i] = fmt.Sprint(v)
+		}
+		_ = cw.Write(rec)
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		slog.Debug("write usage export", "error", err)
+	}
+}
+
+// exportRows flattens the rollups of step in [from, to) into a header and
+// rows of the export columns.
+func (u *UsageStore) exportRows(step, by string, from, to time.Time) ([]string, [][]any) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	buckets := u.inRange(step, from, to)
+	var rows [][]any
+	if by == "" {
+		header := []string{"at", "bytesUp", "bytesDown", "dns", "conns", "block", "direct", "proxy"}
+		for _, b := range buckets {
+			rows = append(rows, []any{b.At.Format(time.RFC3339), b.BytesUp, b.BytesDown, b.DNS, b.Conns, b.Block, b.Direct, b.Proxy})
+		}
+		return header, rows
+	}
+	header := []string{"at", by, "conns", "bytesUp", "bytesDown"}
+	for _, b := range buckets {
+		entries := b.Domains
+		if by == "client" {
+			entries = b.Clients
+		}
+		keys := make([]string, 0, len(entries))
+		for key := range entries {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+		for _, key := range keys {
+			e := entries[key]
+			rows = append(rows, []any{b.At.Format(time.RFC3339), key, e.Conns, e.BytesUp, e.BytesDown})
+		}
+	}
+	return header, rows
+}
+
+// usageStore returns the stats usage store, writing a 404 when usage
+// history is disabled.
+func (s *Server) usageStore(w http.ResponseWriter) *UsageStore {
+	if s.opts.Stats == nil || s.opts.Stats.usage == nil {
+		writeError(w, http.StatusNotFound, "usage history disabled")
+		return nil
+	}
+	return s.opts.Stats.usage
+}
@@ -0,0 +1,217 @@
+package admin
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestUsage returns a store whose clock starts at start and is moved
+// through the returned pointer.
+func newTestUsage(t *testing.T, opts UsageOptions, start time.Time) (*UsageStore, *time.Time) {
+	t.Helper()
+	now := start
+	u := NewUsageStore(opts)
+	u.now = func() time.Time { return now }
+	u.lastAt = start
+	return u, &now
+}
+
+func TestUsageStoreRollsUp(t *testing.T) {
+	start := time.Date(2026, 3, 1, 10, 58, 30, 0, time.Local)
+	u, now := newTestUsage(t, UsageOptions{KeepMinutes: 60, KeepHours: 48, KeepDays: 30}, start)
+
+	u.record("example.com", "192.168.1.20", 1, 100, 1000)
+	*now = start.Add(time.Minute)
+	u.roll(UsageCounters{BytesUp: 100, BytesDown: 1000, Conns: 1, Proxy: 1})
+
+	u.record("example.com", "192.168.1.20", 1, 50, 500)
+	u.record("example.org", "192.168.1.21", 1, 10, 10)
+	*now = start.Add(2 * time.Minute)
+	u.roll(UsageCounters{BytesUp: 160, BytesDown: 1510, Conns: 3, Proxy: 1, Direct: 2})
+
+	if len(u.minutes) != 2 || len(u.hours) != 1 || len(u.days) != 1 {
+		t.Fatalf("rollups = %d minutes, %d hours, %d days", len(u.minutes), len(u.hours), len(u.days))
+	}
+	if m := u.minutes[1]; !m.At.Equal(start.Add(time.Minute).Truncate(time.Minute)) || m.BytesUp != 60 || m.Domains != nil {
+		t.Fatalf("second minute = %+v", m)
+	}
+	day := u.days[0]
+	if day.BytesDown != 1510 || day.Conns != 3 || day.Direct != 2 {
+		t.Fatalf("day = %+v", day.UsageCounters)
+	}
+	if e := day.Clients["192.168.1.20"]; e == nil || e.BytesUp != 150 || e.Conns != 2 {
+		t.Fatalf("day client = %+v", e)
+	}
+
+	report := u.Report(start.Add(-time.Hour), *now)
+	if report.Step != StepHour || report.BytesUp != 160 {
+		t.Fatalf("report = %+v", report)
+	}
+	if len(report.Domains) != 2 || report.Domains[0].Domain != "example.com" || report.Domains[0].BytesDown != 1500 {
+		t.Fatalf("report domains = %+v", report.Domains)
+	}
+
+	series := u.Series("", start.Add(-30*time.Minute), *now)
+	if series.Step != StepMinute || len(series.Samples) != 2 || series.Samples[1].Direct != 2 {
+		t.Fatalf("series = %+v", series)
+	}
+
+	// Advancing past the minute retention drops the minutes only; the
+	// idle interval opens the next hour.
+	*now = start.Add(3 * time.Hour)
+	u.roll(UsageCounters{BytesUp: 160, BytesDown: 1510, Conns: 3, Proxy: 1, Direct: 2})
+	if len(u.minutes) != 0 || len(u.hours) != 2 || len(u.days) != 1 {
+		t.Fatalf("after prune = %d minutes, %d hours, %d days", len(u.minutes), len(u.hours), len(u.days))
+	}
+}
+
+func TestUsageStoreFoldsExcessKeys(t *testing.T) {
+	start := time.Date(2026, 3, 1, 10, 0, 0, 0, time.Local)
+	u, now := newTestUsage(t, UsageOptions{KeepMinutes: 60, KeepHours: 48, KeepDays: 30}, start)
+	for i := range maxRollupKeys + 5 {
+		u.record("d"+strings.Repeat("x", i)+".com", "", 1, 1, 0)
+	}
+	// Keys seen last but carrying the most bytes must survive the fold.
+	u.record("late.com", "", 1, 50, 0)
+	*now = start.Add(time.Minute)
+	u.roll(UsageCounters{BytesUp: maxRollupKeys + 55})
+
+	domains := u.hours[0].Domains
+	var total uint64
+	for _, e := range domains {
+		total += e.BytesUp
+	}
+	if len(domains) != maxRollupKeys+1 || domains[otherUsageKey] == nil || total != maxRollupKeys+55 {
+		t.Fatalf("hour holds %d domains summing %d bytes, other = %+v", len(domains), total, domains[otherUsageKey])
+	}
+	if e := domains["late.com"]; e == nil || e.BytesUp != 50 {
+		t.Fatalf("late.com = %+v", e)
+	}
+
+	// The report merges the rollups before trimming, so the largest keys
+	// of either hour are ranked against each other.
+	*now = start.Add(2 * time.Hour)
+	for i := range maxRollupKeys {
+		u.record("h"+strings.Repeat("x", i)+".com", "", 1, 10, 0)
+	}
+	u.roll(UsageCounters{BytesUp: maxRollupKeys*11 + 55})
+	report := u.Report(start, *now)
+	if len(report.Domains) != maxRollupKeys+1 {
+		t.Fatalf("report holds %d domains", len(report.Domains))
+	}
+	for _, d := range report.Domains {
+		if d.Domain != otherUsageKey && d.Domain != "late.com" && !strings.HasPrefix(d.Domain, "h") {
+			t.Fatalf("report kept %+v over a larger key", d)
+		}
+	}
+}
+
+func TestUsageStorePersists(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "history.json")
+	opts := UsageOptions{File: file, KeepMinutes: 60, KeepHours: 48, KeepDays: 30}
+	start := time.Now().Add(-10 * time.Minute)
+	u, now := newTestUsage(t, opts, start)
+	u.record("example.com", "192.168.1.20", 1, 100, 1000)
+	*now = start.Add(time.Minute)
+	u.roll(UsageCounters{BytesUp: 100, BytesDown: 1000, Conns: 1})
+	if err := u.Save(); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	restored := NewUsageStore(opts)
+	report := restored.Report(start.Add(-time.Hour), time.Now())
+	if report.BytesDown != 1000 || len(report.Clients) != 1 || report.Clients[0].IP != "192.168.1.20" {
+		t.Fatalf("restored report = %+v", report)
+	}
+	if len(restored.minutes) != 1 {
+		t.Fatalf("restored %d minutes", len(restored.minutes))
+	}
+}
+
+func TestUsageEndpoints(t *testing.T) {
+	stats := newTestStats(t)
+	stats.SetUsage(NewUsageStore(UsageOptions{KeepMinutes: 60, KeepHours: 48, KeepDays: 30}))
+	s := NewServer(Options{Password: "secret", Version: "v1.2.3", Date: "2026-01-01", Rules: newFakeRules(), Stats: stats})
+	ts := httptest.NewServer(s.http.Handler)
+	t.Cleanup(ts.Close)
+	cookie := login(t, ts, "secret")
+
+	stats.RecordDNS("example.com", "192.168.1.20")
+	stats.RollUsage()
+
+	resp := authedRequest(t, ts, http.MethodGet, "/api/usage?range=30d", cookie, "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("usage status = %d", resp.StatusCode)
+	}
+	var report UsageReport
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	resp.Body.Close()
+	// A month outlives the hour retention and falls back to days.
+	if report.Step != StepDay || report.DNS != 1 || len(report.Clients) != 1 || report.Clients[0].Conns != 1 {
+		t.Fatalf("report = %+v", report)
+	}
+
+	resp = authedRequest(t, ts, http.MethodGet, "/api/history?range=1h&step=minute", cookie, "")
+	var history History
+	if err := json.NewDecoder(resp.Body).Decode(&history); err != nil {
+		t.Fatalf("decode history: %v", err)
+	}
+	resp.Body.Close()
+	if history.Step != StepMinute || len(history.Samples) != 1 || history.Samples[0].DNS != 1 {
+		t.Fatalf("history = %+v", history)
+	}
+
+	resp = authedRequest(t, ts, http.MethodGet, "/api/usage/export?range=1d&by=domain", cookie, "")
+	if resp.StatusCode != http.StatusOK || !strings.Contains(resp.Header.Get("Content-Disposition"), "sower-usage-hour-domain.csv") {
+		t.Fatalf("export status = %d, disposition %q", resp.StatusCode, resp.Header.Get("Content-Disposition"))
+	}
+	records, err := csv.NewReader(resp.Body).ReadAll()
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("read csv: %v", err)
+	}
+	if len(records) != 2 || records[0][1] != "domain" || records[1][1] != "example.com" || records[1][2] != "1" {
+		t.Fatalf("csv = %v", records)
+	}
+
+	for _, path := range []string{
+		"/api/usage?range=tomorrow",
+		"/api/usage?from=2026-01-02T00:00:00Z&to=2026-01-01T00:00:00Z",
+		"/api/history?range=1h&step=week",
+		"/api/usage/export?format=xml",
+		"/api/usage/export?by=domain&step=minute",
+	} {
+		resp := authedRequest(t, ts, http.MethodGet, path, cookie, "")
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("GET %s = %d, want 400", path, resp.StatusCode)
+		}
+	}
+}
+
+func TestUsageEndpointsDisabled(t *testing.T) {
+	s := NewServer(Options{Password: "secret", Version: "v1.2.3", Date: "2026-01-01", Rules: newFakeRules(), Stats: newTestStats(t)})
+	ts := httptest.NewServer(s.http.Handler)
+	t.Cleanup(ts.Close)
+	cookie := login(t, ts, "secret")
+
+	resp := authedRequest(t, ts, http.MethodGet, "/api/usage", cookie, "")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("usage status = %d, want 404", resp.StatusCode)
+	}
+	// The live ring still answers without a range.
+	resp = authedRequest(t, ts, http.MethodGet, "/api/history", cookie, "")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("history status = %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,359 @@
+package admin
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"slices"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Role is a console user's permission level.
+type Role string
+
+const (
+	// RoleViewer may call the read-only endpoints.
+	RoleViewer Role = "viewer"
+	// RoleEditor may also add, remove and reset rules.
+	RoleEditor Role = "rule-editor"
+	// RoleAdmin may do everything, including config changes, restarts,
+	// tokens and user management.
+	RoleAdmin Role = "admin"
+)
+
+func (r Role) valid() bool {
+	switch r {
+	case RoleViewer, RoleEditor, RoleAdmin:
+		return true
+	default:
+		return false
+	}
+}
+
+// permits reports whether the role may call an endpoint needing scope. The
+// empty scope marks console-only endpoints, which only admins may call.
+func (r Role) permits(scope TokenScope) bool {
+	switch r {
+	case RoleAdmin:
+		return true
+	case RoleEditor:
+		return scope == ScopeRead || scope == ScopeRules
+	case RoleViewer:
+		return scope == ScopeRead
+	default:
+		return false
+	}
+}
+
+const (
+	maxUsers          = 32
+	minPasswordLength = 8
+	// maxPasswordLength is bcrypt's input limit.
+	maxPasswordLength = 72
+)
+
+var userNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{0,31}$`)
+
+// UserInfo is the API view of a console user.
+type UserInfo struct {
+	Name      string    `json:"name"`
+	Role      Role      `json:"role"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// StoredUser is a console user in the state file, with a bcrypt hash of the
+// password.
+type StoredUser struct {
+	UserInfo
+	Hash string `json:"hash"`
+}
+
+var (
+	ErrUserExists   = errors.New("user already exists")
+	ErrUserNotFound = errors.New("user not found")
+	ErrUserLimit    = errors.New("user limit reached")
+)
+
+// dummyHash keeps logins for unknown users as slow as for known ones.
+var dummyHash = sync.OnceValue(func() []byte {
+	h, _ := bcrypt.GenerateFromPassword([]byte("sower-dummy-password"), bcrypt.DefaultCost)
+	return h
+})
+
+func validUserInput(name, password string) error {
+	if !userNamePattern.MatchString(name) {
+		return errors.New("name must be 1 to 32 lowercase letters, digits, '.', '_' or '-'")
+	}
+	if password != "" && (len(password) < minPasswordLength || len(password) > maxPasswordLength) {
+		return fmt.Errorf("password must be %d to %d bytes", minPasswordLength, maxPasswordLength)
+	}
+	return nil
+}
+
+// Users lists the console users in creation order.
+func (st *StateStore) Users() []UserInfo {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	out := make([]UserInfo, 0, len(st.state.Users))
+	for _, u := range st.state.Users {
+		out = append(out, u.UserInfo)
+	}
+	return out
+}
+
+func (st *StateStore) userIndexLocked(name string) int {
+	return slices.IndexFunc(st.state.Users, func(u *StoredUser) bool { return u.Name == name })
+}
+
+// UserAdd stores a new user. Like tokens, users do not bump the revision.
+func (st *StateStore) UserAdd(name, password string, role Role) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("hash password: %w", err)
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.userIndexLocked(name) >= 0 {
+		return ErrUserExists
+	}
+	if len(st.state.Users) >= maxUsers {
+		return ErrUserLimit
+	}
+	cand := st.cloneLocked()
+	cand.Users = append(cand.Users, &StoredUser{
+		UserInfo: UserInfo{Name: name, Role: role, CreatedAt: time.Now()},
+		Hash:     string(hash),
+	})
+	cand.UpdatedAt = time.Now()
+	if err := st.persistLocked(cand); err != nil {
+		return err
+	}
+	st.state = cand
+	return nil
+}
+
+// UserUpdate changes a user's role and, when password is non-empty, its
+// password.
+func (st *StateStore) UserUpdate(name string, role Role, password string) error {
+	var hash []byte
+	if password != "" {
+		var err error
+		if hash, err = bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost); err != nil {
+			return fmt.Errorf("hash password: %w", err)
+		}
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	i := st.userIndexLocked(name)
+	if i < 0 {
+		return ErrUserNotFound
+	}
+	cand := st.cloneLocked()
+	u := cand.Users[i]
+	if role != "" {
+		u.Role = role
+	}
+	if hash != nil {
+		u.Hash = string(hash)
+	}
+	cand.UpdatedAt = time.Now()
+	if err := st.persistLocked(cand); err != nil {
+		return err
+	}
+	st.state = cand
+	return nil
+}
+
+// UserDelete removes a user.
+func (st *StateStore) UserDelete(name string) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	i := st.userIndexLocked(name)
+	if i < 0 {
+		return ErrUserNotFound
+	}
+	cand := st.cloneLocked()
+	cand.Users = slices.Delete(cand.Users, i, i+1)
+	cand.UpdatedAt = time.Now()
+	if err := st.persistLocked(cand); err != nil {
+		return err
+	}
+	st.state = cand
+	return nil
+}
+
+// UserRole returns the current role of a user.
+func (st *StateStore) UserRole(name string) (Role, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if i := st.userIndexLocked(name); i >= 0 {
+		return st.state.Users[i].Role, true
+	}
+	return "", false
+}
+
+// UserAuthenticate checks a user's password. The bcrypt comparison runs
+// outside the store lock.
+func (st *StateStore) UserAuthenticate(name, password string) bool {
+	st.mu.Lock()
+	hash := dummyHash()
+	i := st.userIndexLocked(name)
+	if i >= 0 {
+		hash = []byte(st.state.Users[i].Hash)
+	}
+	st.mu.Unlock()
+	err := bcrypt.CompareHashAndPassword(hash, []byte(password))
+	return i >= 0 && err == nil
+}
+
+// sessionRole returns the role of a session's user. The shared admin
+// password's sessions have no user and are admins; a session whose user
+// was deleted has no role.
+func (s *Server) sessionRole(token string) (string, Role, bool) {
+	s.mu.Lock()
+	sess, ok := s.sessions[token]
+	s.mu.Unlock()
+	if !ok {
+		return "", "", false
+	}
+	if sess.User == "" {
+		return "", RoleAdmin, true
+	}
+	if s.opts.State == nil {
+		return "", "", false
+	}
+	role, ok := s.opts.State.UserRole(sess.User)
+	return sess.User, role, ok
+}
+
+// dropUserSessions logs a user out everywhere, after the user is deleted
+// or given a new password.
+func (s *Server) dropUserSessions(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for token, sess := range s.sessions {
+		if sess.User == name {
+			delete(s.sessions, token)
+		}
+	}
+	if err := s.persistLocked(s.sessions); err != nil {
+		slog.Error("persist admin sessions after user change", "error", err)
+	}
+}
+
+// handleMe reports who the caller is, so the console can hide what the
+// role may not do. Token callers have no user and no role.
+func (s *Server) handleMe(w http.ResponseWriter, r *http.Request) {
+	me := map[string]any{"user": "", "role": ""}
+	if c, err := r.Cookie(sessionCookieName); err == nil {
+		if user, role, ok := s.sessionRole(c.Value); ok {
+			me["user"], me["role"] = user, role
+		}
+	}
+	writeJSON(w, http.StatusOK, me)
+}
+
+type userRequest struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+	Role     Role   `json:"role"`
+}
+
+func (s *Server) handleUsersList(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.opts.State.Users())
+}
+
+func (s *Server) handleUserAdd(w http.ResponseWriter, r *http.Request) {
+	var req userRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if err := validUserInput(req.Name, req.Password); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Password == "" || !req.Role.valid() {
+		writeError(w, http.StatusBadRequest, "password and a role of viewer, rule-editor or admin are required")
+		return
+	}
+	err := s.opts.State.UserAdd(req.Name, req.Password, req.Role)
+	switch {
+	case errors.Is(err, ErrUserExists), errors.Is(err, ErrUserLimit):
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	case err != nil:
+		slog.Error("add admin user", "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to persist user")
+		return
+	}
+	slog.Info("admin user added", "user", req.Name, "role", req.Role)
+	s.audit(r, AuditUserAdd, req.Name, nil, map[string]Role{"role": req.Role})
+	writeJSON(w, http.StatusCreated, UserInfo{Name: req.Name, Role: req.Role})
+}
+
+func (s *Server) handleUserUpdate(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Password string `json:"password"`
+		Role     Role   `json:"role"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	name := r.PathValue("name")
+	if err := validUserInput(name, req.Password); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Role != "" && !req.Role.valid() {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("unknown role %q", req.Role))
+		return
+	}
+	oldRole, _ := s.opts.State.UserRole(name)
+	err := s.opts.State.UserUpdate(name, req.Role, req.Password)
+	switch {
+	case errors.Is(err, ErrUserNotFound):
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	case err != nil:
+		slog.Error("update admin user", "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to persist user")
+		return
+	}
+	if req.Password != "" {
+		s.dropUserSessions(name)
+	}
+	slog.Info("admin user updated", "user", name, "role", req.Role, "password_changed", req.Password != "")
+	before, after := map[string]any{}, map[string]any{}
+	if req.Role != "" && req.Role != oldRole {
+		before["role"], after["role"] = oldRole, req.Role
+	}
+	if req.Password != "" {
+		after["password"] = "changed"
+	}
+	s.audit(r, AuditUserUpdate, name, before, after)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleUserDelete(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	role, _ := s.opts.State.UserRole(name)
+	err := s.opts.State.UserDelete(name)
+	switch {
+	case errors.Is(err, ErrUserNotFound):
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	case err != nil:
+		slog.Error("delete admin user", "error", err)
+		writeError(w, http.StatusInternalServerError, "failed to persist user removal")
+		return
+	}
+	s.dropUserSessions(name)
+	slog.Info("admin user deleted", "user", name)
+	s.audit(r, AuditUserDelete, name, map[string]Role{"role": role}, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,185 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func loginUser(t *testing.T, ts *httptest.Server, user, password string) (string, int) {
+	t.Helper()
+	body := fmt.Sprintf(`{"username":%q,"password":%q}`, user, password)
+	resp, err := http.Post(ts.URL+"/api/session", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("login: %v", err)
+	}
+	resp.Body.Close()
+	for _, c := range resp.Cookies() {
+		if c.Name == sessionCookieName {
+			return c.Value, resp.StatusCode
+		}
+	}
+	return "", resp.StatusCode
+}
+
+func TestStateStoreUsers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	st := LoadStateStore(path)
+	if err := st.UserAdd("alice", "correct horse", RoleEditor); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	if err := st.UserAdd("alice", "another one", RoleViewer); err != ErrUserExists {
+		t.Fatalf("duplicate add = %v, want ErrUserExists", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read state: %v", err)
+	}
+	if strings.Contains(string(data), "correct horse") || !strings.Contains(string(data), `"hash": "$2`) {
+		t.Fatal("state file must hold a bcrypt hash, not the password")
+	}
+
+	reloaded := LoadStateStore(path)
+	if !reloaded.UserAuthenticate("alice", "correct horse") || reloaded.UserAuthenticate("alice", "wrong horse") {
+		t.Fatal("authentication does not match the stored password")
+	}
+	if reloaded.UserAuthenticate("bob", "correct horse") {
+		t.Fatal("unknown user authenticated")
+	}
+	if err := reloaded.UserUpdate("alice", RoleViewer, "battery staple"); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if role, ok := reloaded.UserRole("alice"); !ok || role != RoleViewer {
+		t.Fatalf("role = %q, %v", role, ok)
+	}
+	if !reloaded.UserAuthenticate("alice", "battery staple") {
+		t.Fatal("changed password refused")
+	}
+	if err := reloaded.UserDelete("alice"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if len(reloaded.Users()) != 0 {
+		t.Fatalf("users = %+v", reloaded.Users())
+	}
+}
+
+func TestUserRolesEnforced(t *testing.T) {
+	state := LoadStateStore("")
+	rules := newFakeRules()
+	s := NewServer(Options{Password: "secret", Rules: rules, Stats: newTestStats(t), State: state, Restart: func() error { return nil }})
+	ts := httptest.NewServer(s.http.Handler)
+	t.Cleanup(ts.Close)
+	admin := login(t, ts, "secret")
+
+	for _, u := range []struct{ name, role string }{{"viewer", "viewer"}, {"editor", "rule-editor"}} {
+		resp := authedRequest(t, ts, http.MethodPost, "/api/users", admin, fmt.Sprintf(`{"name":%q,"password":"password1","role":%q}`, u.name, u.role))
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("add %s = %d", u.name, resp.StatusCode)
+		}
+	}
+	if _, code := loginUser(t, ts, "viewer", "password2"); code != http.StatusUnauthorized {
+		t.Fatalf("wrong password login = %d", code)
+	}
+	viewer, _ := loginUser(t, ts, "viewer", "password1")
+	editor, _ := loginUser(t, ts, "editor", "password1")
+
+	addRule := `{"category":"block","rules":["ads.example.com"]}`
+	for _, test := range []struct {
+		who, cookie, method, path, body string
+		want                            int
+	}{
+		{"viewer", viewer, http.MethodGet, "/api/traffic", "", http.StatusOK},
+		{"viewer", viewer, http.MethodPost, "/api/rules", addRule, http.StatusForbidden},
+		{"viewer", viewer, http.MethodGet, "/api/users", "", http.StatusForbidden},
+		{"editor", editor, http.MethodPost, "/api/rules", addRule, http.StatusNoContent},
+		{"editor", editor, http.MethodPost, "/api/restart", "", http.StatusForbidden},
+		{"editor", editor, http.MethodPost, "/api/tokens", `{"name":"x","scopes":["read"]}`, http.StatusForbidden},
+		{"admin", admin, http.MethodPost, "/api/restart", "", http.StatusAccepted},
+	} {
+		resp := authedRequest(t, ts, test.method, test.path, test.cookie, test.body)
+		resp.Body.Close()
+		if resp.StatusCode != test.want {
+			t.Errorf("%s %s %s = %d, want %d", test.who, test.method, test.path, resp.StatusCode, test.want)
+		}
+	}
+
+	resp := authedRequest(t, ts, http.MethodGet, "/api/me", editor, "")
+	var me struct{ User, Role string }
+	if err := json.NewDecoder(resp.Body).Decode(&me); err != nil {
+		t.Fatalf("decode me: %v", err)
+	}
+	resp.Body.Close()
+	if me.User != "editor" || me.Role != string(RoleEditor) {
+		t.Fatalf("me = %+v", me)
+	}
+
+	// A role change applies to live sessions; a new password or deleting a
+	// user ends them.
+	resp = authedRequest(t, ts, http.MethodPatch, "/api/users/editor", admin, `{"role":"viewer"}`)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("update = %d", resp.StatusCode)
+	}
+	resp = authedRequest(t, ts, http.MethodPost, "/api/rules", editor, addRule)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("demoted editor rule change = %d", resp.StatusCode)
+	}
+	resp = authedRequest(t, ts, http.MethodPatch, "/api/users/editor", admin, `{"password":"password2"}`)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("password update = %d", resp.StatusCode)
+	}
+	resp = authedRequest(t, ts, http.MethodGet, "/api/traffic", editor, "")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("session after password change = %d, want 401", resp.StatusCode)
+	}
+	if _, code := loginUser(t, ts, "editor", "password2"); code != http.StatusOK && code != http.StatusNoContent {
+		t.Fatalf("login with new password = %d", code)
+	}
+	resp = authedRequest(t, ts, http.MethodDelete, "/api/users/viewer", admin, "")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("delete = %d", resp.StatusCode)
+	}
+	resp = authedRequest(t, ts, http.MethodGet, "/api/traffic", viewer, "")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("deleted user's session = %d, want 401", resp.StatusCode)
+	}
+
+	for _, body := range []string{
+		`{"name":"Bad Name","password":"password1","role":"viewer"}`,
+		`{"name":"short","password":"pw","role":"viewer"}`,
+		`{"name":"norole","password":"password1","role":"owner"}`,
+	} {
+		resp := authedRequest(t, ts, http.MethodPost, "/api/users", admin, body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("add %s = %d, want 400", body, resp.StatusCode)
+		}
+	}
+}
+
+func TestLegacySessionFileLoadsAsAdmin(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "sessions.json")
+	data, err := json.Marshal(map[string]time.Time{"legacy": time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	if err := os.WriteFile(file, data, 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	s := NewServer(Options{Password: "secret", Rules: newFakeRules(), Stats: newTestStats(t), SessionFile: file})
+	if user, role, ok := s.sessionRole("legacy"); !ok || user != "" || role != RoleAdmin {
+		t.Fatalf("legacy session = %q, %q, %v", user, role, ok)
+	}
+}
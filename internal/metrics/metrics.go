@@ -29,7 +29,7 @@ type Metrics struct {
 
 	bytes       metric.Int64Counter // attr: direction=up|down
 	dnsQueries  metric.Int64Counter
-	conns       metric.Int64Counter // attr: protocol=http|https|socks5
+	conns       metric.Int64Counter // attr: protocol=http|https|socks5|transparent
 	activeConns metric.Int64UpDownCounter
 	ruleHits    metric.Int64Counter // attr: route=block|direct|proxy
 	proxyErrors metric.Int64Counter // attr: kind=dial|dns|accept
@@ -141,9 +141,9 @@ func (m *Metrics) RecordConnDuration(d time.Duration) {
 	m.connDur.Record(context.Background(), d.Milliseconds())
 }
 
-// RecordProxyError counts one proxy-side failure. kind is dial, dns, or
-// accept. Failures are low-frequency relative to the relay hot path, so the
-// attribute is built per call without a precomputed option.
+// RecordProxyError counts one proxy-side failure. kind is dial, dns,
+// accept, or acl. Failures are low-frequency relative to the relay hot
+// path, so the attribute is built per call without a precomputed option.
 func (m *Metrics) RecordProxyError(kind string) {
 	m.proxyErrors.Add(context.Background(), 1,
 		metric.WithAttributes(attribute.String("kind", kind)))
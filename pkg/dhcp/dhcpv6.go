@@ -0,0 +1,296 @@
+package dhcp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-reuseport"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	icmpv6RouterSolicitation  = 133
+	icmpv6RouterAdvertisement = 134
+	ndOptSourceLinkLayerAddr  = 1
+	ndOptRDNSS                = 25 // RFC 8106
+
+	dhcpv6InformationRequest = 11
+	dhcpv6Reply              = 7
+	dhcpv6OptClientID        = 1
+	dhcpv6OptORO             = 6
+	dhcpv6OptElapsedTime     = 8
+	dhcpv6OptDNSServers      = 23 // RFC 3646
+
+	ipv6DiscoveryTimeout = 3 * time.Second
+)
+
+var (
+	allRoutersAddr             = net.ParseIP("ff02::2")
+	allDHCPv6RelayAgentsServer = net.ParseIP("ff02::1:2")
+)
+
+// GetDNSServer6 discovers IPv6 DNS servers on the internet-facing interface
+// from Router Advertisement RDNSS options and a DHCPv6 Information-Request,
+// run in parallel. RA servers come first; an error is returned only when
+// neither source yields a server. Link-local servers carry the interface
+// zone so they can be dialed as-is.
+func GetDNSServer6() ([]string, error) {
+	ifi, err := pickIPv6Interface()
+	if err != nil {
+		return nil, fmt.Errorf("pick ipv6 interface: %w", err)
+	}
+
+	var (
+		wg             sync.WaitGroup
+		raIPs, dhcpIPs []net.IP
+		raErr, dhcpErr error
+	)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		raIPs, raErr = solicitRDNSS(ifi, ipv6DiscoveryTimeout)
+	}()
+	go func() {
+		defer wg.Done()
+		dhcpIPs, dhcpErr = requestDHCPv6DNS(ifi, ipv6DiscoveryTimeout)
+	}()
+	wg.Wait()
+
+	var ips []string
+	seen := make(map[string]struct{})
+	for _, ip := range append(raIPs, dhcpIPs...) {
+		s := ip.String()
+		if ip.IsLinkLocalUnicast() {
+			s += "%" + ifi.Name
+		}
+		if _, ok := seen[s]; ok {
+			continue
+		}
+		seen[s] = struct{}{}
+		ips = append(ips, s)
+	}
+	if len(ips) == 0 {
+		return nil, errors.Join(
+			fmt.Errorf("router advertisement: %w", orNoServers(raErr)),
+			fmt.Errorf("dhcpv6: %w", orNoServers(dhcpErr)))
+	}
+	return ips, nil
+}
+
+func orNoServers(err error) error {
+	if err == nil {
+		return errors.New("no dns servers announced")
+	}
+	return err
+}
+
+// pickIPv6Interface picks the first active interface with an IPv6
+// link-local address, preferring one that also has a global address.
+func pickIPv6Interface() (*net.Interface, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	var fallback *net.Interface
+	for i := range ifaces {
+		ifi := &ifaces[i]
+		if ifi.Flags&net.FlagUp == 0 || ifi.Flags&net.FlagLoopback != 0 || len(ifi.HardwareAddr) == 0 {
+			continue
+		}
+		addrs, err := ifi.Addrs()
+		if err != nil {
+			continue
+		}
+		var linkLocal, global bool
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || ipNet.IP.To4() != nil {
+				continue
+			}
+			linkLocal = linkLocal || ipNet.IP.IsLinkLocalUnicast()
+			global = global || ipNet.IP.IsGlobalUnicast()
+		}
+		switch {
+		case linkLocal && global:
+			return ifi, nil
+		case linkLocal && fallback == nil:
+			fallback = ifi
+		}
+	}
+	if fallback == nil {
+		return nil, errors.New("no ipv6 interface")
+	}
+	return fallback, nil
+}
+
+// solicitRDNSS sends a Router Solicitation on ifi and collects RDNSS
+// servers from the first advertisement that carries any. It needs a raw
+// ICMPv6 socket (root or CAP_NET_RAW).
+func solicitRDNSS(ifi *net.Interface, timeout time.Duration) ([]net.IP, error) {
+	c, err := net.ListenPacket("ip6:ipv6-icmp", "::")
+	if err != nil {
+		return nil, fmt.Errorf("listen icmpv6: %w", err)
+	}
+	defer c.Close()
+
+	p := ipv6.NewPacketConn(c)
+	var filter ipv6.ICMPFilter
+	filter.SetAll(true)
+	filter.Accept(ipv6.ICMPType(icmpv6RouterAdvertisement))
+	if err := p.SetICMPFilter(&filter); err != nil {
+		return nil, fmt.Errorf("set icmpv6 filter: %w", err)
+	}
+	// RFC 4861 6.1.2: hosts and routers drop ND messages whose hop limit
+	// is not 255, which also proves the sender is on-link.
+	if err := p.SetMulticastHopLimit(255); err != nil {
+		return nil, fmt.Errorf("set multicast hop limit: %w", err)
+	}
+	if err := p.SetMulticastInterface(ifi); err != nil {
+		return nil, fmt.Errorf("set multicast interface: %w", err)
+	}
+	if err := p.SetControlMessage(ipv6.FlagHopLimit|ipv6.FlagInterface, true); err != nil {
+		return nil, fmt.Errorf("enable icmpv6 control messages: %w", err)
+	}
+	_ = p.SetDeadline(time.Now().Add(timeout))
+
+	if _, err := p.WriteTo(routerSolicitation(ifi.HardwareAddr), nil, &net.IPAddr{IP: allRoutersAddr, Zone: ifi.Name}); err != nil {
+		return nil, fmt.Errorf("write router solicitation: %w", err)
+	}
+
+	buf := make([]byte, 1500 /*MTU*/)
+	for {
+		n, cm, _, err := p.ReadFrom(buf)
+		if err != nil {
+			return nil, fmt.Errorf("read router advertisement: %w", err)
+		}
+		if cm != nil && (cm.HopLimit != 255 || cm.IfIndex != ifi.Index) {
+			continue
+		}
+		if servers := parseRDNSS(buf[:n]); len(servers) > 0 {
+			return servers, nil
+		}
+	}
+}
+
+func routerSolicitation(mac net.HardwareAddr) []byte {
+	msg := []byte{icmpv6RouterSolicitation, 0, 0, 0, 0, 0, 0, 0}
+	// The source link-layer option is padded to a multiple of 8 bytes.
+	if len(mac) == 6 {
+		msg = append(msg, ndOptSourceLinkLayerAddr, 1)
+		msg = append(msg, mac...)
+	}
+	return msg
+}
+
+// parseRDNSS returns the servers in the RDNSS options of a Router
+// Advertisement. Options with a zero lifetime withdraw their servers and
+// are skipped.
+func parseRDNSS(ra []byte) []net.IP {
+	const raHeaderLen = 16
+	if len(ra) < raHeaderLen || ra[0] != icmpv6RouterAdvertisement {
+		return nil
+	}
+	var servers []net.IP
+	opts := ra[raHeaderLen:]
+	for len(opts) >= 2 {
+		size := int(opts[1]) * 8
+		if size == 0 || size > len(opts) {
+			break // malformed: RFC 4861 says to discard the rest
+		}
+		opt := opts[:size]
+		opts = opts[size:]
+		if opt[0] != ndOptRDNSS || size < 24 {
+			continue
+		}
+		if binary.BigEndian.Uint32(opt[4:8]) == 0 {
+			continue
+		}
+		for addrs := opt[8:]; len(addrs) >= net.IPv6len; addrs = addrs[net.IPv6len:] {
+			servers = append(servers, net.IP(bytes.Clone(addrs[:net.IPv6len])))
+		}
+	}
+	return servers
+}
+
+// requestDHCPv6DNS sends a DHCPv6 Information-Request on ifi and returns the
+// DNS servers (option 23) from the first matching Reply.
+func requestDHCPv6DNS(ifi *net.Interface, timeout time.Duration) ([]net.IP, error) {
+	xid := make([]byte, 3)
+	if _, err := rand.Read(xid); err != nil {
+		return nil, fmt.Errorf("generate xid: %w", err)
+	}
+
+	// The system DHCPv6 client may hold port 546; share it like the DHCPv4
+	// discovery does for port 68.
+	conn, err := reuseport.ListenPacket("udp6", "[::]:546")
+	if err != nil {
+		return nil, fmt.Errorf("listen dhcpv6: %w", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+
+	dst := &net.UDPAddr{IP: allDHCPv6RelayAgentsServer, Port: 547, Zone: ifi.Name}
+	if _, err := conn.WriteTo(dhcpv6InformationRequestPacket(xid, ifi.HardwareAddr), dst); err != nil {
+		return nil, fmt.Errorf("write dhcpv6 information request: %w", err)
+	}
+
+	buf := make([]byte, 1500 /*MTU*/)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return nil, fmt.Errorf("read dhcpv6 reply: %w", err)
+		}
+		if servers, ok := parseDHCPv6Reply(buf[:n], xid); ok {
+			return servers, nil
+		}
+	}
+}
+
+func dhcpv6InformationRequestPacket(xid []byte, mac net.HardwareAddr) []byte {
+	msg := append([]byte{dhcpv6InformationRequest}, xid...)
+	// DUID-LL (RFC 8415 11.4): type 3, hardware type 1 (Ethernet).
+	duid := append([]byte{0, 3, 0, 1}, mac...)
+	msg = appendDHCPv6Option(msg, dhcpv6OptClientID, duid)
+	msg = appendDHCPv6Option(msg, dhcpv6OptORO, []byte{0, dhcpv6OptDNSServers})
+	msg = appendDHCPv6Option(msg, dhcpv6OptElapsedTime, []byte{0, 0})
+	return msg
+}
+
+func appendDHCPv6Option(msg []byte, code uint16, data []byte) []byte {
+	msg = binary.BigEndian.AppendUint16(msg, code)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(len(data)))
+	return append(msg, data...)
+}
+
+// parseDHCPv6Reply extracts option 23 from a Reply for transaction xid. ok
+// is false for packets that belong to another transaction or type, which
+// the caller skips as the socket is shared.
+func parseDHCPv6Reply(msg, xid []byte) ([]net.IP, bool) {
+	if len(msg) < 4 || msg[0] != dhcpv6Reply || !bytes.Equal(msg[1:4], xid) {
+		return nil, false
+	}
+	var servers []net.IP
+	for opts := msg[4:]; len(opts) >= 4; {
+		code := binary.BigEndian.Uint16(opts[0:2])
+		size := int(binary.BigEndian.Uint16(opts[2:4]))
+		if 4+size > len(opts) {
+			break
+		}
+		data := opts[4 : 4+size]
+		opts = opts[4+size:]
+		if code != dhcpv6OptDNSServers {
+			continue
+		}
+		for ; len(data) >= net.IPv6len; data = data[net.IPv6len:] {
+			servers = append(servers, net.IP(bytes.Clone(data[:net.IPv6len])))
+		}
+	}
+	return servers, true
+}
@@ -0,0 +1,63 @@
+package dhcp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+func TestParseRDNSS(t *testing.T) {
+	t.Parallel()
+
+	ra := make([]byte, 16)
+	ra[0] = icmpv6RouterAdvertisement
+	// Source link-layer option, skipped.
+	ra = append(ra, ndOptSourceLinkLayerAddr, 1, 0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff)
+	// RDNSS with two servers: 8 + 2*16 bytes = 5 units.
+	rdnss := []byte{ndOptRDNSS, 5, 0, 0}
+	rdnss = binary.BigEndian.AppendUint32(rdnss, 1800)
+	rdnss = append(rdnss, net.ParseIP("2001:db8::53")...)
+	rdnss = append(rdnss, net.ParseIP("fe80::1")...)
+	ra = append(ra, rdnss...)
+	// Withdrawn RDNSS (lifetime 0), skipped.
+	withdrawn := []byte{ndOptRDNSS, 3, 0, 0, 0, 0, 0, 0}
+	withdrawn = append(withdrawn, net.ParseIP("2001:db8::dead")...)
+	ra = append(ra, withdrawn...)
+
+	got := parseRDNSS(ra)
+	if len(got) != 2 || !got[0].Equal(net.ParseIP("2001:db8::53")) || !got[1].Equal(net.ParseIP("fe80::1")) {
+		t.Fatalf("parseRDNSS = %v", got)
+	}
+
+	if got := parseRDNSS(append(ra[:16:16], ndOptRDNSS, 0)); got != nil {
+		t.Fatalf("zero-length option must stop parsing, got %v", got)
+	}
+}
+
+func TestDHCPv6InformationRequestRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	xid := []byte{1, 2, 3}
+	mac := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}
+	req := dhcpv6InformationRequestPacket(xid, mac)
+	if req[0] != dhcpv6InformationRequest || !bytes.Equal(req[1:4], xid) {
+		t.Fatalf("bad request header: %x", req[:4])
+	}
+	if !bytes.Contains(req, []byte{0, dhcpv6OptORO, 0, 2, 0, dhcpv6OptDNSServers}) {
+		t.Fatalf("request does not ask for option 23: %x", req)
+	}
+
+	reply := append([]byte{dhcpv6Reply}, xid...)
+	reply = appendDHCPv6Option(reply, dhcpv6OptClientID, []byte{0, 3, 0, 1})
+	reply = appendDHCPv6Option(reply, dhcpv6OptDNSServers,
+		append(net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::2").To16()...))
+
+	servers, ok := parseDHCPv6Reply(reply, xid)
+	if !ok || len(servers) != 2 || !servers[1].Equal(net.ParseIP("2001:db8::2")) {
+		t.Fatalf("parseDHCPv6Reply = %v, %v", servers, ok)
+	}
+	if _, ok := parseDHCPv6Reply(reply, []byte{9, 9, 9}); ok {
+		t.Fatal("reply for another transaction must be skipped")
+	}
+}
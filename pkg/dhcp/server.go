@@ -0,0 +1,394 @@
+package dhcp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/krolaw/dhcp4"
+	"github.com/krolaw/dhcp4/conn"
+	"github.com/sower-proxy/sower/internal/fsutil"
+)
+
+const (
+	// offerHold reserves an offered address for the client that asked, so
+	// two clients discovering at once are not offered the same IP.
+	offerHold = time.Minute
+	// declineHold keeps an address a client reported as in use (DHCPDECLINE)
+	// out of the pool; the conflicting host usually has a static address.
+	declineHold = time.Hour
+)
+
+// ServerConfig configures the built-in DHCPv4 server.
+type ServerConfig struct {
+	// ServerIP is the sower address on the served interface. It is the
+	// server identifier and the DNS server handed to clients.
+	ServerIP net.IP
+	Netmask  net.IPMask
+	// Gateway is the default route handed to clients, typically the ISP
+	// router; sower itself stays off the data path for non-proxied traffic.
+	Gateway    net.IP
+	RangeStart net.IP
+	RangeEnd   net.IP
+	Lease      time.Duration
+	// LeaseFile persists leases across restarts; empty keeps them in memory.
+	LeaseFile string
+}
+
+// Lease is one address assignment.
+type Lease struct {
+	IP       net.IP    `json:"ip"`
+	MAC      string    `json:"mac"`
+	Hostname string    `json:"hostname,omitempty"`
+	Expiry   time.Time `json:"expiry"`
+
+	offered bool // held by an unconfirmed offer
+}
+
+// Server is an authoritative DHCPv4 server for one subnet. It implements
+// dhcp4.Handler; lease hostnames also make it an admin HostnameResolver.
+type Server struct {
+	cfg   ServerConfig
+	start net.IP
+	size  int
+	now   func() time.Time
+
+	mu sync.Mutex
+	// leases is indexed by pool offset; declined addresses are held under
+	// an empty MAC.
+	leases map[int]*Lease
+}
+
+// NewServer validates cfg and restores leases from cfg.LeaseFile.
+func NewServer(cfg ServerConfig) (*Server, error) {
+	serverIP, start, end := cfg.ServerIP.To4(), cfg.RangeStart.To4(), cfg.RangeEnd.To4()
+	if serverIP == nil || start == nil || end == nil {
+		return nil, errors.New("dhcp server ip and range must be IPv4")
+	}
+	if cfg.Gateway != nil && cfg.Gateway.To4() == nil {
+		return nil, fmt.Errorf("dhcp gateway %s is not IPv4", cfg.Gateway)
+	}
+	if len(cfg.Netmask) != net.IPv4len {
+		return nil, errors.New("dhcp netmask must be IPv4")
+	}
+	subnet := &net.IPNet{IP: serverIP.Mask(cfg.Netmask), Mask: cfg.Netmask}
+	if !subnet.Contains(start) || !subnet.Contains(end) {
+		return nil, fmt.Errorf("dhcp range %s-%s is outside subnet %s", start, end, subnet)
+	}
+	if dhcp4.IPLess(end, start) {
+		return nil, fmt.Errorf("dhcp range start %s is after end %s", start, end)
+	}
+	if cfg.Lease <= 0 {
+		return nil, errors.New("dhcp lease duration must be positive")
+	}
+	cfg.ServerIP = serverIP
+
+	s := &Server{
+		cfg:    cfg,
+		start:  start,
+		size:   dhcp4.IPRange(start, end),
+		now:    time.Now,
+		leases: make(map[int]*Lease),
+	}
+	if cfg.LeaseFile != "" {
+		if err := s.load(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Listen opens the DHCP server socket on iface. Only packets received on
+// that interface are served.
+func Listen(iface string) (interface {
+	dhcp4.ServeConn
+	io.Closer
+}, error) {
+	c, err := conn.NewUDP4FilterListener(iface, ":67")
+	if err != nil {
+		return nil, fmt.Errorf("listen dhcp on %s: %w", iface, err)
+	}
+	return c, nil
+}
+
+// Serve answers DHCP requests on c until reading or writing fails, e.g.
+// because c was closed.
+func (s *Server) Serve(c dhcp4.ServeConn) error {
+	return dhcp4.Serve(c, s)
+}
+
+// ServeDHCP implements dhcp4.Handler.
+func (s *Server) ServeDHCP(req dhcp4.Packet, msgType dhcp4.MessageType, options dhcp4.Options) dhcp4.Packet {
+	mac := req.CHAddr().String()
+	switch msgType {
+	case dhcp4.Discover:
+		ip, ok := s.offer(mac, net.IP(options[dhcp4.OptionRequestedIPAddress]))
+		if !ok {
+			slog.Warn("dhcp pool exhausted", "mac", mac)
+			return nil
+		}
+		return dhcp4.ReplyPacket(req, dhcp4.Offer, s.cfg.ServerIP, ip, s.cfg.Lease, s.replyOptions(options))
+
+	case dhcp4.Request:
+		if id, ok := options[dhcp4.OptionServerIdentifier]; ok && !net.IP(id).Equal(s.cfg.ServerIP) {
+			return nil // the client picked another server's offer
+		}
+		reqIP := net.IP(options[dhcp4.OptionRequestedIPAddress])
+		if reqIP == nil {
+			reqIP = req.CIAddr()
+		}
+		hostname := sanitizeHostname(string(options[dhcp4.OptionHostName]))
+		if !s.commit(mac, reqIP, hostname) {
+			return dhcp4.ReplyPacket(req, dhcp4.NAK, s.cfg.ServerIP, nil, 0, nil)
+		}
+		return dhcp4.ReplyPacket(req, dhcp4.ACK, s.cfg.ServerIP, reqIP, s.cfg.Lease, s.replyOptions(options))
+
+	case dhcp4.Release:
+		s.release(mac, req.CIAddr())
+
+	case dhcp4.Decline:
+		s.decline(mac, net.IP(options[dhcp4.OptionRequestedIPAddress]))
+
+	case dhcp4.Inform:
+		// RFC 2131 4.3.5: configuration only, no address and no lease time.
+		return dhcp4.ReplyPacket(req, dhcp4.ACK, s.cfg.ServerIP, nil, 0, s.replyOptions(options))
+	}
+	return nil
+}
+
+func (s *Server) replyOptions(req dhcp4.Options) []dhcp4.Option {
+	opts := dhcp4.Options{
+		dhcp4.OptionSubnetMask:       []byte(s.cfg.Netmask),
+		dhcp4.OptionDomainNameServer: []byte(s.cfg.ServerIP),
+	}
+	if gw := s.cfg.Gateway.To4(); gw != nil {
+		opts[dhcp4.OptionRouter] = []byte(gw)
+	}
+	return opts.SelectOrderOrAll(req[dhcp4.OptionParameterRequestList])
+}
+
+// offer picks an address for mac: its current lease, else the requested IP
+// when free, else the first free address. The pick is held briefly.
+func (s *Server) offer(mac string, requested net.IP) (net.IP, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+
+	offset := -1
+	for off, l := range s.leases {
+		if l.MAC == mac {
+			offset = off
+			break
+		}
+	}
+	if offset < 0 {
+		if off, ok := s.offset(requested); ok && s.freeLocked(off, mac, now) {
+			offset = off
+		}
+	}
+	if offset < 0 {
+		for off := 0; off < s.size; off++ {
+			if s.freeLocked(off, mac, now) {
+				offset = off
+				break
+			}
+		}
+	}
+	if offset < 0 {
+		return nil, false
+	}
+
+	l := s.leases[offset]
+	if l == nil || l.MAC != mac || !now.Before(l.Expiry) {
+		l = &Lease{IP: s.ipAt(offset), MAC: mac, Expiry: now.Add(offerHold), offered: true}
+		s.leases[offset] = l
+	}
+	return l.IP, true
+}
+
+// commit turns a request into a lease. It fails when ip is outside the pool
+// or leased to another client.
+func (s *Server) commit(mac string, ip net.IP, hostname string) bool {
+	s.mu.Lock()
+	off, ok := s.offset(ip)
+	if !ok || !s.freeLocked(off, mac, s.now()) {
+		s.mu.Unlock()
+		return false
+	}
+	// A client moving to another address gives up its previous lease.
+	for o, l := range s.leases {
+		if l.MAC == mac && o != off {
+			delete(s.leases, o)
+		}
+	}
+	l := &Lease{IP: s.ipAt(off), MAC: mac, Hostname: hostname, Expiry: s.now().Add(s.cfg.Lease)}
+	if hostname == "" {
+		if prev := s.leases[off]; prev != nil && prev.MAC == mac {
+			l.Hostname = prev.Hostname
+		}
+	}
+	s.leases[off] = l
+	s.mu.Unlock()
+
+	s.persist()
+	return true
+}
+
+func (s *Server) release(mac string, ip net.IP) {
+	s.mu.Lock()
+	off, ok := s.offset(ip)
+	if !ok || s.leases[off] == nil || s.leases[off].MAC != mac {
+		s.mu.Unlock()
+		return
+	}
+	delete(s.leases, off)
+	s.mu.Unlock()
+	s.persist()
+}
+
+func (s *Server) decline(mac string, ip net.IP) {
+	s.mu.Lock()
+	off, ok := s.offset(ip)
+	if !ok || s.leases[off] == nil || s.leases[off].MAC != mac {
+		s.mu.Unlock()
+		return
+	}
+	s.leases[off] = &Lease{IP: s.ipAt(off), Expiry: s.now().Add(declineHold)}
+	s.mu.Unlock()
+	slog.Warn("dhcp address declined, holding it out of the pool", "ip", ip, "mac", mac)
+	s.persist()
+}
+
+// freeLocked reports whether the address at off can be given to mac.
+func (s *Server) freeLocked(off int, mac string, now time.Time) bool {
+	if ip := s.ipAt(off); ip.Equal(s.cfg.ServerIP) || ip.Equal(s.cfg.Gateway) {
+		return false
+	}
+	l := s.leases[off]
+	return l == nil || l.MAC == mac || !now.Before(l.Expiry)
+}
+
+func (s *Server) offset(ip net.IP) (int, bool) {
+	ip = ip.To4()
+	if ip == nil {
+		return 0, false
+	}
+	off := dhcp4.IPRange(s.start, ip) - 1
+	if off < 0 || off >= s.size {
+		return 0, false
+	}
+	return off, true
+}
+
+func (s *Server) ipAt(off int) net.IP {
+	return dhcp4.IPAdd(s.start, off).To4()
+}
+
+// Leases returns the active leases ordered by address. Offers that were
+// never confirmed and declined addresses are omitted.
+func (s *Server) Leases() []Lease {
+	return s.snapshot(false)
+}
+
+// snapshot returns the active leases ordered by address, and with holds
+// also the declined addresses, which carry no MAC.
+func (s *Server) snapshot(holds bool) []Lease {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+
+	out := make([]Lease, 0, len(s.leases))
+	for _, l := range s.leases {
+		if (l.MAC != "" || holds) && !l.offered && now.Before(l.Expiry) {
+			out = append(out, *l)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return bytes.Compare(out[i].IP, out[j].IP) < 0 })
+	return out
+}
+
+// Hostname returns the hostname a client announced in its lease, or empty.
+func (s *Server) Hostname(_ context.Context, ip string) string {
+	off, ok := s.offset(net.ParseIP(ip))
+	if !ok {
+		return ""
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if l := s.leases[off]; l != nil && !l.offered && s.now().Before(l.Expiry) {
+		return l.Hostname
+	}
+	return ""
+}
+
+// persist writes the leases and declined-address holds to the lease file.
+// A failed write is logged: the in-memory leases stay authoritative until
+// the next successful write.
+func (s *Server) persist() {
+	if s.cfg.LeaseFile == "" {
+		return
+	}
+	data, err := json.Marshal(s.snapshot(true))
+	if err == nil {
+		err = fsutil.WriteFileAtomic(s.cfg.LeaseFile, data)
+	}
+	if err != nil {
+		slog.Warn("save dhcp leases", "error", err, "file", s.cfg.LeaseFile)
+	}
+}
+
+func (s *Server) load() error {
+	data, err := os.ReadFile(s.cfg.LeaseFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("read dhcp leases %s: %w", s.cfg.LeaseFile, err)
+	}
+	var leases []Lease
+	if err := json.Unmarshal(data, &leases); err != nil {
+		return fmt.Errorf("parse dhcp leases %s: %w", s.cfg.LeaseFile, err)
+	}
+	// Leases outside a changed range are dropped one by one. An entry
+	// without a MAC is a declined address still on hold.
+	now := s.now()
+	for _, l := range leases {
+		off, ok := s.offset(l.IP)
+		if !ok || !now.Before(l.Expiry) {
+			continue
+		}
+		l.IP = s.ipAt(off)
+		s.leases[off] = &l
+	}
+	if len(s.leases) > 0 {
+		slog.Info("restored dhcp leases", "count", len(s.leases), "file", s.cfg.LeaseFile)
+	}
+	return nil
+}
+
+// sanitizeHostname keeps a client-announced hostname displayable: option 12
+// is free-form and may carry a trailing NUL or a domain suffix.
+func sanitizeHostname(name string) string {
+	name = strings.TrimRight(name, "\x00")
+	name, _, _ = strings.Cut(name, ".")
+	name = strings.TrimSpace(name)
+	if len(name) > 63 {
+		name = name[:63]
+	}
+	for _, c := range name {
+		if c < 0x20 || c == 0x7f {
+			return ""
+		}
+	}
+	return name
+}
@@ -0,0 +1,166 @@
+package dhcp_test
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/krolaw/dhcp4"
+	"github.com/sower-proxy/sower/pkg/dhcp"
+)
+
+func newTestServer(t *testing.T, leaseFile string) *dhcp.Server {
+	t.Helper()
+	srv, err := dhcp.NewServer(dhcp.ServerConfig{
+		ServerIP:   net.IPv4(192, 168, 1, 2),
+		Netmask:    net.IPv4Mask(255, 255, 255, 0),
+		Gateway:    net.IPv4(192, 168, 1, 1),
+		RangeStart: net.IPv4(192, 168, 1, 100),
+		RangeEnd:   net.IPv4(192, 168, 1, 101),
+		Lease:      time.Hour,
+		LeaseFile:  leaseFile,
+	})
+	if err != nil {
+		t.Fatalf("new server: %v", err)
+	}
+	return srv
+}
+
+// exchange sends one client message through the handler and returns the
+// reply with its parsed options.
+func exchange(t *testing.T, srv *dhcp.Server, mt dhcp4.MessageType, mac string, opts ...dhcp4.Option) (dhcp4.Packet, dhcp4.Options) {
+	t.Helper()
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		t.Fatalf("parse mac: %v", err)
+	}
+	req := dhcp4.RequestPacket(mt, hw, nil, []byte{1, 2, 3, 4}, true, opts)
+	reqOpts := req.ParseOptions()
+	reply := srv.ServeDHCP(req, mt, reqOpts)
+	if reply == nil {
+		return nil, nil
+	}
+	return reply, reply.ParseOptions()
+}
+
+func lease(t *testing.T, srv *dhcp.Server, mac, hostname string) net.IP {
+	t.Helper()
+	offer, _ := exchange(t, srv, dhcp4.Discover, mac)
+	if offer == nil {
+		t.Fatalf("%s: no offer", mac)
+	}
+	ip := append(net.IP(nil), offer.YIAddr()...)
+	ack, opts := exchange(t, srv, dhcp4.Request, mac,
+		dhcp4.Option{Code: dhcp4.OptionRequestedIPAddress, Value: ip.To4()},
+		dhcp4.Option{Code: dhcp4.OptionServerIdentifier, Value: net.IPv4(192, 168, 1, 2).To4()},
+		dhcp4.Option{Code: dhcp4.OptionHostName, Value: []byte(hostname)},
+	)
+	if ack == nil || dhcp4.MessageType(opts[dhcp4.OptionDHCPMessageType][0]) != dhcp4.ACK {
+		t.Fatalf("%s: request for %s not acknowledged", mac, ip)
+	}
+	return ip
+}
+
+func TestServerLeasesCarrySowerDNS(t *testing.T) {
+	t.Parallel()
+
+	srv := newTestServer(t, "")
+	offer, opts := exchange(t, srv, dhcp4.Discover, "aa:bb:cc:00:00:01")
+	if offer == nil {
+		t.Fatal("expected offer")
+	}
+	if got := offer.YIAddr(); !got.Equal(net.IPv4(192, 168, 1, 100)) {
+		t.Fatalf("offered %s, want 192.168.1.100", got)
+	}
+	if got := net.IP(opts[dhcp4.OptionDomainNameServer]); !got.Equal(net.IPv4(192, 168, 1, 2)) {
+		t.Fatalf("dns option = %s, want sower ip", got)
+	}
+	if got := net.IP(opts[dhcp4.OptionRouter]); !got.Equal(net.IPv4(192, 168, 1, 1)) {
+		t.Fatalf("router option = %s, want gateway", got)
+	}
+}
+
+func TestServerRejectsAddressLeasedToAnotherClient(t *testing.T) {
+	t.Parallel()
+
+	srv := newTestServer(t, "")
+	first := lease(t, srv, "aa:bb:cc:00:00:01", "laptop")
+	second := lease(t, srv, "aa:bb:cc:00:00:02", "phone")
+	if first.Equal(second) {
+		t.Fatalf("both clients leased %s", first)
+	}
+
+	nak, opts := exchange(t, srv, dhcp4.Request, "aa:bb:cc:00:00:02",
+		dhcp4.Option{Code: dhcp4.OptionRequestedIPAddress, Value: first.To4()})
+	if nak == nil || dhcp4.MessageType(opts[dhcp4.OptionDHCPMessageType][0]) != dhcp4.NAK {
+		t.Fatal("expected NAK for an address leased to another client")
+	}
+
+	// The two-address pool is full: a third client gets no offer.
+	if offer, _ := exchange(t, srv, dhcp4.Discover, "aa:bb:cc:00:00:03"); offer != nil {
+		t.Fatalf("unexpected offer %s from an exhausted pool", offer.YIAddr())
+	}
+}
+
+func TestServerPersistsLeasesAndHostnames(t *testing.T) {
+	t.Parallel()
+
+	file := filepath.Join(t.TempDir(), "leases.json")
+	srv := newTestServer(t, file)
+	ip := lease(t, srv, "aa:bb:cc:00:00:01", "laptop.lan")
+
+	reloaded := newTestServer(t, file)
+	if got := reloaded.Hostname(context.Background(), ip.String()); got != "laptop" {
+		t.Fatalf("hostname after reload = %q, want laptop", got)
+	}
+	leases := reloaded.Leases()
+	if len(leases) != 1 || leases[0].MAC != "aa:bb:cc:00:00:01" || !leases[0].IP.Equal(ip) {
+		t.Fatalf("leases after reload = %+v", leases)
+	}
+
+	// The same client gets its address back after a restart.
+	offer, _ := exchange(t, reloaded, dhcp4.Discover, "aa:bb:cc:00:00:01")
+	if offer == nil || !offer.YIAddr().Equal(ip) {
+		t.Fatalf("re-offer after reload = %v, want %s", offer, ip)
+	}
+}
+
+func TestServerReleaseFreesAddress(t *testing.T) {
+	t.Parallel()
+
+	srv := newTestServer(t, "")
+	ip := lease(t, srv, "aa:bb:cc:00:00:01", "laptop")
+
+	hw, _ := net.ParseMAC("aa:bb:cc:00:00:01")
+	release := dhcp4.RequestPacket(dhcp4.Release, hw, ip, []byte{1, 2, 3, 5}, false, nil)
+	srv.ServeDHCP(release, dhcp4.Release, release.ParseOptions())
+
+	if got := srv.Hostname(context.Background(), ip.String()); got != "" {
+		t.Fatalf("hostname after release = %q, want empty", got)
+	}
+	if leases := srv.Leases(); len(leases) != 0 {
+		t.Fatalf("leases after release = %+v", leases)
+	}
+}
+
+func TestServerPersistsDeclinedAddressHold(t *testing.T) {
+	t.Parallel()
+
+	file := filepath.Join(t.TempDir(), "leases.json")
+	srv := newTestServer(t, file)
+	ip := lease(t, srv, "aa:bb:cc:00:00:01", "laptop")
+	exchange(t, srv, dhcp4.Decline, "aa:bb:cc:00:00:01",
+		dhcp4.Option{Code: dhcp4.OptionRequestedIPAddress, Value: ip.To4()})
+
+	// After a restart the conflicting address is still held out of the pool.
+	reloaded := newTestServer(t, file)
+	if leases := reloaded.Leases(); len(leases) != 0 {
+		t.Fatalf("leases after reload = %+v", leases)
+	}
+	offer, _ := exchange(t, reloaded, dhcp4.Discover, "aa:bb:cc:00:00:02")
+	if offer == nil || offer.YIAddr().Equal(ip) {
+		t.Fatalf("offer after reload = %v, want an address other than %s", offer, ip)
+	}
+}
@@ -0,0 +1,68 @@
+// Package ratelimit provides a byte token bucket for shaping relayed
+// traffic.
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// minBurst keeps a slow bucket able to pass one relay buffer without
+// first building up a deficit.
+const minBurst = 32 << 10
+
+// Bucket is a token bucket of bytes. It refills at its rate up to one
+// second's worth of tokens (at least minBurst). A caller that takes more
+// tokens than are left runs the bucket into debt and sleeps it off, so
+// concurrent flows share the rate without a wait queue. It is safe for
+// concurrent use.
+type Bucket struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second
+	burst  float64
+	tokens float64
+	last   time.Time
+	now    func() time.Time
+}
+
+// New returns a bucket passing bytesPerSec on average, starting full.
+// bytesPerSec must be positive.
+func New(bytesPerSec int64) *Bucket {
+	burst := float64(max(bytesPerSec, minBurst))
+	return &Bucket{
+		rate:   float64(bytesPerSec),
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+		now:    time.Now,
+	}
+}
+
+// Rate returns the refill rate in bytes per second.
+func (b *Bucket) Rate() int64 {
+	return int64(b.rate)
+}
+
+// Reserve takes n tokens and returns how long the caller must wait before
+// using them.
+func (b *Bucket) Reserve(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = min(b.burst, b.tokens+elapsed.Seconds()*b.rate)
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// Wait takes n tokens, sleeping until they are available.
+func (b *Bucket) Wait(n int) {
+	if d := b.Reserve(n); d > 0 {
+		time.Sleep(d)
+	}
+}
@@ -0,0 +1,46 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBucketReserve(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	now := start
+	b := New(64 << 10)
+	b.now = func() time.Time { return now }
+	b.last = start
+
+	// A full bucket passes one second's worth at once.
+	if d := b.Reserve(64 << 10); d != 0 {
+		t.Fatalf("reserve from full bucket waited %v", d)
+	}
+	// Running into debt waits the deficit off at the rate.
+	if d := b.Reserve(32 << 10); d != 500*time.Millisecond {
+		t.Fatalf("reserve into debt waited %v, want 500ms", d)
+	}
+	// The debt carries over to the next caller.
+	now = now.Add(250 * time.Millisecond)
+	if d := b.Reserve(16 << 10); d != 500*time.Millisecond {
+		t.Fatalf("reserve after partial refill waited %v, want 500ms", d)
+	}
+	// Refill stops at the burst.
+	now = now.Add(time.Hour)
+	if d := b.Reserve(64 << 10); d != 0 {
+		t.Fatalf("reserve after long idle waited %v", d)
+	}
+	if d := b.Reserve(1); d == 0 {
+		t.Fatal("bucket refilled past its burst")
+	}
+}
+
+func TestBucketMinimumBurst(t *testing.T) {
+	b := New(1 << 10)
+	if d := b.Reserve(minBurst); d != 0 {
+		t.Fatalf("slow bucket cannot pass one relay buffer: waited %v", d)
+	}
+	if b.Rate() != 1<<10 {
+		t.Fatalf("rate = %d", b.Rate())
+	}
+}
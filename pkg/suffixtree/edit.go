@@ -0,0 +1,170 @@
+package suffixtree
+
+import (
+	"maps"
+	"slices"
+	"strings"
+)
+
+// Editor applies a batch of adds and removes to a copy of a tree while the
+// original keeps serving Match. Only the nodes on an edited path are
+// copied, once per batch, so a batch costs its own rules plus the fan-out
+// of the nodes they pass through, never a rebuild of the tree.
+type Editor struct {
+	root *Node
+	edit *editToken
+}
+
+// editToken identifies an Editor batch in the nodes it owns. It is not
+// zero-sized, so every batch gets a distinct address.
+type editToken struct{ _ byte }
+
+// Edit starts a batch of changes on a copy of n. n itself is never
+// modified and may be matched concurrently with the Editor.
+func (n *Node) Edit() *Editor {
+	e := &Editor{edit: &editToken{}}
+	e.root = &Node{node: n.node.mutable(e.edit), sep: n.sep}
+	return e
+}
+
+// Add inserts item, like Node.Add.
+func (e *Editor) Add(item string) {
+	e.root.add(strings.Split(e.root.trim(item), e.root.sep), item, e.edit)
+}
+
+// Remove deletes the rule added as item, matched by its raw text as
+// MatchRule reports it, and prunes the branches it leaves empty. Other
+// rules that normalize to the same labels keep matching. It reports
+// whether the rule was found.
+func (e *Editor) Remove(item string) bool {
+	if item == "" {
+		return false
+	}
+	root, ok := e.root.remove(strings.Split(e.root.trim(item), e.root.sep), item, e.edit)
+	e.root.node = root
+	return ok
+}
+
+// Node compacts the copied nodes and returns the edited tree. The Editor
+// must not be used afterwards.
+func (e *Editor) Node() *Node {
+	n := e.root
+	n.compact(e.edit)
+	e.root = nil
+	return n
+}
+
+// mutable returns n when it may be changed under edit, i.e. outside any
+// batch or when the batch created it, and a copy owned by edit otherwise.
+func (n *node) mutable(edit *editToken) *node {
+	if edit == nil || n.edit == edit {
+		return n
+	}
+	return &node{
+		secs:     GCSlice(n.secs),
+		subNodes: GCSlice(n.subNodes),
+		indexMap: maps.Clone(n.indexMap),
+		rule:     n.rule,
+		edit:     edit,
+	}
+}
+
+// child returns the idx-th child of n ready for changes under edit; n must
+// be mutable itself.
+func (n *node) child(idx int, edit *editToken) *node {
+	sub := n.subNodes[idx].mutable(edit)
+	n.subNodes[idx] = sub
+	return sub
+}
+
+// remove deletes the marker add left for rule along secs. It returns n, or
+// its copy under edit, with the emptied branches pruned, and n unchanged
+// when rule is not found.
+func (n *node) remove(secs []string, rule string, edit *editToken) (*node, bool) {
+	length := len(secs)
+	if length == 0 {
+		return n, false
+	}
+	if length == 1 && secs[0] == "" && n.rule == rule {
+		// hoist moved the marker up from the "" child.
+		n = n.mutable(edit)
+		n.rule = ""
+		n.hoist()
+		return n, true
+	}
+	sec := secs[length-1]
+	if length > 1 && sec == "**" {
+		sec = "*"
+	}
+	idx := n.index(sec)
+	if idx < 0 || n.subNodes[idx] == nil {
+		return n, false
+	}
+
+	sub, ok := n.subNodes[idx], true
+	switch {
+	case length == 1 && sub.rule == rule:
+		sub = sub.mutable(edit)
+		sub.rule = ""
+		sub.hoist()
+	case length == 1:
+		// The label already existed when rule was added, so its marker
+		// is a "" child.
+		sub, ok = sub.remove([]string{""}, rule, edit)
+	default:
+		sub, ok = sub.remove(secs[:length-1], rule, edit)
+	}
+	if !ok {
+		return n, false
+	}
+
+	n = n.mutable(edit)
+	if sub.rule == "" && len(sub.secs) == 0 {
+		n.removeAt(idx)
+	} else {
+		n.subNodes[idx] = sub
+	}
+	return n, true
+}
+
+// hoist moves the rule of the "" marker child up into n after n lost its
+// own, so MatchRule, which looks one marker deep, still reports a variant
+// of the removed rule (case or trailing dot) that remains.
+func (n *node) hoist() {
+	idx := n.index("")
+	if idx < 0 {
+		return
+	}
+	m := n.subNodes[idx]
+	if m.rule == "" || len(m.secs) > 1 || len(m.secs) == 1 && m.secs[0] != "" {
+		return
+	}
+	n.rule = m.rule
+	if len(m.secs) == 1 {
+		n.subNodes[idx] = m.subNodes[0]
+	} else {
+		n.removeAt(idx)
+	}
+}
+
+func (n *node) removeAt(idx int) {
+	n.secs = slices.Delete(n.secs, idx, idx+1)
+	n.subNodes = slices.Delete(n.subNodes, idx, idx+1)
+	n.indexMap = nil
+	n.ensureIndexMap()
+}
+
+// compact trims the slices of the nodes owned by edit, the counterpart of
+// GC for a batch; shared nodes are matched concurrently and left alone.
+func (n *node) compact(edit *editToken) {
+	if n == nil || n.edit != edit {
+		return
+	}
+	if cap(n.secs) != len(n.secs) || cap(n.subNodes) != len(n.subNodes) {
+		n.secs = GCSlice(n.secs)
+		n.subNodes = GCSlice(n.subNodes)
+	}
+	for _, sub := range n.subNodes {
+		sub.compact(edit)
+	}
+}
@@ -19,6 +19,9 @@ type node struct {
 	// single-label rule, a "" marker child, or a "**" wildcard child);
 	// empty for intermediate nodes. It backs MatchRule's fast path.
 	rule string
+	// edit is the Editor batch that created this node, which may change it
+	// in place; nodes of any other batch are shared and copied first.
+	edit *editToken
 }
 
 func NewNodeFromRules(rules ...string) *Node {
@@ -62,11 +65,13 @@ func (n *Node) trim(item string) string {
 	return strings.ToLower(strings.TrimRight(item, n.sep))
 }
 
+// Add inserts item in place; it must not race with Match. Use Edit to
+// change a tree that is being matched concurrently.
 func (n *Node) Add(item string) {
 	n.Count++
-	n.add(strings.Split(n.trim(item), n.sep), item)
+	n.add(strings.Split(n.trim(item), n.sep), item, nil)
 }
-func (n *node) add(secs []string, rule string) {
+func (n *node) add(secs []string, rule string, edit *editToken) {
 	length := len(secs)
 	switch length {
 	case 0:
@@ -74,16 +79,16 @@ func (n *node) add(secs []string, rule string) {
 		sec := secs[length-1]
 		if idx := n.index(sec); idx >= 0 {
 			if n.subNodes[idx] != nil {
-				n.subNodes[idx].add([]string{""}, rule)
+				n.child(idx, edit).add([]string{""}, rule, edit)
 			}
 			return
 		}
 
 		switch sec {
 		case "", "*", "**":
-			n.prepend(sec, &node{rule: rule})
+			n.prepend(sec, &node{rule: rule, edit: edit})
 		default:
-			n.append(sec, &node{rule: rule})
+			n.append(sec, &node{rule: rule, edit: edit})
 		}
 	default:
 		sec := secs[length-1]
@@ -95,17 +100,17 @@ func (n *node) add(secs []string, rule string) {
 		if idx == -1 {
 			switch sec {
 			case "", "*", "**":
-				idx = n.prepend(sec, &node{})
+				idx = n.prepend(sec, &node{edit: edit})
 			default:
-				idx = n.append(sec, &node{})
+				idx = n.append(sec, &node{edit: edit})
 			}
 
 		} else if n.subNodes[idx] == nil {
-			n.subNodes[idx] = &node{}
-			n.subNodes[idx].add([]string{""}, rule)
+			n.subNodes[idx] = &node{edit: edit}
+			n.subNodes[idx].add([]string{""}, rule, edit)
 		}
 
-		n.subNodes[idx].add(secs[:length-1], rule)
+		n.child(idx, edit).add(secs[:length-1], rule, edit)
 	}
 }
 
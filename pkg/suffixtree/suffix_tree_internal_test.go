@@ -108,3 +108,34 @@ func BenchmarkSuffixTreeBuildAlloc(b *testing.B) {
 		NewNodeFromRules(rules...)
 	}
 }
+
+// TestEditorCopiesOnlyEditedPaths: an edit shares every untouched subtree
+// with the source, and removing all rules prunes the tree to its root.
+func TestEditorCopiesOnlyEditedPaths(t *testing.T) {
+	src := NewNodeFromRules("a.wweir.cc", "b.wweir.cc", "example.com")
+	e := src.Edit()
+	e.Add("c.wweir.cc")
+	got := e.Node()
+
+	if got.node == src.node {
+		t.Fatal("edit did not copy the root")
+	}
+	com := src.subNodes[src.index("com")]
+	if got.subNodes[got.index("com")] != com {
+		t.Fatal("untouched subtree was copied")
+	}
+	if got.subNodes[got.index("cc")] == src.subNodes[src.index("cc")] {
+		t.Fatal("edited path shares the source node")
+	}
+
+	e = got.Edit()
+	for _, rule := range []string{"a.wweir.cc", "b.wweir.cc", "c.wweir.cc", "example.com"} {
+		e.Remove(rule)
+	}
+	if empty := e.Node(); len(empty.secs) != 0 {
+		t.Fatalf("expected an empty root, got %v", empty.secs)
+	}
+	if !got.Match("c.wweir.cc") {
+		t.Fatal("remove changed the published tree")
+	}
+}
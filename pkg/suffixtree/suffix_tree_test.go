@@ -208,3 +208,90 @@ func TestNode_Match(t *testing.T) {
 		})
 	}
 }
+
+// TestEditor_Remove checks an edited tree against one built from the
+// remaining rules, and that the source tree keeps its old answers.
+func TestEditor_Remove(t *testing.T) {
+	rules := []string{
+		"wweir.cc", "a.wweir.cc", "*.wweir.cc", "**.wweir.cc",
+		"example.com", "Example.com", "example.com.", ".example.com",
+		"a.*.cc", "x.**.net", "**.net", "b.com", "a.b.com",
+	}
+	probes := []string{
+		"wweir.cc", "a.wweir.cc", "b.wweir.cc", "a.b.wweir.cc",
+		"example.com", "a.example.com", "a.x.cc", "x.y.net", "net",
+		"b.com", "a.b.com", "x.b.com", "cc",
+	}
+	tests := []struct {
+		name   string
+		remove []string
+	}{
+		{"leaf", []string{"a.b.com"}},
+		{"parent of a leaf", []string{"b.com"}},
+		{"wildcards", []string{"*.wweir.cc", "**.wweir.cc"}},
+		{"double star beside exact", []string{"**.net"}},
+		{"one variant", []string{"example.com"}},
+		{"two variants", []string{"Example.com", "example.com."}},
+		{"every variant", []string{"example.com", "Example.com", "example.com.", ".example.com"}},
+		{"every variant reversed", []string{".example.com", "example.com.", "Example.com", "example.com"}},
+		{"inner variant", []string{"Example.com", "example.com"}},
+		{"everything", rules},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := suffixtree.NewNodeFromRules(rules...)
+			e := src.Edit()
+			for _, rule := range tt.remove {
+				if !e.Remove(rule) {
+					t.Fatalf("Remove(%q) = false", rule)
+				}
+				if e.Remove(rule) {
+					t.Fatalf("second Remove(%q) = true", rule)
+				}
+			}
+			got := e.Node()
+
+			removed := make(map[string]bool)
+			for _, rule := range tt.remove {
+				removed[rule] = true
+			}
+			var kept []string
+			for _, rule := range rules {
+				if !removed[rule] {
+					kept = append(kept, rule)
+				}
+			}
+			want := suffixtree.NewNodeFromRules(kept...)
+			orig := suffixtree.NewNodeFromRules(rules...)
+			for _, p := range probes {
+				if g, w := got.Match(p), want.Match(p); g != w {
+					t.Errorf("Match(%q) = %v, want %v", p, g, w)
+				}
+				if r, g := got.MatchRule(p); g != want.Match(p) || removed[r] {
+					t.Errorf("MatchRule(%q) = (%q, %v), want a kept rule: %v", p, r, g, want.Match(p))
+				}
+				if g, w := src.Match(p), orig.Match(p); g != w {
+					t.Errorf("source Match(%q) = %v after edit, want %v", p, g, w)
+				}
+			}
+		})
+	}
+}
+
+func TestEditor_Add(t *testing.T) {
+	src := suffixtree.NewNodeFromRules("a.wweir.cc")
+	e := src.Edit()
+	e.Add("b.wweir.cc")
+	e.Add("**.example.com")
+	got := e.Node()
+
+	if !got.Match("a.wweir.cc") || !got.Match("b.wweir.cc") || !got.Match("x.y.example.com") {
+		t.Fatal("edited tree misses an added rule")
+	}
+	if src.Match("b.wweir.cc") || src.Match("x.example.com") {
+		t.Fatal("Edit changed the source tree")
+	}
+	if r, ok := got.MatchRule("b.wweir.cc"); !ok || r != "b.wweir.cc" {
+		t.Fatalf("MatchRule = (%q, %v), want b.wweir.cc", r, ok)
+	}
+}
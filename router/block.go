@@ -0,0 +1,108 @@
+package router
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// DNSBlockMode selects how ServeDNS answers a name matched by a block rule.
+type DNSBlockMode string
+
+const (
+	// DNSBlockNXDomain answers NXDOMAIN. It is the default.
+	DNSBlockNXDomain DNSBlockMode = "nxdomain"
+	// DNSBlockRefused answers REFUSED.
+	DNSBlockRefused DNSBlockMode = "refused"
+	// DNSBlockNull answers 0.0.0.0 or ::, so clients fail fast locally
+	// instead of retrying other resolvers on an error rcode.
+	DNSBlockNull DNSBlockMode = "null"
+	// DNSBlockSowerIP answers the sower serve IP, so plain-HTTP visits land
+	// on the transparent HTTP listener, which serves a block page.
+	DNSBlockSowerIP DNSBlockMode = "sower"
+)
+
+// ParseDNSBlockMode parses a configured block mode; an empty string selects
+// DNSBlockNXDomain.
+func ParseDNSBlockMode(s string) (DNSBlockMode, error) {
+	switch mode := DNSBlockMode(strings.ToLower(strings.TrimSpace(s))); mode {
+	case "":
+		return DNSBlockNXDomain, nil
+	case DNSBlockNXDomain, DNSBlockRefused, DNSBlockNull, DNSBlockSowerIP:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown dns block mode %q", s)
+	}
+}
+
+// SetDNSBlockMode selects the DNS answer for blocked names. It must be called
+// before serving.
+func (r *Router) SetDNSBlockMode(mode DNSBlockMode) {
+	r.blockMode = mode
+}
+
+// DNSBlockMode returns the configured block answer mode.
+func (r *Router) DNSBlockMode() DNSBlockMode {
+	if r.blockMode == "" {
+		return DNSBlockNXDomain
+	}
+	return r.blockMode
+}
+
+// BlockingRule returns the block rule that matches host, if any. A fake-IP
+// host is mapped back to its domain first.
+func (r *Router) BlockingRule(host string) (string, bool) {
+	host = strings.ToLower(strings.TrimSuffix(strings.Trim(host, "[]"), "."))
+	if domain, ok := r.FakeIPDomain(host); ok {
+		host = domain
+	}
+	if host == "" {
+		return "", false
+	}
+	return r.BlockRule.MatchRule(host)
+}
+
+// dnsBlockReply builds the answer for a blocked query. The address modes
+// answer only A/AAAA; other types get NODATA, since an error rcode would
+// make some stub resolvers discard the address answer as well.
+func (r *Router) dnsBlockReply(domain string, localAddr net.Addr, req *dns.Msg) *dns.Msg {
+	qtype := req.Question[0].Qtype
+	mode := r.DNSBlockMode()
+	switch mode {
+	case DNSBlockRefused:
+		return r.dnsFail(req, dns.RcodeRefused)
+	case DNSBlockNull, DNSBlockSowerIP:
+	default:
+		return r.dnsFail(req, dns.RcodeNameError)
+	}
+
+	reply := dnsReply(req)
+	if !isAddressQuestion(qtype) {
+		return reply
+	}
+
+	var ip net.IP
+	if mode == DNSBlockNull {
+		ip = net.IPv4zero
+		if qtype == dns.TypeAAAA {
+			ip = net.IPv6unspecified
+		}
+	} else {
+		var err error
+		ip, err = r.proxyReplyIP(localAddr, qtype)
+		if err != nil {
+			// No serve IP of this family: NODATA keeps the client on the
+			// family that does reach the block page.
+			return reply
+		}
+	}
+
+	record, err := proxyReplyRecord(domain, qtype, ip)
+	if err != nil {
+		return reply
+	}
+	reply.Answer = []dns.RR{record}
+	return reply
+}
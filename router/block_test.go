@@ -0,0 +1,85 @@
+package router
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestServeDNSBlockModes(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		mode      DNSBlockMode
+		qtype     uint16
+		wantRcode int
+		wantIP    string // empty expects no answer
+	}{
+		{mode: DNSBlockNXDomain, qtype: dns.TypeA, wantRcode: dns.RcodeNameError},
+		{mode: DNSBlockRefused, qtype: dns.TypeA, wantRcode: dns.RcodeRefused},
+		{mode: DNSBlockNull, qtype: dns.TypeA, wantRcode: dns.RcodeSuccess, wantIP: "0.0.0.0"},
+		{mode: DNSBlockNull, qtype: dns.TypeAAAA, wantRcode: dns.RcodeSuccess, wantIP: "::"},
+		{mode: DNSBlockNull, qtype: dns.TypeMX, wantRcode: dns.RcodeSuccess},
+		{mode: DNSBlockSowerIP, qtype: dns.TypeA, wantRcode: dns.RcodeSuccess, wantIP: "10.0.0.1"},
+		// No IPv6 serve address: NODATA rather than an unreachable answer.
+		{mode: DNSBlockSowerIP, qtype: dns.TypeAAAA, wantRcode: dns.RcodeSuccess},
+	}
+	for _, tt := range tests {
+		r := newTestRouter(t, []string{"10.0.0.1"}, "", "223.5.5.5", "", nil)
+		r.BlockRule = NewRuleSet("**.ads.example")
+		r.SetDNSBlockMode(tt.mode)
+
+		req := new(dns.Msg)
+		req.SetQuestion("tracker.ads.example.", tt.qtype)
+		writer := &mockDNSWriter{localAddr: &net.UDPAddr{IP: net.ParseIP("0.0.0.0"), Port: 53}}
+		r.ServeDNS(writer, req)
+
+		name := string(tt.mode) + "/" + dns.TypeToString[tt.qtype]
+		if writer.msg == nil {
+			t.Fatalf("%s: expected response message", name)
+		}
+		if writer.msg.Rcode != tt.wantRcode {
+			t.Fatalf("%s: rcode = %s, want %s", name, dns.RcodeToString[writer.msg.Rcode], dns.RcodeToString[tt.wantRcode])
+		}
+		ips := answerIPs(writer.msg)
+		if tt.wantIP == "" {
+			if len(writer.msg.Answer) != 0 {
+				t.Fatalf("%s: expected no answer, got %v", name, writer.msg.Answer)
+			}
+			continue
+		}
+		if len(ips) != 1 || ips[0].String() != tt.wantIP {
+			t.Fatalf("%s: answer = %v, want %s", name, ips, tt.wantIP)
+		}
+	}
+}
+
+func TestParseDNSBlockMode(t *testing.T) {
+	t.Parallel()
+
+	if mode, err := ParseDNSBlockMode(""); err != nil || mode != DNSBlockNXDomain {
+		t.Fatalf("empty mode = %q, %v; want nxdomain", mode, err)
+	}
+	if mode, err := ParseDNSBlockMode(" Sower "); err != nil || mode != DNSBlockSowerIP {
+		t.Fatalf("sower mode = %q, %v; want sower", mode, err)
+	}
+	if _, err := ParseDNSBlockMode("drop"); err == nil {
+		t.Fatal("expected error for unknown mode")
+	}
+}
+
+func TestBlockingRuleReportsMatchedRule(t *testing.T) {
+	t.Parallel()
+
+	r := newTestRouter(t, []string{"10.0.0.1"}, "", "223.5.5.5", "", nil)
+	r.BlockRule = NewRuleSet("**.ads.example")
+
+	rule, ok := r.BlockingRule("Tracker.Ads.Example.")
+	if !ok || rule != "**.ads.example" {
+		t.Fatalf("BlockingRule = %q, %v; want **.ads.example", rule, ok)
+	}
+	if _, ok := r.BlockingRule("example.com"); ok {
+		t.Fatal("unexpected block match for example.com")
+	}
+}
@@ -34,25 +34,31 @@ func (r *Router) localSite(ctx context.Context, domain string) bool {
 }
 
 func (r *Router) localIP(domain string, ip net.IP) bool {
-	// CIDR match
+	cidr, country, err := r.ipLocation(ip)
+	if err != nil {
+		slog.Warn("mmdb search", "error", err, "domain", domain, "ip", ip)
+		return false
+	}
+	return cidr != nil || country == "CN"
+}
+
+// ipLocation returns the country CIDR that contains ip, or else its GeoIP
+// country code; both are empty without CIDRs and GeoIP database.
+func (r *Router) ipLocation(ip net.IP) (*net.IPNet, string, error) {
 	for _, cidr := range r.country.cidrs {
 		if cidr.Contains(ip) {
-			return true
+			return cidr, "", nil
 		}
 	}
 
 	r.country.RLock()
-	reader := r.country.Reader
-	if reader == nil {
-		r.country.RUnlock()
-		return false
+	defer r.country.RUnlock()
+	if r.country.Reader == nil {
+		return nil, "", nil
 	}
-	city, err := reader.City(ip)
-	r.country.RUnlock()
+	city, err := r.country.Reader.City(ip)
 	if err != nil {
-		slog.Warn("mmdb search", "error", err, "domain", domain, "ip", ip)
-		return false
+		return nil, "", err
 	}
-
-	return city.Country.IsoCode == "CN"
+	return nil, city.Country.IsoCode, nil
 }
@@ -7,6 +7,7 @@ import (
 	"net"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/miekg/dns"
@@ -23,24 +24,44 @@ func (e retryableDNSError) Error() string {
 }
 
 func (r *Router) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	start := time.Now()
+	resp, decision, upstream := r.serveDNS(w, req)
+	_ = w.WriteMsg(resp)
+
+	if r.dnsQueryObserver != nil {
+		q := DNSQuery{
+			Client:   ClientIPOf(req, w.RemoteAddr()),
+			Decision: decision,
+			Upstream: upstream,
+			Rcode:    resp.Rcode,
+			Duration: time.Since(start),
+		}
+		if len(req.Question) > 0 {
+			q.Domain = req.Question[0].Name
+			q.Qtype = req.Question[0].Qtype
+		}
+		r.dnsQueryObserver(q)
+	}
+}
+
+// serveDNS answers one query and reports the decision that produced the
+// reply, plus the upstream that answered a forwarded query.
+func (r *Router) serveDNS(w dns.ResponseWriter, req *dns.Msg) (*dns.Msg, DNSDecision, string) {
 	// https://stackoverflow.com/questions/4082081/requesting-a-and-aaaa-records-in-single-dns-query/4083071#4083071
 	if len(req.Question) != 1 {
-		_ = w.WriteMsg(r.dnsFail(req, dns.RcodeFormatError))
-		return
+		return r.dnsFail(req, dns.RcodeFormatError), DNSInvalid, ""
 	}
 
 	domain := req.Question[0].Name
 	qtype := req.Question[0].Qtype
 	if req.Question[0].Qclass != dns.ClassINET {
-		_ = w.WriteMsg(r.dnsFail(req, dns.RcodeNotImplemented))
-		return
+		return r.dnsFail(req, dns.RcodeNotImplemented), DNSInvalid, ""
 	}
 
 	// 1. rule_based( block > direct > proxy )
 	routeDomains := dnsRouteDomains(domain, qtype)
 	if dnsRuleMatch(r.BlockRule, routeDomains) {
-		_ = w.WriteMsg(r.dnsFail(req, dns.RcodeNameError))
-		return
+		return r.dnsBlockReply(domain, w.LocalAddr(), req), DNSBlock, ""
 	}
 
 	// Internal reverse lookups (RFC1918, CGNAT, link-local, loopback, ULA)
@@ -52,47 +73,37 @@ func (r *Router) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 	// fallback.
 	if arpaIP, ok := parseReverseName(domain); ok && isInternalIP(arpaIP) {
 		if !r.dnsSelectedUpstreamIsInternal() {
-			_ = w.WriteMsg(r.dnsFail(req, dns.RcodeNameError))
-			return
+			return r.dnsFail(req, dns.RcodeNameError), DNSLocal, ""
 		}
 		addrs, index, _, err := r.currentUpstreamState(time.Now())
 		if err != nil || index < 0 || index >= len(addrs) || !isInternalHost(addrs[index]) {
-			_ = w.WriteMsg(r.dnsFail(req, dns.RcodeServerFailure))
-			return
+			return r.dnsFail(req, dns.RcodeServerFailure), DNSForwarded, ""
 		}
 		resp, err := r.exchangeWithRetry(req, addrs[index])
 		if err != nil {
-			_ = w.WriteMsg(r.dnsFail(req, dns.RcodeServerFailure))
-			return
+			return r.dnsFail(req, dns.RcodeServerFailure), DNSForwarded, addrs[index]
 		}
-		_ = w.WriteMsg(resp)
-		return
+		return resp, DNSForwarded, addrs[index]
 	}
 
 	if !dnsRuleMatch(r.DirectRule, routeDomains) && dnsRuleMatch(r.ProxyRule, routeDomains) {
-		switch {
-		case isAddressQuestion(qtype):
-			resp, err := r.dnsProxyReply(domain, w.LocalAddr(), req)
-			if err != nil {
-				slog.Warn("proxy dns", "error", err, "domain", domain)
-				_ = w.WriteMsg(r.dnsFail(req, dns.RcodeServerFailure))
-				return
-			}
-			_ = w.WriteMsg(resp)
-			return
-		default:
-			_ = w.WriteMsg(r.dnsNoData(req))
-			return
+		if !isAddressQuestion(qtype) {
+			return r.dnsNoData(req), DNSProxyLocal, ""
 		}
+		resp, err := r.dnsProxyReply(domain, w.LocalAddr(), req)
+		if err != nil {
+			slog.Warn("proxy dns", "error", err, "domain", domain)
+			return r.dnsFail(req, dns.RcodeServerFailure), DNSProxyLocal, ""
+		}
+		return resp, DNSProxyLocal, ""
 	}
 
 	// 2. direct query, do not fallback to proxy to avoid side-effect
-	resp, err := r.Exchange(req)
+	resp, upstream, err := r.exchange(req)
 	if err != nil {
-		_ = w.WriteMsg(r.dnsFail(req, dns.RcodeServerFailure))
-	} else {
-		_ = w.WriteMsg(resp)
+		return r.dnsFail(req, dns.RcodeServerFailure), DNSForwarded, upstream
 	}
+	return resp, DNSForwarded, upstream
 }
 
 func (r *Router) dnsFail(req *dns.Msg, rcode int) *dns.Msg {
@@ -116,7 +127,13 @@ func (r *Router) dnsProxyReply(domain string, localAddr net.Addr, req *dns.Msg)
 	qtype := req.Question[0].Qtype
 	reply := dnsReply(req)
 
-	localIP, err := r.proxyReplyIP(localAddr, qtype)
+	var localIP net.IP
+	var err error
+	if r.fakeIP != nil {
+		localIP, err = r.fakeIPReplyIP(domain, qtype)
+	} else {
+		localIP, err = r.proxyReplyIP(localAddr, qtype)
+	}
 	if err != nil {
 		if errors.Is(err, errNoLocalIPForQuestionType) {
 			return reply, nil
@@ -350,34 +367,50 @@ const (
 	dnsRefreshTTL    = 5 * time.Minute
 )
 
-func (r *Router) Exchange(req *dns.Msg) (_ *dns.Msg, err error) {
+func (r *Router) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	resp, _, err := r.exchange(req)
+	return resp, err
+}
+
+// exchange forwards req upstream and also returns the upstream address that
+// produced the final answer (or the last one tried on failure).
+func (r *Router) exchange(req *dns.Msg) (_ *dns.Msg, upstream string, err error) {
 	addrs, index, shouldProbe, gen, err := r.currentUpstreamStateWithGeneration(time.Now())
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
 	if shouldProbe {
+		start := time.Now()
 		resp, probeErr := r.exchangeWithRetry(req, addrs[0])
 		if probeErr == nil {
 			r.promoteUpstream(gen)
-			return resp, nil
+			return r.guardPoison(req, resp, addrs[0], time.Since(start)), addrs[0], nil
 		}
 		r.scheduleRetry(time.Now(), gen)
 	}
 
-	resp, err := r.exchangeWithRetry(req, addrs[index])
+	upstream = addrs[index]
+	start := time.Now()
+	resp, err := r.exchangeWithRetry(req, upstream)
 	if err != nil {
 		nextIndex, switched := r.degradeUpstream(index, gen, len(addrs))
 		if switched {
 			slog.Info("use upstream dns", "ip", addrs[nextIndex])
-			resp, err = r.exchangeWithRetry(req, addrs[nextIndex])
+			upstream = addrs[nextIndex]
+			start = time.Now()
+			resp, err = r.exchangeWithRetry(req, upstream)
 		}
 	}
+	rtt := time.Since(start)
 
 	if resp != nil && isRetryableDNSResponseErr(err) {
-		return resp, nil
+		return resp, upstream, nil
 	}
-	return resp, err
+	if err == nil {
+		resp = r.guardPoison(req, resp, upstream, rtt)
+	}
+	return resp, upstream, err
 }
 
 func isRetryableDNSResponseErr(err error) bool {
@@ -525,11 +558,7 @@ func (r *Router) SetDNS(upstream, fallback string) {
 func (r *Router) buildUpstreamAddrs(upstream, fallback string) ([]string, error) {
 	dnsIPs := []string{upstream}
 	if upstream == "" {
-		var err error
-		dnsIPs, err = r.dns.getDNSServer()
-		if err != nil {
-			slog.Error("get dns server", "error", err, "dns", dnsIPs)
-		}
+		dnsIPs = r.discoverDNSServers()
 	}
 
 	addrs := make([]string, 0, len(dnsIPs)+1)
@@ -557,6 +586,35 @@ func (r *Router) buildUpstreamAddrs(upstream, fallback string) ([]string, error)
 	return addrs, nil
 }
 
+// discoverDNSServers runs DHCPv4 and IPv6 (RA/DHCPv6) discovery in parallel
+// and merges the results, IPv4 servers first. Either family failing leaves
+// the other's servers in place.
+func (r *Router) discoverDNSServers() []string {
+	var (
+		wg      sync.WaitGroup
+		ips6    []string
+		err6    error
+		getDNS6 = r.dns.getDNSServer6
+	)
+	if getDNS6 != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ips6, err6 = getDNS6()
+		}()
+	}
+	ips, err := r.dns.getDNSServer()
+	if err != nil {
+		slog.Error("get dns server", "error", err, "dns", ips)
+	}
+	wg.Wait()
+	if err6 != nil {
+		// IPv6 discovery fails routinely on IPv4-only networks.
+		slog.Debug("get ipv6 dns server", "error", err6)
+	}
+	return append(ips, ips6...)
+}
+
 func (r *Router) shouldRefreshUpstreams(now time.Time) bool {
 	return r.dns.upstreamDNS == "" && !r.dns.refreshAt.IsZero() && !now.Before(r.dns.refreshAt)
 }
@@ -767,3 +825,42 @@ func (r *Router) isServeIP(raw string) bool {
 	}
 	return false
 }
+
+// DNSDecision identifies how ServeDNS answered a query.
+type DNSDecision string
+
+const (
+	// DNSBlock is a block-rule answer in the configured DNSBlockMode.
+	DNSBlock DNSDecision = "block"
+	// DNSProxyLocal is a local answer for a proxy-routed name: the serve IP,
+	// a fake IP, or NODATA for non-address types.
+	DNSProxyLocal DNSDecision = "proxy-local"
+	// DNSForwarded is a query sent to an upstream resolver.
+	DNSForwarded DNSDecision = "forwarded"
+	// DNSLocal is an internal reverse lookup answered locally.
+	DNSLocal DNSDecision = "local"
+	// DNSInvalid is a malformed or unsupported query rejected up front.
+	DNSInvalid DNSDecision = "invalid"
+)
+
+// DNSQuery describes one answered DNS query. Upstream is empty unless the
+// query was forwarded.
+type DNSQuery struct {
+	Client   string
+	Domain   string
+	Qtype    uint16
+	Decision DNSDecision
+	Upstream string
+	Rcode    int
+	Duration time.Duration
+}
+
+// DNSQueryObserver receives every query answered by ServeDNS after the reply
+// is written. It runs on the DNS serving goroutine and must not block.
+type DNSQueryObserver func(DNSQuery)
+
+// SetDNSQueryObserver installs the DNS query observer, or clears it with a
+// nil argument.
+func (r *Router) SetDNSQueryObserver(fn DNSQueryObserver) {
+	r.dnsQueryObserver = fn
+}
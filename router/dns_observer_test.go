@@ -0,0 +1,56 @@
+package router
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestDNSQueryObserverReportsDecisions(t *testing.T) {
+	t.Parallel()
+
+	upstreamAddr := startUDPTestDNSServer(t, dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetRcode(req, dns.RcodeNameError)
+		_ = w.WriteMsg(m)
+	}))
+
+	r := newTestRouter(t, []string{"127.0.0.1"}, "", "223.5.5.5", "", nil)
+	r.dns.upstreamAddrs = []string{upstreamAddr}
+	r.dns.upstreamIndex = 0
+	r.BlockRule.Add("ads.example")
+	r.ProxyRule.Add("**.proxy.example")
+
+	var got []DNSQuery
+	r.SetDNSQueryObserver(func(q DNSQuery) { got = append(got, q) })
+
+	for _, name := range []string{"ads.example.", "www.proxy.example.", "missing.example."} {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		r.ServeDNS(&mockDNSWriter{localAddr: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 53}}, req)
+	}
+
+	want := []struct {
+		decision DNSDecision
+		upstream string
+		rcode    int
+	}{
+		{DNSBlock, "", dns.RcodeNameError},
+		{DNSProxyLocal, "", dns.RcodeSuccess},
+		{DNSForwarded, upstreamAddr, dns.RcodeNameError},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("observer fired %d times, want %d", len(got), len(want))
+	}
+	for i, w := range want {
+		q := got[i]
+		if q.Decision != w.decision || q.Upstream != w.upstream || q.Rcode != w.rcode {
+			t.Fatalf("query %d (%s) = %s via %q rcode %d, want %s via %q rcode %d",
+				i, q.Domain, q.Decision, q.Upstream, q.Rcode, w.decision, w.upstream, w.rcode)
+		}
+		if q.Qtype != dns.TypeA || q.Duration <= 0 {
+			t.Fatalf("query %d missing type or duration: %+v", i, q)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package router
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Checks of a RouteTrace, in the order DialSmart evaluates them.
+const (
+	CheckFakeIP     = "fake-ip"
+	CheckBlockRule  = "block-rule"
+	CheckDirectRule = "direct-rule"
+	CheckProxyRule  = "proxy-rule"
+	CheckLocalSite  = "local-site"
+	CheckAccess     = "access-probe"
+	CheckFallback   = "fallback"
+)
+
+// RouteTrace explains how DialSmart would route a TCP connection to
+// domain:port. Tracing never dials, probes, or reports to the observers,
+// so a step that depends on an uncached access probe leaves Pending set:
+// the route then is proxy unless the probe finds the site reachable.
+type RouteTrace struct {
+	Domain string
+	Port   uint16
+	// Steps lists the checks evaluated, up to the deciding one.
+	Steps []TraceStep
+	// IPs and ResolveErr are filled once the local-site check resolves
+	// the name.
+	IPs        []TraceIP
+	ResolveErr string
+	Route      RouteCategory
+	Pending    bool
+	// DNS is what ServeDNS would answer for an A query of the name.
+	DNS DNSTrace
+}
+
+// TraceStep is one check of a RouteTrace. Rule is the matching rule of a
+// rule check; Skipped marks a check that did not apply.
+type TraceStep struct {
+	Check   string
+	Matched bool
+	Skipped bool
+	Rule    string
+	Detail  string
+}
+
+// TraceIP is one resolved address with the country data localSite judges
+// it by: the country CIDR containing it, or its GeoIP country code.
+type TraceIP struct {
+	IP      net.IP
+	CIDR    string
+	Country string
+	Local   bool
+	Err     string
+}
+
+// DNSTrace explains the ServeDNS decision for a name. Answer is the local
+// answer of block and proxy-local decisions; Upstream is the resolver a
+// forwarded query goes to first.
+type DNSTrace struct {
+	Decision DNSDecision
+	Rule     string
+	Answer   string
+	Upstream string
+	// Poisoned reports a name detected as poisoned, which forwarded
+	// queries resolve through the trusted resolver instead.
+	Poisoned bool
+}
+
+// Explain traces the DialSmart decision for domain:port.
+func (r *Router) Explain(domain string, port uint16) RouteTrace {
+	t := RouteTrace{Domain: domain, Port: port}
+	if r.isFakeIP(domain) {
+		mapped, ok := r.FakeIPDomain(domain)
+		if !ok {
+			t.Steps = append(t.Steps, TraceStep{Check: CheckFakeIP, Matched: true, Detail: "unmapped fake IP, the dial fails"})
+			return t
+		}
+		t.Steps = append(t.Steps, TraceStep{Check: CheckFakeIP, Matched: true, Detail: "maps to " + mapped})
+		t.DNS = r.ExplainDNS(mapped)
+		if rule, ok := r.BlockRule.MatchRule(mapped); ok {
+			t.Steps = append(t.Steps, TraceStep{Check: CheckBlockRule, Matched: true, Rule: rule})
+			t.Route = RouteBlock
+			return t
+		}
+		t.Steps = append(t.Steps, TraceStep{Check: CheckBlockRule})
+		t.Route = RouteProxy
+		return t
+	}
+
+	t.DNS = r.ExplainDNS(domain)
+	for _, c := range []struct {
+		check string
+		rules *RuleSet
+		route RouteCategory
+	}{
+		{CheckBlockRule, r.BlockRule, RouteBlock},
+		{CheckDirectRule, r.DirectRule, RouteDirect},
+		{CheckProxyRule, r.ProxyRule, RouteProxy},
+	} {
+		rule, ok := c.rules.MatchRule(domain)
+		t.Steps = append(t.Steps, TraceStep{Check: c.check, Matched: ok, Rule: rule})
+		if ok {
+			t.Route = c.route
+			return t
+		}
+	}
+
+	local := r.traceLocalSite(&t)
+	t.Steps = append(t.Steps, TraceStep{Check: CheckLocalSite, Matched: local})
+	if local {
+		t.Route = RouteDirect
+		return t
+	}
+
+	access := TraceStep{Check: CheckAccess}
+	switch reachable, cached := r.accessCache.Peek(accessCacheKey(domain, port)); {
+	case port != 80 && port != 443:
+		access.Skipped = true
+		access.Detail = "only ports 80 and 443 are probed"
+	case cached:
+		access.Matched = reachable
+		access.Detail = "cached verdict"
+	default:
+		access.Detail = "not cached, the next connection probes"
+		t.Pending = true
+	}
+	t.Steps = append(t.Steps, access)
+	if access.Matched {
+		t.Route = RouteDirect
+		return t
+	}
+	t.Steps = append(t.Steps, TraceStep{Check: CheckFallback, Matched: true})
+	t.Route = RouteProxy
+	return t
+}
+
+// traceLocalSite mirrors localSite, recording every address it judges.
+func (r *Router) traceLocalSite(t *RouteTrace) bool {
+	ips := []net.IP{net.ParseIP(t.Domain)}
+	if ips[0] == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		var err error
+		ips, err = net.DefaultResolver.LookupIP(ctx, "ip", t.Domain)
+		if err != nil || len(ips) == 0 {
+			t.ResolveErr = fmt.Sprintf("resolve %s: %v", t.Domain, err)
+			return false
+		}
+	}
+
+	local := false
+	for _, ip := range ips {
+		ti := TraceIP{IP: ip}
+		cidr, country, err := r.ipLocation(ip)
+		switch {
+		case err != nil:
+			ti.Err = err.Error()
+		case cidr != nil:
+			ti.CIDR = cidr.String()
+			ti.Local = true
+		default:
+			ti.Country = country
+			ti.Local = country == "CN"
+		}
+		local = local || ti.Local
+		t.IPs = append(t.IPs, ti)
+	}
+	return local
+}
+
+// ExplainDNS traces the ServeDNS decision for an A query of domain, without
+// sending the query or assigning a fake IP.
+func (r *Router) ExplainDNS(domain string) DNSTrace {
+	name := dns.Fqdn(domain)
+	if rule, ok := r.BlockRule.MatchRule(name); ok {
+		return DNSTrace{Decision: DNSBlock, Rule: rule, Answer: string(r.DNSBlockMode())}
+	}
+	if arpaIP, ok := parseReverseName(name); ok && isInternalIP(arpaIP) {
+		if !r.dnsSelectedUpstreamIsInternal() {
+			return DNSTrace{Decision: DNSLocal, Answer: "NXDOMAIN"}
+		}
+		return DNSTrace{Decision: DNSForwarded, Upstream: r.selectedUpstream()}
+	}
+	if _, direct := r.DirectRule.MatchRule(name); !direct {
+		if rule, ok := r.ProxyRule.MatchRule(name); ok {
+			t := DNSTrace{Decision: DNSProxyLocal, Rule: rule}
+			switch {
+			case r.fakeIP != nil:
+				if ip, ok := r.fakeIP.Peek(name); ok {
+					t.Answer = "fake IP " + ip.String()
+				} else {
+					t.Answer = "a new fake IP from " + r.fakeIP.Prefix().String()
+				}
+			default:
+				// The listener address the query arrives on comes first.
+				t.Answer = "listener IP"
+				for _, ip := range r.dns.serveIPs {
+					t.Answer += " / " + ip.String()
+				}
+			}
+			return t
+		}
+	}
+
+	t := DNSTrace{Decision: DNSForwarded, Upstream: r.selectedUpstream()}
+	if r.poison != nil {
+		_, t.Poisoned = r.poison.poisoned.GetIfPresent(strings.ToLower(strings.TrimSuffix(name, ".")))
+	}
+	return t
+}
+
+// selectedUpstream returns the upstream resolver the next forwarded query
+// tries first, or the configured upstream before discovery ran.
+func (r *Router) selectedUpstream() string {
+	r.dns.Lock()
+	defer r.dns.Unlock()
+	if i := r.dns.upstreamIndex; i >= 0 && i < len(r.dns.upstreamAddrs) {
+		return r.dns.upstreamAddrs[i]
+	}
+	return r.dns.upstreamDNS
+}
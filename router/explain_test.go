@@ -0,0 +1,85 @@
+package router
+
+import (
+	"testing"
+)
+
+func traceChecks(t RouteTrace) []string {
+	var out []string
+	for _, s := range t.Steps {
+		out = append(out, s.Check)
+	}
+	return out
+}
+
+func TestExplainFollowsDialSmartPrecedence(t *testing.T) {
+	t.Parallel()
+
+	r := newTestRouter(t, []string{"192.0.2.1"}, "", "223.5.5.5", "", nil)
+	r.BlockRule.Add("ads.example.com")
+	r.DirectRule.Add("**.example.com")
+	r.ProxyRule.Add("**.example.com", "**.example.org")
+
+	block := r.Explain("ads.example.com", 443)
+	if block.Route != RouteBlock || len(block.Steps) != 1 || block.Steps[0].Rule != "ads.example.com" {
+		t.Fatalf("block trace = %+v", block)
+	}
+	if block.DNS.Decision != DNSBlock || block.DNS.Answer != string(DNSBlockNXDomain) {
+		t.Fatalf("block dns = %+v", block.DNS)
+	}
+
+	direct := r.Explain("www.example.com", 443)
+	if direct.Route != RouteDirect || len(direct.Steps) != 2 || direct.Steps[1].Rule != "**.example.com" {
+		t.Fatalf("direct trace = %+v", direct)
+	}
+	// The direct rule wins on the DNS path too, so the query is forwarded.
+	if direct.DNS.Decision != DNSForwarded {
+		t.Fatalf("direct dns = %+v", direct.DNS)
+	}
+
+	proxy := r.Explain("www.example.org", 443)
+	if proxy.Route != RouteProxy || proxy.DNS.Decision != DNSProxyLocal || proxy.DNS.Answer != "listener IP / 192.0.2.1" {
+		t.Fatalf("proxy trace = %+v", proxy)
+	}
+}
+
+func TestExplainReportsAccessCacheState(t *testing.T) {
+	t.Parallel()
+
+	probes := 0
+	r := newTestRouter(t, nil, "", "223.5.5.5", "", nil)
+	r.accessCache = newAccessCache(accessCacheTTL, func(string) (bool, error) {
+		probes++
+		return true, nil
+	})
+	if err := r.AddCountryCIDRs("198.51.100.0/24"); err != nil {
+		t.Fatal(err)
+	}
+
+	local := r.Explain("198.51.100.7", 443)
+	if local.Route != RouteDirect || len(local.IPs) != 1 || local.IPs[0].CIDR != "198.51.100.0/24" {
+		t.Fatalf("local trace = %+v", local)
+	}
+
+	pending := r.Explain("203.0.113.10", 443)
+	if pending.Route != RouteProxy || !pending.Pending || probes != 0 {
+		t.Fatalf("uncached trace = %+v, probes %d", pending, probes)
+	}
+	if got := traceChecks(pending); len(got) != 6 || got[4] != CheckAccess || got[5] != CheckFallback {
+		t.Fatalf("uncached checks = %v", got)
+	}
+
+	if !r.isAccess("203.0.113.10", 443) {
+		t.Fatal("probe failed")
+	}
+	cached := r.Explain("203.0.113.10", 443)
+	if cached.Route != RouteDirect || cached.Pending || !cached.Steps[4].Matched {
+		t.Fatalf("cached trace = %+v", cached)
+	}
+	if other := r.Explain("203.0.113.10", 22); other.Route != RouteProxy || !other.Steps[4].Skipped {
+		t.Fatalf("port 22 trace = %+v", other)
+	}
+	if probes != 1 {
+		t.Fatalf("explain probed: %d probes", probes)
+	}
+}
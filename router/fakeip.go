@@ -0,0 +1,362 @@
+package router
+
+import (
+	"container/list"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+	"github.com/sower-proxy/sower/internal/fsutil"
+)
+
+// maxFakeIPPoolSize caps the number of addresses a pool hands out, so a
+// short IPv6 prefix does not turn into an unbounded mapping table.
+const maxFakeIPPoolSize = 1 << 20
+
+var errFakeIPUnmapped = errors.New("fake ip has no domain mapping")
+
+// FakeIPPool assigns every proxy-routed domain a unique address from a
+// reserved range (e.g. 198.18.0.0/15), so connections that arrive at that
+// address on any port can be mapped back to the domain. Addresses are handed
+// out sequentially; once the range is exhausted the least recently used
+// mapping is recycled. Both DNS answers and reverse lookups count as use.
+type FakeIPPool struct {
+	prefix netip.Prefix
+	first  netip.Addr
+	size   uint64
+	file   string
+
+	mu     sync.Mutex
+	next   uint64     // offsets below next are assigned
+	lru    *list.List // *fakeIPEntry, most recently used first
+	byName map[string]*list.Element
+	byAddr map[netip.Addr]*list.Element
+	dirty  bool
+}
+
+type fakeIPEntry struct {
+	Domain string     `json:"domain"`
+	Addr   netip.Addr `json:"ip"`
+}
+
+// fakeIPState is the on-disk form. Entries are ordered most recently used
+// first so a reload keeps the recycling order.
+type fakeIPState struct {
+	Prefix  string        `json:"prefix"`
+	Next    uint64        `json:"next"`
+	Entries []fakeIPEntry `json:"entries"`
+}
+
+// NewFakeIPPool creates a pool over cidr. A non-empty file persists the
+// mappings: it is loaded here and written by Save. A file recorded for a
+// different range is ignored, since its addresses would be out of range.
+func NewFakeIPPool(cidr, file string) (*FakeIPPool, error) {
+	prefix, err := netip.ParsePrefix(strings.TrimSpace(cidr))
+	if err != nil {
+		return nil, fmt.Errorf("parse fake ip range %q: %w", cidr, err)
+	}
+	prefix = prefix.Masked()
+
+	hostBits := prefix.Addr().BitLen() - prefix.Bits()
+	size := uint64(maxFakeIPPoolSize)
+	if hostBits < 21 {
+		size = uint64(1) << hostBits
+	}
+	first := prefix.Addr()
+	// Skip the network address, and the broadcast address of an IPv4
+	// range that ends inside the pool.
+	if size > 2 {
+		first = first.Next()
+		size--
+		if prefix.Addr().Is4() && hostBits < 21 {
+			size--
+		}
+	}
+	if size < 2 {
+		return nil, fmt.Errorf("fake ip range %q is too small", cidr)
+	}
+
+	p := &FakeIPPool{
+		prefix: prefix,
+		first:  first,
+		size:   size,
+		file:   file,
+		lru:    list.New(),
+		byName: make(map[string]*list.Element),
+		byAddr: make(map[netip.Addr]*list.Element),
+	}
+	if file != "" {
+		if err := p.load(); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// Prefix returns the address range the pool allocates from.
+func (p *FakeIPPool) Prefix() netip.Prefix {
+	return p.prefix
+}
+
+// Contains reports whether ip falls inside the pool range.
+func (p *FakeIPPool) Contains(ip netip.Addr) bool {
+	return p.prefix.Contains(ip.Unmap())
+}
+
+// Len returns the number of live mappings.
+func (p *FakeIPPool) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.lru.Len()
+}
+
+// Lookup returns the address assigned to domain, assigning one (and
+// recycling the least recently used mapping when the range is full) if the
+// domain has none yet.
+func (p *FakeIPPool) Lookup(domain string) netip.Addr {
+	domain = normalizeFakeIPDomain(domain)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if el, ok := p.byName[domain]; ok {
+		p.lru.MoveToFront(el)
+		return el.Value.(*fakeIPEntry).Addr
+	}
+
+	var entry *fakeIPEntry
+	if p.next < p.size {
+		entry = &fakeIPEntry{Addr: addrAdd(p.first, p.next)}
+		p.next++
+	} else {
+		el := p.lru.Back()
+		entry = p.lru.Remove(el).(*fakeIPEntry)
+		delete(p.byName, entry.Domain)
+		delete(p.byAddr, entry.Addr)
+	}
+	entry.Domain = domain
+	el := p.lru.PushFront(entry)
+	p.byName[domain] = el
+	p.byAddr[entry.Addr] = el
+	p.dirty = true
+	return entry.Addr
+}
+
+// Peek returns the address assigned to domain without assigning one or
+// touching its recency.
+func (p *FakeIPPool) Peek(domain string) (netip.Addr, bool) {
+	domain = normalizeFakeIPDomain(domain)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if el, ok := p.byName[domain]; ok {
+		return el.Value.(*fakeIPEntry).Addr, true
+	}
+	return netip.Addr{}, false
+}
+
+// Domain returns the domain that owns ip. ok is false when ip is outside the
+// pool or currently unassigned.
+func (p *FakeIPPool) Domain(ip netip.Addr) (string, bool) {
+	ip = ip.Unmap()
+	if !p.prefix.Contains(ip) {
+		return "", false
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	el, ok := p.byAddr[ip]
+	if !ok {
+		return "", false
+	}
+	p.lru.MoveToFront(el)
+	return el.Value.(*fakeIPEntry).Domain, true
+}
+
+// Save writes the mappings to the pool file if they changed since the last
+// save. It is a no-op for pools without a file.
+func (p *FakeIPPool) Save() error {
+	if p.file == "" {
+		return nil
+	}
+
+	p.mu.Lock()
+	if !p.dirty {
+		p.mu.Unlock()
+		return nil
+	}
+	state := fakeIPState{
+		Prefix:  p.prefix.String(),
+		Next:    p.next,
+		Entries: make([]fakeIPEntry, 0, p.lru.Len()),
+	}
+	for el := p.lru.Front(); el != nil; el = el.Next() {
+		state.Entries = append(state.Entries, *el.Value.(*fakeIPEntry))
+	}
+	p.dirty = false
+	p.mu.Unlock()
+
+	data, err := json.Marshal(state)
+	if err == nil {
+		err = fsutil.WriteFileAtomic(p.file, data)
+	}
+	if err != nil {
+		p.mu.Lock()
+		p.dirty = true
+		p.mu.Unlock()
+		return fmt.Errorf("save fake ip pool %s: %w", p.file, err)
+	}
+	return nil
+}
+
+func (p *FakeIPPool) load() error {
+	data, err := os.ReadFile(p.file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("read fake ip pool %s: %w", p.file, err)
+	}
+
+	var state fakeIPState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("parse fake ip pool %s: %w", p.file, err)
+	}
+	if state.Prefix != p.prefix.String() {
+		slog.Warn("fake ip pool range changed, discarding saved mappings",
+			"file", p.file, "saved", state.Prefix, "range", p.prefix)
+		return nil
+	}
+
+	// Entries are validated one by one: a hand-edited or truncated file
+	// loses the bad mappings rather than the whole pool.
+	p.next = min(state.Next, p.size)
+	for _, e := range state.Entries {
+		domain := normalizeFakeIPDomain(e.Domain)
+		if domain == "" || !e.Addr.IsValid() {
+			continue
+		}
+		offset, ok := addrOffset(p.first, e.Addr)
+		if !ok || offset >= p.next {
+			continue
+		}
+		if _, dup := p.byName[domain]; dup {
+			continue
+		}
+		if _, dup := p.byAddr[e.Addr]; dup {
+			continue
+		}
+		el := p.lru.PushBack(&fakeIPEntry{Domain: domain, Addr: e.Addr})
+		p.byName[domain] = el
+		p.byAddr[e.Addr] = el
+	}
+	if p.lru.Len() > 0 {
+		slog.Info("restored fake ip pool", "count", p.lru.Len(), "file", p.file)
+	}
+	return nil
+}
+
+// FakeIPPool returns the configured pool, or nil when fake-IP DNS is off.
+func (r *Router) FakeIPPool() *FakeIPPool {
+	return r.fakeIP
+}
+
+// SetFakeIPPool enables fake-IP answers for proxy-routed domains, or
+// disables them with a nil argument. It must be called before serving.
+func (r *Router) SetFakeIPPool(p *FakeIPPool) {
+	r.fakeIP = p
+}
+
+// FakeIPDomain maps a fake-IP host back to its domain. ok is false when host
+// is not an address inside the fake-IP range or fake-IP DNS is off.
+func (r *Router) FakeIPDomain(host string) (string, bool) {
+	if r.fakeIP == nil {
+		return "", false
+	}
+	ip, err := netip.ParseAddr(strings.Trim(host, "[]"))
+	if err != nil {
+		return "", false
+	}
+	return r.fakeIP.Domain(ip)
+}
+
+// isFakeIP reports whether host is an address inside the fake-IP range,
+// mapped or not.
+func (r *Router) isFakeIP(host string) bool {
+	if r.fakeIP == nil {
+		return false
+	}
+	ip, err := netip.ParseAddr(strings.Trim(host, "[]"))
+	return err == nil && r.fakeIP.Contains(ip)
+}
+
+func normalizeFakeIPDomain(domain string) string {
+	return strings.ToLower(strings.TrimSuffix(strings.TrimSpace(domain), "."))
+}
+
+// addrAdd returns base advanced by n addresses.
+func addrAdd(base netip.Addr, n uint64) netip.Addr {
+	b := base.As16()
+	for i := len(b) - 1; i >= 0 && n > 0; i-- {
+		sum := uint64(b[i]) + n&0xff
+		b[i] = byte(sum)
+		n = n>>8 + sum>>8
+	}
+	addr := netip.AddrFrom16(b)
+	if base.Is4() {
+		return addr.Unmap()
+	}
+	return addr
+}
+
+// addrOffset returns how many addresses ip lies past base. ok is false when
+// ip precedes base, is of a different family, or is too far away to matter
+// for a pool.
+func addrOffset(base, ip netip.Addr) (uint64, bool) {
+	if base.Is4() != ip.Is4() || ip.Less(base) {
+		return 0, false
+	}
+	a, b := base.As16(), ip.As16()
+	var diff [16]byte
+	borrow := 0
+	for i := len(a) - 1; i >= 0; i-- {
+		d := int(b[i]) - int(a[i]) - borrow
+		borrow = 0
+		if d < 0 {
+			d += 256
+			borrow = 1
+		}
+		diff[i] = byte(d)
+	}
+	var offset uint64
+	for i, v := range diff {
+		if i < 8 && v != 0 {
+			return 0, false
+		}
+		if i >= 8 {
+			offset = offset<<8 | uint64(v)
+		}
+	}
+	return offset, true
+}
+
+// fakeIPReplyIP returns the fake address for domain when it matches the
+// question family; other families get NODATA so clients fall back to the
+// family the pool serves.
+func (r *Router) fakeIPReplyIP(domain string, qtype uint16) (net.IP, error) {
+	if !isAddressQuestion(qtype) {
+		return nil, fmt.Errorf("unsupported question type %d", qtype)
+	}
+	if r.fakeIP.prefix.Addr().Is4() != (qtype == dns.TypeA) {
+		return nil, fmt.Errorf("%w %d", errNoLocalIPForQuestionType, qtype)
+	}
+	return net.IP(r.fakeIP.Lookup(domain).AsSlice()), nil
+}
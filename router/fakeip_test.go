@@ -0,0 +1,144 @@
+package router
+
+import (
+	"net"
+	"net/netip"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestFakeIPPoolAssignsStableUniqueAddresses(t *testing.T) {
+	t.Parallel()
+
+	pool, err := NewFakeIPPool("198.18.0.0/15", "")
+	if err != nil {
+		t.Fatalf("new pool: %v", err)
+	}
+
+	a := pool.Lookup("a.example.com.")
+	b := pool.Lookup("B.example.com")
+	if a == b {
+		t.Fatalf("distinct domains share %s", a)
+	}
+	if a != netip.MustParseAddr("198.18.0.1") {
+		t.Fatalf("first address = %s, want 198.18.0.1 (network address skipped)", a)
+	}
+	if got := pool.Lookup("A.Example.com"); got != a {
+		t.Fatalf("repeat lookup = %s, want %s", got, a)
+	}
+	if domain, ok := pool.Domain(b); !ok || domain != "b.example.com" {
+		t.Fatalf("Domain(%s) = %q, %v; want b.example.com", b, domain, ok)
+	}
+	if _, ok := pool.Domain(netip.MustParseAddr("198.18.9.9")); ok {
+		t.Fatal("unassigned address resolved to a domain")
+	}
+	if _, ok := pool.Domain(netip.MustParseAddr("10.0.0.1")); ok {
+		t.Fatal("address outside the range resolved to a domain")
+	}
+}
+
+func TestFakeIPPoolRecyclesLeastRecentlyUsed(t *testing.T) {
+	t.Parallel()
+
+	// A /30 has two usable addresses once network and broadcast are skipped.
+	pool, err := NewFakeIPPool("198.18.0.0/30", "")
+	if err != nil {
+		t.Fatalf("new pool: %v", err)
+	}
+
+	a := pool.Lookup("a.example.com")
+	pool.Lookup("b.example.com")
+	// Reverse lookups count as use, so b becomes the eviction candidate.
+	if _, ok := pool.Domain(a); !ok {
+		t.Fatal("a.example.com not mapped")
+	}
+	c := pool.Lookup("c.example.com")
+
+	if pool.Len() != 2 {
+		t.Fatalf("Len() = %d, want 2", pool.Len())
+	}
+	if domain, _ := pool.Domain(a); domain != "a.example.com" {
+		t.Fatalf("recently used mapping was recycled, %s now owned by %q", a, domain)
+	}
+	if domain, _ := pool.Domain(c); domain != "c.example.com" {
+		t.Fatalf("Domain(%s) = %q, want c.example.com", c, domain)
+	}
+	if c == netip.MustParseAddr("198.18.0.3") {
+		t.Fatal("broadcast address was assigned")
+	}
+}
+
+func TestFakeIPPoolPersistsMappings(t *testing.T) {
+	t.Parallel()
+
+	file := filepath.Join(t.TempDir(), "fakeip.json")
+	pool, err := NewFakeIPPool("198.18.0.0/15", file)
+	if err != nil {
+		t.Fatalf("new pool: %v", err)
+	}
+	a := pool.Lookup("a.example.com")
+	b := pool.Lookup("b.example.com")
+	if err := pool.Save(); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	restored, err := NewFakeIPPool("198.18.0.0/15", file)
+	if err != nil {
+		t.Fatalf("reload pool: %v", err)
+	}
+	if got := restored.Lookup("a.example.com"); got != a {
+		t.Fatalf("restored a.example.com = %s, want %s", got, a)
+	}
+	if domain, ok := restored.Domain(b); !ok || domain != "b.example.com" {
+		t.Fatalf("restored Domain(%s) = %q, %v", b, domain, ok)
+	}
+	if got := restored.Lookup("c.example.com"); got == a || got == b {
+		t.Fatalf("new mapping reused a restored address %s", got)
+	}
+
+	other, err := NewFakeIPPool("100.64.0.0/16", file)
+	if err != nil {
+		t.Fatalf("reload with another range: %v", err)
+	}
+	if other.Len() != 0 {
+		t.Fatalf("mappings from another range were restored: %d", other.Len())
+	}
+}
+
+func TestServeDNSAnswersProxyDomainWithFakeIP(t *testing.T) {
+	t.Parallel()
+
+	r := newTestRouter(t, []string{"127.0.0.1"}, "", "223.5.5.5", "", nil)
+	r.ProxyRule.Add("**.proxy.example")
+	pool, err := NewFakeIPPool("198.18.0.0/15", "")
+	if err != nil {
+		t.Fatalf("new pool: %v", err)
+	}
+	r.SetFakeIPPool(pool)
+
+	w := &mockDNSWriter{localAddr: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 53}}
+	req := new(dns.Msg)
+	req.SetQuestion("www.proxy.example.", dns.TypeA)
+	r.ServeDNS(w, req)
+
+	if w.msg == nil || len(w.msg.Answer) != 1 {
+		t.Fatalf("unexpected reply: %v", w.msg)
+	}
+	a, ok := w.msg.Answer[0].(*dns.A)
+	if !ok {
+		t.Fatalf("answer = %T, want *dns.A", w.msg.Answer[0])
+	}
+	if domain, ok := r.FakeIPDomain(a.A.String()); !ok || domain != "www.proxy.example" {
+		t.Fatalf("FakeIPDomain(%s) = %q, %v", a.A, domain, ok)
+	}
+
+	w = &mockDNSWriter{localAddr: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 53}}
+	req = new(dns.Msg)
+	req.SetQuestion("www.proxy.example.", dns.TypeAAAA)
+	r.ServeDNS(w, req)
+	if w.msg == nil || w.msg.Rcode != dns.RcodeSuccess || len(w.msg.Answer) != 0 {
+		t.Fatalf("AAAA for an IPv4 pool should be NODATA, got %v", w.msg)
+	}
+}
@@ -0,0 +1,307 @@
+package router
+
+import (
+	"context"
+	"encoding/binary"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// fallbackWindow is how long a detection-based direct connection may
+	// stay silent after the client's first bytes before it is retried
+	// through the proxy. A blackholed handshake never answers at all.
+	fallbackWindow = 5 * time.Second
+	// maxFallbackReplay caps the client bytes held for a replay; a TLS
+	// ClientHello fits with room to spare.
+	maxFallbackReplay = 16 << 10
+)
+
+// dialDetected dials a destination that detection judged reachable
+// directly and falls back to the proxy when it is not after all: a failed
+// direct dial is retried through the proxy at once, and a connection that
+// dies before answering is retried by fallbackConn. Either way the access
+// cache learns a proxy verdict for the destination.
+func (r *Router) dialDetected(ctx context.Context, network, domain, target, addr string, port uint16) (net.Conn, error) {
+	canFallback := r.ProxyDial != nil && strings.HasPrefix(network, "tcp")
+	conn, err := r.directDial(ctx, network, addr)
+	if err != nil {
+		r.observeRuleMiss(domain, RouteDirect, err)
+		if !canFallback {
+			r.observe(RouteDirect, domain)
+			return nil, err
+		}
+		r.learnUnreachable(domain, port)
+		slog.Info("direct dial failed, falling back to proxy", "domain", domain, "port", port, "error", err)
+		return r.dialProxy(network, domain, target, port)
+	}
+	r.observe(RouteDirect, domain)
+	if !canFallback {
+		r.observeRuleMiss(domain, RouteDirect, nil)
+		return conn, nil
+	}
+	return &fallbackConn{r: r, network: network, domain: domain, target: target, port: port, conn: conn, route: RouteDirect, armed: true}, nil
+}
+
+// learnUnreachable records a proxy verdict for domain:port after a direct
+// connection failed, so the next connection skips the direct attempt.
+func (r *Router) learnUnreachable(domain string, port uint16) {
+	if port == 80 || port == 443 {
+		r.accessCache.Learn(accessCacheKey(domain, port), false)
+	}
+}
+
+// fallbackConn is a direct connection that is retried through the proxy
+// when it fails before its first byte back: reset, closed, or silent for
+// fallbackWindow. The client bytes written so far are replayed on the
+// proxy connection, so only TLS handshake records qualify: once the client
+// sent anything else, e.g. an HTTP request the server may have acted on,
+// the connection is left to fail. The rule-miss observer hears about the
+// connection once its outcome is known.
+type fallbackConn struct {
+	r       *Router
+	network string
+	domain  string
+	target  string
+	port    uint16
+	settle  sync.Once
+
+	mu    sync.Mutex
+	conn  net.Conn
+	route RouteCategory
+	// armed holds until the first byte back, a failure, or client bytes
+	// that cannot be replayed; sent buffers the client bytes meanwhile.
+	armed bool
+	sent  []byte
+	// deadline marks a read deadline set by the caller, which ends the
+	// fallback window.
+	deadline bool
+	closed   bool
+	// swapping is set while fallback dials the proxy without holding mu
+	// and closed once conn is settled; Read, Write and the deadline
+	// setters wait for it instead of using the failed conn.
+	swapping chan struct{}
+}
+
+func (c *fallbackConn) Read(p []byte) (int, error) {
+	for {
+		c.mu.Lock()
+		c.waitLocked()
+		conn, armed := c.conn, c.armed
+		c.mu.Unlock()
+
+		n, err := conn.Read(p)
+		if n > 0 {
+			if armed {
+				c.disarm(conn)
+			}
+			c.report(nil)
+			return n, err
+		}
+		if err == nil {
+			return n, err
+		}
+		if armed && c.fallback(conn, err) {
+			continue
+		}
+		c.report(err)
+		return n, err
+	}
+}
+
+func (c *fallbackConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	c.waitLocked()
+	conn := c.conn
+	if c.armed {
+		first := len(c.sent) == 0
+		c.sent = append(c.sent, p...)
+		switch {
+		case len(c.sent) > maxFallbackReplay || !replayableTLS(c.sent):
+			c.disarmLocked()
+		case first && !c.deadline:
+			_ = conn.SetReadDeadline(time.Now().Add(fallbackWindow))
+		}
+	}
+	armed := c.armed
+	c.mu.Unlock()
+
+	n, err := conn.Write(p)
+	if err == nil {
+		return n, nil
+	}
+	// p is part of the replay once the connection fell back.
+	if armed && c.fallback(conn, err) {
+		return len(p), nil
+	}
+	c.report(err)
+	return n, err
+}
+
+// disarm ends the fallback window of conn after its first byte back.
+func (c *fallbackConn) disarm(conn net.Conn) {
+	c.mu.Lock()
+	if c.conn == conn {
+		c.disarmLocked()
+	}
+	c.mu.Unlock()
+}
+
+func (c *fallbackConn) disarmLocked() {
+	if !c.armed {
+		return
+	}
+	c.armed, c.sent = false, nil
+	if !c.deadline {
+		_ = c.conn.SetReadDeadline(time.Time{})
+	}
+}
+
+// fallback replaces the failed direct conn with a proxy connection and
+// replays the client bytes on it. It reports whether the caller should
+// retry on the new connection, which is also the case when a concurrent
+// Read or Write already fell back. The dial and the replay run without
+// holding mu, so Close stays prompt; a Close meanwhile discards the proxy
+// connection.
+func (c *fallbackConn) fallback(conn net.Conn, cause error) bool {
+	c.mu.Lock()
+	c.waitLocked()
+	if c.conn != conn {
+		c.mu.Unlock()
+		return true
+	}
+	if !c.armed || c.closed {
+		c.mu.Unlock()
+		return false
+	}
+	sent := c.sent
+	c.armed, c.sent = false, nil
+	swapped := make(chan struct{})
+	c.swapping = swapped
+	c.mu.Unlock()
+
+	c.report(cause)
+	c.r.learnUnreachable(c.domain, c.port)
+	rc := c.dialReplay(sent, cause)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.swapping = nil
+	close(swapped)
+	if rc == nil {
+		return false
+	}
+	if c.closed {
+		_ = rc.Close()
+		return false
+	}
+	slog.Info("direct connection failed, fell back to proxy", "domain", c.domain, "port", c.port, "cause", cause)
+	_ = conn.Close()
+	c.conn, c.route = rc, RouteProxy
+	return true
+}
+
+// dialReplay dials the proxy and replays sent on it, or returns nil.
+func (c *fallbackConn) dialReplay(sent []byte, cause error) net.Conn {
+	rc, err := c.r.ProxyDial(c.network, c.target, c.port)
+	if err != nil {
+		slog.Warn("fall back to proxy", "domain", c.domain, "port", c.port, "cause", cause, "error", err)
+		return nil
+	}
+	if len(sent) > 0 {
+		if _, err := rc.Write(sent); err != nil {
+			slog.Warn("replay to proxy", "domain", c.domain, "port", c.port, "error", err)
+			_ = rc.Close()
+			return nil
+		}
+	}
+	return rc
+}
+
+// waitLocked blocks, with mu held, until no fallback is in flight.
+func (c *fallbackConn) waitLocked() {
+	for c.swapping != nil {
+		swapped := c.swapping
+		c.mu.Unlock()
+		<-swapped
+		c.mu.Lock()
+	}
+}
+
+// report tells the rule-miss observer how the direct attempt went, once:
+// the first byte back or a close is a success, an earlier error a failure.
+func (c *fallbackConn) report(err error) {
+	c.settle.Do(func() {
+		c.r.observeRuleMiss(c.domain, RouteDirect, err)
+	})
+}
+
+func (c *fallbackConn) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	conn := c.conn
+	c.mu.Unlock()
+	c.report(nil)
+	return conn.Close()
+}
+
+func (c *fallbackConn) current() net.Conn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn
+}
+
+func (c *fallbackConn) LocalAddr() net.Addr  { return c.current().LocalAddr() }
+func (c *fallbackConn) RemoteAddr() net.Addr { return c.current().RemoteAddr() }
+
+func (c *fallbackConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+// SetReadDeadline ends the fallback window: the caller's deadline wins.
+func (c *fallbackConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.waitLocked()
+	c.deadline = true
+	c.disarmLocked()
+	conn := c.conn
+	c.mu.Unlock()
+	return conn.SetReadDeadline(t)
+}
+
+func (c *fallbackConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.waitLocked()
+	conn := c.conn
+	c.mu.Unlock()
+	return conn.SetWriteDeadline(t)
+}
+
+func (c *fallbackConn) currentRoute() RouteCategory {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.route
+}
+
+// replayableTLS reports whether b holds nothing but TLS handshake records,
+// the last possibly partial: what a client sends before the server's first
+// answer, unless it uses early data.
+func replayableTLS(b []byte) bool {
+	for len(b) >= 5 {
+		if b[0] != 0x16 {
+			return false
+		}
+		n := 5 + int(binary.BigEndian.Uint16(b[3:5]))
+		if n > len(b) {
+			return true
+		}
+		b = b[n:]
+	}
+	return len(b) == 0 || b[0] == 0x16
+}
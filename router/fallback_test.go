@@ -0,0 +1,226 @@
+package router
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+)
+
+// clientHello is a complete, if tiny, TLS handshake record.
+var clientHello = []byte{0x16, 0x03, 0x01, 0x00, 0x03, 0x01, 0x00, 0x00}
+
+type missLog struct {
+	mu   sync.Mutex
+	errs []error
+}
+
+func (l *missLog) observe(domain string, route RouteCategory, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if route == RouteDirect {
+		l.errs = append(l.errs, err)
+	}
+}
+
+func (l *missLog) get() []error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.errs
+}
+
+// pipeServer returns the client end of a pipe whose server end reads n
+// bytes, replies with reply when it is not empty, and hangs up.
+func pipeServer(n int, reply string, got chan<- []byte) net.Conn {
+	client, server := net.Pipe()
+	go func() {
+		defer server.Close()
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(server, buf); err != nil {
+			return
+		}
+		if got != nil {
+			got <- buf
+		}
+		if reply != "" {
+			_, _ = server.Write([]byte(reply))
+		}
+	}()
+	return client
+}
+
+func newFallbackConn(r *Router, direct net.Conn) *fallbackConn {
+	return &fallbackConn{r: r, network: "tcp", domain: "example.com", target: "example.com", port: 443, conn: direct, route: RouteDirect, armed: true}
+}
+
+func TestFallbackConnReplaysHandshakeThroughProxy(t *testing.T) {
+	t.Parallel()
+
+	replayed := make(chan []byte, 1)
+	misses := &missLog{}
+	r := &Router{
+		accessCache: newAccessCache(accessCacheTTL, nil),
+		ProxyDial: func(network, host string, port uint16) (net.Conn, error) {
+			return pipeServer(len(clientHello), "answer", replayed), nil
+		},
+	}
+	r.SetRuleMissObserver(misses.observe)
+
+	// The direct path swallows the ClientHello and resets.
+	c := newFallbackConn(r, pipeServer(len(clientHello), "", nil))
+	defer c.Close()
+	if _, err := c.Write(clientHello); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	buf := make([]byte, 16)
+	n, err := c.Read(buf)
+	if err != nil || string(buf[:n]) != "answer" {
+		t.Fatalf("read = %q, %v; want the proxied answer", buf[:n], err)
+	}
+	if got := <-replayed; string(got) != string(clientHello) {
+		t.Fatalf("replayed %x, want the ClientHello", got)
+	}
+	if RouteOf(c) != RouteProxy {
+		t.Fatalf("route = %q, want proxy after the fallback", RouteOf(c))
+	}
+	if reachable, cached := r.accessCache.Peek("443:example.com"); !cached || reachable {
+		t.Fatalf("access verdict = %v, cached %v; want a learned proxy verdict", reachable, cached)
+	}
+	if errs := misses.get(); len(errs) != 1 || errs[0] == nil {
+		t.Fatalf("rule misses = %v, want one failed direct attempt", errs)
+	}
+}
+
+func TestFallbackConnCloseDuringProxyDial(t *testing.T) {
+	t.Parallel()
+
+	dialing, release := make(chan struct{}), make(chan struct{})
+	proxyClient, proxyServer := net.Pipe()
+	discarded := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(io.Discard, proxyServer)
+		close(discarded)
+	}()
+	r := &Router{
+		accessCache: newAccessCache(accessCacheTTL, nil),
+		ProxyDial: func(string, string, uint16) (net.Conn, error) {
+			close(dialing)
+			<-release
+			return proxyClient, nil
+		},
+	}
+
+	// The direct path is already gone, so the first write falls back.
+	direct, server := net.Pipe()
+	server.Close()
+	c := newFallbackConn(r, direct)
+	written := make(chan error, 1)
+	go func() {
+		_, err := c.Write(clientHello)
+		written <- err
+	}()
+	<-dialing
+	// Close must not wait for the proxy dial.
+	c.Close()
+	close(release)
+	if err := <-written; err == nil {
+		t.Fatal("write succeeded on a connection closed during the fallback")
+	}
+	<-discarded
+	if RouteOf(c) != RouteDirect {
+		t.Fatalf("route = %q, want direct after the fallback was abandoned", RouteOf(c))
+	}
+}
+
+func TestFallbackConnLeavesApplicationDataAlone(t *testing.T) {
+	t.Parallel()
+
+	request := "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"
+	for name, test := range map[string]struct {
+		write, reply string
+		wantFailure  bool
+	}{
+		// The server may have acted on the request: do not replay it.
+		"http request": {write: request, wantFailure: true},
+		// Once the server answered, a later reset is the server's business.
+		"answered handshake": {write: string(clientHello), reply: "x"},
+	} {
+		misses := &missLog{}
+		r := &Router{accessCache: newAccessCache(accessCacheTTL, nil)}
+		r.ProxyDial = func(string, string, uint16) (net.Conn, error) {
+			t.Errorf("%s: fell back to the proxy", name)
+			return nil, errors.New("unexpected proxy dial")
+		}
+		r.SetRuleMissObserver(misses.observe)
+
+		c := newFallbackConn(r, pipeServer(len(test.write), test.reply, nil))
+		if _, err := c.Write([]byte(test.write)); err != nil {
+			t.Fatalf("%s: write: %v", name, err)
+		}
+		_, _ = io.ReadAll(c)
+		c.Close()
+		if RouteOf(c) != RouteDirect {
+			t.Errorf("%s: route = %q, want direct", name, RouteOf(c))
+		}
+		if errs := misses.get(); len(errs) != 1 || (errs[0] != nil) != test.wantFailure {
+			t.Errorf("%s: rule misses = %v, want failure %v", name, errs, test.wantFailure)
+		}
+		if _, cached := r.accessCache.Peek("443:example.com"); cached {
+			t.Errorf("%s: learned an access verdict without a fallback", name)
+		}
+	}
+}
+
+func TestDialSmartFallsBackWhenDetectedDirectDialFails(t *testing.T) {
+	t.Parallel()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).AddrPort().Port()
+	_ = ln.Close()
+
+	proxyErr := errors.New("proxy called")
+	var routes []RouteCategory
+	misses := &missLog{}
+	r := newTestRouter(t, nil, "", "223.5.5.5", "", func(network, host string, port uint16) (net.Conn, error) {
+		return nil, proxyErr
+	})
+	if err := r.AddCountryCIDRs("127.0.0.0/8"); err != nil {
+		t.Fatal(err)
+	}
+	r.SetRouteObserver(func(c RouteCategory, domain string) { routes = append(routes, c) })
+	r.SetRuleMissObserver(misses.observe)
+
+	if _, err := r.DialSmart("tcp", "127.0.0.1", port); !errors.Is(err, proxyErr) {
+		t.Fatalf("dial = %v, want the proxy retry's error", err)
+	}
+	if len(routes) != 1 || routes[0] != RouteProxy {
+		t.Fatalf("routes = %v, want the proxy retry only", routes)
+	}
+	if errs := misses.get(); len(errs) != 1 || errs[0] == nil {
+		t.Fatalf("rule misses = %v, want the failed direct dial", errs)
+	}
+}
+
+func TestReplayableTLS(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		in   []byte
+		want bool
+	}{
+		{nil, true},
+		{clientHello, true},
+		{clientHello[:3], true},
+		{append(append([]byte{}, clientHello...), clientHello...), true},
+		{append(append([]byte{}, clientHello...), 0x17, 0x03, 0x03, 0x00, 0x01, 0x00), false},
+		{[]byte("GET / HTTP/1.1\r\n"), false},
+	} {
+		if got := replayableTLS(test.in); got != test.want {
+			t.Errorf("replayableTLS(%x) = %v, want %v", test.in, got, test.want)
+		}
+	}
+}
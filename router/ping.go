@@ -1,13 +1,23 @@
 package router
 
 import (
+	"cmp"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/maypok86/otter/v2"
+	"github.com/sower-proxy/sower/internal/fsutil"
 )
 
 const (
@@ -17,18 +27,36 @@ const (
 
 type accessProbeFunc func(key string) (bool, error)
 
+// accessVerdict is a probe result and when it was made, or when an
+// operator pinned it.
+type accessVerdict struct {
+	reachable bool
+	at        time.Time
+}
+
+// accessProbeCache caches access probe verdicts per "port:domain" key for
+// ttl. Pinned verdicts sit beside the cache: they never expire, are never
+// evicted for size, and win over probing until they are evicted by hand.
 type accessProbeCache struct {
-	cache *otter.Cache[string, bool]
+	cache *otter.Cache[string, accessVerdict]
 	probe accessProbeFunc
+	ttl   time.Duration
+	file  string
+	dirty atomic.Bool
+
+	mu   sync.RWMutex
+	pins map[string]accessVerdict
 }
 
 func newAccessCache(ttl time.Duration, probe accessProbeFunc) *accessProbeCache {
 	return &accessProbeCache{
-		cache: otter.Must(&otter.Options[string, bool]{
+		cache: otter.Must(&otter.Options[string, accessVerdict]{
 			MaximumSize:      accessCacheMaxEntries,
-			ExpiryCalculator: otter.ExpiryWriting[string, bool](ttl),
+			ExpiryCalculator: otter.ExpiryWriting[string, accessVerdict](ttl),
 		}),
 		probe: probe,
+		ttl:   ttl,
+		pins:  make(map[string]accessVerdict),
 	}
 }
 
@@ -36,11 +64,268 @@ func (c *accessProbeCache) Get(key string) (bool, error) {
 	if c == nil || c.probe == nil {
 		return false, nil
 	}
-	return c.cache.Get(context.Background(), key, otter.LoaderFunc[string, bool](
-		func(_ context.Context, key string) (bool, error) {
-			return c.probe(key)
+	if v, ok := c.pinned(key); ok {
+		return v.reachable, nil
+	}
+	v, err := c.cache.Get(context.Background(), key, otter.LoaderFunc[string, accessVerdict](
+		func(_ context.Context, key string) (accessVerdict, error) {
+			reachable, err := c.probe(key)
+			if err != nil {
+				return accessVerdict{}, err
+			}
+			c.dirty.Store(true)
+			return accessVerdict{reachable: reachable, at: time.Now()}, nil
 		},
 	))
+	return v.reachable, err
+}
+
+// Peek returns the cached verdict for key without probing; cached is false
+// when there is none.
+func (c *accessProbeCache) Peek(key string) (reachable, cached bool) {
+	if c == nil {
+		return false, false
+	}
+	if v, ok := c.pinned(key); ok {
+		return v.reachable, true
+	}
+	v, ok := c.cache.GetIfPresent(key)
+	return v.reachable, ok
+}
+
+func (c *accessProbeCache) pinned(key string) (accessVerdict, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	v, ok := c.pins[key]
+	return v, ok
+}
+
+// Pin stores a verdict for key that holds until it is evicted.
+func (c *accessProbeCache) Pin(key string, reachable bool) {
+	c.mu.Lock()
+	c.pins[key] = accessVerdict{reachable: reachable, at: time.Now()}
+	c.mu.Unlock()
+	c.cache.Invalidate(key)
+	c.dirty.Store(true)
+}
+
+// Learn stores a verdict for key found without probing, e.g. a direct
+// connection that failed. It leaves a pinned verdict alone.
+func (c *accessProbeCache) Learn(key string, reachable bool) {
+	if c == nil {
+		return
+	}
+	if _, ok := c.pinned(key); ok {
+		return
+	}
+	c.cache.Set(key, accessVerdict{reachable: reachable, at: time.Now()})
+	c.dirty.Store(true)
+}
+
+// Evict drops the verdict for key, pinned or not, so the next connection
+// probes again. It reports whether there was one.
+func (c *accessProbeCache) Evict(key string) bool {
+	c.mu.Lock()
+	_, pinned := c.pins[key]
+	delete(c.pins, key)
+	c.mu.Unlock()
+	_, cached := c.cache.Invalidate(key)
+	if pinned || cached {
+		c.dirty.Store(true)
+	}
+	return pinned || cached
+}
+
+// Flush drops every verdict, pins included, and returns how many there
+// were.
+func (c *accessProbeCache) Flush() int {
+	n := len(c.entries())
+	c.mu.Lock()
+	clear(c.pins)
+	c.mu.Unlock()
+	c.cache.InvalidateAll()
+	c.dirty.Store(true)
+	return n
+}
+
+// accessRecord is the persisted and listed form of a verdict.
+type accessRecord struct {
+	Key       string    `json:"key"`
+	Reachable bool      `json:"reachable"`
+	At        time.Time `json:"at"`
+	Pinned    bool      `json:"pinned,omitempty"`
+}
+
+// entries returns every live verdict, pins first shadowing probed ones.
+func (c *accessProbeCache) entries() []accessRecord {
+	c.mu.RLock()
+	out := make([]accessRecord, 0, len(c.pins)+c.cache.EstimatedSize())
+	for key, v := range c.pins {
+		out = append(out, accessRecord{Key: key, Reachable: v.reachable, At: v.at, Pinned: true})
+	}
+	c.mu.RUnlock()
+	for key, v := range c.cache.All() {
+		if _, ok := c.pinned(key); ok {
+			continue
+		}
+		out = append(out, accessRecord{Key: key, Reachable: v.reachable, At: v.at})
+	}
+	return out
+}
+
+// Save writes the verdicts to the cache file if they changed since the
+// last save. It is a no-op for caches without a file.
+func (c *accessProbeCache) Save() error {
+	if c.file == "" || !c.dirty.Swap(false) {
+		return nil
+	}
+	data, err := json.Marshal(c.entries())
+	if err == nil {
+		err = fsutil.WriteFileAtomic(c.file, data)
+	}
+	if err != nil {
+		c.dirty.Store(true)
+		return fmt.Errorf("save access cache %s: %w", c.file, err)
+	}
+	return nil
+}
+
+// load restores the verdicts saved in the cache file. Probed verdicts keep
+// their original expiry, so the ones that ran out while sower was down are
+// dropped; malformed records are skipped one by one.
+func (c *accessProbeCache) load() error {
+	data, err := os.ReadFile(c.file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("read access cache %s: %w", c.file, err)
+	}
+	var records []accessRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return fmt.Errorf("parse access cache %s: %w", c.file, err)
+	}
+
+	restored := 0
+	for _, rec := range records {
+		if _, _, err := accessProbeTarget(rec.Key); err != nil {
+			continue
+		}
+		v := accessVerdict{reachable: rec.Reachable, at: rec.At}
+		if rec.Pinned {
+			c.mu.Lock()
+			c.pins[rec.Key] = v
+			c.mu.Unlock()
+			restored++
+			continue
+		}
+		left := c.ttl - time.Since(rec.At)
+		if left <= 0 || left > c.ttl {
+			continue
+		}
+		c.cache.Set(rec.Key, v)
+		c.cache.SetExpiresAfter(rec.Key, left)
+		restored++
+	}
+	if restored > 0 {
+		slog.Info("restored access cache", "count", restored, "file", c.file)
+	}
+	return nil
+}
+
+// AccessEntry is one access probe verdict: whether domain:port answered a
+// probe, and when it was probed or pinned. Pinned verdicts never expire;
+// the others expire at Expires.
+type AccessEntry struct {
+	Domain    string
+	Port      uint16
+	Reachable bool
+	Pinned    bool
+	At        time.Time
+	Expires   time.Time
+}
+
+// AccessEntries lists the cached access probe verdicts, by domain then
+// port.
+func (r *Router) AccessEntries() []AccessEntry {
+	if r.accessCache == nil {
+		return nil
+	}
+	records := r.accessCache.entries()
+	out := make([]AccessEntry, 0, len(records))
+	for _, rec := range records {
+		portStr, domain, ok := strings.Cut(rec.Key, ":")
+		port, err := strconv.ParseUint(portStr, 10, 16)
+		if !ok || err != nil {
+			continue
+		}
+		e := AccessEntry{Domain: domain, Port: uint16(port), Reachable: rec.Reachable, Pinned: rec.Pinned, At: rec.At}
+		if !rec.Pinned {
+			e.Expires = rec.At.Add(r.accessCache.ttl)
+		}
+		out = append(out, e)
+	}
+	slices.SortFunc(out, func(a, b AccessEntry) int {
+		if c := strings.Compare(a.Domain, b.Domain); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Port, b.Port)
+	})
+	return out
+}
+
+// EvictAccess drops the verdict for domain:port, so the next connection
+// probes again. It reports whether there was one.
+func (r *Router) EvictAccess(domain string, port uint16) bool {
+	if r.accessCache == nil {
+		return false
+	}
+	return r.accessCache.Evict(accessCacheKey(domain, port))
+}
+
+// FlushAccess drops every access probe verdict, pins included, and
+// returns how many there were.
+func (r *Router) FlushAccess() int {
+	if r.accessCache == nil {
+		return 0
+	}
+	return r.accessCache.Flush()
+}
+
+// ErrAccessPort reports an access cache operation on a port that is never
+// probed.
+var ErrAccessPort = errors.New("only ports 80 and 443 are probed")
+
+// PinAccess fixes the verdict for domain:port until it is evicted. Only
+// ports 80 and 443 are probed, so only they can be pinned.
+func (r *Router) PinAccess(domain string, port uint16, reachable bool) error {
+	if port != 80 && port != 443 {
+		return fmt.Errorf("%w: port %d", ErrAccessPort, port)
+	}
+	if r.accessCache == nil {
+		return errors.New("access cache unavailable")
+	}
+	r.accessCache.Pin(accessCacheKey(domain, port), reachable)
+	return nil
+}
+
+// SetAccessCacheFile restores the access cache from file and saves it
+// there from then on. It must be called before serving.
+func (r *Router) SetAccessCacheFile(file string) error {
+	if r.accessCache == nil || file == "" {
+		return nil
+	}
+	r.accessCache.file = file
+	return r.accessCache.load()
+}
+
+// SaveAccessCache writes the access cache to its file if it changed. It
+// is a no-op without a file.
+func (r *Router) SaveAccessCache() error {
+	if r.accessCache == nil {
+		return nil
+	}
+	return r.accessCache.Save()
 }
 
 func (r *Router) isAccess(domain string, port uint16) bool {
@@ -78,7 +363,7 @@ func httpPing(key string) (bool, error) {
 }
 
 func accessCacheKey(domain string, port uint16) string {
-	return fmt.Sprintf("%d:%s", port, domain)
+	return fmt.Sprintf("%d:%s", port, strings.ToLower(strings.TrimSuffix(domain, ".")))
 }
 
 func accessProbeTarget(key string) (string, string, error) {
@@ -0,0 +1,105 @@
+package router
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAccessCachePinEvictFlush(t *testing.T) {
+	t.Parallel()
+
+	probes := 0
+	r := &Router{accessCache: newAccessCache(accessCacheTTL, func(string) (bool, error) {
+		probes++
+		return true, nil
+	})}
+
+	if !r.isAccess("Example.com.", 443) || !r.isAccess("example.com", 443) || probes != 1 {
+		t.Fatalf("probes = %d, want one probe shared by equivalent names", probes)
+	}
+	if err := r.PinAccess("example.com", 443, false); err != nil {
+		t.Fatalf("pin: %v", err)
+	}
+	if err := r.PinAccess("example.com", 8443, false); !errors.Is(err, ErrAccessPort) {
+		t.Fatalf("pin on 8443 = %v, want ErrAccessPort", err)
+	}
+	if r.isAccess("example.com", 443) {
+		t.Fatal("pinned unreachable verdict did not win over the probed one")
+	}
+	r.isAccess("example.org", 80)
+
+	entries := r.AccessEntries()
+	if len(entries) != 2 || entries[0].Domain != "example.com" || !entries[0].Pinned || !entries[0].Expires.IsZero() {
+		t.Fatalf("entries = %+v", entries)
+	}
+	if e := entries[1]; e.Domain != "example.org" || e.Port != 80 || !e.Reachable || e.Expires.Sub(e.At) != accessCacheTTL {
+		t.Fatalf("probed entry = %+v", e)
+	}
+
+	if !r.EvictAccess("example.com", 443) || r.EvictAccess("example.com", 443) {
+		t.Fatal("evict should report the pinned entry once")
+	}
+	if !r.isAccess("example.com", 443) || probes != 3 {
+		t.Fatalf("evicted entry was not probed again: probes = %d", probes)
+	}
+	if n := r.FlushAccess(); n != 2 || len(r.AccessEntries()) != 0 {
+		t.Fatalf("flush = %d, left %+v", n, r.AccessEntries())
+	}
+}
+
+func TestAccessCachePersists(t *testing.T) {
+	t.Parallel()
+
+	file := filepath.Join(t.TempDir(), "access.json")
+	probe := func(string) (bool, error) { return true, nil }
+	r := &Router{accessCache: newAccessCache(accessCacheTTL, probe)}
+	if err := r.SetAccessCacheFile(file); err != nil {
+		t.Fatalf("load missing file: %v", err)
+	}
+	r.isAccess("example.org", 443)
+	if err := r.PinAccess("example.com", 80, false); err != nil {
+		t.Fatalf("pin: %v", err)
+	}
+	if err := r.SaveAccessCache(); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	// A verdict that ran out while sower was down, and junk, are dropped.
+	var records []accessRecord
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &records); err != nil {
+		t.Fatal(err)
+	}
+	records = append(records,
+		accessRecord{Key: "443:stale.example", Reachable: true, At: time.Now().Add(-2 * accessCacheTTL)},
+		accessRecord{Key: "8080:example.net", Reachable: true, At: time.Now()},
+	)
+	if data, err = json.Marshal(records); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := &Router{accessCache: newAccessCache(accessCacheTTL, func(string) (bool, error) {
+		t.Error("restored verdict was probed again")
+		return false, nil
+	})}
+	if err := restored.SetAccessCacheFile(file); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	entries := restored.AccessEntries()
+	if len(entries) != 2 || !entries[0].Pinned || entries[0].Reachable || entries[1].Domain != "example.org" {
+		t.Fatalf("restored entries = %+v", entries)
+	}
+	if !restored.isAccess("example.org", 443) || restored.isAccess("example.com", 80) {
+		t.Fatal("restored verdicts not used")
+	}
+}
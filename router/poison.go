@@ -0,0 +1,278 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/maypok86/otter/v2"
+	"github.com/miekg/dns"
+)
+
+const (
+	// poisonedDomainTTL keeps a detected domain on the trusted path without
+	// re-verifying every query; injection for a name is rarely transient.
+	poisonedDomainTTL        = 6 * time.Hour
+	poisonedDomainMaxEntries = 4096
+	// verifiedDomainTTL spares a domain whose fast answer matched the
+	// trusted resolver the proxy round trip on repeat queries, typically
+	// served from the upstream's cache; it is short so that injection that
+	// starts later is still caught.
+	verifiedDomainTTL = 10 * time.Minute
+)
+
+// PoisonConfig configures poisoned-answer detection for forwarded A/AAAA
+// queries. Trusted is the resolver queried over TCP through the proxy
+// dialer, both to verify suspicious answers and to requery poisoned names;
+// an empty Trusted disables detection.
+type PoisonConfig struct {
+	Trusted string
+	// BogusIPs lists IPs or CIDRs that injected answers are known to use.
+	// An answer containing one is poisoned without verification.
+	BogusIPs []string
+	// MinRTT flags answers from a non-internal upstream that arrive faster
+	// than any plausible round trip; they are verified against the trusted
+	// resolver. Zero disables the check.
+	MinRTT time.Duration
+}
+
+// PoisonObserver receives every domain whose direct answer was detected as
+// poisoned, once per detection.
+type PoisonObserver func(domain string)
+
+// SetPoisonObserver installs the poisoned-answer observer, or clears it with
+// a nil argument.
+func (r *Router) SetPoisonObserver(fn PoisonObserver) {
+	r.poisonObserver = fn
+}
+
+type poisonGuard struct {
+	trustedHost string
+	trustedPort uint16
+	bogus       []netip.Prefix
+	minRTT      time.Duration
+	// poisoned remembers detected domains so repeat queries go straight to
+	// the trusted path instead of handing clients the injected answer again.
+	poisoned *otter.Cache[string, struct{}]
+	// verified remembers domains whose fast answers the trusted resolver
+	// confirmed, so MinRTT does not verify them on every query.
+	verified *otter.Cache[string, struct{}]
+}
+
+// SetPoisonDetection enables poisoned-answer detection, or disables it when
+// cfg.Trusted is empty. It must be called before serving.
+func (r *Router) SetPoisonDetection(cfg PoisonConfig) error {
+	if strings.TrimSpace(cfg.Trusted) == "" {
+		r.poison = nil
+		return nil
+	}
+	host, port, err := splitDNSServer(cfg.Trusted)
+	if err != nil {
+		return fmt.Errorf("parse trusted dns %q: %w", cfg.Trusted, err)
+	}
+	g := &poisonGuard{
+		trustedHost: host,
+		trustedPort: port,
+		minRTT:      cfg.MinRTT,
+		poisoned: otter.Must(&otter.Options[string, struct{}]{
+			MaximumSize:      poisonedDomainMaxEntries,
+			ExpiryCalculator: otter.ExpiryWriting[string, struct{}](poisonedDomainTTL),
+		}),
+		verified: otter.Must(&otter.Options[string, struct{}]{
+			MaximumSize:      poisonedDomainMaxEntries,
+			ExpiryCalculator: otter.ExpiryWriting[string, struct{}](verifiedDomainTTL),
+		}),
+	}
+	for _, s := range cfg.BogusIPs {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		prefix, err := parseIPOrPrefix(s)
+		if err != nil {
+			return fmt.Errorf("parse bogus ip %q: %w", s, err)
+		}
+		g.bogus = append(g.bogus, prefix)
+	}
+	r.poison = g
+	return nil
+}
+
+// guardPoison inspects a forwarded answer and returns the reply to serve:
+// the original when it looks genuine, or the trusted resolver's answer when
+// poisoning is detected. rtt is how long the upstream took to answer.
+func (r *Router) guardPoison(req, resp *dns.Msg, upstream string, rtt time.Duration) *dns.Msg {
+	g := r.poison
+	if g == nil || resp == nil || len(req.Question) != 1 || !isAddressQuestion(req.Question[0].Qtype) {
+		return resp
+	}
+	domain := strings.ToLower(strings.TrimSuffix(req.Question[0].Name, "."))
+
+	if _, known := g.poisoned.GetIfPresent(domain); known {
+		if trusted, err := r.exchangeTrusted(req); err == nil {
+			return trusted
+		}
+		return resp
+	}
+
+	answer := answerIPs(resp)
+	if len(answer) == 0 {
+		return resp
+	}
+
+	reason := ""
+	var trusted *dns.Msg
+	switch {
+	case g.isBogus(answer):
+		reason = "bogus ip"
+	case g.minRTT > 0 && rtt < g.minRTT && !isInternalHost(upstream):
+		if _, ok := g.verified.GetIfPresent(domain); ok {
+			return resp
+		}
+		// Too fast to have come from the upstream: verify through the
+		// proxy. A failed verification keeps the original answer rather
+		// than failing the query.
+		var err error
+		trusted, err = r.exchangeTrusted(req)
+		if err != nil {
+			slog.Debug("verify fast dns answer", "error", err, "domain", domain)
+			return resp
+		}
+		if trustedIPs := answerIPs(trusted); len(trustedIPs) == 0 || overlaps(answer, trustedIPs) {
+			g.verified.Set(domain, struct{}{})
+			return resp
+		}
+		reason = "fast answer differs from trusted resolver"
+	default:
+		return resp
+	}
+
+	g.poisoned.Set(domain, struct{}{})
+	slog.Info("poisoned dns answer detected", "domain", domain, "upstream", upstream, "rtt", rtt, "reason", reason)
+	if r.poisonObserver != nil {
+		r.poisonObserver(domain)
+	}
+
+	if trusted == nil {
+		var err error
+		trusted, err = r.exchangeTrusted(req)
+		if err != nil {
+			// Never hand out a known-bogus answer: fail the query instead.
+			slog.Warn("requery poisoned domain", "error", err, "domain", domain)
+			return r.dnsFail(req, dns.RcodeServerFailure)
+		}
+	}
+	return trusted
+}
+
+// exchangeTrusted resolves req over TCP DNS through the proxy dialer, so the
+// query never crosses the network path where injection happens.
+func (r *Router) exchangeTrusted(req *dns.Msg) (*dns.Msg, error) {
+	g := r.poison
+	if r.ProxyDial == nil {
+		return nil, errors.New("proxy dialer unavailable")
+	}
+	conn, err := r.ProxyDial("tcp", g.trustedHost, g.trustedPort)
+	if err != nil {
+		return nil, fmt.Errorf("dial trusted dns: %w", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(2 * dnsTimeout))
+
+	msg := req.Copy()
+	stripECS(msg)
+	dc := &dns.Conn{Conn: conn}
+	if err := dc.WriteMsg(msg); err != nil {
+		return nil, fmt.Errorf("write trusted dns query: %w", err)
+	}
+	resp, err := dc.ReadMsg()
+	if err != nil {
+		return nil, fmt.Errorf("read trusted dns answer: %w", err)
+	}
+	if resp.Id != msg.Id {
+		return nil, errors.New("trusted dns answer id mismatch")
+	}
+	return resp, nil
+}
+
+func (g *poisonGuard) isBogus(ips []netip.Addr) bool {
+	for _, ip := range ips {
+		for _, prefix := range g.bogus {
+			if prefix.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func answerIPs(resp *dns.Msg) []netip.Addr {
+	var out []netip.Addr
+	for _, rr := range resp.Answer {
+		var ip net.IP
+		switch v := rr.(type) {
+		case *dns.A:
+			ip = v.A
+		case *dns.AAAA:
+			ip = v.AAAA
+		default:
+			continue
+		}
+		if addr, ok := netip.AddrFromSlice(ip); ok {
+			out = append(out, addr.Unmap())
+		}
+	}
+	return out
+}
+
+func overlaps(a, b []netip.Addr) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func parseIPOrPrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// splitDNSServer parses "host" or "host:port" with port 53 as the default.
+func splitDNSServer(s string) (string, uint16, error) {
+	s = strings.TrimSpace(s)
+	if ip := net.ParseIP(strings.Trim(s, "[]")); ip != nil {
+		return ip.String(), 53, nil
+	}
+	if !strings.Contains(s, ":") {
+		return s, 53, nil
+	}
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return "", 0, err
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || p == 0 {
+		return "", 0, fmt.Errorf("invalid port %q", port)
+	}
+	return host, uint16(p), nil
+}
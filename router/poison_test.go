@@ -0,0 +1,166 @@
+package router
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// startTCPTestDNSServer serves handler over TCP and returns its address.
+func startTCPTestDNSServer(t *testing.T, handler dns.Handler) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen tcp: %v", err)
+	}
+	server := &dns.Server{Listener: ln, Handler: handler}
+	go func() { _ = server.ActivateAndServe() }()
+	t.Cleanup(func() { _ = server.Shutdown() })
+	return ln.Addr().String()
+}
+
+func answerA(ip string) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Answer = append(m.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.ParseIP(ip),
+		})
+		_ = w.WriteMsg(m)
+	}
+}
+
+// newPoisonTestRouter returns a router whose proxy dialer reaches a trusted
+// TCP resolver answering 93.184.216.34, counting trusted queries.
+func newPoisonTestRouter(t *testing.T, cfg PoisonConfig) (*Router, *atomic.Int32, *[]string) {
+	t.Helper()
+
+	trustedAddr := startTCPTestDNSServer(t, answerA("93.184.216.34"))
+	var dials atomic.Int32
+	r := newTestRouter(t, nil, "", "223.5.5.5", "", func(network, host string, port uint16) (net.Conn, error) {
+		dials.Add(1)
+		return net.Dial("tcp", trustedAddr)
+	})
+	cfg.Trusted = "8.8.8.8"
+	if err := r.SetPoisonDetection(cfg); err != nil {
+		t.Fatalf("set poison detection: %v", err)
+	}
+	var reported []string
+	r.SetPoisonObserver(func(domain string) { reported = append(reported, domain) })
+	return r, &dials, &reported
+}
+
+func firstA(t *testing.T, resp *dns.Msg) string {
+	t.Helper()
+	if resp == nil || len(resp.Answer) == 0 {
+		t.Fatalf("no answer in %v", resp)
+	}
+	a, ok := resp.Answer[0].(*dns.A)
+	if !ok {
+		t.Fatalf("answer = %T, want *dns.A", resp.Answer[0])
+	}
+	return a.A.String()
+}
+
+func TestExchangeReplacesBogusAnswer(t *testing.T) {
+	t.Parallel()
+
+	r, dials, reported := newPoisonTestRouter(t, PoisonConfig{BogusIPs: []string{"243.185.187.0/24"}})
+	r.dns.upstreamAddrs = []string{startUDPTestDNSServer(t, answerA("243.185.187.39"))}
+
+	req := new(dns.Msg)
+	req.SetQuestion("blocked.example.", dns.TypeA)
+	resp, err := r.Exchange(req)
+	if err != nil {
+		t.Fatalf("exchange: %v", err)
+	}
+	if got := firstA(t, resp); got != "93.184.216.34" {
+		t.Fatalf("answer = %s, want the trusted resolver's answer", got)
+	}
+	if len(*reported) != 1 || (*reported)[0] != "blocked.example" {
+		t.Fatalf("reported = %v, want [blocked.example]", *reported)
+	}
+
+	// A detected domain skips the poisoned answer on later queries without
+	// being reported again.
+	resp, err = r.Exchange(req)
+	if err != nil {
+		t.Fatalf("second exchange: %v", err)
+	}
+	if got := firstA(t, resp); got != "93.184.216.34" {
+		t.Fatalf("second answer = %s, want the trusted resolver's answer", got)
+	}
+	if len(*reported) != 1 || dials.Load() != 2 {
+		t.Fatalf("reported %d times with %d trusted queries, want 1 and 2", len(*reported), dials.Load())
+	}
+}
+
+func TestGuardPoisonVerifiesFastPublicAnswers(t *testing.T) {
+	t.Parallel()
+
+	r, dials, reported := newPoisonTestRouter(t, PoisonConfig{MinRTT: 10 * time.Millisecond})
+	req := new(dns.Msg)
+	req.SetQuestion("fast.example.", dns.TypeA)
+
+	reply := func(ip string) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Answer = []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.ParseIP(ip),
+		}}
+		return m
+	}
+
+	// Slow answers and internal upstreams (e.g. a LAN cache) are trusted.
+	if got := firstA(t, r.guardPoison(req, reply("1.2.3.4"), "203.0.113.1:53", 50*time.Millisecond)); got != "1.2.3.4" {
+		t.Fatalf("slow answer replaced with %s", got)
+	}
+	if got := firstA(t, r.guardPoison(req, reply("1.2.3.4"), "192.168.1.1:53", time.Millisecond)); got != "1.2.3.4" {
+		t.Fatalf("internal upstream answer replaced with %s", got)
+	}
+	if dials.Load() != 0 {
+		t.Fatalf("trusted resolver queried %d times for unsuspicious answers", dials.Load())
+	}
+
+	// A fast answer that agrees with the trusted resolver is kept.
+	if got := firstA(t, r.guardPoison(req, reply("93.184.216.34"), "203.0.113.1:53", time.Millisecond)); got != "93.184.216.34" {
+		t.Fatalf("agreeing answer replaced with %s", got)
+	}
+	if len(*reported) != 0 {
+		t.Fatalf("agreeing answer reported as poisoned: %v", *reported)
+	}
+	// The confirmed domain is not verified again on repeat queries.
+	if got := firstA(t, r.guardPoison(req, reply("93.184.216.34"), "203.0.113.1:53", time.Millisecond)); got != "93.184.216.34" {
+		t.Fatalf("verified answer replaced with %s", got)
+	}
+	if dials.Load() != 1 {
+		t.Fatalf("trusted resolver queried %d times, want 1 for a verified domain", dials.Load())
+	}
+
+	// A fast answer that disagrees is replaced and reported.
+	req.SetQuestion("poisoned.example.", dns.TypeA)
+	if got := firstA(t, r.guardPoison(req, reply("1.2.3.4"), "203.0.113.1:53", time.Millisecond)); got != "93.184.216.34" {
+		t.Fatalf("fast disagreeing answer = %s, want the trusted answer", got)
+	}
+	if len(*reported) != 1 || (*reported)[0] != "poisoned.example" {
+		t.Fatalf("reported = %v, want [fast.example]", *reported)
+	}
+}
+
+func TestSetPoisonDetectionRejectsInvalidBogusIP(t *testing.T) {
+	t.Parallel()
+
+	r := newTestRouter(t, nil, "", "223.5.5.5", "", nil)
+	if err := r.SetPoisonDetection(PoisonConfig{Trusted: "8.8.8.8", BogusIPs: []string{"not-an-ip"}}); err == nil {
+		t.Fatal("expected error for an invalid bogus ip")
+	}
+	if err := r.SetPoisonDetection(PoisonConfig{BogusIPs: []string{"not-an-ip"}}); err != nil {
+		t.Fatalf("disabled detection should ignore its settings: %v", err)
+	}
+}
@@ -28,13 +28,21 @@ type (
 		routeObserver    RouteObserver
 		ruleHitObserver  RuleHitObserver
 		ruleMissObserver RuleMissObserver
+		dnsQueryObserver DNSQueryObserver
+		poisonObserver   PoisonObserver
+		poison           *poisonGuard
 		accessCache      *accessProbeCache
+		fakeIP           *FakeIPPool
+		blockMode        DNSBlockMode
 
 		dns struct {
 			upstreamDNS  string
 			fallbackDNS  string
 			serveIPs     []net.IP
 			getDNSServer func() ([]string, error)
+			// getDNSServer6 is optional IPv6 discovery merged after the
+			// DHCPv4 results.
+			getDNSServer6 func() ([]string, error)
 
 			sync.Mutex
 			upstreamAddrs     []string
@@ -60,6 +68,11 @@ type (
 
 var ErrBlocked = errors.New("route blocked")
 
+// ErrUDPNotProxied reports a UDP flow routed to the proxy. The upstream
+// transports carry TCP only, so such flows are dropped and clients such as
+// QUIC fall back to TCP, which is proxied.
+var ErrUDPNotProxied = errors.New("udp cannot be proxied")
+
 // RouteCategory identifies a connection routing decision.
 type RouteCategory string
 
@@ -69,6 +82,25 @@ const (
 	RouteProxy  RouteCategory = "proxy"
 )
 
+// routedConn is an upstream connection tagged with the route that dialed
+// it, for callers that report per-connection routes.
+type routedConn struct {
+	net.Conn
+	route RouteCategory
+}
+
+// RouteOf returns the route that dialed conn, or "" when the Router did not
+// dial it.
+func RouteOf(conn net.Conn) RouteCategory {
+	switch rc := conn.(type) {
+	case *routedConn:
+		return rc.route
+	case *fallbackConn:
+		return rc.currentRoute()
+	}
+	return ""
+}
+
 // RouteObserver receives every connection routing decision, exactly once per
 // connection: block/direct decisions in DialSmart, proxy decisions in
 // DialProxyOnly (which also covers the HTTP/HTTPS proxy paths).
@@ -94,8 +126,11 @@ func (r *Router) SetRuleHitObserver(fn RuleHitObserver) {
 
 // RuleMissObserver receives every routing decision that matched no block,
 // direct, or proxy rule — detection-based direct and fallback proxy — once
-// per connection. Rule-hit decisions are not reported here.
-type RuleMissObserver func(domain string)
+// per connection, after the dial, with the route taken and the dial error.
+// A detection-based direct connection is reported once it answers or
+// fails; when it fails and falls back to the proxy, the report carries the
+// direct route and its error. Rule-hit decisions are not reported here.
+type RuleMissObserver func(domain string, route RouteCategory, err error)
 
 // SetRuleMissObserver installs the rule-miss observer, or clears it with a
 // nil argument.
@@ -115,9 +150,9 @@ func (r *Router) observeRuleHit(category RouteCategory, domain string) {
 	}
 }
 
-func (r *Router) observeRuleMiss(domain string) {
+func (r *Router) observeRuleMiss(domain string, route RouteCategory, err error) {
 	if r.ruleMissObserver != nil {
-		r.ruleMissObserver(domain)
+		r.ruleMissObserver(domain, route, err)
 	}
 }
 
@@ -133,6 +168,7 @@ func NewRouter(serveIPs []string, upstreamDNS, fallbackDNS, mmdbFile string, pro
 	r.dns.upstreamDNS = upstreamDNS
 	r.dns.fallbackDNS = fallbackDNS
 	r.dns.getDNSServer = dhcp.GetDNSServer
+	r.dns.getDNSServer6 = dhcp.GetDNSServer6
 	for _, serveIP := range serveIPs {
 		if ip := net.ParseIP(serveIP); ip != nil {
 			r.dns.serveIPs = append(r.dns.serveIPs, ip)
@@ -204,12 +240,42 @@ func (r *Router) Dial(network, domain string, port uint16) (net.Conn, error) {
 }
 
 func (r *Router) DialSmart(network, domain string, port uint16) (net.Conn, error) {
+	return r.dialSmart(network, domain, domain, port)
+}
+
+// DialSniffed routes on domain, a name sniffed from the connection's first
+// bytes, but dials target, the IP the client asked for. Passing the domain
+// as target dials the name instead.
+func (r *Router) DialSniffed(network, domain, target string, port uint16) (net.Conn, error) {
+	return r.dialSmart(network, domain, target, port)
+}
+
+func (r *Router) dialSmart(network, domain, target string, port uint16) (net.Conn, error) {
 	ctx := context.Background()
-	addr := net.JoinHostPort(domain, strconv.FormatUint(uint64(port), 10))
+	addr := net.JoinHostPort(target, strconv.FormatUint(uint64(port), 10))
 
 	// 1. rule_based( block > direct > proxy )
 	// 2. detect_based( CN IP || access site )
 	// 3. fallback( proxy )
+	// A fake IP only ever reaches a dialer for a proxy-routed domain, and
+	// the address itself is not routable: map it back and proxy the
+	// domain, unless the domain has since been blocked.
+	if r.isFakeIP(domain) {
+		mapped, ok := r.FakeIPDomain(domain)
+		if !ok {
+			return nil, fmt.Errorf("dial %s: %w", addr, errFakeIPUnmapped)
+		}
+		if r.BlockRule.Match(mapped) {
+			r.observe(RouteBlock, mapped)
+			r.observeRuleHit(RouteBlock, mapped)
+			return nil, ErrBlocked
+		}
+		if r.ProxyRule.Match(mapped) {
+			r.observeRuleHit(RouteProxy, mapped)
+		}
+		return r.DialProxyOnly(network, mapped, port)
+	}
+
 	switch {
 	case r.BlockRule.Match(domain):
 		r.observe(RouteBlock, domain)
@@ -221,28 +287,115 @@ func (r *Router) DialSmart(network, domain string, port uint16) (net.Conn, error
 		return r.directDial(ctx, network, addr)
 	case r.ProxyRule.Match(domain):
 		r.observeRuleHit(RouteProxy, domain)
-		return r.DialProxyOnly(network, domain, port)
+		return r.dialProxy(network, domain, target, port)
 	case r.localSite(ctx, domain), r.isAccess(domain, port):
-		r.observe(RouteDirect, domain)
-		r.observeRuleMiss(domain)
-		return r.directDial(ctx, network, addr)
+		return r.dialDetected(ctx, network, domain, target, addr, port)
 	default:
-		r.observeRuleMiss(domain)
-		return r.DialProxyOnly(network, domain, port)
+		conn, err := r.dialProxy(network, domain, target, port)
+		r.observeRuleMiss(domain, RouteProxy, err)
+		return conn, err
 	}
 }
 
 func (r *Router) DialProxyOnly(network, domain string, port uint16) (net.Conn, error) {
+	return r.dialProxy(network, domain, domain, port)
+}
+
+// DialForced dials a connection whose route was chosen by the listener
+// rather than the rules: RouteDirect dials target directly, RouteProxy
+// through proxyDial, or ProxyDial when it is nil. Block rules still apply
+// to domain, and a fake-IP domain or target maps back to its name.
+func (r *Router) DialForced(route RouteCategory, network, domain, target string, port uint16, proxyDial ProxyDialFn) (net.Conn, error) {
+	for _, host := range []*string{&domain, &target} {
+		if !r.isFakeIP(*host) {
+			continue
+		}
+		mapped, ok := r.FakeIPDomain(*host)
+		if !ok {
+			return nil, fmt.Errorf("dial %s:%d: %w", *host, port, errFakeIPUnmapped)
+		}
+		*host = mapped
+	}
+	if r.BlockRule.Match(domain) {
+		r.observe(RouteBlock, domain)
+		r.observeRuleHit(RouteBlock, domain)
+		return nil, ErrBlocked
+	}
+
+	switch route {
+	case RouteDirect:
+		r.observe(RouteDirect, domain)
+		return r.directDial(context.Background(), network, net.JoinHostPort(target, strconv.FormatUint(uint64(port), 10)))
+	case RouteProxy:
+		if proxyDial == nil {
+			return r.dialProxy(network, domain, target, port)
+		}
+		r.observe(RouteProxy, domain)
+		start := time.Now()
+		rc, err := proxyDial(network, target, port)
+		if err != nil {
+			return nil, fmt.Errorf("proxy dial %s:%d, spend (%s): %w", target, port, time.Since(start), err)
+		}
+		return &routedConn{Conn: rc, route: RouteProxy}, nil
+	default:
+		return nil, fmt.Errorf("unsupported forced route %q", route)
+	}
+}
+
+// dialProxy reports the proxy decision for domain and dials target through
+// the upstream.
+func (r *Router) dialProxy(network, domain, target string, port uint16) (net.Conn, error) {
 	if r.ProxyDial == nil {
 		return nil, fmt.Errorf("proxy dialer unavailable")
 	}
 	r.observe(RouteProxy, domain)
 	start := time.Now()
-	rc, err := r.ProxyDial(network, domain, port)
+	rc, err := r.ProxyDial(network, target, port)
 	if err != nil {
-		return nil, fmt.Errorf("proxy dial %s:%d, spend (%s): %w", domain, port, time.Since(start), err)
+		return nil, fmt.Errorf("proxy dial %s:%d, spend (%s): %w", target, port, time.Since(start), err)
+	}
+	return &routedConn{Conn: rc, route: RouteProxy}, nil
+}
+
+// DialUDP applies the DialSmart decision to a UDP flow, routing on domain
+// and dialing target as DialSniffed does; without a sniffed name both are
+// the destination. Block and direct decisions behave as for TCP; a proxy
+// decision returns ErrUDPNotProxied. The access probe is skipped because it
+// checks HTTP reachability, which says nothing about UDP.
+func (r *Router) DialUDP(domain, target string, port uint16) (net.Conn, error) {
+	ctx := context.Background()
+	addr := net.JoinHostPort(target, strconv.FormatUint(uint64(port), 10))
+
+	if r.isFakeIP(domain) {
+		mapped, ok := r.FakeIPDomain(domain)
+		if !ok {
+			return nil, fmt.Errorf("dial %s: %w", addr, errFakeIPUnmapped)
+		}
+		if r.BlockRule.Match(mapped) {
+			r.observe(RouteBlock, mapped)
+			r.observeRuleHit(RouteBlock, mapped)
+			return nil, ErrBlocked
+		}
+		return nil, ErrUDPNotProxied
+	}
+
+	switch {
+	case r.BlockRule.Match(domain):
+		r.observe(RouteBlock, domain)
+		r.observeRuleHit(RouteBlock, domain)
+		return nil, ErrBlocked
+	case r.DirectRule.Match(domain):
+		r.observe(RouteDirect, domain)
+		r.observeRuleHit(RouteDirect, domain)
+		return r.directDial(ctx, "udp", addr)
+	case r.ProxyRule.Match(domain):
+		return nil, ErrUDPNotProxied
+	case r.localSite(ctx, domain):
+		r.observe(RouteDirect, domain)
+		return r.directDial(ctx, "udp", addr)
+	default:
+		return nil, ErrUDPNotProxied
 	}
-	return rc, nil
 }
 
 func (r *Router) directDial(ctx context.Context, network, addr string) (net.Conn, error) {
@@ -252,5 +405,5 @@ func (r *Router) directDial(ctx context.Context, network, addr string) (net.Conn
 	if err != nil {
 		return nil, fmt.Errorf("direct dial %s, spend (%s): %w", addr, time.Since(start), err)
 	}
-	return conn, nil
+	return &routedConn{Conn: conn, route: RouteDirect}, nil
 }
@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"net"
+	"slices"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -19,6 +20,9 @@ func newTestRouter(t *testing.T, serveIPs []string, upstreamDNS, fallbackDNS, mm
 	if err != nil {
 		t.Fatalf("new router: %v", err)
 	}
+	// Keep tests off the real network; tests that exercise discovery stub
+	// the hooks they need.
+	r.dns.getDNSServer6 = nil
 	return r
 }
 
@@ -191,6 +195,156 @@ func TestDialSmartFallsBackToProxyForUnknownTCP(t *testing.T) {
 	}
 }
 
+func TestDialUDPNeverUsesProxy(t *testing.T) {
+	t.Parallel()
+
+	r := newTestRouter(t, nil, "", "223.5.5.5", "", func(network, host string, port uint16) (net.Conn, error) {
+		t.Errorf("udp flow dialed through proxy: %s %s:%d", network, host, port)
+		return nil, errors.New("proxy called")
+	})
+	r.BlockRule.Add("**.ads.example")
+	r.ProxyRule.Add("**.proxied.example")
+	if err := r.AddCountryCIDRs("127.0.0.0/8"); err != nil {
+		t.Fatalf("add country cidrs: %v", err)
+	}
+
+	if _, err := r.DialUDP("tracker.ads.example", "tracker.ads.example", 443); !errors.Is(err, ErrBlocked) {
+		t.Fatalf("blocked udp err = %v, want ErrBlocked", err)
+	}
+	if _, err := r.DialUDP("www.proxied.example", "www.proxied.example", 443); !errors.Is(err, ErrUDPNotProxied) {
+		t.Fatalf("proxy-routed udp err = %v, want ErrUDPNotProxied", err)
+	}
+	if _, err := r.DialUDP("203.0.113.10", "203.0.113.10", 443); !errors.Is(err, ErrUDPNotProxied) {
+		t.Fatalf("fallback udp err = %v, want ErrUDPNotProxied", err)
+	}
+	conn, err := r.DialUDP("127.0.0.1", "127.0.0.1", 9)
+	if err != nil {
+		t.Fatalf("local udp dial: %v", err)
+	}
+	_ = conn.Close()
+}
+
+func TestDialSniffedRoutesOnDomainAndDialsTarget(t *testing.T) {
+	t.Parallel()
+
+	var gotHost string
+	proxyErr := errors.New("proxy called")
+	r := newTestRouter(t, nil, "", "223.5.5.5", "", func(network, host string, port uint16) (net.Conn, error) {
+		gotHost = host
+		return nil, proxyErr
+	})
+	r.BlockRule.Add("**.ads.example")
+	r.ProxyRule.Add("**.proxied.example")
+	var routed []string
+	r.SetRouteObserver(func(c RouteCategory, domain string) {
+		routed = append(routed, string(c)+" "+domain)
+	})
+
+	if _, err := r.DialSniffed("tcp", "tracker.ads.example", "203.0.113.10", 443); !errors.Is(err, ErrBlocked) {
+		t.Fatalf("sniffed blocked name err = %v, want ErrBlocked", err)
+	}
+	if _, err := r.DialSniffed("tcp", "www.proxied.example", "203.0.113.10", 443); !errors.Is(err, proxyErr) {
+		t.Fatalf("sniffed proxied name err = %v, want proxy error", err)
+	}
+	if gotHost != "203.0.113.10" {
+		t.Fatalf("proxy dialed %q, want the original IP", gotHost)
+	}
+	want := []string{"block tracker.ads.example", "proxy www.proxied.example"}
+	if !slices.Equal(routed, want) {
+		t.Fatalf("route observations = %v, want %v", routed, want)
+	}
+}
+
+func TestRuleMissObserverReportsRouteAndDialError(t *testing.T) {
+	t.Parallel()
+
+	proxyErr := errors.New("proxy called")
+	r := newTestRouter(t, nil, "", "223.5.5.5", "", func(network, host string, port uint16) (net.Conn, error) {
+		return nil, proxyErr
+	})
+	r.accessCache = newAccessCache(accessCacheTTL, func(key string) (bool, error) {
+		return false, nil
+	})
+	r.ProxyRule.Add("**.proxied.example")
+	type miss struct {
+		domain string
+		route  RouteCategory
+		err    error
+	}
+	var misses []miss
+	r.SetRuleMissObserver(func(domain string, route RouteCategory, err error) {
+		misses = append(misses, miss{domain, route, err})
+	})
+
+	if _, err := r.DialSmart("tcp", "203.0.113.10", 443); !errors.Is(err, proxyErr) {
+		t.Fatalf("fallback dial err = %v, want proxy error", err)
+	}
+	if _, err := r.DialSmart("tcp", "www.proxied.example", 443); !errors.Is(err, proxyErr) {
+		t.Fatalf("rule dial err = %v, want proxy error", err)
+	}
+	if len(misses) != 1 || misses[0].domain != "203.0.113.10" || misses[0].route != RouteProxy || !errors.Is(misses[0].err, proxyErr) {
+		t.Fatalf("rule misses = %+v, want one failed fallback proxy dial", misses)
+	}
+}
+
+func TestDialForcedIgnoresRoutingRulesButNotBlock(t *testing.T) {
+	t.Parallel()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			_ = conn.Close()
+		}
+	}()
+
+	r := newTestRouter(t, nil, "", "223.5.5.5", "", func(network, host string, port uint16) (net.Conn, error) {
+		t.Errorf("forced dial used the main upstream: %s %s:%d", network, host, port)
+		return nil, errors.New("proxy called")
+	})
+	r.BlockRule.Add("**.ads.example")
+	r.ProxyRule.Add("127.0.0.1")
+	r.DirectRule.Add("**.direct.example")
+	var routed []string
+	r.SetRouteObserver(func(c RouteCategory, domain string) {
+		routed = append(routed, string(c)+" "+domain)
+	})
+
+	port := uint16(ln.Addr().(*net.TCPAddr).Port)
+	conn, err := r.DialForced(RouteDirect, "tcp", "127.0.0.1", "127.0.0.1", port, nil)
+	if err != nil {
+		t.Fatalf("forced direct dial: %v", err)
+	}
+	if got := RouteOf(conn); got != RouteDirect {
+		t.Fatalf("RouteOf(forced direct conn) = %q", got)
+	}
+	_ = conn.Close()
+
+	var viaHost string
+	viaErr := errors.New("listener upstream called")
+	via := func(network, host string, port uint16) (net.Conn, error) {
+		viaHost = host
+		return nil, viaErr
+	}
+	if _, err := r.DialForced(RouteProxy, "tcp", "www.direct.example", "www.direct.example", 443, via); !errors.Is(err, viaErr) {
+		t.Fatalf("forced proxy err = %v, want the listener upstream error", err)
+	}
+	if viaHost != "www.direct.example" {
+		t.Fatalf("listener upstream dialed %q", viaHost)
+	}
+	if _, err := r.DialForced(RouteProxy, "tcp", "x.ads.example", "x.ads.example", 443, via); !errors.Is(err, ErrBlocked) {
+		t.Fatalf("forced blocked err = %v, want ErrBlocked", err)
+	}
+
+	want := []string{"direct 127.0.0.1", "proxy www.direct.example", "block x.ads.example"}
+	if !slices.Equal(routed, want) {
+		t.Fatalf("route observations = %v, want %v", routed, want)
+	}
+}
+
 func TestExchangeSkipsServeIPInUpstreamList(t *testing.T) {
 	t.Parallel()
 
@@ -861,6 +1015,40 @@ func TestCurrentUpstreamStateRefreshesDHCPUpstreams(t *testing.T) {
 	}
 }
 
+func TestBuildUpstreamAddrsMergesIPv6Discovery(t *testing.T) {
+	t.Parallel()
+
+	r := newTestRouter(t, []string{"127.0.0.1"}, "", "9.9.9.9", "", nil)
+	r.dns.getDNSServer = func() ([]string, error) {
+		return []string{"192.168.1.1"}, nil
+	}
+	r.dns.getDNSServer6 = func() ([]string, error) {
+		return []string{"2001:db8::53", "fe80::1%eth0"}, nil
+	}
+
+	addrs, err := r.buildUpstreamAddrs("", "9.9.9.9")
+	if err != nil {
+		t.Fatalf("buildUpstreamAddrs: %v", err)
+	}
+	want := "192.168.1.1:53,[2001:db8::53]:53,[fe80::1%eth0]:53,9.9.9.9:53"
+	if got := strings.Join(addrs, ","); got != want {
+		t.Fatalf("upstreams = %s, want %s", got, want)
+	}
+
+	// A failed DHCPv4 discovery keeps the IPv6 servers.
+	r.dns.getDNSServer = func() ([]string, error) {
+		return nil, errors.New("no offer")
+	}
+	addrs, err = r.buildUpstreamAddrs("", "9.9.9.9")
+	if err != nil {
+		t.Fatalf("buildUpstreamAddrs: %v", err)
+	}
+	want = "[2001:db8::53]:53,[fe80::1%eth0]:53,9.9.9.9:53"
+	if got := strings.Join(addrs, ","); got != want {
+		t.Fatalf("upstreams without dhcpv4 = %s, want %s", got, want)
+	}
+}
+
 func TestCurrentUpstreamStateBacksOffInitialDHCPFailure(t *testing.T) {
 	t.Parallel()
 
@@ -1,36 +1,48 @@
 package router
 
 import (
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 
 	"github.com/sower-proxy/sower/pkg/suffixtree"
 )
 
 // RuleSet is a thread-safe rule container. It retains the raw rule list so
 // rules can be listed and removed at runtime; the suffixtree is derived
-// state and is rebuilt from the retained list whenever a rule is removed.
-// Membership for Add/Remove uses the raw rule strings (set), so case and
-// trailing-dot variants stay distinct entries in the configuration.
+// state. Both are published together as an immutable snapshot, so readers
+// never block: writers, serialized by mu, edit a copy-on-write candidate
+// and swap it in. Membership for Add/Remove uses the raw rule strings
+// (set), so case and trailing-dot variants stay distinct entries in the
+// configuration.
 type RuleSet struct {
-	mu    sync.RWMutex
+	mu   sync.Mutex
+	set  map[string]struct{}
+	snap atomic.Pointer[ruleSnapshot]
+}
+
+// ruleSnapshot is one published state of a RuleSet and never changes once
+// stored. Add appends past the end of rules, which no earlier snapshot can
+// see; every other writer copies the slice.
+type ruleSnapshot struct {
 	rules []string
-	set   map[string]struct{}
 	tree  *suffixtree.Node
 }
 
 // NewRuleSet returns a RuleSet initialized with the given rules.
 func NewRuleSet(rules ...string) *RuleSet {
 	rs := &RuleSet{set: make(map[string]struct{}, len(rules))}
+	rs.snap.Store(&ruleSnapshot{tree: suffixtree.NewNodeFromRules()})
 	rs.Add(rules...)
-	rs.Compact()
 	return rs
 }
 
 // Add appends rules that are not already present, using the raw rule string
 // as the membership key. Duplicates are ignored. Empty rules are dropped:
 // aconfig parses an empty TOML array as [""], which would otherwise surface
-// as a rule that can never match a real domain.
+// as a rule that can never match a real domain. Each call copies the tree
+// paths it touches, so large rule files should be added in one call.
 func (rs *RuleSet) Add(rules ...string) {
 	if len(rules) == 0 {
 		return
@@ -38,6 +50,9 @@ func (rs *RuleSet) Add(rules ...string) {
 
 	rs.mu.Lock()
 	defer rs.mu.Unlock()
+	cur := rs.snap.Load()
+	next := &ruleSnapshot{rules: cur.rules}
+	var edit *suffixtree.Editor
 	for _, rule := range rules {
 		if rule == "" {
 			continue
@@ -46,20 +61,25 @@ func (rs *RuleSet) Add(rules ...string) {
 			continue
 		}
 		rs.set[rule] = struct{}{}
-		rs.rules = append(rs.rules, rule)
-		if rs.tree == nil {
-			rs.tree = suffixtree.NewNodeFromRules()
+		next.rules = append(next.rules, rule)
+		if edit == nil {
+			edit = cur.tree.Edit()
 		}
-		rs.tree.Add(rule)
+		edit.Add(rule)
+	}
+	if edit == nil {
+		return
 	}
+	next.tree = edit.Node()
+	rs.snap.Store(next)
 }
 
 // Replace swaps the entire rule list atomically, rebuilding the suffix
 // tree. Literal duplicates in the input are dropped. It is used to rebuild
 // a rule set from the boot baseline after a delta reset.
 func (rs *RuleSet) Replace(rules ...string) {
-	// Construct the full immutable candidate before taking the match lock.
-	// The field swap below is the operation's linearization point.
+	// Construct the full candidate before taking the writer lock; the
+	// snapshot store below is the operation's linearization point.
 	nextRules := make([]string, 0, len(rules))
 	nextSet := make(map[string]struct{}, len(rules))
 	nextTree := suffixtree.NewNodeFromRules()
@@ -77,24 +97,19 @@ func (rs *RuleSet) Replace(rules ...string) {
 	nextTree.GC()
 
 	rs.mu.Lock()
-	rs.rules = nextRules
 	rs.set = nextSet
-	rs.tree = nextTree
+	rs.snap.Store(&ruleSnapshot{rules: nextRules, tree: nextTree})
 	rs.mu.Unlock()
 }
 
-// Compact runs garbage collection on the underlying tree. Call it after a
-// batch of adds to avoid per-add compaction overhead on large rule files.
-func (rs *RuleSet) Compact() {
-	rs.mu.Lock()
-	defer rs.mu.Unlock()
-	if rs.tree != nil {
-		rs.tree.GC()
-	}
-}
+// Compact used to garbage collect the tree after a batch of adds.
+//
+// Deprecated: no-op. Every published tree is already compact.
+func (rs *RuleSet) Compact() {}
 
-// Remove deletes the first occurrence of the rule and rebuilds the tree from
-// the retained list. It reports whether the rule was present.
+// Remove deletes the first occurrence of the rule and its marker in the
+// tree, copying only the path to it. It reports whether the rule was
+// present.
 func (rs *RuleSet) Remove(rule string) bool {
 	rs.mu.Lock()
 	defer rs.mu.Unlock()
@@ -103,13 +118,13 @@ func (rs *RuleSet) Remove(rule string) bool {
 	}
 
 	delete(rs.set, rule)
-	for i := range rs.rules {
-		if rs.rules[i] == rule {
-			rs.rules = append(rs.rules[:i], rs.rules[i+1:]...)
-			break
-		}
-	}
-	rs.tree = suffixtree.NewNodeFromRules(rs.rules...)
+	cur := rs.snap.Load()
+	i := slices.Index(cur.rules, rule)
+	rules := make([]string, 0, len(cur.rules)-1)
+	rules = append(append(rules, cur.rules[:i]...), cur.rules[i+1:]...)
+	edit := cur.tree.Edit()
+	edit.Remove(rule)
+	rs.snap.Store(&ruleSnapshot{rules: rules, tree: edit.Node()})
 	return true
 }
 
@@ -119,12 +134,7 @@ func (rs *RuleSet) Match(item string) bool {
 		return false
 	}
 
-	rs.mu.RLock()
-	defer rs.mu.RUnlock()
-	if rs.tree == nil {
-		return false
-	}
-	return rs.tree.Match(item)
+	return rs.snap.Load().tree.Match(item)
 }
 
 // MatchRule reports the first retained rule that matches item, mirroring the
@@ -136,9 +146,7 @@ func (rs *RuleSet) MatchRule(item string) (string, bool) {
 		return "", false
 	}
 
-	rs.mu.RLock()
-	defer rs.mu.RUnlock()
-	for _, rule := range rs.rules {
+	for _, rule := range rs.snap.Load().rules {
 		if matchRule(rule, item) {
 			return rule, true
 		}
@@ -155,12 +163,7 @@ func (rs *RuleSet) MatchRuleFast(item string) (string, bool) {
 		return "", false
 	}
 
-	rs.mu.RLock()
-	defer rs.mu.RUnlock()
-	if rs.tree == nil {
-		return "", false
-	}
-	return rs.tree.MatchRule(item)
+	return rs.snap.Load().tree.MatchRule(item)
 }
 
 // matchRule reports whether one rule pattern matches item. A "**" in the
@@ -197,9 +200,7 @@ func matchRule(rule, item string) bool {
 
 // List returns a copy of the retained rules.
 func (rs *RuleSet) List() []string {
-	rs.mu.RLock()
-	defer rs.mu.RUnlock()
-	return append([]string(nil), rs.rules...)
+	return append([]string(nil), rs.snap.Load().rules...)
 }
 
 // ListFiltered returns up to limit retained rules that contain q as a
@@ -207,22 +208,21 @@ func (rs *RuleSet) List() []string {
 // matches. An empty q matches every rule. It avoids copying the full list
 // when the caller only needs a page.
 func (rs *RuleSet) ListFiltered(q string, offset, limit int) ([]string, uint64) {
-	rs.mu.RLock()
-	defer rs.mu.RUnlock()
+	rules := rs.snap.Load().rules
 	if q == "" {
-		if offset >= len(rs.rules) {
-			return []string{}, uint64(len(rs.rules))
+		if offset >= len(rules) {
+			return []string{}, uint64(len(rules))
 		}
 		end := offset + limit
-		if end > len(rs.rules) {
-			end = len(rs.rules)
+		if end > len(rules) {
+			end = len(rules)
 		}
-		return append([]string(nil), rs.rules[offset:end]...), uint64(len(rs.rules))
+		return append([]string(nil), rules[offset:end]...), uint64(len(rules))
 	}
 
 	matched := make([]string, 0, min(limit, 64))
 	total := uint64(0)
-	for _, rule := range rs.rules {
+	for _, rule := range rules {
 		if !containsFold(rule, q) {
 			continue
 		}
@@ -253,7 +253,5 @@ func containsFold(s, substr string) bool {
 
 // Count returns the number of retained rules.
 func (rs *RuleSet) Count() uint64 {
-	rs.mu.RLock()
-	defer rs.mu.RUnlock()
-	return uint64(len(rs.rules))
+	return uint64(len(rs.snap.Load().rules))
 }
@@ -2,6 +2,8 @@ package router
 
 import (
 	"fmt"
+	"runtime/metrics"
+	"sync/atomic"
 	"testing"
 )
 
@@ -32,3 +34,64 @@ func BenchmarkRuleSetMatchHit(b *testing.B) {
 		rs.Match("host5000.example.com")
 	}
 }
+
+// newBenchRuleSet builds n rules in the shape of the china list: many
+// hosts under many second-level domains.
+func newBenchRuleSet(n int) *RuleSet {
+	rules := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		rules = append(rules, fmt.Sprintf("host%d.example%d.com", i, i%2000))
+	}
+	return NewRuleSet(rules...)
+}
+
+// BenchmarkRuleSetMatchDuringMutation matches in parallel while a writer
+// keeps removing and re-adding rules of a 100k-rule set. It reports the
+// time goroutines spent blocked on mutexes per Match: readers never wait
+// for the writer, so it stays near zero however slow a write is.
+func BenchmarkRuleSetMatchDuringMutation(b *testing.B) {
+	rs := newBenchRuleSet(100000)
+	done := make(chan struct{})
+	var writes atomic.Int64
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			rule := fmt.Sprintf("host%d.example%d.com", i%100000, i%100000%2000)
+			rs.Remove(rule)
+			rs.Add(rule)
+			writes.Add(2)
+		}
+	}()
+
+	wait := []metrics.Sample{{Name: "/sync/mutex/wait/total:seconds"}}
+	metrics.Read(wait)
+	before := wait[0].Value.Float64()
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			rs.Match("host5000.example1000.com")
+		}
+	})
+	b.StopTimer()
+	close(done)
+	metrics.Read(wait)
+	b.ReportMetric((wait[0].Value.Float64()-before)*1e9/float64(b.N), "mutex-wait-ns/op")
+	b.ReportMetric(float64(writes.Load())/b.Elapsed().Seconds(), "writes/s")
+}
+
+func BenchmarkRuleSetRemove(b *testing.B) {
+	rs := newBenchRuleSet(100000)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := range b.N {
+		rule := fmt.Sprintf("host%d.example%d.com", i%100000, i%100000%2000)
+		rs.Remove(rule)
+		rs.Add(rule)
+	}
+}
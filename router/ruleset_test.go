@@ -230,3 +230,49 @@ func TestRuleSetDropsEmptyRules(t *testing.T) {
 		t.Fatalf("Replace should drop empty rules: %q", list)
 	}
 }
+
+// TestRuleSetMatchDuringMutation: readers keep seeing every rule that is
+// never removed while writers add and remove others around it.
+func TestRuleSetMatchDuringMutation(t *testing.T) {
+	rules := make([]string, 0, 1000)
+	for i := 0; i < 1000; i++ {
+		rules = append(rules, fmt.Sprintf("host%d.example.com", i))
+	}
+	rs := NewRuleSet(rules...)
+	var stop atomic.Bool
+	var misses atomic.Int64
+	var wg sync.WaitGroup
+	for g := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := g; !stop.Load(); i++ {
+				if !rs.Match(fmt.Sprintf("host%d.example.com", i%1000)) {
+					misses.Add(1)
+				}
+				if _, ok := rs.MatchRuleFast("host1.example.com"); !ok {
+					misses.Add(1)
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 500; i++ {
+		rule := fmt.Sprintf("churn%d.example.com", i%50)
+		rs.Add(rule, "**."+rule)
+		if !rs.Match("a." + rule) {
+			t.Fatalf("expected %s to match after Add", rule)
+		}
+		rs.Remove("**." + rule)
+		rs.Remove(rule)
+	}
+	stop.Store(true)
+	wg.Wait()
+
+	if n := misses.Load(); n != 0 {
+		t.Fatalf("readers missed a stable rule %d times", n)
+	}
+	if rs.Match("churn1.example.com") || rs.Count() != 1000 {
+		t.Fatalf("unexpected final state: %d rules", rs.Count())
+	}
+}
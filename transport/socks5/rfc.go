@@ -32,12 +32,12 @@ func (req *authReq) Fulfill(r io.Reader) error {
 	return nil
 }
 
-func (r *authReq) IsValid() bool {
+func (r *authReq) IsValid(method byte) bool {
 	if r.VER != 5 || len(r.METHODS) == 0 {
 		return false
 	}
-	for _, method := range r.METHODS {
-		if method == 0 {
+	for _, m := range r.METHODS {
+		if m == method {
 			return true
 		}
 	}
@@ -50,6 +50,42 @@ type authResp struct {
 	METHOD byte
 }
 
+// https://tools.ietf.org/html/rfc1929
+
+// 2a. client sends username/password after METHOD=0x02 is selected
+type userPassReq struct {
+	VER    byte
+	UNAME  []byte
+	PASSWD []byte
+}
+
+func (req *userPassReq) Fulfill(r io.Reader) error {
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return err
+	}
+	req.VER = buf[0]
+	req.UNAME = make([]byte, int(buf[1]))
+	if _, err := io.ReadFull(r, req.UNAME); err != nil {
+		return err
+	}
+
+	if _, err := io.ReadFull(r, buf[:1]); err != nil {
+		return err
+	}
+	req.PASSWD = make([]byte, int(buf[0]))
+	if _, err := io.ReadFull(r, req.PASSWD); err != nil {
+		return err
+	}
+	return nil
+}
+
+// 2b. server response to username/password; STATUS 0 is success
+type userPassResp struct {
+	VER    byte
+	STATUS byte
+}
+
 // 3. client request with target address
 type reqHead struct {
 	VER  byte
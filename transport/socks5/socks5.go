@@ -2,6 +2,7 @@ package socks5
 
 import (
 	"bytes"
+	"crypto/subtle"
 	"encoding/binary"
 	"fmt"
 	"net"
@@ -23,20 +24,37 @@ func (h *AddrHead) String() string {
 // Socks5 is a SOCKS5 proxy. It implements the teeconn.Conn interface.
 // It is used to be a second relay of other proxy tools.
 // user -> sower -socks5-> third-party proxy -> target
-type Socks5 struct{}
+type Socks5 struct {
+	// username and password, when set, make ReadRequest demand RFC 1929
+	// username/password authentication instead of no-auth.
+	username, password string
+}
 
 func New() *Socks5 {
 	return &Socks5{}
 }
 
+// NewWithAuth returns a server side that accepts only clients presenting
+// username and password. Empty credentials behave as New.
+func NewWithAuth(username, password string) *Socks5 {
+	return &Socks5{username: username, password: password}
+}
+
 const (
-	RepSucceeded            = 0x00
-	RepGeneralFailure       = 0x01
-	RepConnectionNotAllowed = 0x02
+	methodNoAuth   = 0x00
+	methodUserPass = 0x02
 )
 
 var (
-	noAuthResp = authResp{VER: 5, METHOD: 0}
+	// ErrAuthFailed reports a client whose username or password did not match.
+	ErrAuthFailed         = errors.New("socks5 authentication failed")
+	errNoAcceptableMethod = errors.New("no acceptable auth method")
+)
+
+const (
+	RepSucceeded            = 0x00
+	RepGeneralFailure       = 0x01
+	RepConnectionNotAllowed = 0x02
 )
 
 func (s *Socks5) Unwrap(conn net.Conn) (net.Addr, error) {
@@ -52,22 +70,31 @@ func (s *Socks5) Unwrap(conn net.Conn) (net.Addr, error) {
 
 func (s *Socks5) ReadRequest(conn net.Conn) (net.Addr, error) {
 	{ // auth
+		method := byte(methodNoAuth)
+		if s.username != "" || s.password != "" {
+			method = methodUserPass
+		}
 		auth := new(authReq)
 		if err := auth.Fulfill(conn); err != nil {
 			return nil, fmt.Errorf("read auth request: %w", err)
 		}
-		if !auth.IsValid() {
+		if !auth.IsValid(method) {
 			// RFC 1928 requires a METHOD=0xFF failure response so the peer
 			// does not hang waiting for a selection it will never get.
 			if err := binary.Write(conn, binary.BigEndian, authResp{VER: 5, METHOD: 0xFF}); err != nil {
 				return nil, fmt.Errorf("write auth failure: %w", err)
 			}
-			return nil, errors.New("no acceptable auth method")
+			return nil, errNoAcceptableMethod
 		}
 
-		if err := binary.Write(conn, binary.BigEndian, noAuthResp); err != nil {
+		if err := binary.Write(conn, binary.BigEndian, authResp{VER: 5, METHOD: method}); err != nil {
 			return nil, fmt.Errorf("write auth: %w", err)
 		}
+		if method == methodUserPass {
+			if err := s.checkUserPass(conn); err != nil {
+				return nil, err
+			}
+		}
 	}
 
 	var addr addrType
@@ -100,6 +127,25 @@ func (s *Socks5) ReadRequest(conn net.Conn) (net.Addr, error) {
 	}, nil
 }
 
+// checkUserPass runs the RFC 1929 subnegotiation. Both fields are compared
+// in constant time so the reply timing does not reveal a matching username.
+func (s *Socks5) checkUserPass(conn net.Conn) error {
+	req := new(userPassReq)
+	if err := req.Fulfill(conn); err != nil {
+		return fmt.Errorf("read username/password: %w", err)
+	}
+	userOK := subtle.ConstantTimeCompare(req.UNAME, []byte(s.username))
+	passOK := subtle.ConstantTimeCompare(req.PASSWD, []byte(s.password))
+	if req.VER != 1 || userOK&passOK != 1 {
+		_ = binary.Write(conn, binary.BigEndian, userPassResp{VER: 1, STATUS: 1})
+		return ErrAuthFailed
+	}
+	if err := binary.Write(conn, binary.BigEndian, userPassResp{VER: 1, STATUS: 0}); err != nil {
+		return fmt.Errorf("write username/password status: %w", err)
+	}
+	return nil
+}
+
 func (s *Socks5) WriteReply(conn net.Conn, rep byte) error {
 	head := respHead{VER: 5, REP: rep, RSV: 0, ATYP: 1}
 	return binary.Write(conn, binary.BigEndian, head)
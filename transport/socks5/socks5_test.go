@@ -3,6 +3,7 @@ package socks5
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"io"
 	"net"
 	"testing"
@@ -37,6 +38,55 @@ func TestUnwrapAcceptsNoAuthWhenNotFirstMethod(t *testing.T) {
 	}
 }
 
+func TestReadRequestWithAuth(t *testing.T) {
+	head := []byte{0x05, 0x01, 0x00, 0x03, 0x0b}
+	head = append(head, []byte("example.com")...)
+	head = append(head, 0x01, 0xbb)
+	userPass := func(user, pass string) []byte {
+		b := []byte{0x01, byte(len(user))}
+		b = append(b, user...)
+		b = append(b, byte(len(pass)))
+		return append(b, pass...)
+	}
+
+	tests := []struct {
+		name    string
+		req     []byte
+		wantErr error
+		want    []byte // the method selection and subnegotiation status
+	}{
+		{
+			name: "accepted",
+			req:  append(append([]byte{0x05, 0x02, 0x00, 0x02}, userPass("alice", "secret")...), head...),
+			want: []byte{0x05, 0x02, 0x01, 0x00},
+		},
+		{
+			name:    "wrong password",
+			req:     append([]byte{0x05, 0x01, 0x02}, userPass("alice", "guess")...),
+			wantErr: ErrAuthFailed,
+			want:    []byte{0x05, 0x02, 0x01, 0x01},
+		},
+		{
+			name:    "no-auth only",
+			req:     []byte{0x05, 0x01, 0x00},
+			wantErr: errNoAcceptableMethod,
+			want:    []byte{0x05, 0xff},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := conntest.NewMockConn(tt.req)
+			_, err := NewWithAuth("alice", "secret").ReadRequest(conn)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ReadRequest error = %v, want %v", err, tt.wantErr)
+			}
+			if got := conn.Writes.Bytes(); !bytes.Equal(got, tt.want) {
+				t.Fatalf("server wrote % x, want % x", got, tt.want)
+			}
+		})
+	}
+}
+
 func TestWrapRejectsAuthFailure(t *testing.T) {
 	server, client := net.Pipe()
 	defer server.Close()
@@ -2,7 +2,7 @@ export type Category = "block" | "direct" | "proxy";
 
 export type DomainSort = "bytes" | "recent" | "conns";
 
-export type Source = "all" | "http" | "https" | "socks5" | "dns";
+export type Source = "all" | "http" | "https" | "socks5" | "transparent" | "dns";
 
 export interface Status {
 	version: string;
@@ -35,17 +35,53 @@ export interface BlockedStat {
 	lastSeen: string;
 }
 
+export interface ListenerStat {
+	name: string;
+	kind: "socks5" | "http";
+	addr: string;
+	mode: "smart" | "proxy" | "direct" | "remote";
+	conns: number;
+	active: number;
+	bytesUp: number;
+	bytesDown: number;
+	rejected: number;
+}
+
+export interface QuotaStat {
+	client: string;
+	used: number;
+	limit: number;
+	period: "daily" | "monthly";
+	action: "block" | "direct";
+	resetAt: string;
+	exhausted: boolean;
+}
+
+export interface ConnStat {
+	id: number;
+	kind: "http" | "https" | "socks5" | "transparent";
+	listener?: string;
+	client: string;
+	hostname: string;
+	domain: string;
+	port: number;
+	route: "" | "direct" | "proxy";
+	start: string;
+	bytesUp: number;
+	bytesDown: number;
+}
+
 export interface ErrorEvent {
 	at: string;
-	kind: "dial" | "dns" | "accept";
+	kind: "dial" | "dns" | "accept" | "acl";
 	detail: string;
 }
 
 export interface TrafficSnapshot {
 	uptime: number;
 	dnsQueries: number;
-	conns: { http: number; https: number; socks5: number };
-	active: { http: number; https: number; socks5: number };
+	conns: { http: number; https: number; socks5: number; transparent: number };
+	active: { http: number; https: number; socks5: number; transparent: number };
 	rates: {
 		bytesUpPerSec: number;
 		bytesDownPerSec: number;
@@ -53,9 +89,11 @@ export interface TrafficSnapshot {
 		connsPerSec: number;
 	};
 	ruleHits: { block: number; direct: number; proxy: number };
-	errors: { dial: number; dns: number; accept: number };
+	errors: { dial: number; dns: number; accept: number; acl: number };
 	events: ErrorEvent[];
 	blocked: BlockedStat[];
+	listeners: ListenerStat[];
+	quotas: QuotaStat[] | null;
 	system: { goroutines: number; heapAlloc: number };
 	bytesUp: number;
 	bytesDown: number;
@@ -78,15 +116,49 @@ export interface HistorySample {
 	activeHttp: number;
 	activeHttps: number;
 	activeSocks: number;
+	activeTransparent: number;
 	block: number;
 	direct: number;
 	proxy: number;
 }
 
+export type UsageStep = "minute" | "hour" | "day";
+
 export interface History {
+	step?: UsageStep;
 	samples: HistorySample[];
 }
 
+export interface UsageReport {
+	from: string;
+	to: string;
+	step: UsageStep;
+	bytesUp: number;
+	bytesDown: number;
+	dns: number;
+	conns: number;
+	block: number;
+	direct: number;
+	proxy: number;
+	domains: DomainStat[];
+	clients: ClientStat[];
+}
+
+export type TokenScope = "read" | "rules" | "config" | "restart";
+
+export interface TokenInfo {
+	id: string;
+	name: string;
+	scopes: TokenScope[];
+	createdAt: string;
+	expiresAt?: string;
+	lastUsed?: string;
+}
+
+export interface CreatedToken extends TokenInfo {
+	token: string;
+}
+
 export interface RulesResponse {
 	category: Category;
 	rules: RuleEntry[];
@@ -99,12 +171,44 @@ export interface RuleEntry {
 	rule: string;
 	count: number;
 	lastSeen?: string;
+	/** Set on temporary additions. */
+	expires?: string;
 }
 
 export interface RuleHit {
 	rule: string;
 	count: number;
+	/** Rule-miss entries only: connections per detected route, failed
+	 * dials of that route, and poisoned direct DNS answers. */
+	direct?: number;
+	directFailed?: number;
+	proxy?: number;
+	proxyFailed?: number;
+	poisoned?: number;
+	lastSeen: string;
+}
+
+export type SuggestionReason = "poisoned" | "direct_failed" | "proxied" | "direct";
+
+// RuleSuggestion proposes a "**." rule for a registrable domain whose names
+// keep missing every rule, with the group's rule-miss counters.
+export interface RuleSuggestion {
+	rule: string;
+	category: Category;
+	reason: SuggestionReason;
+	domain: string;
+	domains: number;
+	samples: string[];
+	count: number;
+	direct: number;
+	directFailed: number;
+	proxy: number;
+	proxyFailed: number;
+	poisoned: number;
 	lastSeen: string;
+	// overlaps lists the block and proxy rules inside a direct suggestion's
+	// suffix.
+	overlaps?: { category: Category; rule: string }[];
 }
 
 export interface CategoryTest {
@@ -120,6 +224,75 @@ export interface DomainTest {
 	note?: string;
 }
 
+// RouteExplain traces the routing decision for one destination: the checks
+// DialSmart evaluates in order, the resolved IPs, the route and upstream,
+// and the DNS answer for the same name. Pending marks a route that hinges
+// on an access probe not cached yet.
+export interface RouteExplain {
+	domain: string;
+	port: number;
+	client?: string;
+	steps: ExplainStep[];
+	ips: ExplainIP[];
+	resolveError?: string;
+	route: "block" | "direct" | "proxy";
+	pending?: boolean;
+	upstream?: string;
+	dns: DNSExplain;
+	acl?: ACLVerdict[];
+}
+
+export type ExplainCheck =
+	| "fake-ip"
+	| "block-rule"
+	| "direct-rule"
+	| "proxy-rule"
+	| "local-site"
+	| "access-probe"
+	| "fallback";
+
+export interface ExplainStep {
+	check: ExplainCheck;
+	matched: boolean;
+	skipped?: boolean;
+	rule?: string;
+	detail?: string;
+}
+
+export interface ExplainIP {
+	ip: string;
+	cidr?: string;
+	country?: string;
+	local: boolean;
+	error?: string;
+}
+
+export interface DNSExplain {
+	decision: "block" | "proxy-local" | "forwarded" | "local";
+	rule?: string;
+	answer?: string;
+	upstream?: string;
+	poisoned?: boolean;
+}
+
+export interface ACLVerdict {
+	listener: string;
+	allowed: boolean;
+}
+
+// AccessEntry is one access probe verdict: whether an unmatched site
+// answered the probe that sends it direct. Pinned verdicts hold until
+// evicted; age is in seconds.
+export interface AccessEntry {
+	domain: string;
+	port: number;
+	reachable: boolean;
+	pinned: boolean;
+	at: string;
+	age: number;
+	expires?: string;
+}
+
 export interface RulesQuery {
 	q?: string;
 	offset?: number;
@@ -135,6 +308,8 @@ export type RuleSortDir = "asc" | "desc";
 export interface RuleDelta {
 	add: string[];
 	remove: string[];
+	/** Expiry of temporary additions and tombstones, by rule. */
+	expires?: Record<string, string>;
 }
 
 export interface RuleChangeSet {
@@ -170,7 +345,8 @@ export interface ConfigView {
 
 // ConfigChanges is the whitelisted PATCH payload: a present key replaces the
 // override (empty string or empty list clears it), an absent key leaves it
-// unchanged. List fields (rule sources) carry the full inline lists.
+// unchanged. List fields (rule sources, client ACLs) carry the full inline
+// lists; acl is keyed by listener group.
 export interface ConfigChanges {
 	log_level?: string;
 	dns_upstream?: string;
@@ -203,12 +379,73 @@ export interface ConfigChanges {
 	router_country_mmdb?: string;
 	router_country_file?: string;
 	router_country_rules?: string[];
+	acl?: Record<string, { allow?: string[]; deny?: string[] }>;
 }
 
 export interface LoginInfo {
 	temporaryPassword: boolean;
 }
 
+export type Role = "viewer" | "rule-editor" | "admin";
+
+// Me is the logged-in console user; the shared admin password has no user
+// name.
+export interface Me {
+	user: string;
+	role: Role | "";
+}
+
+export interface UserInfo {
+	name: string;
+	role: Role;
+	createdAt: string;
+}
+
+// AuditEntry is one admin mutation or login attempt. user is empty for the
+// shared admin password; token names the API token of script calls.
+export interface AuditEntry {
+	time: string;
+	ip: string;
+	user?: string;
+	token?: string;
+	session?: string;
+	action: string;
+	target?: string;
+	before?: unknown;
+	after?: unknown;
+}
+
+// RevisionInfo summarizes one retained admin state revision.
+export interface RevisionInfo {
+	revision: number;
+	updatedAt: string;
+	current: boolean;
+	ruleAdds: number;
+	ruleRemoves: number;
+	configKeys: number;
+}
+
+export interface RevisionDiff {
+	from: number;
+	to: number;
+	rules: Record<Category, { added: string[]; removed: string[] }>;
+	// An absent side means no override, i.e. the config-file value.
+	config: Record<string, { from?: unknown; to?: unknown }>;
+}
+
+export type RuleFormat = "text" | "json" | "clash";
+
+// RuleImport previews (or reports) an import into one category; only the
+// new rules are applied.
+export interface RuleImport {
+	category: Category;
+	new: string[];
+	duplicates: string[];
+	conflicts: { rule: string; category: Category; existing: string }[];
+	invalid: { line: number; text: string; error: string }[];
+	applied: boolean;
+}
+
 export class ApiError extends Error {
 	constructor(
 		public status: number,
@@ -242,11 +479,12 @@ export const probeSession = () =>
 
 export const api = {
 	loginInfo: () => request<LoginInfo>("/api/login-info"),
-	login: (password: string) =>
+	login: (password: string, username = "") =>
 		request<void>("/api/session", {
 			method: "POST",
-			body: JSON.stringify({ password }),
+			body: JSON.stringify({ username, password }),
 		}),
+	me: () => request<Me>("/api/me"),
 	logout: () => request<void>("/api/session", { method: "DELETE" }),
 	status: () => request<Status>("/api/status"),
 	rules: (category: Category, params?: RulesQuery) => {
@@ -260,15 +498,16 @@ export const api = {
 		}
 		return request<RulesResponse>(`/api/rules?${sp}`);
 	},
-	addRules: (category: Category, rules: string[]) =>
+	// ttl (a Go duration such as "1h") makes the change temporary.
+	addRules: (category: Category, rules: string[], ttl?: string) =>
 		request<void>("/api/rules", {
 			method: "POST",
-			body: JSON.stringify({ category, rules }),
+			body: JSON.stringify({ category, rules, ttl }),
 		}),
-	removeRules: (category: Category, rules: string[]) =>
+	removeRules: (category: Category, rules: string[], ttl?: string) =>
 		request<void>("/api/rules", {
 			method: "DELETE",
-			body: JSON.stringify({ category, rules }),
+			body: JSON.stringify({ category, rules, ttl }),
 		}),
 	rulesTest: (domain: string) =>
 		request<DomainTest>(`/api/rules/test?domain=${encodeURIComponent(domain)}`),
@@ -300,4 +539,78 @@ export const api = {
 		);
 	},
 	history: () => request<History>("/api/history"),
+	historyRange: (range: string) =>
+		request<History>(`/api/history?range=${encodeURIComponent(range)}`),
+	usage: (range: string) =>
+		request<UsageReport>(`/api/usage?range=${encodeURIComponent(range)}`),
+	users: () => request<UserInfo[]>("/api/users"),
+	addUser: (name: string, password: string, role: Role) =>
+		request<UserInfo>("/api/users", {
+			method: "POST",
+			body: JSON.stringify({ name, password, role }),
+		}),
+	updateUser: (name: string, changes: { role?: Role; password?: string }) =>
+		request<void>(`/api/users/${encodeURIComponent(name)}`, {
+			method: "PATCH",
+			body: JSON.stringify(changes),
+		}),
+	deleteUser: (name: string) =>
+		request<void>(`/api/users/${encodeURIComponent(name)}`, { method: "DELETE" }),
+	tokens: () => request<TokenInfo[]>("/api/tokens"),
+	createToken: (name: string, scopes: TokenScope[], expiresIn: number) =>
+		request<CreatedToken>("/api/tokens", {
+			method: "POST",
+			body: JSON.stringify({ name, scopes, expiresIn }),
+		}),
+	revokeToken: (id: string) =>
+		request<void>(`/api/tokens/${encodeURIComponent(id)}`, { method: "DELETE" }),
+	closeConnection: (id: number) =>
+		request<void>(`/api/connections/${id}`, { method: "DELETE" }),
+	accessCache: () => request<AccessEntry[]>("/api/rules/access"),
+	pinAccess: (domain: string, port: number, reachable: boolean) =>
+		request<void>("/api/rules/access", {
+			method: "PUT",
+			body: JSON.stringify({ domain, port, reachable }),
+		}),
+	evictAccess: (domain: string, port: number) =>
+		request<void>(
+			`/api/rules/access?${new URLSearchParams({ domain, port: String(port) })}`,
+			{ method: "DELETE" },
+		),
+	flushAccess: () =>
+		request<{ flushed: number }>("/api/rules/access/flush", { method: "POST" }),
+	rulesExplain: (domain: string, port: number, client?: string) => {
+		const sp = new URLSearchParams({ domain, port: String(port) });
+		if (client) sp.set("client", client);
+		return request<RouteExplain>(`/api/rules/explain?${sp}`);
+	},
+	ruleSuggestions: () => request<RuleSuggestion[]>("/api/rules/suggestions"),
+	acceptSuggestions: (rules: { category: Category; rule: string }[]) =>
+		request<{ added: Partial<Record<Category, string[]>> }>("/api/rules/suggestions/accept", {
+			method: "POST",
+			body: JSON.stringify({ rules }),
+		}),
+	importRules: (category: Category, format: RuleFormat, file: string, dryRun: boolean) =>
+		request<RuleImport>(
+			`/api/rules/import?category=${category}&format=${format}&dry_run=${dryRun}`,
+			{ method: "POST", headers: { "Content-Type": "text/plain" }, body: file },
+		),
+	revisions: () =>
+		request<{ current: number; revisions: RevisionInfo[] }>("/api/state/revisions"),
+	revisionDiff: (from: number, to?: number) =>
+		request<RevisionDiff>(
+			`/api/state/revisions/diff?from=${from}${to === undefined ? "" : `&to=${to}`}`,
+		),
+	rollback: (revision: number) =>
+		request<{ revision: number }>("/api/state/rollback", {
+			method: "POST",
+			body: JSON.stringify({ revision }),
+		}),
+	audit: (params: { action?: string; user?: string; limit?: number } = {}) => {
+		const sp = new URLSearchParams();
+		if (params.action) sp.set("action", params.action);
+		if (params.user) sp.set("user", params.user);
+		if (params.limit) sp.set("limit", String(params.limit));
+		return request<{ entries: AuditEntry[] }>(`/api/audit?${sp}`);
+	},
 };